@@ -2,6 +2,10 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
 	"time"
 
 	libConfig "github.com/alexferl/golib/config"
@@ -18,7 +22,9 @@ type Config struct {
 	HTTP    *libHttp.Config
 	Logging *libLog.Config
 
-	BaseURL string
+	BaseURL        string
+	FrontendURL    string
+	TrustedProxies []string
 
 	Admin   *Admin
 	OAuth2  *OAuth2
@@ -28,6 +34,19 @@ type Config struct {
 	Casbin  *Casbin
 	OpenAPI *OpenAPI
 	MongoDB *MongoDB
+	Mailer  *Mailer
+
+	EmailVerification *EmailVerification
+	PasswordPolicy    *PasswordPolicy
+	PasswordHash      *PasswordHash
+	PasswordReset     *PasswordReset
+	EmailChange       *EmailChange
+	AccountDeletion   *AccountDeletion
+	Export            *Export
+	Impersonation     *Impersonation
+	PAT               *PAT
+	MFA               *MFA
+	LoginThrottle     *LoginThrottle
 }
 
 type Admin struct {
@@ -38,8 +57,70 @@ type Admin struct {
 }
 
 type OAuth2 struct {
-	ClientId     string
-	ClientSecret string
+	ClientId          string
+	ClientSecret      string
+	Providers         []OAuth2Provider
+	TokenExpiry       time.Duration
+	StateExpiry       time.Duration
+	RedirectAllowlist []string
+}
+
+// OAuth2Provider is an OpenID Connect provider found with discovery from its
+// Issuer, or a plain OAuth 2.0 provider like GitHub configured with its URLs.
+// Providers are configured in the config file, see README.md.
+type OAuth2Provider struct {
+	Name         string       `mapstructure:"name"`
+	Issuer       string       `mapstructure:"issuer"`
+	ClientId     string       `mapstructure:"client-id"`
+	ClientSecret string       `mapstructure:"client-secret"`
+	Scopes       []string     `mapstructure:"scopes"`
+	AuthURL      string       `mapstructure:"auth-url"`
+	TokenURL     string       `mapstructure:"token-url"`
+	UserInfoURL  string       `mapstructure:"userinfo-url"`
+	Claims       OAuth2Claims `mapstructure:"claims"`
+}
+
+// DefaultOAuth2Provider is the provider configured by the oauth2-client-id
+// and oauth2-client-secret flags, which predate oauth2-providers.
+var DefaultOAuth2Provider = OAuth2Provider{
+	Name:   "google",
+	Issuer: "https://accounts.google.com",
+}
+
+// GetOAuth2Providers returns the providers of oauth2-providers along with
+// the default one when oauth2-client-id is set and it isn't among them.
+func GetOAuth2Providers() ([]OAuth2Provider, error) {
+	var providers []OAuth2Provider
+	if err := viper.UnmarshalKey(OAuth2Providers, &providers); err != nil {
+		return nil, err
+	}
+
+	id := viper.GetString(OAuth2ClientId)
+	if id == "" {
+		return providers, nil
+	}
+
+	for _, p := range providers {
+		if p.Name == DefaultOAuth2Provider.Name {
+			return providers, nil
+		}
+	}
+
+	p := DefaultOAuth2Provider
+	p.ClientId = id
+	p.ClientSecret = viper.GetString(OAuth2ClientSecret)
+
+	return append(providers, p), nil
+}
+
+// OAuth2Claims maps user attributes to the claims of the ID token or the
+// fields of the userinfo response holding them.
+type OAuth2Claims struct {
+	Subject       string `mapstructure:"subject"`
+	Email         string `mapstructure:"email"`
+	EmailVerified string `mapstructure:"email-verified"`
+	Name          string `mapstructure:"name"`
+	Username      string `mapstructure:"username"`
 }
 
 type JWT struct {
@@ -47,8 +128,10 @@ type JWT struct {
 	AccessTokenCookieName  string
 	RefreshTokenExpiry     time.Duration
 	RefreshTokenCookieName string
+	RefreshTokenSecret     string
 	PrivateKey             string
 	Issuer                 string
+	RevocationEnabled      bool
 }
 
 type Cookies struct {
@@ -83,13 +166,105 @@ type MongoDB struct {
 	SocketTimeoutMs          time.Duration // query timeout
 }
 
+type Mailer struct {
+	Transport    string
+	From         string
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+	FileDir      string
+}
+
+type EmailVerification struct {
+	Mode        string
+	TokenExpiry time.Duration
+}
+
+// PasswordPolicy is checked when passwords are set. MinScore is a
+// zxcvbn-style strength score from 0 to 4. BreachedDir holds Have I Been
+// Pwned range files named after the first 5 characters of the SHA-1 hashes.
+type PasswordPolicy struct {
+	MinLength   int
+	MinScore    int
+	BreachedDir string
+}
+
+// PasswordHash is how new passwords are hashed. Argon2Memory is in KiB.
+// Passwords hashed otherwise are hashed again when users log in.
+// Argon2Concurrency bounds the memory used by argon2id to about
+// Argon2Memory * Argon2Concurrency.
+type PasswordHash struct {
+	Algorithm         string
+	Argon2Memory      uint32
+	Argon2Iterations  uint32
+	Argon2Parallelism uint8
+	Argon2Concurrency int
+	BcryptCost        int
+}
+
+type PasswordReset struct {
+	TokenExpiry time.Duration
+}
+
+type EmailChange struct {
+	TokenExpiry time.Duration
+}
+
+type AccountDeletion struct {
+	GracePeriod   time.Duration
+	PurgeInterval time.Duration
+}
+
+type Export struct {
+	ClaimTimeout   time.Duration
+	Expiry         time.Duration
+	DownloadExpiry time.Duration
+	Interval       time.Duration
+}
+
+type Impersonation struct {
+	TokenExpiry time.Duration
+}
+
+type PAT struct {
+	Prefix                 string
+	LegacyJWTEnabled       bool
+	CacheTTL               time.Duration
+	UsageFlushInterval     time.Duration
+	UsageWindow            time.Duration
+	RotationMaxGracePeriod time.Duration
+	ExpiryNotice           time.Duration
+	ExpiryNotifyInterval   time.Duration
+	MaxLifetime            time.Duration
+	MaxTokens              int
+	RoleMaxLifetime        map[string]string
+	RoleMaxTokens          map[string]string
+}
+
+type MFA struct {
+	Issuer      string
+	TokenExpiry time.Duration
+}
+
+type LoginThrottle struct {
+	MaxFailures     int
+	IPMaxFailures   int
+	BackoffBase     time.Duration
+	BackoffMax      time.Duration
+	LockoutDuration time.Duration
+	FailureWindow   time.Duration
+}
+
 // New creates a Config instance
 func New() *Config {
 	return &Config{
-		Config:  libConfig.New("APP"),
-		HTTP:    libHttp.DefaultConfig,
-		Logging: libLog.DefaultConfig,
-		BaseURL: "http://localhost:1323",
+		Config:         libConfig.New("APP"),
+		HTTP:           libHttp.DefaultConfig,
+		Logging:        libLog.DefaultConfig,
+		BaseURL:        "http://localhost:1323",
+		FrontendURL:    "http://localhost:3000",
+		TrustedProxies: []string{},
 		Admin: &Admin{
 			Create:   false,
 			Email:    "admin@example.com",
@@ -97,16 +272,20 @@ func New() *Config {
 			Password: "",
 		},
 		OAuth2: &OAuth2{
-			ClientId:     "",
-			ClientSecret: "",
+			Providers:         []OAuth2Provider{},
+			TokenExpiry:       10 * time.Minute,
+			StateExpiry:       5 * time.Minute,
+			RedirectAllowlist: []string{},
 		},
 		JWT: &JWT{
 			AccessTokenExpiry:      10 * time.Minute,
 			AccessTokenCookieName:  "access_token",
 			RefreshTokenExpiry:     (30 * 24) * time.Hour,
 			RefreshTokenCookieName: "refresh_token",
+			RefreshTokenSecret:     "",
 			PrivateKey:             "./private-key.pem",
 			Issuer:                 "http://localhost:1323",
+			RevocationEnabled:      true,
 		},
 		Cookies: &Cookies{
 			Enabled: false,
@@ -135,6 +314,77 @@ func New() *Config {
 			ConnectTimeoutMs:         time.Millisecond * 5000,
 			SocketTimeoutMs:          time.Millisecond * 30000,
 		},
+		Mailer: &Mailer{
+			Transport:    MailerTransportLog,
+			From:         "no-reply@example.com",
+			SMTPHost:     "",
+			SMTPPort:     587,
+			SMTPUsername: "",
+			SMTPPassword: "",
+			FileDir:      "./mail",
+		},
+		EmailVerification: &EmailVerification{
+			Mode:        EmailVerificationOptional,
+			TokenExpiry: 24 * time.Hour,
+		},
+		PasswordPolicy: &PasswordPolicy{
+			MinLength:   12,
+			MinScore:    3,
+			BreachedDir: "",
+		},
+		PasswordHash: &PasswordHash{
+			Algorithm:         PasswordHashArgon2id,
+			Argon2Memory:      64 * 1024,
+			Argon2Iterations:  3,
+			Argon2Parallelism: 2,
+			Argon2Concurrency: 4,
+			BcryptCost:        10,
+		},
+		PasswordReset: &PasswordReset{
+			TokenExpiry: time.Hour,
+		},
+		EmailChange: &EmailChange{
+			TokenExpiry: 24 * time.Hour,
+		},
+		AccountDeletion: &AccountDeletion{
+			GracePeriod:   30 * 24 * time.Hour,
+			PurgeInterval: time.Hour,
+		},
+		Export: &Export{
+			ClaimTimeout:   30 * time.Minute,
+			Expiry:         24 * time.Hour,
+			DownloadExpiry: 15 * time.Minute,
+			Interval:       10 * time.Second,
+		},
+		Impersonation: &Impersonation{
+			TokenExpiry: 15 * time.Minute,
+		},
+		PAT: &PAT{
+			Prefix:                 "ebp",
+			LegacyJWTEnabled:       true,
+			CacheTTL:               time.Minute,
+			UsageFlushInterval:     10 * time.Second,
+			UsageWindow:            30 * 24 * time.Hour,
+			RotationMaxGracePeriod: 7 * 24 * time.Hour,
+			ExpiryNotice:           7 * 24 * time.Hour,
+			ExpiryNotifyInterval:   time.Hour,
+			MaxLifetime:            365 * 24 * time.Hour,
+			MaxTokens:              50,
+			RoleMaxLifetime:        map[string]string{},
+			RoleMaxTokens:          map[string]string{},
+		},
+		MFA: &MFA{
+			Issuer:      "echo-boilerplate",
+			TokenExpiry: 5 * time.Minute,
+		},
+		LoginThrottle: &LoginThrottle{
+			MaxFailures:     10,
+			IPMaxFailures:   100,
+			BackoffBase:     time.Second,
+			BackoffMax:      time.Minute,
+			LockoutDuration: 15 * time.Minute,
+			FailureWindow:   time.Hour,
+		},
 	}
 }
 
@@ -145,22 +395,30 @@ const (
 	HTTPBindAddress = libHttp.HTTPBindAddress
 	HTTPBindPort    = libHttp.HTTPBindPort
 
-	BaseURL = "base-url"
+	BaseURL            = "base-url"
+	FrontendURL        = "frontend-url"
+	HTTPTrustedProxies = "http-trusted-proxies"
 
 	AdminCreate   = "admin-create"
 	AdminEmail    = "admin-email"
 	AdminUsername = "admin-username"
 	AdminPassword = "admin-password"
 
-	OAuth2ClientId     = "oauth2-client-id"
-	OAuth2ClientSecret = "oauth2-client-secret"
+	OAuth2ClientId          = "oauth2-client-id"
+	OAuth2ClientSecret      = "oauth2-client-secret"
+	OAuth2Providers         = "oauth2-providers"
+	OAuth2TokenExpiry       = "oauth2-token-expiry"
+	OAuth2StateExpiry       = "oauth2-state-expiry"
+	OAuth2RedirectAllowlist = "oauth2-redirect-allowlist"
 
 	JWTAccessTokenExpiry      = "jwt-access-token-expiry"
 	JWTAccessTokenCookieName  = "jwt-access-token-cookie-name"
 	JWTRefreshTokenExpiry     = "jwt-refresh-token-expiry"
 	JWTRefreshTokenCookieName = "jwt-refresh-token-cookie-name"
+	JWTRefreshTokenSecret     = "jwt-refresh-token-secret"
 	JWTPrivateKey             = "jwt-private-key"
 	JWTIssuer                 = "jwt-issuer"
+	JWTRevocationEnabled      = "jwt-revocation-enabled"
 
 	CookiesEnabled = "cookies-enabled"
 	CookiesDomain  = "cookies-domain"
@@ -183,19 +441,111 @@ const (
 	MongoDBServerSelectionTimeoutMs = "mongodb-server-selection-timeout-ms"
 	MongoDBConnectTimeoutMs         = "mongodb-connect-timeout-ms"
 	MongoDBSocketTimeoutMs          = "mongodb-socket-timeout-ms"
+
+	MailerTransport    = "mailer-transport"
+	MailerFrom         = "mailer-from"
+	MailerSMTPHost     = "mailer-smtp-host"
+	MailerSMTPPort     = "mailer-smtp-port"
+	MailerSMTPUsername = "mailer-smtp-username"
+	MailerSMTPPassword = "mailer-smtp-password"
+	MailerFileDir      = "mailer-file-dir"
+
+	EmailVerificationMode        = "email-verification-mode"
+	EmailVerificationTokenExpiry = "email-verification-token-expiry"
+
+	PasswordMinLength   = "password-min-length"
+	PasswordMinScore    = "password-min-score"
+	PasswordBreachedDir = "password-breached-dir"
+
+	PasswordHashAlgorithm         = "password-hash-algorithm"
+	PasswordHashArgon2Memory      = "password-hash-argon2-memory"
+	PasswordHashArgon2Iterations  = "password-hash-argon2-iterations"
+	PasswordHashArgon2Parallelism = "password-hash-argon2-parallelism"
+	PasswordHashArgon2Concurrency = "password-hash-argon2-concurrency"
+	PasswordHashBcryptCost        = "password-hash-bcrypt-cost"
+
+	PasswordResetTokenExpiry = "password-reset-token-expiry"
+
+	EmailChangeTokenExpiry = "email-change-token-expiry"
+
+	AccountDeletionGracePeriod   = "account-deletion-grace-period"
+	AccountDeletionPurgeInterval = "account-deletion-purge-interval"
+
+	ExportClaimTimeout   = "export-claim-timeout"
+	ExportExpiry         = "export-expiry"
+	ExportDownloadExpiry = "export-download-expiry"
+	ExportInterval       = "export-interval"
+
+	ImpersonationTokenExpiry = "impersonation-token-expiry"
+
+	PATPrefix                 = "pat-prefix"
+	PATLegacyJWTEnabled       = "pat-legacy-jwt-enabled"
+	PATCacheTTL               = "pat-cache-ttl"
+	PATUsageFlushInterval     = "pat-usage-flush-interval"
+	PATUsageWindow            = "pat-usage-window"
+	PATRotationMaxGracePeriod = "pat-rotation-max-grace-period"
+	PATExpiryNotice           = "pat-expiry-notice"
+	PATExpiryNotifyInterval   = "pat-expiry-notify-interval"
+	PATMaxLifetime            = "pat-max-lifetime"
+	PATMaxTokens              = "pat-max-tokens"
+	PATRoleMaxLifetime        = "pat-role-max-lifetime"
+	PATRoleMaxTokens          = "pat-role-max-tokens"
+
+	MFAIssuer      = "mfa-issuer"
+	MFATokenExpiry = "mfa-token-expiry"
+
+	LoginMaxFailures     = "login-max-failures"
+	LoginIPMaxFailures   = "login-ip-max-failures"
+	LoginBackoffBase     = "login-backoff-base"
+	LoginBackoffMax      = "login-backoff-max"
+	LoginLockoutDuration = "login-lockout-duration"
+	LoginFailureWindow   = "login-failure-window"
+)
+
+const (
+	MailerTransportSMTP = "smtp"
+	MailerTransportLog  = "log"
+	MailerTransportFile = "file"
+)
+
+const (
+	// EmailVerificationOptional sends verification emails but doesn't restrict unverified users.
+	EmailVerificationOptional = "optional"
+	// EmailVerificationLogin prevents unverified users from logging in.
+	EmailVerificationLogin = "login"
+	// EmailVerificationRestricted only lets unverified users reach /user.
+	EmailVerificationRestricted = "restricted"
+)
+
+const (
+	// PasswordHashArgon2id hashes passwords with argon2id.
+	PasswordHashArgon2id = "argon2id"
+	// PasswordHashBcrypt hashes passwords with bcrypt.
+	PasswordHashBcrypt = "bcrypt"
 )
 
 // addFlags adds all the flags from the command line
 func (c *Config) addFlags(fs *pflag.FlagSet) {
 	fs.StringVar(&c.BaseURL, BaseURL, c.BaseURL, "Base URL where the app will be served")
+	fs.StringVar(&c.FrontendURL, FrontendURL, c.FrontendURL, "URL of the frontend emails link to for pages users act on")
+	fs.StringSliceVar(&c.TrustedProxies, HTTPTrustedProxies, c.TrustedProxies,
+		"CIDR ranges of the proxies trusted to set X-Forwarded-For, the client IP is the peer address when unset")
 
 	fs.BoolVar(&c.Admin.Create, AdminCreate, c.Admin.Create, "Create admin")
 	fs.StringVar(&c.Admin.Email, AdminEmail, c.Admin.Email, "Admin email")
 	fs.StringVar(&c.Admin.Username, AdminUsername, c.Admin.Username, "Admin username")
 	fs.StringVar(&c.Admin.Password, AdminPassword, c.Admin.Password, "Admin password")
 
-	fs.StringVar(&c.OAuth2.ClientId, OAuth2ClientId, c.OAuth2.ClientId, "OAuth2 client id")
-	fs.StringVar(&c.OAuth2.ClientSecret, OAuth2ClientSecret, c.OAuth2.ClientSecret, "OAuth2 client secret")
+	fs.StringVar(&c.OAuth2.ClientId, OAuth2ClientId, c.OAuth2.ClientId,
+		"Client id of the default provider, Google, unless it's configured in oauth2-providers")
+	fs.StringVar(&c.OAuth2.ClientSecret, OAuth2ClientSecret, c.OAuth2.ClientSecret,
+		"Client secret of the default provider, Google, unless it's configured in oauth2-providers")
+	fs.DurationVar(&c.OAuth2.TokenExpiry, OAuth2TokenExpiry, c.OAuth2.TokenExpiry,
+		"Expiry of the tokens used to finish signing up with a provider")
+	fs.DurationVar(&c.OAuth2.StateExpiry, OAuth2StateExpiry, c.OAuth2.StateExpiry,
+		"Expiry of the signed cookie holding the state, nonce and PKCE verifier of a provider log in")
+	fs.StringSliceVar(&c.OAuth2.RedirectAllowlist, OAuth2RedirectAllowlist, c.OAuth2.RedirectAllowlist,
+		"URLs users can be sent back to with redirect_to after logging in with a provider")
 
 	fs.DurationVar(&c.JWT.AccessTokenExpiry, JWTAccessTokenExpiry, c.JWT.AccessTokenExpiry,
 		"JWT access token expiry")
@@ -205,8 +555,12 @@ func (c *Config) addFlags(fs *pflag.FlagSet) {
 		"JWT refresh token expiry")
 	fs.StringVar(&c.JWT.RefreshTokenCookieName, JWTRefreshTokenCookieName, c.JWT.RefreshTokenCookieName,
 		"JWT refresh token cookie name")
+	fs.StringVar(&c.JWT.RefreshTokenSecret, JWTRefreshTokenSecret, c.JWT.RefreshTokenSecret,
+		"Secret refresh tokens are hashed with, derived from the JWT private key when unset")
 	fs.StringVar(&c.JWT.PrivateKey, JWTPrivateKey, c.JWT.PrivateKey, "JWT private key file path")
 	fs.StringVar(&c.JWT.Issuer, JWTIssuer, c.JWT.Issuer, "JWT issuer")
+	fs.BoolVar(&c.JWT.RevocationEnabled, JWTRevocationEnabled, c.JWT.RevocationEnabled,
+		"Check access tokens against the denylist and the user's token version on every request")
 
 	fs.BoolVar(&c.Cookies.Enabled, CookiesEnabled, c.Cookies.Enabled, "Send cookies with authentication requests")
 	fs.StringVar(&c.Cookies.Domain, CookiesDomain, c.Cookies.Domain, "Cookies domain")
@@ -232,6 +586,106 @@ func (c *Config) addFlags(fs *pflag.FlagSet) {
 		"MongoDB connect timeout ms")
 	fs.DurationVar(&c.MongoDB.SocketTimeoutMs, MongoDBSocketTimeoutMs, c.MongoDB.SocketTimeoutMs,
 		"MongoDB socket timeout ms")
+
+	fs.StringVar(&c.Mailer.Transport, MailerTransport, c.Mailer.Transport,
+		"Mailer transport. Valid transports: 'smtp', 'log' and 'file'")
+	fs.StringVar(&c.Mailer.From, MailerFrom, c.Mailer.From, "Mailer from address")
+	fs.StringVar(&c.Mailer.SMTPHost, MailerSMTPHost, c.Mailer.SMTPHost, "Mailer SMTP host")
+	fs.IntVar(&c.Mailer.SMTPPort, MailerSMTPPort, c.Mailer.SMTPPort, "Mailer SMTP port")
+	fs.StringVar(&c.Mailer.SMTPUsername, MailerSMTPUsername, c.Mailer.SMTPUsername, "Mailer SMTP username")
+	fs.StringVar(&c.Mailer.SMTPPassword, MailerSMTPPassword, c.Mailer.SMTPPassword, "Mailer SMTP password")
+	fs.StringVar(&c.Mailer.FileDir, MailerFileDir, c.Mailer.FileDir,
+		"Directory the file transport writes emails to")
+
+	fs.StringVar(&c.EmailVerification.Mode, EmailVerificationMode, c.EmailVerification.Mode,
+		"Email verification mode. Valid modes: 'optional', 'login' (unverified users can't log in) "+
+			"and 'restricted' (unverified users can only reach /user)")
+	fs.DurationVar(&c.EmailVerification.TokenExpiry, EmailVerificationTokenExpiry, c.EmailVerification.TokenExpiry,
+		"Email verification token expiry")
+
+	fs.IntVar(&c.PasswordPolicy.MinLength, PasswordMinLength, c.PasswordPolicy.MinLength, "Minimum password length")
+	fs.IntVar(&c.PasswordPolicy.MinScore, PasswordMinScore, c.PasswordPolicy.MinScore,
+		"Minimum password strength score, from 0 (too guessable) to 4 (very unguessable)")
+	fs.StringVar(&c.PasswordPolicy.BreachedDir, PasswordBreachedDir, c.PasswordPolicy.BreachedDir,
+		"Directory of Have I Been Pwned range files passwords are checked against, unset disables the check")
+
+	fs.StringVar(&c.PasswordHash.Algorithm, PasswordHashAlgorithm, c.PasswordHash.Algorithm,
+		fmt.Sprintf("Algorithm new passwords are hashed with. Valid algorithms: '%s' and '%s'",
+			PasswordHashArgon2id, PasswordHashBcrypt))
+	fs.Uint32Var(&c.PasswordHash.Argon2Memory, PasswordHashArgon2Memory, c.PasswordHash.Argon2Memory,
+		"Memory used by argon2id to hash a password, in KiB")
+	fs.Uint32Var(&c.PasswordHash.Argon2Iterations, PasswordHashArgon2Iterations, c.PasswordHash.Argon2Iterations,
+		"Number of passes of argon2id over the memory")
+	fs.Uint8Var(&c.PasswordHash.Argon2Parallelism, PasswordHashArgon2Parallelism, c.PasswordHash.Argon2Parallelism,
+		"Number of threads used by argon2id")
+	fs.IntVar(&c.PasswordHash.Argon2Concurrency, PasswordHashArgon2Concurrency, c.PasswordHash.Argon2Concurrency,
+		"Most passwords hashed with argon2id at once, others wait. Peak memory is about memory * concurrency, 0 means no limit")
+	fs.IntVar(&c.PasswordHash.BcryptCost, PasswordHashBcryptCost, c.PasswordHash.BcryptCost, "Cost of bcrypt")
+
+	fs.DurationVar(&c.PasswordReset.TokenExpiry, PasswordResetTokenExpiry, c.PasswordReset.TokenExpiry,
+		"Password reset token expiry")
+
+	fs.DurationVar(&c.EmailChange.TokenExpiry, EmailChangeTokenExpiry, c.EmailChange.TokenExpiry,
+		"Expiry of the links confirming an email change and cancelling it")
+
+	fs.DurationVar(&c.AccountDeletion.GracePeriod, AccountDeletionGracePeriod, c.AccountDeletion.GracePeriod,
+		"Time during which a deleted account can be restored before it's purged, 0 purges it right away")
+	fs.DurationVar(&c.AccountDeletion.PurgeInterval, AccountDeletionPurgeInterval, c.AccountDeletion.PurgeInterval,
+		"Interval at which deleted accounts past their grace period are purged")
+
+	fs.DurationVar(&c.Export.ClaimTimeout, ExportClaimTimeout, c.Export.ClaimTimeout,
+		"Time after which a data export still running is considered abandoned and built again")
+	fs.DurationVar(&c.Export.Expiry, ExportExpiry, c.Export.Expiry,
+		"Time a data export can be downloaded for before it's deleted")
+	fs.DurationVar(&c.Export.DownloadExpiry, ExportDownloadExpiry, c.Export.DownloadExpiry,
+		"Expiry of the signed tokens to download a data export")
+	fs.DurationVar(&c.Export.Interval, ExportInterval, c.Export.Interval,
+		"Interval at which pending data exports are processed")
+
+	fs.DurationVar(&c.Impersonation.TokenExpiry, ImpersonationTokenExpiry, c.Impersonation.TokenExpiry,
+		"Expiry of the access tokens admins get to impersonate a user")
+
+	fs.StringVar(&c.PAT.Prefix, PATPrefix, c.PAT.Prefix,
+		"Prefix of personal access tokens, which lets secret scanners recognize them")
+	fs.BoolVar(&c.PAT.LegacyJWTEnabled, PATLegacyJWTEnabled, c.PAT.LegacyJWTEnabled,
+		"Accept the personal access tokens issued as JWTs")
+	fs.DurationVar(&c.PAT.CacheTTL, PATCacheTTL, c.PAT.CacheTTL,
+		"Time a validated personal access token is trusted without checking it again, 0 disables the cache")
+	fs.DurationVar(&c.PAT.UsageFlushInterval, PATUsageFlushInterval, c.PAT.UsageFlushInterval,
+		"Interval at which the usage of personal access tokens is written")
+	fs.DurationVar(&c.PAT.UsageWindow, PATUsageWindow, c.PAT.UsageWindow,
+		"Time the request count of personal access tokens covers, requests are counted by day")
+	fs.DurationVar(&c.PAT.RotationMaxGracePeriod, PATRotationMaxGracePeriod, c.PAT.RotationMaxGracePeriod,
+		"Longest time a rotated personal access token can keep working")
+	fs.DurationVar(&c.PAT.ExpiryNotice, PATExpiryNotice, c.PAT.ExpiryNotice,
+		"Time before a personal access token expires that its owner is notified")
+	fs.DurationVar(&c.PAT.ExpiryNotifyInterval, PATExpiryNotifyInterval, c.PAT.ExpiryNotifyInterval,
+		"Interval at which the owners of expiring personal access tokens are notified")
+	fs.DurationVar(&c.PAT.MaxLifetime, PATMaxLifetime, c.PAT.MaxLifetime,
+		"Longest lifetime of personal access tokens, 0 means no limit")
+	fs.IntVar(&c.PAT.MaxTokens, PATMaxTokens, c.PAT.MaxTokens,
+		"Most personal access tokens a user can have, 0 means no limit")
+	fs.StringToStringVar(&c.PAT.RoleMaxLifetime, PATRoleMaxLifetime, c.PAT.RoleMaxLifetime,
+		"Longest lifetime of personal access tokens by role, e.g. admin=720h")
+	fs.StringToStringVar(&c.PAT.RoleMaxTokens, PATRoleMaxTokens, c.PAT.RoleMaxTokens,
+		"Most personal access tokens a user can have by role, e.g. admin=100")
+
+	fs.StringVar(&c.MFA.Issuer, MFAIssuer, c.MFA.Issuer, "Issuer shown in authenticator apps")
+	fs.DurationVar(&c.MFA.TokenExpiry, MFATokenExpiry, c.MFA.TokenExpiry,
+		"Expiry of the token used to complete a login with a second factor")
+
+	fs.IntVar(&c.LoginThrottle.MaxFailures, LoginMaxFailures, c.LoginThrottle.MaxFailures,
+		"Failed logins after which an account is locked out")
+	fs.IntVar(&c.LoginThrottle.IPMaxFailures, LoginIPMaxFailures, c.LoginThrottle.IPMaxFailures,
+		"Failed logins after which a client IP is locked out")
+	fs.DurationVar(&c.LoginThrottle.BackoffBase, LoginBackoffBase, c.LoginThrottle.BackoffBase,
+		"Delay after the first failed login of an account, doubled after each failure")
+	fs.DurationVar(&c.LoginThrottle.BackoffMax, LoginBackoffMax, c.LoginThrottle.BackoffMax,
+		"Maximum delay between failed logins")
+	fs.DurationVar(&c.LoginThrottle.LockoutDuration, LoginLockoutDuration, c.LoginThrottle.LockoutDuration,
+		"Lockout duration")
+	fs.DurationVar(&c.LoginThrottle.FailureWindow, LoginFailureWindow, c.LoginThrottle.FailureWindow,
+		"Failed logins are forgotten after this long without a new failure")
 }
 
 func (c *Config) BindFlags() {
@@ -257,6 +711,12 @@ func (c *Config) BindFlags() {
 		panic(fmt.Errorf("failed creating logger: %v", err))
 	}
 
+	for _, proxy := range viper.GetStringSlice(HTTPTrustedProxies) {
+		if _, _, err := net.ParseCIDR(proxy); err != nil {
+			log.Panic().Msgf("HTTP: trusted proxy '%s' is not a CIDR range!", proxy)
+		}
+	}
+
 	if viper.GetBool(CSRFEnabled) && viper.GetString(CSRFSecretKey) == "" {
 		log.Panic().Msg("CSRF: secret key is unset!")
 	}
@@ -265,6 +725,84 @@ func (c *Config) BindFlags() {
 		log.Panic().Msg("Admin create: password is unset!")
 	}
 
+	if score := viper.GetInt(PasswordMinScore); score < 0 || score > 4 {
+		log.Panic().Msgf("Password: min score must be between 0 and 4, got %d!", score)
+	}
+
+	switch viper.GetString(PasswordHashAlgorithm) {
+	case PasswordHashArgon2id:
+		if viper.GetUint32(PasswordHashArgon2Iterations) < 1 || viper.GetUint32(PasswordHashArgon2Parallelism) < 1 {
+			log.Panic().Msg("Password hash: argon2id iterations and parallelism must be at least 1!")
+		}
+		if n := viper.GetInt(PasswordHashArgon2Concurrency); n < 0 {
+			log.Panic().Msgf("Password hash: argon2id concurrency must be at least 0, got %d!", n)
+		}
+	case PasswordHashBcrypt:
+		if cost := viper.GetInt(PasswordHashBcryptCost); cost < 4 || cost > 31 {
+			log.Panic().Msgf("Password hash: bcrypt cost must be between 4 and 31, got %d!", cost)
+		}
+	default:
+		log.Panic().Msgf("Password hash: unknown algorithm '%s'!", viper.GetString(PasswordHashAlgorithm))
+	}
+
+	if dir := viper.GetString(PasswordBreachedDir); dir != "" {
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			log.Panic().Msgf("Password: breached directory '%s' is not a directory!", dir)
+		}
+	}
+
+	if c.OAuth2.Providers, err = GetOAuth2Providers(); err != nil {
+		log.Panic().Msgf("OAuth2: failed reading providers: %v", err)
+	}
+
+	for _, p := range c.OAuth2.Providers {
+		if p.Name == "" || p.ClientId == "" {
+			log.Panic().Msg("OAuth2: provider name or client id is unset!")
+		}
+
+		if p.Issuer == "" && (p.AuthURL == "" || p.TokenURL == "" || p.UserInfoURL == "") {
+			log.Panic().Msgf("OAuth2: provider '%s' needs an issuer or auth, token and userinfo URLs!", p.Name)
+		}
+	}
+
+	for _, allowed := range viper.GetStringSlice(OAuth2RedirectAllowlist) {
+		if u, err := url.Parse(allowed); err != nil || u.Scheme == "" || u.Host == "" {
+			log.Panic().Msgf("OAuth2: redirect allowlist entry '%s' must be an absolute URL!", allowed)
+		}
+	}
+
+	switch viper.GetString(MailerTransport) {
+	case MailerTransportSMTP:
+		if viper.GetString(MailerSMTPHost) == "" {
+			log.Panic().Msg("Mailer: SMTP host is unset!")
+		}
+	case MailerTransportLog, MailerTransportFile:
+	default:
+		log.Panic().Msgf("Mailer: unknown transport '%s'!", viper.GetString(MailerTransport))
+	}
+
+	for role, lifetime := range viper.GetStringMapString(PATRoleMaxLifetime) {
+		if d, err := time.ParseDuration(lifetime); err != nil || d < 0 {
+			log.Panic().Msgf("PAT: max lifetime '%s' of role '%s' must be a duration!", lifetime, role)
+		}
+	}
+
+	for role, tokens := range viper.GetStringMapString(PATRoleMaxTokens) {
+		if n, err := strconv.Atoi(tokens); err != nil || n < 0 {
+			log.Panic().Msgf("PAT: max tokens '%s' of role '%s' must be a number!", tokens, role)
+		}
+	}
+
+	if viper.GetInt(LoginMaxFailures) < 1 || viper.GetInt(LoginIPMaxFailures) < 1 {
+		log.Panic().Msg("Login throttle: max failures must be at least 1!")
+	}
+
+	switch viper.GetString(EmailVerificationMode) {
+	case EmailVerificationOptional, EmailVerificationLogin, EmailVerificationRestricted:
+	default:
+		log.Panic().Msgf("Email verification: unknown mode '%s'!", viper.GetString(EmailVerificationMode))
+	}
+
 	if viper.GetBool(libHttp.HTTPCORSEnabled) {
 		for _, origin := range viper.GetStringSlice(libHttp.HTTPCORSAllowOrigins) {
 			if origin == "*" {
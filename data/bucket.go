@@ -0,0 +1,94 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/alexferl/echo-boilerplate/config"
+)
+
+var ErrFileNotFound = errors.New("file not found")
+
+// Bucket stores files too large to fit in a document, like data exports.
+type Bucket interface {
+	Upload(ctx context.Context, id string, name string, r io.Reader) error
+	Open(ctx context.Context, id string) (io.ReadCloser, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// GridFSBucket is a Bucket backed by GridFS, so files are shared by
+// every instance of the app and backed up along with the database.
+type GridFSBucket struct {
+	client *mongo.Client
+	name   string
+}
+
+func NewBucket(client *mongo.Client, name string) Bucket {
+	return &GridFSBucket{client, name}
+}
+
+// bucket returns a new GridFS bucket since deadlines are set on the bucket
+// itself and can't be shared by concurrent operations.
+func (b *GridFSBucket) bucket(ctx context.Context) (*gridfs.Bucket, error) {
+	db := b.client.Database(viper.GetString(config.AppName))
+	bucket, err := gridfs.NewBucket(db, options.GridFSBucket().SetName(b.name))
+	if err != nil {
+		return nil, err
+	}
+
+	// a zero deadline, when ctx has none, means no deadline
+	deadline, _ := ctx.Deadline()
+	if err = bucket.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+	if err = bucket.SetWriteDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	return bucket, nil
+}
+
+func (b *GridFSBucket) Upload(ctx context.Context, id string, name string, r io.Reader) error {
+	bucket, err := b.bucket(ctx)
+	if err != nil {
+		return err
+	}
+
+	return bucket.UploadFromStreamWithID(id, name, r)
+}
+
+func (b *GridFSBucket) Open(ctx context.Context, id string) (io.ReadCloser, error) {
+	bucket, err := b.bucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := bucket.OpenDownloadStream(id)
+	if err == gridfs.ErrFileNotFound {
+		return nil, ErrFileNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+func (b *GridFSBucket) Delete(ctx context.Context, id string) error {
+	bucket, err := b.bucket(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = bucket.DeleteContext(ctx, id)
+	if err == gridfs.ErrFileNotFound {
+		return ErrFileNotFound
+	}
+
+	return err
+}
@@ -50,6 +50,18 @@ func NewClient() (*mongo.Client, error) {
 	return client, nil
 }
 
+// tokenOpts returns the options of a unique index on the token field.
+// Documents without a token have it set to an empty string, a sparse index
+// would still hold those, so only the documents with a token are indexed.
+// The collation is the one the users mapper queries with, so lookups can
+// use the index.
+func tokenOpts(field string) *options.IndexOptions {
+	return options.Index().
+		SetUnique(true).
+		SetPartialFilterExpression(bson.D{{field, bson.D{{"$gt", ""}}}}).
+		SetCollation(&options.Collation{Locale: "en", Strength: 2})
+}
+
 func CreateIndexes(client *mongo.Client) {
 	db := client.Database(viper.GetString(config.AppName))
 
@@ -90,6 +102,35 @@ func CreateIndexes(client *mongo.Client) {
 				Unique: &t,
 			},
 		},
+		{
+			Keys: bson.D{
+				{"password_reset_token", 1},
+			},
+			Options: tokenOpts("password_reset_token"),
+		},
+		{
+			Keys: bson.D{
+				{"restore_token", 1},
+			},
+			Options: tokenOpts("restore_token"),
+		},
+		{
+			Keys: bson.D{
+				{"email_change_token", 1},
+			},
+			Options: tokenOpts("email_change_token"),
+		},
+		{
+			Keys: bson.D{
+				{"email_change_cancel_token", 1},
+			},
+			Options: tokenOpts("email_change_cancel_token"),
+		},
+		{
+			Keys: bson.D{
+				{"purge_at", 1},
+			},
+		},
 	})
 	if err != nil {
 		panic(err)
@@ -109,6 +150,159 @@ func CreateIndexes(client *mongo.Client) {
 		panic(err)
 	}
 
+	_, err = db.Collection("sessions").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{
+				{"id", 1},
+			},
+			Options: &options.IndexOptions{
+				Unique: &t,
+			},
+		},
+		{
+			Keys: bson.D{
+				{"user_id", 1},
+			},
+		},
+		{
+			Keys: bson.D{
+				{"expires_at", 1},
+			},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Collection("audit_events").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{
+				{"id", 1},
+			},
+			Options: &options.IndexOptions{
+				Unique: &t,
+			},
+		},
+		{
+			Keys: bson.D{
+				{"user_id", 1},
+				{"created_at", -1},
+			},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Collection("revoked_tokens").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{
+				{"id", 1},
+			},
+			Options: &options.IndexOptions{
+				Unique: &t,
+			},
+		},
+		{
+			Keys: bson.D{
+				{"expires_at", 1},
+			},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Collection("login_attempts").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{
+				{"id", 1},
+			},
+			Options: &options.IndexOptions{
+				Unique: &t,
+			},
+		},
+		{
+			Keys: bson.D{
+				{"type", 1},
+				{"key", 1},
+			},
+			Options: &options.IndexOptions{
+				Unique: &t,
+			},
+		},
+		{
+			Keys: bson.D{
+				{"locked_until", 1},
+			},
+		},
+		{
+			Keys: bson.D{
+				{"expires_at", 1},
+			},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Collection("identities").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{
+				{"id", 1},
+			},
+			Options: &options.IndexOptions{
+				Unique: &t,
+			},
+		},
+		{
+			Keys: bson.D{
+				{"provider", 1},
+				{"subject", 1},
+			},
+			Options: &options.IndexOptions{
+				Unique: &t,
+			},
+		},
+		{
+			Keys: bson.D{
+				{"user_id", 1},
+			},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Collection("exports").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{
+				{"id", 1},
+			},
+			Options: &options.IndexOptions{
+				Unique: &t,
+			},
+		},
+		{
+			Keys: bson.D{
+				{"user_id", 1},
+				{"status", 1},
+			},
+		},
+		{
+			Keys: bson.D{
+				{"status", 1},
+				{"created_at", 1},
+			},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+
 	_, err = db.Collection("personal_access_tokens").Indexes().CreateMany(ctx, []mongo.IndexModel{
 		{
 			Keys: bson.D{
@@ -132,6 +326,18 @@ func CreateIndexes(client *mongo.Client) {
 				Unique: &t,
 			},
 		},
+		{
+			Keys: bson.D{
+				{"token_hash", 1},
+			},
+			Options: tokenOpts("token_hash"),
+		},
+		{
+			Keys: bson.D{
+				{"previous_token_hash", 1},
+			},
+			Options: tokenOpts("previous_token_hash"),
+		},
 	})
 	if err != nil {
 		panic(err)
@@ -12,10 +12,13 @@ type Mapper interface {
 	Insert(ctx context.Context, document any, result any, opts ...*options.InsertOneOptions) (any, error)
 	FindOne(ctx context.Context, filter any, result any, opts ...*options.FindOneOptions) (any, error)
 	FindOneById(ctx context.Context, id string, result any, opts ...*options.FindOneOptions) (any, error)
+	FindOneAndUpdate(ctx context.Context, filter any, update any, result any, opts ...*options.FindOneAndUpdateOptions) (any, error)
 	Find(ctx context.Context, filter any, result any, opts ...*options.FindOptions) (any, error)
 	Aggregate(ctx context.Context, filter any, limit int, skip int, result any, opts ...*options.AggregateOptions) (any, error)
 	Count(ctx context.Context, filter any, opts ...*options.CountOptions) (int64, error)
 	Update(ctx context.Context, filter any, update any, result any, opts ...*options.UpdateOptions) (any, error)
 	UpdateById(ctx context.Context, id string, document any, result any, opts ...*options.UpdateOptions) (any, error)
+	UpdateMany(ctx context.Context, filter any, update any, opts ...*options.UpdateOptions) (int64, error)
+	Delete(ctx context.Context, filter any, opts ...*options.DeleteOptions) (int64, error)
 	Upsert(ctx context.Context, filter any, update any, result any, opts ...*options.FindOneAndUpdateOptions) (any, error)
 }
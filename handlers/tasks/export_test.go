@@ -0,0 +1,3 @@
+package tasks
+
+var AggregatePipeline = aggregatePipeline
@@ -13,6 +13,7 @@ import (
 
 	"github.com/alexferl/echo-boilerplate/config"
 	"github.com/alexferl/echo-boilerplate/data"
+	"github.com/alexferl/echo-boilerplate/handlers/users"
 )
 
 var ErrTaskNotFound = errors.New("task not found")
@@ -100,10 +101,33 @@ func (m *Mapper) Find(ctx context.Context, filter any, result any, opts ...*opti
 }
 
 func (m *Mapper) Aggregate(ctx context.Context, filter any, limit int, skip int, result any, opts ...*options.AggregateOptions) (any, error) {
+	cur, err := m.collection.Aggregate(ctx, aggregatePipeline(filter, limit, skip), opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	defer cur.Close(ctx)
+
+	err = cur.All(ctx, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = cur.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// aggregatePipeline returns the pipeline matching the tasks of filter with
+// the users who created, updated and completed them.
+func aggregatePipeline(filter any, limit int, skip int) mongo.Pipeline {
 	if filter == nil {
 		filter = bson.D{}
 	}
-	pipeline := mongo.Pipeline{
+
+	return mongo.Pipeline{
 		{{"$match", filter}},
 		{{"$lookup", bson.M{
 			"from":         "users",
@@ -112,6 +136,7 @@ func (m *Mapper) Aggregate(ctx context.Context, filter any, limit int, skip int,
 			"as":           "created_by",
 		}}},
 		{{"$unwind", "$created_by"}},
+		{{"$set", bson.M{"created_by": publicUser("$created_by")}}},
 		{{"$lookup", bson.M{
 			"from":         "users",
 			"localField":   "updated_by",
@@ -124,6 +149,7 @@ func (m *Mapper) Aggregate(ctx context.Context, filter any, limit int, skip int,
 				{"preserveNullAndEmptyArrays", true},
 			},
 		}},
+		{{"$set", bson.M{"updated_by": publicUser("$updated_by")}}},
 		{{"$lookup", bson.M{
 			"from":         "users",
 			"localField":   "completed_by",
@@ -136,27 +162,24 @@ func (m *Mapper) Aggregate(ctx context.Context, filter any, limit int, skip int,
 				{"preserveNullAndEmptyArrays", true},
 			},
 		}},
+		{{"$set", bson.M{"completed_by": publicUser("$completed_by")}}},
 		{{"$limit", skip + limit}},
 		{{"$skip", skip}},
 	}
+}
 
-	cur, err := m.collection.Aggregate(ctx, pipeline, opts...)
-	if err != nil {
-		return nil, err
-	}
-
-	defer cur.Close(ctx)
-
-	err = cur.All(ctx, &result)
-	if err != nil {
-		return nil, err
-	}
-
-	if err = cur.Err(); err != nil {
-		return nil, err
-	}
-
-	return result, nil
+// publicUser replaces the user looked up at field with a
+// placeholder if they deleted their account.
+func publicUser(field string) bson.M {
+	return bson.M{"$cond": bson.A{
+		bson.M{"$gt": bson.A{field + ".deleted_at", nil}},
+		bson.M{
+			"id":       field + ".id",
+			"username": users.DeletedUsername,
+			"name":     users.DeletedName,
+		},
+		field,
+	}}
 }
 
 func (m *Mapper) Count(ctx context.Context, filter any, opts ...*options.CountOptions) (int64, error) {
@@ -207,6 +230,29 @@ func (m *Mapper) UpdateById(ctx context.Context, id string, document any, result
 	return m.Update(ctx, filter, update, result, opts...)
 }
 
+func (m *Mapper) UpdateMany(ctx context.Context, filter any, update any, opts ...*options.UpdateOptions) (int64, error) {
+	res, err := m.collection.UpdateMany(ctx, filter, update, opts...)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.ModifiedCount, nil
+}
+
+func (m *Mapper) Delete(ctx context.Context, filter any, opts ...*options.DeleteOptions) (int64, error) {
+	res, err := m.collection.DeleteMany(ctx, filter, opts...)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.DeletedCount, nil
+}
+
+func (m *Mapper) FindOneAndUpdate(ctx context.Context, filter any, update any, result any, opts ...*options.FindOneAndUpdateOptions) (any, error) {
+	// TODO implement me
+	panic("implement me")
+}
+
 func (m *Mapper) Upsert(ctx context.Context, filter any, update any, result any, opts ...*options.FindOneAndUpdateOptions) (any, error) {
 	// TODO implement me
 	panic("implement me")
@@ -50,13 +50,9 @@ type TaskResponse struct {
 
 func (t *Task) MakeResponse(createdBy *users.User, updatedBy *users.User, completedBy *users.User) *TaskResponse {
 	resp := &TaskResponse{
-		Id:        t.Id,
-		CreatedAt: t.CreatedAt,
-		CreatedBy: &users.PublicUser{
-			Id:       createdBy.Id,
-			Username: createdBy.Username,
-			Name:     createdBy.Name,
-		},
+		Id:          t.Id,
+		CreatedAt:   t.CreatedAt,
+		CreatedBy:   createdBy.Public(),
 		DeletedAt:   t.DeletedAt,
 		DeletedBy:   t.DeletedBy,
 		UpdatedAt:   t.UpdatedAt,
@@ -66,19 +62,11 @@ func (t *Task) MakeResponse(createdBy *users.User, updatedBy *users.User, comple
 	}
 
 	if updatedBy != nil {
-		resp.UpdatedBy = &users.PublicUser{
-			Id:       updatedBy.Id,
-			Username: updatedBy.Username,
-			Name:     updatedBy.Name,
-		}
+		resp.UpdatedBy = updatedBy.Public()
 	}
 
 	if completedBy != nil {
-		resp.CompletedBy = &users.PublicUser{
-			Id:       completedBy.Id,
-			Username: completedBy.Username,
-			Name:     completedBy.Name,
-		}
+		resp.CompletedBy = completedBy.Public()
 	}
 
 	return resp
@@ -10,6 +10,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/bson"
 
 	"github.com/alexferl/echo-boilerplate/data"
 	"github.com/alexferl/echo-boilerplate/handlers/tasks"
@@ -20,7 +21,7 @@ func TestHandler_GetTask_200(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	newTask := tasks.NewTask()
@@ -51,6 +52,74 @@ func TestHandler_GetTask_200(t *testing.T) {
 	assert.Equal(t, http.StatusOK, resp.Code)
 }
 
+func TestHandler_GetTask_200_DeletedCreator(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	creator := users.NewUser("deleted@example.com", "creator")
+	creator.Name = "Creator"
+	creator.Delete(creator.Id)
+
+	newTask := tasks.NewTask()
+	newTask.Create(creator.Id)
+	task := newTask.MakeResponse(creator, nil, nil)
+
+	req := httptest.NewRequest(http.MethodGet, "/tasks/id", nil)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	var filter any
+	mapper.Mock.
+		On(
+			"Aggregate",
+			mock.Anything,
+			mock.Anything,
+			1,
+			0,
+			mock.Anything,
+		).
+		Run(func(args mock.Arguments) {
+			filter = args.Get(1)
+		}).
+		Return(
+			[]*tasks.TaskResponse{task},
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	var result tasks.TaskResponse
+	err = json.Unmarshal(resp.Body.Bytes(), &result)
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, creator.Id, result.CreatedBy.Id)
+	assert.Equal(t, users.DeletedUsername, result.CreatedBy.Username)
+	assert.Equal(t, users.DeletedName, result.CreatedBy.Name)
+
+	// the mapper replaces deleted users in the pipeline built from filter
+	assert.Equal(t, bson.D{{"id", "id"}}, filter)
+	var createdBy any
+	for _, stage := range tasks.AggregatePipeline(filter, 1, 0) {
+		if set, ok := stage[0].Value.(bson.M); ok && stage[0].Key == "$set" && set["created_by"] != nil {
+			createdBy = set["created_by"]
+		}
+	}
+	assert.Equal(t, bson.M{"$cond": bson.A{
+		bson.M{"$gt": bson.A{"$created_by.deleted_at", nil}},
+		bson.M{
+			"id":       "$created_by.id",
+			"username": users.DeletedUsername,
+			"name":     users.DeletedName,
+		},
+		"$created_by",
+	}}, createdBy)
+}
+
 func TestHandler_GetTask_401(t *testing.T) {
 	_, s := getMapperAndServer(t)
 
@@ -67,7 +136,7 @@ func TestHandler_GetTask_404(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	req := httptest.NewRequest(http.MethodGet, "/tasks/id", nil)
@@ -98,7 +167,7 @@ func TestHandler_GetTask_410(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	newTask := tasks.NewTask()
@@ -134,7 +203,7 @@ func TestHandler_UpdateTask_200(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	payload := &tasks.UpdateTaskRequest{
@@ -201,7 +270,7 @@ func TestHandler_UpdateTask_403(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	payload := &tasks.UpdateTaskRequest{
@@ -239,7 +308,7 @@ func TestHandler_UpdateTask_404(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	payload := &tasks.UpdateTaskRequest{
@@ -274,7 +343,7 @@ func TestHandler_UpdateTask_410(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	payload := &tasks.UpdateTaskRequest{
@@ -318,7 +387,7 @@ func TestHandler_UpdateTask_422(t *testing.T) {
 	_, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	b := bytes.NewBuffer([]byte(`{"invalid": "invalid"}`))
@@ -336,7 +405,7 @@ func TestHandler_DeleteTask_204(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	task := tasks.NewTask()
@@ -398,7 +467,7 @@ func TestHandler_DeleteTask_403(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	task := tasks.NewTask()
@@ -430,7 +499,7 @@ func TestHandler_DeleteTask_404(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	req := httptest.NewRequest(http.MethodDelete, "/tasks/id", nil)
@@ -459,7 +528,7 @@ func TestHandler_DeleteTask_410(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	newTask := tasks.NewTask()
@@ -19,7 +19,7 @@ func TestHandler_CreateTask_200(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	payload := &tasks.CreateTaskRequest{
@@ -76,7 +76,7 @@ func TestHandler_CreateTask_422(t *testing.T) {
 	_, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	payload := &tasks.CreateTaskRequest{
@@ -116,7 +116,7 @@ func TestHandler_ListTasks_200(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	retTasks := createTasks(10, user)
@@ -0,0 +1,89 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+)
+
+const AuditEventsCollection = "audit_events"
+
+const (
+	// AuditRefreshTokenReuse is recorded when a refresh token that was
+	// already rotated is presented again, the session is then revoked.
+	AuditRefreshTokenReuse = "refresh_token_reuse"
+	// AuditPasswordChanged is recorded when a user changes their password,
+	// their other sessions are then revoked.
+	AuditPasswordChanged = "password_changed"
+	// AuditEmailChangeReverted is recorded when a confirmed email change is
+	// cancelled from the previous address, the sessions are then revoked.
+	AuditEmailChangeReverted = "email_change_reverted"
+	// AuditAccountDeleted is recorded when a user deletes their account,
+	// or an admin deletes it for them.
+	AuditAccountDeleted = "account_deleted"
+	// AuditAccountRestored is recorded when a deleted account is restored
+	// during its grace period.
+	AuditAccountRestored = "account_restored"
+	// AuditRolesChanged is recorded when an admin changes the roles of a user.
+	AuditRolesChanged = "roles_changed"
+	// AuditAccountSuspended is recorded when an admin suspends a user, their
+	// sessions are then revoked and their tokens refused.
+	AuditAccountSuspended = "account_suspended"
+	// AuditAccountUnsuspended is recorded when an admin lifts a suspension.
+	AuditAccountUnsuspended = "account_unsuspended"
+	// AuditPasswordResetForced is recorded when an admin requires a user to
+	// reset their password before they can log in again.
+	AuditPasswordResetForced = "password_reset_forced"
+	// AuditTokensRevoked is recorded when an admin revokes every session and
+	// personal access token of a user.
+	AuditTokensRevoked = "tokens_revoked"
+	// AuditImpersonationStarted is recorded when an admin gets a token to
+	// impersonate a user.
+	AuditImpersonationStarted = "impersonation_started"
+	// AuditMFAReset is recorded when an admin disables the two-factor
+	// authentication of a user, their sessions are then revoked.
+	AuditMFAReset = "mfa_reset"
+)
+
+// AuditEvent records a security relevant event for a user.
+type AuditEvent struct {
+	Id        string         `json:"id" bson:"id"`
+	Type      string         `json:"type" bson:"type"`
+	UserId    string         `json:"user_id" bson:"user_id"`
+	IP        string         `json:"ip" bson:"ip"`
+	UserAgent string         `json:"user_agent" bson:"user_agent"`
+	Data      map[string]any `json:"data,omitempty" bson:"data,omitempty"`
+	CreatedAt *time.Time     `json:"created_at" bson:"created_at"`
+}
+
+func NewAuditEvent(c echo.Context, typ string, userId string, data map[string]any) *AuditEvent {
+	t := time.Now()
+	return &AuditEvent{
+		Id:        xid.New().String(),
+		Type:      typ,
+		UserId:    userId,
+		IP:        c.RealIP(),
+		UserAgent: c.Request().UserAgent(),
+		Data:      data,
+		CreatedAt: &t,
+	}
+}
+
+func (h *Handler) recordEvent(ctx context.Context, event *AuditEvent) error {
+	log.Warn().
+		Str("type", event.Type).
+		Str("user_id", event.UserId).
+		Str("ip", event.IP).
+		Msg("security event")
+
+	_, err := h.Mapper.Collection(AuditEventsCollection).Insert(ctx, event, nil)
+	if err != nil {
+		return fmt.Errorf("failed inserting audit event: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,159 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/alexferl/echo-boilerplate/util"
+)
+
+type AuthEmailChangeRequest struct {
+	Token string `json:"token"`
+}
+
+// AuthCheckEmailChange serves the link emailed to the new address, it tells
+// whether its token can still confirm the change. Only POST confirms it so
+// that fetching the link, like mail scanners do, has no effect.
+func (h *Handler) AuthCheckEmailChange(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, errResp, err := h.getEmailChangeUser(ctx, c, "email_change_token", c.QueryParam("token"), (*User).ValidateEmailChangeToken)
+	if err != nil {
+		return err
+	} else if errResp != nil {
+		return errResp()
+	}
+
+	return h.Validate(c, http.StatusNoContent, nil)
+}
+
+// AuthConfirmEmailChange replaces the email of a user with the pending one
+// using the token sent to the new address.
+func (h *Handler) AuthConfirmEmailChange(c echo.Context) error {
+	body := &AuthEmailChangeRequest{}
+	if err := c.Bind(body); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	user, errResp, err := h.getEmailChangeUser(ctx, c, "email_change_token", body.Token, (*User).ValidateEmailChangeToken)
+	if err != nil {
+		return err
+	} else if errResp != nil {
+		return errResp()
+	}
+
+	if err = user.ConfirmEmailChange(body.Token); err != nil {
+		return fmt.Errorf("failed confirming email change: %v", err)
+	}
+
+	user.Update(user.Id)
+
+	_, err = h.Mapper.UpdateById(ctx, user.Id, user, nil)
+	if err != nil {
+		if err == ErrDuplicateKey {
+			return h.Validate(c, http.StatusConflict, echo.Map{"message": "email already in-use"})
+		}
+		return fmt.Errorf("failed updating user: %v", err)
+	}
+
+	return h.Validate(c, http.StatusNoContent, nil)
+}
+
+// AuthCheckEmailChangeCancel serves the link emailed to the previous
+// address, it tells whether its token can still cancel the change. Only
+// POST cancels it so that fetching the link doesn't log the user out.
+func (h *Handler) AuthCheckEmailChangeCancel(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, errResp, err := h.getEmailChangeUser(ctx, c, "email_change_cancel_token", c.QueryParam("token"), (*User).ValidateEmailChangeCancelToken)
+	if err != nil {
+		return err
+	} else if errResp != nil {
+		return errResp()
+	}
+
+	return h.Validate(c, http.StatusNoContent, nil)
+}
+
+// AuthCancelEmailChange drops a pending email change using the token sent
+// to the previous address. A change that was already confirmed is undone
+// and the user is logged out everywhere since their account may be hijacked.
+func (h *Handler) AuthCancelEmailChange(c echo.Context) error {
+	body := &AuthEmailChangeRequest{}
+	if err := c.Bind(body); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	user, errResp, err := h.getEmailChangeUser(ctx, c, "email_change_cancel_token", body.Token, (*User).ValidateEmailChangeCancelToken)
+	if err != nil {
+		return err
+	} else if errResp != nil {
+		return errResp()
+	}
+
+	reverted, err := user.CancelEmailChange(body.Token)
+	if err != nil {
+		return fmt.Errorf("failed cancelling email change: %v", err)
+	}
+
+	user.Update(user.Id)
+
+	_, err = h.Mapper.UpdateById(ctx, user.Id, user, nil)
+	if err != nil {
+		if err == ErrDuplicateKey {
+			return h.Validate(c, http.StatusConflict, echo.Map{"message": "email already in-use"})
+		}
+		return fmt.Errorf("failed updating user: %v", err)
+	}
+
+	if reverted {
+		if err = h.revokeSessions(ctx, user.Id, ""); err != nil {
+			return err
+		}
+
+		if err = h.recordEvent(ctx, NewAuditEvent(c, AuditEmailChangeReverted, user.Id, nil)); err != nil {
+			return err
+		}
+	}
+
+	return h.Validate(c, http.StatusNoContent, nil)
+}
+
+// getEmailChangeUser returns the user whose token is stored hashed in field,
+// if validate accepts the token.
+func (h *Handler) getEmailChangeUser(
+	ctx context.Context,
+	c echo.Context,
+	field string,
+	token string,
+	validate func(*User, string) error,
+) (*User, func() error, error) {
+	invalid := func() error {
+		return h.Validate(c, http.StatusBadRequest, echo.Map{"message": "token invalid or expired"})
+	}
+
+	filter := bson.D{{field, util.HashToken([]byte(token))}}
+	result, err := h.Mapper.FindOne(ctx, filter, &User{})
+	if err != nil {
+		if err == ErrNoDocuments {
+			return nil, invalid, nil
+		}
+		return nil, nil, fmt.Errorf("failed getting user: %v", err)
+	}
+
+	user := result.(*User)
+	if err = validate(user, token); err != nil {
+		return nil, invalid, nil
+	}
+
+	return user, nil, nil
+}
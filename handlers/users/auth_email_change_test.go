@@ -0,0 +1,531 @@
+package users_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/alexferl/echo-boilerplate/handlers/users"
+)
+
+func TestHandler_UpdateUser_200_Email(t *testing.T) {
+	mapper, m, s := getMapperMailerAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(&users.UpdateUserRequest{Email: "new@example.com"})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPatch, "/user", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			users.ErrNoDocuments,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			&users.UserResponse{Id: user.Id, Username: user.Username, Email: user.Email, PendingEmail: "new@example.com"},
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, "test@example.com", user.Email)
+	assert.Equal(t, "new@example.com", user.PendingEmail)
+	assert.NotEmpty(t, user.EmailChangeToken)
+	assert.NotEmpty(t, user.EmailChangeCancelToken)
+
+	sent := map[string]string{}
+	for i := 0; i < 2; i++ {
+		msg := m.wait(t)
+		sent[msg.To[0]] = msg.Body
+	}
+	assert.Contains(t, sent["new@example.com"], "/auth/email-change/confirm?token=")
+	assert.Contains(t, sent["test@example.com"], "/auth/email-change/cancel?token=")
+}
+
+func TestHandler_EmailChange_Links(t *testing.T) {
+	mapper, m, s := getMapperMailerAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(&users.UpdateUserRequest{Email: "new@example.com"})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPatch, "/user", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			users.ErrNoDocuments,
+		).
+		Once().
+		On(
+			"UpdateById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			&users.UserResponse{Id: user.Id, Username: user.Username, Email: user.Email, PendingEmail: "new@example.com"},
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code)
+
+	links := map[string]string{}
+	tokens := map[string]string{}
+	for i := 0; i < 2; i++ {
+		msg := m.wait(t)
+		links[msg.To[0]] = link(t, msg)
+		tokens[msg.To[0]] = linkToken(t, msg)
+	}
+
+	// the user is found by the token of each link from now on
+	mapper.Mock.
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"Collection",
+			mock.Anything,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"UpdateMany",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			int64(1),
+			nil,
+		).
+		On(
+			"Insert",
+			mock.Anything,
+			mock.MatchedBy(func(e *users.AuditEvent) bool { return e.Type == users.AuditEmailChangeReverted }),
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	// fetching the links only checks their tokens
+	for _, l := range links {
+		req = httptest.NewRequest(http.MethodGet, l, nil)
+		resp = httptest.NewRecorder()
+
+		s.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusNoContent, resp.Code)
+		assert.Equal(t, "test@example.com", user.Email)
+		assert.Equal(t, "new@example.com", user.PendingEmail)
+	}
+	mapper.AssertNotCalled(t, "UpdateMany", mock.Anything, mock.Anything, mock.Anything)
+
+	b, err = json.Marshal(&users.AuthEmailChangeRequest{Token: tokens["new@example.com"]})
+	assert.NoError(t, err)
+
+	req = httptest.NewRequest(http.MethodPost, "/auth/email-change/confirm", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp = httptest.NewRecorder()
+
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, "new@example.com", user.Email)
+
+	b, err = json.Marshal(&users.AuthEmailChangeRequest{Token: tokens["test@example.com"]})
+	assert.NoError(t, err)
+
+	req = httptest.NewRequest(http.MethodPost, "/auth/email-change/cancel", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp = httptest.NewRecorder()
+
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, "test@example.com", user.Email)
+}
+
+func TestHandler_UpdateUser_409(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(&users.UpdateUserRequest{Email: "taken@example.com"})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPatch, "/user", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			users.NewUser("taken@example.com", "taken"),
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Equal(t, "", user.PendingEmail)
+}
+
+func TestHandler_AuthConfirmEmailChange_204(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	confirm, _, err := user.NewEmailChange("new@example.com")
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(&users.AuthEmailChangeRequest{Token: confirm})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/email-change/confirm", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, "new@example.com", user.Email)
+	assert.Equal(t, "test@example.com", user.PreviousEmail)
+	assert.True(t, user.EmailVerified)
+	assert.Equal(t, "", user.PendingEmail)
+}
+
+func TestHandler_AuthConfirmEmailChange_400(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	b, err := json.Marshal(&users.AuthEmailChangeRequest{Token: "invalid"})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/email-change/confirm", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			users.ErrNoDocuments,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestHandler_AuthConfirmEmailChange_409(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	confirm, _, err := user.NewEmailChange("taken@example.com")
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(&users.AuthEmailChangeRequest{Token: confirm})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/email-change/confirm", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			users.ErrDuplicateKey,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Contains(t, resp.Body.String(), "email already in-use")
+}
+
+func TestHandler_AuthCancelEmailChange_204(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	_, cancel, err := user.NewEmailChange("new@example.com")
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(&users.AuthEmailChangeRequest{Token: cancel})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/email-change/cancel", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, "test@example.com", user.Email)
+	assert.Equal(t, "", user.PendingEmail)
+	assert.Equal(t, "", user.EmailChangeToken)
+}
+
+func TestHandler_AuthCancelEmailChange_204_Confirmed(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	confirm, cancel, err := user.NewEmailChange("hijacker@example.com")
+	assert.NoError(t, err)
+	assert.NoError(t, user.ConfirmEmailChange(confirm))
+
+	b, err := json.Marshal(&users.AuthEmailChangeRequest{Token: cancel})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/email-change/cancel", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		).
+		On(
+			"Collection",
+			users.SessionsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"UpdateMany",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			int64(1),
+			nil,
+		).
+		On(
+			"Collection",
+			users.AuditEventsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Insert",
+			mock.Anything,
+			mock.MatchedBy(func(e *users.AuditEvent) bool { return e.Type == users.AuditEmailChangeReverted }),
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, "test@example.com", user.Email)
+	assert.Equal(t, int64(1), user.TokenVersion)
+}
+
+func TestHandler_AuthCancelEmailChange_400(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	confirm, _, err := user.NewEmailChange("new@example.com")
+	assert.NoError(t, err)
+
+	// the confirm token can't cancel
+	b, err := json.Marshal(&users.AuthEmailChangeRequest{Token: confirm})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/email-change/cancel", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Equal(t, "new@example.com", user.PendingEmail)
+}
@@ -26,6 +26,37 @@ type TokenResponse struct {
 	TokenType    string `json:"token_type"`
 }
 
+// MFARequiredResponse is returned instead of tokens to users with MFA
+// enabled. The mfa_token must be sent with a code to /auth/login/mfa.
+type MFARequiredResponse struct {
+	MFAToken  string `json:"mfa_token"`
+	ExpiresIn int64  `json:"expires_in"`
+}
+
+// rehashPassword saves the password of user hashed again if its hash uses an
+// old algorithm or parameters. The hash is only replaced if it's still the
+// one that was checked, so that a concurrent password change isn't undone.
+func (h *Handler) rehashPassword(ctx context.Context, user *User, password string) error {
+	old := user.Password
+	rehashed, err := user.RehashPassword(password)
+	if err != nil {
+		return fmt.Errorf("failed rehashing password: %v", err)
+	}
+
+	if !rehashed {
+		return nil
+	}
+
+	filter := bson.D{{"id", user.Id}, {"password", old}}
+	update := bson.D{{"$set", bson.D{{"password", user.Password}}}}
+	_, err = h.Mapper.Update(ctx, filter, update, nil)
+	if err != nil {
+		return fmt.Errorf("failed updating password: %v", err)
+	}
+
+	return nil
+}
+
 func (h *Handler) AuthLogIn(c echo.Context) error {
 	body := &AuthLogInRequest{}
 	if err := c.Bind(body); err != nil {
@@ -34,33 +65,101 @@ func (h *Handler) AuthLogIn(c echo.Context) error {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
+	attempts, errResp := h.getLoginAttempts(ctx, c, body.Email)
+	if errResp != nil {
+		return errResp()
+	}
+
+	invalid := func() error {
+		if err := h.loginFailed(ctx, attempts); err != nil {
+			return err
+		}
+		return h.Validate(c, http.StatusUnauthorized, echo.Map{"message": "invalid email or password"})
+	}
+
 	filter := bson.D{{"email", body.Email}}
 	result, err := h.Mapper.FindOne(ctx, filter, &User{})
 	if err != nil {
 		if err == ErrNoDocuments {
-			return h.Validate(c, http.StatusUnauthorized, echo.Map{"message": "invalid email or password"})
+			return invalid()
 		}
 		return fmt.Errorf("failed getting user: %v", err)
 	}
 
 	user := result.(*User)
 	err = user.ValidatePassword(body.Password)
-	if err != nil {
-		return h.Validate(c, http.StatusUnauthorized, echo.Map{"message": "invalid email or password"})
+	if err != nil || user.DeletedAt != nil {
+		return invalid()
 	}
 
-	access, refresh, err := user.Login()
-	if err != nil {
-		return fmt.Errorf("failed generating tokens: %v", err)
+	if err = h.loginSucceeded(ctx, attempts); err != nil {
+		return err
+	}
+
+	if err = h.rehashPassword(ctx, user, body.Password); err != nil {
+		return err
 	}
 
-	_, err = h.Mapper.UpdateById(ctx, user.Id, user, nil)
+	status, resp, err := h.logInUser(ctx, c, user)
 	if err != nil {
-		return fmt.Errorf("failed updating user: %v", err)
+		return err
+	}
+
+	if tokens, ok := resp.(*TokenResponse); ok && viper.GetBool(config.CookiesEnabled) {
+		util.SetTokenCookies(c, []byte(tokens.AccessToken), []byte(tokens.RefreshToken))
+	}
+
+	return h.Validate(c, status, resp)
+}
+
+// logInUser is the gate of every way to log in, once user proved who they
+// are. It returns why user can't log in, a challenge for their second factor
+// if they enabled one, or the tokens of a new session.
+func (h *Handler) logInUser(ctx context.Context, c echo.Context, user *User) (int, any, error) {
+	if status, resp := logInDenied(user); resp != nil {
+		return status, resp, nil
+	}
+
+	if user.MFAEnabled {
+		mfa, err := util.GenerateMFAToken(user.Id)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed generating mfa token: %v", err)
+		}
+
+		resp := &MFARequiredResponse{
+			MFAToken:  string(mfa),
+			ExpiresIn: int64(viper.GetDuration(config.MFATokenExpiry).Seconds()),
+		}
+
+		return http.StatusAccepted, resp, nil
+	}
+
+	return h.logInSession(ctx, c, user)
+}
+
+// logInDenied returns why user can't log in, if they can't. It's checked
+// again at the second factor since the user may have changed meanwhile.
+func logInDenied(user *User) (int, any) {
+	if user.Suspended {
+		return http.StatusForbidden, echo.Map{"message": "account suspended"}
+	}
+
+	if user.PasswordResetRequired {
+		return http.StatusForbidden, echo.Map{"message": "password reset required"}
+	}
+
+	if !user.EmailVerified && viper.GetString(config.EmailVerificationMode) == config.EmailVerificationLogin {
+		return http.StatusForbidden, echo.Map{"message": "email not verified"}
 	}
 
-	if viper.GetBool(config.CookiesEnabled) {
-		util.SetTokenCookies(c, access, refresh)
+	return 0, nil
+}
+
+// logInSession returns the tokens of a new session of user.
+func (h *Handler) logInSession(ctx context.Context, c echo.Context, user *User) (int, any, error) {
+	access, refresh, err := h.login(ctx, c, user)
+	if err != nil {
+		return 0, nil, err
 	}
 
 	resp := &TokenResponse{
@@ -70,5 +169,5 @@ func (h *Handler) AuthLogIn(c echo.Context) error {
 		TokenType:    "Bearer",
 	}
 
-	return h.Validate(c, http.StatusOK, resp)
+	return http.StatusOK, resp, nil
 }
@@ -0,0 +1,120 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/alexferl/echo-boilerplate/config"
+	"github.com/alexferl/echo-boilerplate/util"
+)
+
+type AuthLogInMFARequest struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"`
+}
+
+func (h *Handler) AuthLogInMFA(c echo.Context) error {
+	body := &AuthLogInMFARequest{}
+	if err := c.Bind(body); err != nil {
+		return err
+	}
+
+	invalid := func() error {
+		return h.Validate(c, http.StatusUnauthorized, echo.Map{"message": "invalid mfa token or code"})
+	}
+
+	token, err := util.ParseToken([]byte(body.MFAToken))
+	if err != nil {
+		return invalid()
+	}
+
+	if typ, _ := token.Get("type"); typ != util.MFAToken.String() {
+		return invalid()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := h.Mapper.FindOneById(ctx, token.Subject(), &User{})
+	if err != nil {
+		if err == ErrNoDocuments {
+			return invalid()
+		}
+		return fmt.Errorf("failed getting user: %v", err)
+	}
+
+	user := result.(*User)
+	if user.DeletedAt != nil {
+		return invalid()
+	}
+
+	if status, resp := logInDenied(user); resp != nil {
+		return h.Validate(c, status, resp)
+	}
+
+	attempts, errResp := h.getLoginAttempts(ctx, c, user.Email)
+	if errResp != nil {
+		return errResp()
+	}
+
+	consumed, err := h.consumeMFACode(ctx, user, body.Code)
+	if err != nil {
+		return err
+	}
+
+	if !consumed {
+		if err = h.loginFailed(ctx, attempts); err != nil {
+			return err
+		}
+		return invalid()
+	}
+
+	if err = h.loginSucceeded(ctx, attempts); err != nil {
+		return err
+	}
+
+	status, resp, err := h.logInSession(ctx, c, user)
+	if err != nil {
+		return err
+	}
+
+	if tokens, ok := resp.(*TokenResponse); ok && viper.GetBool(config.CookiesEnabled) {
+		util.SetTokenCookies(c, []byte(tokens.AccessToken), []byte(tokens.RefreshToken))
+	}
+
+	return h.Validate(c, status, resp)
+}
+
+// consumeMFACode reports whether code is valid for user and marks it used.
+// A TOTP code only counts if no code of its time step or a later one was
+// used meanwhile and a recovery code only if it's still stored, so that
+// concurrent requests can't both use the same code.
+func (h *Handler) consumeMFACode(ctx context.Context, user *User, code string) (bool, error) {
+	counter := user.TOTPLastCounter
+	if err := user.ValidateMFACode(code); err != nil {
+		return false, nil
+	}
+
+	var filter, update bson.D
+	if user.TOTPLastCounter != counter {
+		filter = bson.D{{"id", user.Id}, {"totp_last_counter", bson.D{{"$lt", user.TOTPLastCounter}}}}
+		update = bson.D{{"$set", bson.D{{"totp_last_counter", user.TOTPLastCounter}}}}
+	} else {
+		hash := util.HashToken([]byte(normalizeRecoveryCode(code)))
+		filter = bson.D{{"id", user.Id}, {"recovery_codes", hash}}
+		update = bson.D{{"$pull", bson.D{{"recovery_codes", hash}}}}
+	}
+
+	res, err := h.Mapper.Update(ctx, filter, update, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed consuming mfa code: %v", err)
+	}
+
+	return res.(*mongo.UpdateResult).MatchedCount == 1, nil
+}
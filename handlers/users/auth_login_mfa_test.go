@@ -0,0 +1,435 @@
+package users_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/alexferl/echo-boilerplate/handlers/users"
+	"github.com/alexferl/echo-boilerplate/util"
+)
+
+func TestHandler_AuthLogin_202_MFA(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	pwd := "abcdefghijkl"
+	user, _ := newMFAUser(t)
+	err := user.SetPassword(pwd)
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(&users.AuthLogInRequest{Email: user.Email, Password: pwd})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/login", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.LoginAttemptsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			[]*users.LoginAttempt{},
+			nil,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	var result users.MFARequiredResponse
+	err = json.Unmarshal(resp.Body.Bytes(), &result)
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusAccepted, resp.Code)
+	assert.Empty(t, resp.Result().Cookies())
+	assert.NotContains(t, resp.Body.String(), "access_token")
+
+	token, err := util.ParseToken([]byte(result.MFAToken))
+	assert.NoError(t, err)
+	typ, _ := token.Get("type")
+	assert.Equal(t, util.MFAToken.String(), typ)
+}
+
+func TestHandler_AuthLoginMFA_200(t *testing.T) {
+	user, codes := newMFAUser(t)
+
+	mfaToken, err := util.GenerateMFAToken(user.Id)
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name   string
+		code   string
+		update bson.D
+	}{
+		{
+			"totp",
+			totpCode(t, user.TOTPSecret, 1),
+			bson.D{{"$set", bson.D{{"totp_last_counter", util.TOTPCounter(time.Now()) + 1}}}},
+		},
+		{
+			"recovery code",
+			codes[0],
+			bson.D{{"$pull", bson.D{{"recovery_codes", user.RecoveryCodes[0]}}}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mapper, s := getMapperAndServer(t)
+
+			b, err := json.Marshal(&users.AuthLogInMFARequest{MFAToken: string(mfaToken), Code: tc.code})
+			assert.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/auth/login/mfa", bytes.NewBuffer(b))
+			req.Header.Set("Content-Type", "application/json")
+			resp := httptest.NewRecorder()
+
+			mapper.Mock.
+				On(
+					"Collection",
+					users.LoginAttemptsCollection,
+				).
+				Return(
+					mapper,
+				).
+				On(
+					"Find",
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					[]*users.LoginAttempt{},
+					nil,
+				).
+				On(
+					"FindOneById",
+					mock.Anything,
+					user.Id,
+					mock.Anything,
+				).
+				Return(
+					user,
+					nil,
+				).
+				On(
+					"Collection",
+					users.SessionsCollection,
+				).
+				Return(
+					mapper,
+				).
+				On(
+					"Insert",
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					nil,
+					nil,
+				).
+				On(
+					"Update",
+					mock.Anything,
+					mock.Anything,
+					tc.update,
+					mock.Anything,
+				).
+				Return(
+					&mongo.UpdateResult{MatchedCount: 1},
+					nil,
+				).
+				On(
+					"Update",
+					mock.Anything,
+					bson.D{{"id", user.Id}},
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					nil,
+					nil,
+				)
+
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, http.StatusOK, resp.Code)
+			assert.Equal(t, 2, len(resp.Result().Cookies()))
+			assert.Contains(t, resp.Body.String(), "access_token")
+			assert.Contains(t, resp.Body.String(), "refresh_token")
+		})
+	}
+}
+
+func TestHandler_AuthLoginMFA_401(t *testing.T) {
+	user, _ := newMFAUser(t)
+
+	mfaToken, err := util.GenerateMFAToken(user.Id)
+	assert.NoError(t, err)
+
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name  string
+		token string
+		code  string
+		find  bool
+	}{
+		{"invalid token", "invalid", totpCode(t, user.TOTPSecret, 1), false},
+		{"wrong token type", string(access), totpCode(t, user.TOTPSecret, 1), false},
+		{"invalid code", string(mfaToken), "000000", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mapper, s := getMapperAndServer(t)
+
+			b, err := json.Marshal(&users.AuthLogInMFARequest{MFAToken: tc.token, Code: tc.code})
+			assert.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/auth/login/mfa", bytes.NewBuffer(b))
+			req.Header.Set("Content-Type", "application/json")
+			resp := httptest.NewRecorder()
+
+			if tc.find {
+				mapper.Mock.
+					On(
+						"Collection",
+						users.LoginAttemptsCollection,
+					).
+					Return(
+						mapper,
+					).
+					On(
+						"Find",
+						mock.Anything,
+						mock.Anything,
+						mock.Anything,
+					).
+					Return(
+						[]*users.LoginAttempt{},
+						nil,
+					).
+					On(
+						"FindOneAndUpdate",
+						mock.Anything,
+						mock.Anything,
+						mock.Anything,
+						mock.Anything,
+						mock.Anything,
+					).
+					Return(
+						&users.LoginAttempt{Type: users.LoginAttemptAccount, Failures: 1},
+						nil,
+					).
+					On(
+						"Update",
+						mock.Anything,
+						mock.Anything,
+						mock.Anything,
+						mock.Anything,
+					).
+					Return(
+						nil,
+						nil,
+					).
+					On(
+						"FindOneById",
+						mock.Anything,
+						mock.Anything,
+						mock.Anything,
+					).
+					Return(
+						user,
+						nil,
+					)
+			}
+
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, http.StatusUnauthorized, resp.Code)
+		})
+	}
+}
+
+func TestHandler_AuthLoginMFA_401_Code_Used(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user, codes := newMFAUser(t)
+	mfaToken, err := util.GenerateMFAToken(user.Id)
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(&users.AuthLogInMFARequest{MFAToken: string(mfaToken), Code: codes[0]})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/login/mfa", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	// another request used the code after the user was read
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			user.Id,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"Collection",
+			users.LoginAttemptsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			[]*users.LoginAttempt{},
+			nil,
+		).
+		On(
+			"Update",
+			mock.Anything,
+			bson.D{{"id", user.Id}, {"recovery_codes", user.RecoveryCodes[0]}},
+			bson.D{{"$pull", bson.D{{"recovery_codes", user.RecoveryCodes[0]}}}},
+			mock.Anything,
+		).
+		Return(
+			&mongo.UpdateResult{MatchedCount: 0},
+			nil,
+		).
+		On(
+			"Update",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		).
+		On(
+			"FindOneAndUpdate",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			&users.LoginAttempt{Type: users.LoginAttemptAccount, Failures: 1},
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	mapper.AssertNotCalled(t, "Insert", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestHandler_AuthLoginMFA_403(t *testing.T) {
+	testCases := []struct {
+		name    string
+		update  func(*users.User)
+		message string
+	}{
+		{"suspended", func(u *users.User) { u.Suspended = true }, "account suspended"},
+		{"password reset required", func(u *users.User) { u.PasswordResetRequired = true }, "password reset required"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mapper, s := getMapperAndServer(t)
+
+			user, _ := newMFAUser(t)
+			mfaToken, err := util.GenerateMFAToken(user.Id)
+			assert.NoError(t, err)
+
+			// the user changed between the password and the mfa step
+			tc.update(user)
+
+			b, err := json.Marshal(&users.AuthLogInMFARequest{
+				MFAToken: string(mfaToken),
+				Code:     totpCode(t, user.TOTPSecret, 1),
+			})
+			assert.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/auth/login/mfa", bytes.NewBuffer(b))
+			req.Header.Set("Content-Type", "application/json")
+			resp := httptest.NewRecorder()
+
+			mapper.Mock.
+				On(
+					"FindOneById",
+					mock.Anything,
+					user.Id,
+					mock.Anything,
+				).
+				Return(
+					user,
+					nil,
+				)
+
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, http.StatusForbidden, resp.Code)
+			assert.Contains(t, resp.Body.String(), tc.message)
+			mapper.AssertNotCalled(t, "Update", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+		})
+	}
+}
+
+func TestHandler_MFAToken_401_As_Access_Token(t *testing.T) {
+	_, s := getMapperAndServer(t)
+
+	user, _ := newMFAUser(t)
+	mfaToken, err := util.GenerateMFAToken(user.Id)
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/user", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", mfaToken))
+	resp := httptest.NewRecorder()
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+}
@@ -5,11 +5,14 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/crypto/bcrypt"
 
 	"github.com/alexferl/echo-boilerplate/config"
 	"github.com/alexferl/echo-boilerplate/handlers/users"
@@ -31,6 +34,23 @@ func TestHandler_AuthLogin_200(t *testing.T) {
 	resp := httptest.NewRecorder()
 
 	mapper.Mock.
+		On(
+			"Collection",
+			users.LoginAttemptsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			[]*users.LoginAttempt{},
+			nil,
+		).
 		On(
 			"FindOne",
 			mock.Anything,
@@ -42,10 +62,27 @@ func TestHandler_AuthLogin_200(t *testing.T) {
 			nil,
 		).
 		On(
-			"UpdateById",
+			"Collection",
+			users.SessionsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Insert",
 			mock.Anything,
 			mock.Anything,
 			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		).
+		On(
+			"Update",
+			mock.Anything,
+			bson.D{{"id", user.Id}},
+			mock.Anything,
 			mock.Anything,
 		).
 		Return(
@@ -113,6 +150,46 @@ func TestHandler_AuthLogin_401(t *testing.T) {
 			resp := httptest.NewRecorder()
 
 			mapper.Mock.
+				On(
+					"Collection",
+					users.LoginAttemptsCollection,
+				).
+				Return(
+					mapper,
+				).
+				On(
+					"Find",
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					[]*users.LoginAttempt{},
+					nil,
+				).
+				On(
+					"FindOneAndUpdate",
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					&users.LoginAttempt{Type: users.LoginAttemptAccount, Failures: 1},
+					nil,
+				).
+				On(
+					"Update",
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					nil,
+					nil,
+				).
 				On(
 					"FindOne",
 					mock.Anything,
@@ -142,3 +219,161 @@ func TestHandler_AuthLogin_422(t *testing.T) {
 	s.ServeHTTP(resp, req)
 	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
 }
+
+func TestHandler_AuthLogin_403(t *testing.T) {
+	testCases := []struct {
+		name string
+		fn   func(user *users.User)
+		msg  string
+	}{
+		{"suspended", func(user *users.User) { user.Suspend("admin") }, "account suspended"},
+		{"password reset required", func(user *users.User) { user.PasswordResetRequired = true }, "password reset required"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mapper, s := getMapperAndServer(t)
+
+			user := users.NewUser("test@example.com", "test")
+			err := user.SetPassword("abcdefghijkl")
+			assert.NoError(t, err)
+			tc.fn(user)
+
+			b, err := json.Marshal(&users.AuthLogInRequest{Email: user.Email, Password: "abcdefghijkl"})
+			assert.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/auth/login", bytes.NewBuffer(b))
+			req.Header.Set("Content-Type", "application/json")
+			resp := httptest.NewRecorder()
+
+			mapper.Mock.
+				On(
+					"Collection",
+					users.LoginAttemptsCollection,
+				).
+				Return(
+					mapper,
+				).
+				On(
+					"Find",
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					[]*users.LoginAttempt{},
+					nil,
+				).
+				On(
+					"FindOne",
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					user,
+					nil,
+				)
+
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, http.StatusForbidden, resp.Code)
+			assert.Contains(t, resp.Body.String(), tc.msg)
+		})
+	}
+}
+
+func TestHandler_AuthLogin_200_Rehash(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	pwd := "abcdefghijkl"
+	user := users.NewUser("test@example.com", "test")
+	hash, err := bcrypt.GenerateFromPassword([]byte(pwd), bcrypt.MinCost)
+	assert.NoError(t, err)
+	user.Password = string(hash)
+
+	b, err := json.Marshal(&users.AuthLogInRequest{Email: user.Email, Password: pwd})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/login", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.LoginAttemptsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			[]*users.LoginAttempt{},
+			nil,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"Update",
+			mock.Anything,
+			bson.D{{"id", user.Id}, {"password", string(hash)}},
+			mock.MatchedBy(func(update bson.D) bool {
+				set := update[0].Value.(bson.D)
+				return strings.HasPrefix(set[0].Value.(string), "$argon2id$")
+			}),
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		).
+		On(
+			"Collection",
+			users.SessionsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Insert",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		).
+		On(
+			"Update",
+			mock.Anything,
+			bson.D{{"id", user.Id}},
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.True(t, strings.HasPrefix(user.Password, "$argon2id$"))
+	assert.NoError(t, user.ValidatePassword(pwd))
+	mapper.AssertCalled(t, "Update", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
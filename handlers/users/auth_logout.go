@@ -4,11 +4,14 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/spf13/viper"
 
+	"github.com/alexferl/echo-boilerplate/config"
 	"github.com/alexferl/echo-boilerplate/util"
 )
 
@@ -17,28 +20,66 @@ type AuthLogOutRequest struct {
 }
 
 func (h *Handler) AuthLogOut(c echo.Context) error {
-	token := c.Get("refresh_token").(jwt.Token)
-	encodedToken := c.Get("refresh_token_encoded").(string)
-
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	result, err := h.Mapper.FindOneById(ctx, token.Subject(), &User{})
+	session, errResp := h.getRefreshSession(ctx, c)
+	if errResp != nil {
+		return errResp()
+	}
+
+	result, err := h.Mapper.FindOneById(ctx, session.UserId, &User{})
 	if err != nil {
 		return fmt.Errorf("failed getting user: %v", err)
 	}
 
 	user := result.(*User)
-	if err = user.ValidateRefreshToken(encodedToken); err != nil {
-		return h.Validate(c, http.StatusUnauthorized, echo.Map{"message": "Token mismatch"})
+	user.Logout(session)
+
+	_, err = h.Mapper.Collection(SessionsCollection).UpdateById(ctx, session.Id, session, nil)
+	if err != nil {
+		return fmt.Errorf("failed updating session: %v", err)
 	}
 
-	user.Logout()
-	_, err = h.Mapper.UpdateById(ctx, token.Subject(), user, nil)
+	_, err = h.Mapper.UpdateById(ctx, user.Id, user, nil)
 	if err != nil {
 		return fmt.Errorf("failed updating user: %v", err)
 	}
 
+	// the access token sent along stops working right away
+	if access := logOutAccessToken(c, user.Id); access != nil {
+		if err = h.revokeToken(ctx, access); err != nil {
+			return err
+		}
+	}
+
 	util.SetExpiredTokenCookies(c)
 
 	return h.Validate(c, http.StatusNoContent, nil)
 }
+
+// logOutAccessToken returns the valid access token of userId sent in the
+// Authorization header or cookie, if any. The middleware only parses the
+// refresh token on this route.
+func logOutAccessToken(c echo.Context, userId string) jwt.Token {
+	var encodedToken string
+	if auth := c.Request().Header.Get(echo.HeaderAuthorization); strings.HasPrefix(auth, "Bearer ") {
+		encodedToken = strings.TrimPrefix(auth, "Bearer ")
+	} else if cookie, err := c.Cookie(viper.GetString(config.JWTAccessTokenCookieName)); err == nil {
+		encodedToken = cookie.Value
+	}
+
+	if encodedToken == "" {
+		return nil
+	}
+
+	token, err := util.ParseToken([]byte(encodedToken))
+	if err != nil {
+		return nil
+	}
+
+	if typ, _ := token.Get("type"); typ != util.AccessToken.String() || token.Subject() != userId {
+		return nil
+	}
+
+	return token
+}
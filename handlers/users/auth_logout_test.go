@@ -31,7 +31,7 @@ func TestHandler_AuthLogout_401_Cookie_Invalid(t *testing.T) {
 	_, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	_, _, err := user.Login()
+	_, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	req := httptest.NewRequest(http.MethodPost, "/auth/logout", nil)
@@ -48,9 +48,10 @@ func TestHandler_AuthLogout_401_Cookie_Mismatch(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	_, refresh, err := user.Login()
+	session := users.NewSession(user.Id, "", "")
+	_, refresh, err := user.Login(session)
 	assert.NoError(t, err)
-	user.Logout()
+	user.Logout(session)
 
 	req := httptest.NewRequest(http.MethodPost, "/auth/logout", nil)
 	req.Header.Set("Content-Type", "application/json")
@@ -59,13 +60,20 @@ func TestHandler_AuthLogout_401_Cookie_Mismatch(t *testing.T) {
 
 	mapper.Mock.
 		On(
-			"FindOneById",
+			"Collection",
+			mock.Anything,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
 			mock.Anything,
 			mock.Anything,
 			mock.Anything,
 		).
 		Return(
-			user,
+			session,
 			nil,
 		)
 
@@ -78,7 +86,72 @@ func TestHandler_AuthLogout_200_Token(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	_, refresh, err := user.Login()
+	session := users.NewSession(user.Id, "", "")
+	_, refresh, err := user.Login(session)
+	assert.NoError(t, err)
+
+	payload := &users.AuthLogOutRequest{
+		RefreshToken: string(refresh),
+	}
+	b, err := json.Marshal(payload)
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/logout", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			mock.Anything,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			session,
+			nil,
+		).
+		On(
+			"FindOneById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+}
+
+func TestHandler_AuthLogout_200_Token_RevokesAccessToken(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	session := users.NewSession(user.Id, "", "")
+	access, refresh, err := user.Login(session)
+	assert.NoError(t, err)
+	token, err := util.ParseToken(access)
 	assert.NoError(t, err)
 
 	payload := &users.AuthLogOutRequest{
@@ -89,9 +162,27 @@ func TestHandler_AuthLogout_200_Token(t *testing.T) {
 
 	req := httptest.NewRequest(http.MethodPost, "/auth/logout", bytes.NewBuffer(b))
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
 	resp := httptest.NewRecorder()
 
 	mapper.Mock.
+		On(
+			"Collection",
+			mock.Anything,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			session,
+			nil,
+		).
 		On(
 			"FindOneById",
 			mock.Anything,
@@ -109,6 +200,18 @@ func TestHandler_AuthLogout_200_Token(t *testing.T) {
 			mock.Anything,
 			mock.Anything,
 		).
+		Return(
+			nil,
+			nil,
+		).
+		On(
+			"Insert",
+			mock.Anything,
+			mock.MatchedBy(func(r *users.RevokedToken) bool {
+				return r.Id == token.JwtID() && r.UserId == user.Id
+			}),
+			mock.Anything,
+		).
 		Return(
 			nil,
 			nil,
@@ -134,7 +237,7 @@ func TestHandler_AuthLogout_401_Token_Invalid(t *testing.T) {
 	_, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	payload := &users.AuthLogOutRequest{
@@ -157,9 +260,10 @@ func TestHandler_AuthLogout_401_Token_Mismatch(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	_, refresh, err := user.Login()
+	session := users.NewSession(user.Id, "", "")
+	_, refresh, err := user.Login(session)
 	assert.NoError(t, err)
-	user.Logout()
+	user.Logout(session)
 
 	payload := &users.AuthLogOutRequest{
 		RefreshToken: string(refresh),
@@ -173,13 +277,20 @@ func TestHandler_AuthLogout_401_Token_Mismatch(t *testing.T) {
 
 	mapper.Mock.
 		On(
-			"FindOneById",
+			"Collection",
+			mock.Anything,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
 			mock.Anything,
 			mock.Anything,
 			mock.Anything,
 		).
 		Return(
-			user,
+			session,
 			nil,
 		)
 
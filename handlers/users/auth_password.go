@@ -0,0 +1,139 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/alexferl/echo-boilerplate/util"
+)
+
+type AuthForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+// AuthForgotPassword always returns a 202 so that it can't
+// be used to find out which emails have an account.
+func (h *Handler) AuthForgotPassword(c echo.Context) error {
+	body := &AuthForgotPasswordRequest{}
+	if err := c.Bind(body); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	filter := bson.D{{"email", body.Email}}
+	result, err := h.Mapper.FindOne(ctx, filter, &User{})
+	if err != nil {
+		if err == ErrNoDocuments {
+			return c.NoContent(http.StatusAccepted)
+		}
+		return fmt.Errorf("failed getting user: %v", err)
+	}
+
+	user := result.(*User)
+	if user.DeletedAt != nil {
+		return c.NoContent(http.StatusAccepted)
+	}
+
+	token, err := user.NewPasswordResetToken()
+	if err != nil {
+		return fmt.Errorf("failed generating password reset token: %v", err)
+	}
+
+	_, err = h.Mapper.UpdateById(ctx, user.Id, user, nil)
+	if err != nil {
+		return fmt.Errorf("failed updating user: %v", err)
+	}
+
+	h.sendMail(newResetPasswordMessage(user, token))
+
+	return c.NoContent(http.StatusAccepted)
+}
+
+// AuthCheckPasswordReset serves the emailed link, it tells whether its token
+// can still reset the password before the new password is asked for.
+func (h *Handler) AuthCheckPasswordReset(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, errResp, err := h.getPasswordResetUser(ctx, c, c.QueryParam("token"))
+	if err != nil {
+		return err
+	} else if errResp != nil {
+		return errResp()
+	}
+
+	return h.Validate(c, http.StatusNoContent, nil)
+}
+
+type AuthResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func (h *Handler) AuthResetPassword(c echo.Context) error {
+	body := &AuthResetPasswordRequest{}
+	if err := c.Bind(body); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	user, errResp, err := h.getPasswordResetUser(ctx, c, body.Token)
+	if err != nil {
+		return err
+	} else if errResp != nil {
+		return errResp()
+	}
+
+	if errResp := h.checkPassword(c, "password", body.Password, user.Username, user.Email); errResp != nil {
+		return errResp()
+	}
+
+	err = user.ResetPassword(body.Token, body.Password)
+	if err != nil {
+		return fmt.Errorf("failed resetting password: %v", err)
+	}
+
+	user.Update(user.Id)
+
+	_, err = h.Mapper.UpdateById(ctx, user.Id, user, nil)
+	if err != nil {
+		return fmt.Errorf("failed updating user: %v", err)
+	}
+
+	if err = h.revokeSessions(ctx, user.Id, ""); err != nil {
+		return err
+	}
+
+	util.SetExpiredTokenCookies(c)
+
+	return h.Validate(c, http.StatusNoContent, nil)
+}
+
+// getPasswordResetUser returns the user whose password token can reset.
+func (h *Handler) getPasswordResetUser(ctx context.Context, c echo.Context, token string) (*User, func() error, error) {
+	invalid := func() error {
+		return h.Validate(c, http.StatusBadRequest, echo.Map{"message": "token invalid or expired"})
+	}
+
+	filter := bson.D{{"password_reset_token", util.HashToken([]byte(token))}}
+	result, err := h.Mapper.FindOne(ctx, filter, &User{})
+	if err != nil {
+		if err == ErrNoDocuments {
+			return nil, invalid, nil
+		}
+		return nil, nil, fmt.Errorf("failed getting user: %v", err)
+	}
+
+	user := result.(*User)
+	if err = user.ValidatePasswordResetToken(token); err != nil {
+		return nil, invalid, nil
+	}
+
+	return user, nil, nil
+}
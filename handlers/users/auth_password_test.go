@@ -0,0 +1,311 @@
+package users_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/alexferl/echo-boilerplate/config"
+	"github.com/alexferl/echo-boilerplate/data"
+	"github.com/alexferl/echo-boilerplate/handlers/users"
+)
+
+func TestHandler_AuthForgotPassword_202(t *testing.T) {
+	mapper, m, s := getMapperMailerAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+
+	b, err := json.Marshal(&users.AuthForgotPasswordRequest{Email: user.Email})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/password/forgot", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusAccepted, resp.Code)
+	assert.NotEqual(t, "", user.PasswordResetToken)
+	assert.NotNil(t, user.PasswordResetExpiresAt)
+
+	msg := m.wait(t)
+	assert.Equal(t, []string{user.Email}, msg.To)
+	assert.Contains(t, msg.Body, "/auth/password/reset?token=")
+}
+
+func TestHandler_AuthForgotPassword_202_No_Email(t *testing.T) {
+	deleted := users.NewUser("test@example.com", "test")
+	deleted.Delete(deleted.Id)
+
+	testCases := []struct {
+		name       string
+		returnUser *users.User
+		err        error
+	}{
+		{"user not found", nil, users.ErrNoDocuments},
+		{"user deleted", deleted, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mapper, s := getMapperAndServer(t)
+
+			b, err := json.Marshal(&users.AuthForgotPasswordRequest{Email: "test@example.com"})
+			assert.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/auth/password/forgot", bytes.NewBuffer(b))
+			req.Header.Set("Content-Type", "application/json")
+			resp := httptest.NewRecorder()
+
+			mapper.Mock.
+				On(
+					"FindOne",
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					tc.returnUser,
+					tc.err,
+				)
+
+			s.ServeHTTP(resp, req)
+			assert.Equal(t, http.StatusAccepted, resp.Code)
+		})
+	}
+}
+
+func TestHandler_AuthCheckPasswordReset_204_Link(t *testing.T) {
+	mapper, m, s := getMapperMailerAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+
+	b, err := json.Marshal(&users.AuthForgotPasswordRequest{Email: user.Email})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/password/forgot", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusAccepted, resp.Code)
+
+	req = httptest.NewRequest(http.MethodGet, link(t, m.wait(t)), nil)
+	resp = httptest.NewRecorder()
+
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+
+	user.PasswordResetExpiresAt = nil
+	req = httptest.NewRequest(http.MethodGet, "/auth/password/reset?token=invalid", nil)
+	resp = httptest.NewRecorder()
+
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+}
+
+func TestHandler_AuthResetPassword_204(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	err := user.SetPassword("abcdefghijkl")
+	assert.NoError(t, err)
+	token, err := user.NewPasswordResetToken()
+	assert.NoError(t, err)
+
+	newPwd := "quiet-lantern-47-orbit"
+	b, err := json.Marshal(&users.AuthResetPasswordRequest{Token: token, Password: newPwd})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/password/reset", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		).
+		On(
+			"Collection",
+			users.SessionsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"UpdateMany",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			int64(1),
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.NoError(t, user.ValidatePassword(newPwd))
+	assert.Equal(t, "", user.PasswordResetToken)
+	assert.Equal(t, int64(1), user.TokenVersion)
+}
+
+func TestHandler_AuthResetPassword_400(t *testing.T) {
+	expired := users.NewUser("test@example.com", "test")
+	expiredToken, err := expired.NewPasswordResetToken()
+	assert.NoError(t, err)
+	past := time.Now().Add(-time.Minute)
+	expired.PasswordResetExpiresAt = &past
+
+	testCases := []struct {
+		name       string
+		token      string
+		returnUser *users.User
+		err        error
+	}{
+		{"token not found", "invalid", nil, users.ErrNoDocuments},
+		{"token expired", expiredToken, expired, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mapper, s := getMapperAndServer(t)
+
+			b, err := json.Marshal(&users.AuthResetPasswordRequest{Token: tc.token, Password: "abcdefghijkl"})
+			assert.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/auth/password/reset", bytes.NewBuffer(b))
+			req.Header.Set("Content-Type", "application/json")
+			resp := httptest.NewRecorder()
+
+			mapper.Mock.
+				On(
+					"FindOne",
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					tc.returnUser,
+					tc.err,
+				)
+
+			s.ServeHTTP(resp, req)
+			assert.Equal(t, http.StatusBadRequest, resp.Code)
+			assert.Contains(t, resp.Body.String(), "token invalid or expired")
+		})
+	}
+}
+
+func TestHandler_AuthResetPassword_422(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	token, err := user.NewPasswordResetToken()
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(&users.AuthResetPasswordRequest{Token: token, Password: "short"})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/password/reset", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+	assert.Contains(t, resp.Body.String(), users.PasswordTooShort)
+}
+
+func TestUser_ResetPassword(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	user := &users.User{Model: data.NewModel()}
+	token, err := user.NewPasswordResetToken()
+	assert.NoError(t, err)
+
+	assert.ErrorIs(t, user.ResetPassword("invalid", "abcdefghijkl"), users.ErrTokenMismatch)
+	assert.NoError(t, user.ResetPassword(token, "abcdefghijkl"))
+	assert.ErrorIs(t, user.ResetPassword(token, "abcdefghijkl"), users.ErrTokenMismatch)
+}
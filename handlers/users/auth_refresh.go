@@ -7,8 +7,8 @@ import (
 	"time"
 
 	"github.com/labstack/echo/v4"
-	"github.com/lestrrat-go/jwx/v2/jwt"
 	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
 
 	"github.com/alexferl/echo-boilerplate/config"
 	"github.com/alexferl/echo-boilerplate/util"
@@ -19,27 +19,48 @@ type AuthRefreshRequest struct {
 }
 
 func (h *Handler) AuthRefresh(c echo.Context) error {
-	token := c.Get("refresh_token").(jwt.Token)
-	encodedToken := c.Get("refresh_token_encoded").(string)
-
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	result, err := h.Mapper.FindOneById(ctx, token.Subject(), &User{})
-	if err != nil {
+	session, errResp := h.getRefreshSession(ctx, c)
+	if errResp != nil {
+		return errResp()
+	}
+
+	result, err := h.Mapper.FindOneById(ctx, session.UserId, &User{})
+	if err != nil && err != ErrNoDocuments {
 		return fmt.Errorf("failed getting user: %v", err)
 	}
 
-	user := result.(*User)
-	if err = user.ValidateRefreshToken(encodedToken); err != nil {
-		return h.Validate(c, http.StatusUnauthorized, echo.Map{"message": "Token mismatch"})
+	// the session of a user suspended or deleted since it started ends here
+	user, _ := result.(*User)
+	if user == nil || user.Suspended || user.DeletedAt != nil {
+		session.Revoke()
+		_, err = h.Mapper.Collection(SessionsCollection).UpdateById(ctx, session.Id, session, nil)
+		if err != nil {
+			return fmt.Errorf("failed revoking session: %v", err)
+		}
+
+		if user != nil && user.Suspended && user.DeletedAt == nil {
+			return h.Validate(c, http.StatusForbidden, echo.Map{"message": "account suspended"})
+		}
+		return h.Validate(c, http.StatusUnauthorized, echo.Map{"message": "Token is revoked"})
 	}
 
-	access, refresh, err := user.Refresh()
+	jti := session.RefreshTokenId
+	access, refresh, err := user.Refresh(session)
 	if err != nil {
 		return fmt.Errorf("failed generating tokens: %v", err)
 	}
 
-	_, err = h.Mapper.UpdateById(ctx, token.Subject(), user, nil)
+	rotated, err := h.rotateRefreshToken(ctx, c, session, jti)
+	if err != nil {
+		return err
+	} else if !rotated {
+		return h.Validate(c, http.StatusUnauthorized, echo.Map{"message": "Token mismatch"})
+	}
+
+	update := bson.D{{"$set", bson.D{{"last_refresh_at", user.LastRefreshAt}}}}
+	_, err = h.Mapper.Update(ctx, bson.D{{"id", user.Id}}, update, nil)
 	if err != nil {
 		return fmt.Errorf("failed updating user: %v", err)
 	}
@@ -2,14 +2,20 @@ package users_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
 
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
 
 	"github.com/alexferl/echo-boilerplate/config"
 	"github.com/alexferl/echo-boilerplate/handlers/users"
@@ -20,7 +26,8 @@ func TestHandler_AuthRefresh_200_Cookie(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	_, refresh, err := user.Login()
+	session := users.NewSession(user.Id, "", "")
+	_, refresh, err := user.Login(session)
 	assert.NoError(t, err)
 
 	req := httptest.NewRequest(http.MethodPost, "/auth/refresh", nil)
@@ -29,6 +36,23 @@ func TestHandler_AuthRefresh_200_Cookie(t *testing.T) {
 	resp := httptest.NewRecorder()
 
 	mapper.Mock.
+		On(
+			"Collection",
+			mock.Anything,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			session,
+			nil,
+		).
 		On(
 			"FindOneById",
 			mock.Anything,
@@ -40,14 +64,14 @@ func TestHandler_AuthRefresh_200_Cookie(t *testing.T) {
 			nil,
 		).
 		On(
-			"UpdateById",
+			"Update",
 			mock.Anything,
 			mock.Anything,
 			mock.Anything,
 			mock.Anything,
 		).
 		Return(
-			nil,
+			&mongo.UpdateResult{MatchedCount: 1},
 			nil,
 		)
 
@@ -100,9 +124,10 @@ func TestHandler_AuthRefresh_401_Cookie_Mismatch(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	_, refresh, err := user.Login()
+	session := users.NewSession(user.Id, "", "")
+	_, refresh, err := user.Login(session)
 	assert.NoError(t, err)
-	user.Logout()
+	user.Logout(session)
 
 	req := httptest.NewRequest(http.MethodPost, "/auth/refresh", nil)
 	req.Header.Set("Content-Type", "application/json")
@@ -111,13 +136,20 @@ func TestHandler_AuthRefresh_401_Cookie_Mismatch(t *testing.T) {
 
 	mapper.Mock.
 		On(
-			"FindOneById",
+			"Collection",
+			mock.Anything,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
 			mock.Anything,
 			mock.Anything,
 			mock.Anything,
 		).
 		Return(
-			user,
+			session,
 			nil,
 		)
 
@@ -130,7 +162,8 @@ func TestHandler_AuthRefresh_200_Token(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	_, refresh, err := user.Login()
+	session := users.NewSession(user.Id, "", "")
+	_, refresh, err := user.Login(session)
 	assert.NoError(t, err)
 
 	payload := &users.AuthRefreshRequest{
@@ -144,6 +177,23 @@ func TestHandler_AuthRefresh_200_Token(t *testing.T) {
 	resp := httptest.NewRecorder()
 
 	mapper.Mock.
+		On(
+			"Collection",
+			mock.Anything,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			session,
+			nil,
+		).
 		On(
 			"FindOneById",
 			mock.Anything,
@@ -155,14 +205,14 @@ func TestHandler_AuthRefresh_200_Token(t *testing.T) {
 			nil,
 		).
 		On(
-			"UpdateById",
+			"Update",
 			mock.Anything,
 			mock.Anything,
 			mock.Anything,
 			mock.Anything,
 		).
 		Return(
-			nil,
+			&mongo.UpdateResult{MatchedCount: 1},
 			nil,
 		)
 
@@ -220,9 +270,10 @@ func TestHandler_AuthRefresh_401_Token_Mismatch(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	_, refresh, err := user.Login()
+	session := users.NewSession(user.Id, "", "")
+	_, refresh, err := user.Login(session)
 	assert.NoError(t, err)
-	user.Logout()
+	user.Logout(session)
 
 	payload := &users.AuthRefreshRequest{
 		RefreshToken: string(refresh),
@@ -236,17 +287,383 @@ func TestHandler_AuthRefresh_401_Token_Mismatch(t *testing.T) {
 
 	mapper.Mock.
 		On(
-			"FindOneById",
+			"Collection",
+			mock.Anything,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
 			mock.Anything,
 			mock.Anything,
 			mock.Anything,
 		).
 		Return(
-			user,
+			session,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	assert.Contains(t, resp.Body.String(), "Token mismatch")
+}
+
+func TestHandler_AuthRefresh_401_Reuse(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	session := users.NewSession(user.Id, "", "")
+	_, refresh, err := user.Login(session)
+	assert.NoError(t, err)
+	_, _, err = user.Refresh(session)
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/refresh", nil)
+	req.Header.Set("Content-Type", "application/json")
+	req.AddCookie(util.NewRefreshTokenCookie(refresh))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			mock.Anything,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			session,
+			nil,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			session.Id,
+			mock.MatchedBy(func(s *users.Session) bool { return s.RevokedAt != nil }),
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		).
+		On(
+			"Insert",
+			mock.Anything,
+			mock.MatchedBy(func(e *users.AuditEvent) bool {
+				return e.Type == users.AuditRefreshTokenReuse && e.UserId == user.Id
+			}),
+			mock.Anything,
+		).
+		Return(
+			nil,
 			nil,
 		)
 
 	s.ServeHTTP(resp, req)
 	assert.Equal(t, http.StatusUnauthorized, resp.Code)
 	assert.Contains(t, resp.Body.String(), "Token mismatch")
+	assert.NotNil(t, session.RevokedAt)
+}
+
+func TestHandler_AuthRefresh_Concurrent(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	session := users.NewSession(user.Id, "", "")
+	_, refresh, err := user.Login(session)
+	assert.NoError(t, err)
+
+	// both requests read the session before either rotates its refresh token,
+	// the database only lets the first one swap it
+	var mu sync.Mutex
+	current := session.RefreshTokenId
+	rotate := func(ctx context.Context, filter any, update any, result any, opts ...*options.UpdateOptions) any {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, e := range filter.(bson.D) {
+			if e.Key == "refresh_token_id" && e.Value == current {
+				current = ""
+				return &mongo.UpdateResult{MatchedCount: 1, ModifiedCount: 1}
+			}
+		}
+		return &mongo.UpdateResult{}
+	}
+
+	mapper.Mock.
+		On(
+			"Collection",
+			mock.Anything,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			func(context.Context, any, any, ...*options.FindOneOptions) any {
+				s := *session
+				return &s
+			},
+			nil,
+		).
+		On(
+			"FindOneById",
+			mock.Anything,
+			user.Id,
+			mock.Anything,
+		).
+		Return(
+			func(context.Context, string, any, ...*options.FindOneOptions) any {
+				u := *user
+				return &u
+			},
+			nil,
+		).
+		On(
+			"Update",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			rotate,
+			nil,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			session.Id,
+			mock.MatchedBy(func(s *users.Session) bool { return s.RevokedAt != nil }),
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		).
+		Once().
+		On(
+			"Insert",
+			mock.Anything,
+			mock.MatchedBy(func(e *users.AuditEvent) bool {
+				return e.Type == users.AuditRefreshTokenReuse && e.UserId == user.Id
+			}),
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		).
+		Once()
+
+	codes := make([]int, 2)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, "/auth/refresh", nil)
+			req.Header.Set("Content-Type", "application/json")
+			req.AddCookie(util.NewRefreshTokenCookie(refresh))
+			resp := httptest.NewRecorder()
+			s.ServeHTTP(resp, req)
+			codes[i] = resp.Code
+		}(i)
+	}
+	wg.Wait()
+
+	assert.ElementsMatch(t, []int{http.StatusOK, http.StatusUnauthorized}, codes)
+}
+
+func TestHandler_AuthRefresh_User_CutOff(t *testing.T) {
+	testCases := []struct {
+		name       string
+		update     func(user *users.User)
+		err        error
+		statusCode int
+		msg        string
+	}{
+		{"suspended", func(user *users.User) { user.Suspend("admin") }, nil, http.StatusForbidden, "account suspended"},
+		{"deleted", func(user *users.User) { user.Delete(user.Id) }, nil, http.StatusUnauthorized, "Token is revoked"},
+		{"not found", nil, users.ErrNoDocuments, http.StatusUnauthorized, "Token is revoked"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mapper, s := getMapperAndServer(t)
+
+			user := users.NewUser("test@example.com", "test")
+			session := users.NewSession(user.Id, "", "")
+			_, refresh, err := user.Login(session)
+			assert.NoError(t, err)
+
+			var result *users.User
+			if tc.update != nil {
+				tc.update(user)
+				result = user
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/auth/refresh", nil)
+			req.Header.Set("Content-Type", "application/json")
+			req.AddCookie(util.NewRefreshTokenCookie(refresh))
+			resp := httptest.NewRecorder()
+
+			mapper.Mock.
+				On(
+					"Collection",
+					mock.Anything,
+				).
+				Return(
+					mapper,
+				).
+				On(
+					"FindOne",
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					session,
+					nil,
+				).
+				On(
+					"FindOneById",
+					mock.Anything,
+					user.Id,
+					mock.Anything,
+				).
+				Return(
+					result,
+					tc.err,
+				).
+				On(
+					"UpdateById",
+					mock.Anything,
+					session.Id,
+					mock.MatchedBy(func(s *users.Session) bool { return s.RevokedAt != nil }),
+					mock.Anything,
+				).
+				Return(
+					nil,
+					nil,
+				)
+
+			s.ServeHTTP(resp, req)
+			assert.Equal(t, tc.statusCode, resp.Code)
+			assert.Contains(t, resp.Body.String(), tc.msg)
+			assert.NotNil(t, session.RevokedAt)
+		})
+	}
+}
+
+// BenchmarkHandler_AuthRefresh compares refreshing a session whose refresh
+// token is stored as a keyed hash with one still stored as a bcrypt hash.
+func BenchmarkHandler_AuthRefresh(b *testing.B) {
+	benchmarks := []struct {
+		name string
+		hash func(refresh []byte) (string, error)
+	}{
+		{"hmac-sha256", func(refresh []byte) (string, error) {
+			return util.HashRefreshToken(refresh)
+		}},
+		{"bcrypt", func(refresh []byte) (string, error) {
+			hash, err := bcrypt.GenerateFromPassword(refresh, bcrypt.DefaultCost)
+			return string(hash), err
+		}},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			mapper, s := getMapperAndServer(b)
+
+			user := users.NewUser("test@example.com", "test")
+			session := users.NewSession(user.Id, "", "")
+			_, refresh, err := user.Login(session)
+			assert.NoError(b, err)
+
+			jti := session.RefreshTokenId
+			hash, err := bm.hash(refresh)
+			assert.NoError(b, err)
+
+			mapper.Mock.
+				On(
+					"Collection",
+					mock.Anything,
+				).
+				Return(
+					mapper,
+				).
+				On(
+					"FindOne",
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					session,
+					nil,
+				).
+				On(
+					"FindOneById",
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					user,
+					nil,
+				).
+				On(
+					"Update",
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					&mongo.UpdateResult{MatchedCount: 1},
+					nil,
+				).
+				On(
+					"UpdateById",
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					nil,
+					nil,
+				)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				session.RefreshToken = hash
+				session.RefreshTokenId = jti
+
+				req := httptest.NewRequest(http.MethodPost, "/auth/refresh", nil)
+				req.Header.Set("Content-Type", "application/json")
+				req.AddCookie(util.NewRefreshTokenCookie(refresh))
+				resp := httptest.NewRecorder()
+				b.StartTimer()
+
+				s.ServeHTTP(resp, req)
+				if resp.Code != http.StatusOK {
+					b.Fatalf("expected 200, got %d: %s", resp.Code, resp.Body.String())
+				}
+			}
+		})
+	}
 }
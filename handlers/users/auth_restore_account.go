@@ -0,0 +1,91 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/alexferl/echo-boilerplate/util"
+)
+
+type AuthRestoreAccountRequest struct {
+	Token string `json:"token"`
+}
+
+// AuthCheckAccountRestore serves the emailed link, it tells whether its
+// token can still restore the account. Only POST restores it so that
+// fetching the link, like mail scanners do, has no effect.
+func (h *Handler) AuthCheckAccountRestore(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, errResp, err := h.getRestoreUser(ctx, c, c.QueryParam("token"))
+	if err != nil {
+		return err
+	} else if errResp != nil {
+		return errResp()
+	}
+
+	return h.Validate(c, http.StatusNoContent, nil)
+}
+
+// AuthRestoreAccount undoes the deletion of an account using the token
+// emailed when it was deleted. The user then has to log in again.
+func (h *Handler) AuthRestoreAccount(c echo.Context) error {
+	body := &AuthRestoreAccountRequest{}
+	if err := c.Bind(body); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	user, errResp, err := h.getRestoreUser(ctx, c, body.Token)
+	if err != nil {
+		return err
+	} else if errResp != nil {
+		return errResp()
+	}
+
+	if err = user.Restore(body.Token); err != nil {
+		return fmt.Errorf("failed restoring account: %v", err)
+	}
+
+	user.Update(user.Id)
+
+	_, err = h.Mapper.UpdateById(ctx, user.Id, user, nil)
+	if err != nil {
+		return fmt.Errorf("failed updating user: %v", err)
+	}
+
+	if err = h.recordEvent(ctx, NewAuditEvent(c, AuditAccountRestored, user.Id, nil)); err != nil {
+		return err
+	}
+
+	return h.Validate(c, http.StatusNoContent, nil)
+}
+
+// getRestoreUser returns the deleted user whose account token can restore.
+func (h *Handler) getRestoreUser(ctx context.Context, c echo.Context, token string) (*User, func() error, error) {
+	invalid := func() error {
+		return h.Validate(c, http.StatusBadRequest, echo.Map{"message": "token invalid or expired"})
+	}
+
+	filter := bson.D{{"restore_token", util.HashToken([]byte(token))}}
+	result, err := h.Mapper.FindOne(ctx, filter, &User{})
+	if err != nil {
+		if err == ErrNoDocuments {
+			return nil, invalid, nil
+		}
+		return nil, nil, fmt.Errorf("failed getting user: %v", err)
+	}
+
+	user := result.(*User)
+	if err = user.ValidateRestoreToken(token); err != nil {
+		return nil, invalid, nil
+	}
+
+	return user, nil, nil
+}
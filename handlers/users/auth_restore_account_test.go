@@ -0,0 +1,203 @@
+package users_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/alexferl/echo-boilerplate/handlers/users"
+)
+
+func TestHandler_AuthRestoreAccount_204(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	token, err := user.NewDeletion()
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(&users.AuthRestoreAccountRequest{Token: token})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/account/restore", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			user.Id,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		).
+		On(
+			"Collection",
+			users.AuditEventsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Insert",
+			mock.Anything,
+			mock.MatchedBy(func(e *users.AuditEvent) bool { return e.Type == users.AuditAccountRestored }),
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Nil(t, user.DeletedAt)
+	assert.Nil(t, user.PurgeAt)
+	assert.Empty(t, user.RestoreToken)
+}
+
+func TestHandler_AuthRestoreAccount_400(t *testing.T) {
+	expired := users.NewUser("test@example.com", "test")
+	expiredToken, err := expired.NewDeletion()
+	assert.NoError(t, err)
+	past := time.Now().Add(-time.Minute)
+	expired.PurgeAt = &past
+
+	testCases := []struct {
+		name  string
+		token string
+		user  *users.User
+		err   error
+	}{
+		{"unknown token", "invalid", nil, users.ErrNoDocuments},
+		{"grace period ended", expiredToken, expired, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mapper, s := getMapperAndServer(t)
+
+			b, err := json.Marshal(&users.AuthRestoreAccountRequest{Token: tc.token})
+			assert.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/auth/account/restore", bytes.NewBuffer(b))
+			req.Header.Set("Content-Type", "application/json")
+			resp := httptest.NewRecorder()
+
+			var result any
+			if tc.user != nil {
+				result = tc.user
+			}
+
+			mapper.Mock.
+				On(
+					"FindOne",
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					result,
+					tc.err,
+				)
+
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, http.StatusBadRequest, resp.Code)
+			assert.Contains(t, resp.Body.String(), "token invalid or expired")
+		})
+	}
+}
+
+func TestHandler_AuthLogin_401_Deleted(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	err := user.SetPassword("abcdefghijkl")
+	assert.NoError(t, err)
+	_, err = user.NewDeletion()
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(&users.AuthLogInRequest{Email: user.Email, Password: "abcdefghijkl"})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/login", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.LoginAttemptsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			[]*users.LoginAttempt{},
+			nil,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"FindOneAndUpdate",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			&users.LoginAttempt{Type: users.LoginAttemptAccount, Failures: 1},
+			nil,
+		).
+		On(
+			"Update",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+}
@@ -43,6 +43,10 @@ func (h *Handler) AuthSignUp(c echo.Context) error {
 		return h.Validate(c, http.StatusConflict, echo.Map{"message": "email or username already in-use"})
 	}
 
+	if errResp := h.checkPassword(c, "password", body.Password, body.Username, body.Email); errResp != nil {
+		return errResp()
+	}
+
 	newUser := NewUser(body.Email, body.Username)
 	newUser.Name = body.Name
 	newUser.Bio = body.Bio
@@ -51,13 +55,23 @@ func (h *Handler) AuthSignUp(c echo.Context) error {
 		return fmt.Errorf("failed to set password: %v", err)
 	}
 
+	token, err := newUser.NewEmailVerificationToken()
+	if err != nil {
+		return fmt.Errorf("failed to generate email verification token: %v", err)
+	}
+
 	newUser.Create(newUser.Id)
 
 	opts := options.FindOneAndUpdate().SetUpsert(true)
 	user, err := h.Mapper.Upsert(ctx, filter, newUser, &UserResponse{}, opts)
 	if err != nil {
+		if err == ErrDuplicateKey {
+			return h.Validate(c, http.StatusConflict, echo.Map{"message": "email or username already in-use"})
+		}
 		return fmt.Errorf("failed to insert newUser: %v", err)
 	}
 
+	h.sendMail(newVerifyEmailMessage(newUser, token))
+
 	return h.Validate(c, http.StatusOK, user)
 }
@@ -14,13 +14,13 @@ import (
 )
 
 func TestHandler_Auth_Signup_200(t *testing.T) {
-	mapper, s := getMapperAndServer(t)
+	mapper, m, s := getMapperMailerAndServer(t)
 
 	payload := &users.AuthSignUpRequest{
 		Email:    "test@example.com",
 		Username: "test",
 		Name:     "Test",
-		Password: "abcdefghijkl",
+		Password: "violet-tractor-88-meadow",
 	}
 	b, err := json.Marshal(payload)
 	assert.NoError(t, err)
@@ -55,6 +55,10 @@ func TestHandler_Auth_Signup_200(t *testing.T) {
 
 	s.ServeHTTP(resp, req)
 	assert.Equal(t, http.StatusOK, resp.Code)
+
+	msg := m.wait(t)
+	assert.Equal(t, []string{payload.Email}, msg.To)
+	assert.Contains(t, msg.Body, "/auth/verify-email?token=")
 }
 
 func TestHandler_Auth_Signup_409(t *testing.T) {
@@ -64,7 +68,7 @@ func TestHandler_Auth_Signup_409(t *testing.T) {
 		Email:    "test@example.com",
 		Username: "test",
 		Name:     "Test",
-		Password: "abcdefghijkl",
+		Password: "violet-tractor-88-meadow",
 	}
 	b, err := json.Marshal(payload)
 	assert.NoError(t, err)
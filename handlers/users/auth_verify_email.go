@@ -0,0 +1,107 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/alexferl/echo-boilerplate/util"
+)
+
+// AuthVerifyEmailRequest is sent as JSON, or as the query of the emailed link.
+type AuthVerifyEmailRequest struct {
+	Token string `json:"token" query:"token"`
+}
+
+func (h *Handler) AuthVerifyEmail(c echo.Context) error {
+	body := &AuthVerifyEmailRequest{}
+	if err := c.Bind(body); err != nil {
+		return err
+	}
+
+	invalid := func() error {
+		return h.Validate(c, http.StatusBadRequest, echo.Map{"message": "token invalid or expired"})
+	}
+
+	token, err := util.ParseToken([]byte(body.Token))
+	if err != nil {
+		return invalid()
+	}
+
+	if typ, _ := token.Get("type"); typ != util.VerifyEmailToken.String() {
+		return invalid()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := h.Mapper.FindOneById(ctx, token.Subject(), &User{})
+	if err != nil {
+		if err == ErrNoDocuments {
+			return invalid()
+		}
+		return fmt.Errorf("failed getting user: %v", err)
+	}
+
+	user := result.(*User)
+	if email, _ := token.Get("email"); email != user.Email {
+		return invalid()
+	}
+
+	if err = user.VerifyEmail(body.Token); err != nil {
+		return invalid()
+	}
+
+	_, err = h.Mapper.UpdateById(ctx, user.Id, user, nil)
+	if err != nil {
+		return fmt.Errorf("failed updating user: %v", err)
+	}
+
+	return h.Validate(c, http.StatusNoContent, nil)
+}
+
+type AuthResendVerifyEmailRequest struct {
+	Email string `json:"email"`
+}
+
+// AuthResendVerifyEmail always returns a 202 so that it can't
+// be used to find out which emails have an account.
+func (h *Handler) AuthResendVerifyEmail(c echo.Context) error {
+	body := &AuthResendVerifyEmailRequest{}
+	if err := c.Bind(body); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	filter := bson.D{{"email", body.Email}}
+	result, err := h.Mapper.FindOne(ctx, filter, &User{})
+	if err != nil {
+		if err == ErrNoDocuments {
+			return c.NoContent(http.StatusAccepted)
+		}
+		return fmt.Errorf("failed getting user: %v", err)
+	}
+
+	user := result.(*User)
+	if user.EmailVerified {
+		return c.NoContent(http.StatusAccepted)
+	}
+
+	token, err := user.NewEmailVerificationToken()
+	if err != nil {
+		return fmt.Errorf("failed generating email verification token: %v", err)
+	}
+
+	_, err = h.Mapper.UpdateById(ctx, user.Id, user, nil)
+	if err != nil {
+		return fmt.Errorf("failed updating user: %v", err)
+	}
+
+	h.sendMail(newVerifyEmailMessage(user, token))
+
+	return c.NoContent(http.StatusAccepted)
+}
@@ -0,0 +1,365 @@
+package users_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/alexferl/echo-boilerplate/config"
+	"github.com/alexferl/echo-boilerplate/handlers/users"
+	"github.com/alexferl/echo-boilerplate/util"
+)
+
+func TestHandler_AuthVerifyEmail_204(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	token, err := user.NewEmailVerificationToken()
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(&users.AuthVerifyEmailRequest{Token: string(token)})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/verify-email", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.True(t, user.EmailVerified)
+	assert.NotNil(t, user.EmailVerifiedAt)
+	assert.Equal(t, "", user.EmailVerificationToken)
+}
+
+func TestHandler_AuthVerifyEmail_204_Link(t *testing.T) {
+	mapper, m, s := getMapperMailerAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+
+	b, err := json.Marshal(&users.AuthResendVerifyEmailRequest{Email: user.Email})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/verify-email/resend", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"FindOneById",
+			mock.Anything,
+			user.Id,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			user.Id,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusAccepted, resp.Code)
+
+	req = httptest.NewRequest(http.MethodGet, link(t, m.wait(t)), nil)
+	resp = httptest.NewRecorder()
+
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.True(t, user.EmailVerified)
+}
+
+func TestHandler_AuthVerifyEmail_400(t *testing.T) {
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	used := users.NewUser("test@example.com", "test")
+	usedToken, err := used.NewEmailVerificationToken()
+	assert.NoError(t, err)
+	err = used.VerifyEmail(string(usedToken))
+	assert.NoError(t, err)
+
+	changed := users.NewUser("test@example.com", "test")
+	changedToken, err := changed.NewEmailVerificationToken()
+	assert.NoError(t, err)
+	changed.Email = "changed@example.com"
+
+	testCases := []struct {
+		name       string
+		token      []byte
+		returnUser *users.User
+		err        error
+	}{
+		{"invalid token", []byte("invalid"), nil, nil},
+		{"wrong token type", access, nil, nil},
+		{"user not found", usedToken, nil, users.ErrNoDocuments},
+		{"token already used", usedToken, used, nil},
+		{"email changed", changedToken, changed, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mapper, s := getMapperAndServer(t)
+
+			b, err := json.Marshal(&users.AuthVerifyEmailRequest{Token: string(tc.token)})
+			assert.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/auth/verify-email", bytes.NewBuffer(b))
+			req.Header.Set("Content-Type", "application/json")
+			resp := httptest.NewRecorder()
+
+			if tc.returnUser != nil || tc.err != nil {
+				mapper.Mock.
+					On(
+						"FindOneById",
+						mock.Anything,
+						mock.Anything,
+						mock.Anything,
+					).
+					Return(
+						tc.returnUser,
+						tc.err,
+					)
+			}
+
+			s.ServeHTTP(resp, req)
+			assert.Equal(t, http.StatusBadRequest, resp.Code)
+			assert.Contains(t, resp.Body.String(), "token invalid or expired")
+		})
+	}
+}
+
+func TestHandler_AuthVerifyEmail_422(t *testing.T) {
+	_, s := getMapperAndServer(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/verify-email", bytes.NewBuffer([]byte(`{"invalid": "key"}`)))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+}
+
+func TestHandler_AuthResendVerifyEmail_202(t *testing.T) {
+	mapper, m, s := getMapperMailerAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+
+	b, err := json.Marshal(&users.AuthResendVerifyEmailRequest{Email: user.Email})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/verify-email/resend", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusAccepted, resp.Code)
+	assert.NotEqual(t, "", user.EmailVerificationToken)
+
+	msg := m.wait(t)
+	assert.Equal(t, []string{user.Email}, msg.To)
+	assert.Contains(t, msg.Body, "/auth/verify-email?token=")
+}
+
+func TestHandler_AuthResendVerifyEmail_202_No_Email(t *testing.T) {
+	verified := users.NewUser("test@example.com", "test")
+	verified.EmailVerified = true
+
+	testCases := []struct {
+		name       string
+		returnUser *users.User
+		err        error
+	}{
+		{"user not found", nil, users.ErrNoDocuments},
+		{"already verified", verified, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mapper, s := getMapperAndServer(t)
+
+			b, err := json.Marshal(&users.AuthResendVerifyEmailRequest{Email: "test@example.com"})
+			assert.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/auth/verify-email/resend", bytes.NewBuffer(b))
+			req.Header.Set("Content-Type", "application/json")
+			resp := httptest.NewRecorder()
+
+			mapper.Mock.
+				On(
+					"FindOne",
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					tc.returnUser,
+					tc.err,
+				)
+
+			s.ServeHTTP(resp, req)
+			assert.Equal(t, http.StatusAccepted, resp.Code)
+		})
+	}
+}
+
+func TestHandler_EmailVerification_Restricted(t *testing.T) {
+	_, s := getMapperAndServer(t)
+
+	viper.Set(config.EmailVerificationMode, config.EmailVerificationRestricted)
+	defer viper.Set(config.EmailVerificationMode, config.EmailVerificationOptional)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/user/personal_access_tokens", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Contains(t, resp.Body.String(), "Email not verified")
+}
+
+func TestHandler_AuthLogin_403_Email_Not_Verified(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	viper.Set(config.EmailVerificationMode, config.EmailVerificationLogin)
+	defer viper.Set(config.EmailVerificationMode, config.EmailVerificationOptional)
+
+	pwd := "abcdefghijkl"
+	user := users.NewUser("test@example.com", "test")
+	err := user.SetPassword(pwd)
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(&users.AuthLogInRequest{Email: user.Email, Password: pwd})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/login", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.LoginAttemptsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			[]*users.LoginAttempt{},
+			nil,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Contains(t, resp.Body.String(), "email not verified")
+}
+
+func TestUser_VerifyEmail(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	user := users.NewUser("test@example.com", "test")
+	token, err := user.NewEmailVerificationToken()
+	assert.NoError(t, err)
+
+	parsed, err := util.ParseToken(token)
+	assert.NoError(t, err)
+	email, _ := parsed.Get("email")
+	assert.Equal(t, user.Email, email)
+
+	assert.ErrorIs(t, user.VerifyEmail("invalid"), users.ErrTokenMismatch)
+	assert.NoError(t, user.VerifyEmail(string(token)))
+	assert.ErrorIs(t, user.VerifyEmail(string(token)), users.ErrTokenMismatch)
+}
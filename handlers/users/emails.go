@@ -0,0 +1,167 @@
+package users
+
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+
+	"github.com/alexferl/echo-boilerplate/config"
+	"github.com/alexferl/echo-boilerplate/mailer"
+)
+
+func newVerifyEmailMessage(user *User, token []byte) *mailer.Message {
+	body := fmt.Sprintf(`Hi %s,
+
+Please verify your email address by visiting the link below:
+
+%s/auth/verify-email?token=%s
+
+This link expires in %s. If you didn't create an account, you can ignore this email.
+`,
+		user.Username,
+		viper.GetString(config.BaseURL),
+		token,
+		viper.GetDuration(config.EmailVerificationTokenExpiry),
+	)
+
+	return &mailer.Message{
+		To:      []string{user.Email},
+		Subject: "Verify your email address",
+		Body:    body,
+	}
+}
+
+func newResetPasswordMessage(user *User, token string) *mailer.Message {
+	body := fmt.Sprintf(`Hi %s,
+
+Someone asked to reset the password of your account. You can choose a new password by visiting the link below:
+
+%s/auth/password/reset?token=%s
+
+This link expires in %s. If you didn't ask to reset your password, you can ignore this email.
+`,
+		user.Username,
+		viper.GetString(config.BaseURL),
+		token,
+		viper.GetDuration(config.PasswordResetTokenExpiry),
+	)
+
+	return &mailer.Message{
+		To:      []string{user.Email},
+		Subject: "Reset your password",
+		Body:    body,
+	}
+}
+
+func newForcedPasswordResetMessage(user *User, token string) *mailer.Message {
+	body := fmt.Sprintf(`Hi %s,
+
+An administrator requires you to choose a new password before you can log in again. You can choose a new password by visiting the link below:
+
+%s/auth/password/reset?token=%s
+
+This link expires in %s.
+`,
+		user.Username,
+		viper.GetString(config.BaseURL),
+		token,
+		viper.GetDuration(config.PasswordResetTokenExpiry),
+	)
+
+	return &mailer.Message{
+		To:      []string{user.Email},
+		Subject: "Reset your password",
+		Body:    body,
+	}
+}
+
+func newConfirmEmailChangeMessage(user *User, token string) *mailer.Message {
+	body := fmt.Sprintf(`Hi %s,
+
+Please confirm the new email address of your account by visiting the link below:
+
+%s/auth/email-change/confirm?token=%s
+
+This link expires in %s. If you didn't ask to change your email, you can ignore this email.
+`,
+		user.Username,
+		viper.GetString(config.BaseURL),
+		token,
+		viper.GetDuration(config.EmailChangeTokenExpiry),
+	)
+
+	return &mailer.Message{
+		To:      []string{user.PendingEmail},
+		Subject: "Confirm your new email address",
+		Body:    body,
+	}
+}
+
+func newEmailChangeNotificationMessage(user *User, token string) *mailer.Message {
+	body := fmt.Sprintf(`Hi %s,
+
+Someone asked to change the email address of your account to %s. If it wasn't you, cancel the change
+by visiting the link below, it works even after the new address is confirmed:
+
+%s/auth/email-change/cancel?token=%s
+
+This link expires in %s.
+`,
+		user.Username,
+		user.PendingEmail,
+		viper.GetString(config.BaseURL),
+		token,
+		viper.GetDuration(config.EmailChangeTokenExpiry),
+	)
+
+	return &mailer.Message{
+		To:      []string{user.Email},
+		Subject: "Your email address is being changed",
+		Body:    body,
+	}
+}
+
+func newAccountDeletedMessage(user *User, token string) *mailer.Message {
+	body := fmt.Sprintf(`Hi %s,
+
+Your account was deleted. If you change your mind, you can restore it by visiting the link below:
+
+%s/auth/account/restore?token=%s
+
+This link expires in %s, after which your account and personal information are permanently removed.
+`,
+		user.Username,
+		viper.GetString(config.BaseURL),
+		token,
+		viper.GetDuration(config.AccountDeletionGracePeriod),
+	)
+
+	return &mailer.Message{
+		To:      []string{user.Email},
+		Subject: "Your account was deleted",
+		Body:    body,
+	}
+}
+
+func newPATExpiringMessage(user *User, pat *PersonalAccessToken) *mailer.Message {
+	body := fmt.Sprintf(`Hi %s,
+
+Your personal access token "%s" expires on %s. You can rotate it to get a new one by visiting the link below:
+
+%s/settings/personal-access-tokens/%s
+
+If you don't need it anymore, you can ignore this email.
+`,
+		user.Username,
+		pat.Name,
+		pat.ExpiresAt.Format("2006-01-02"),
+		viper.GetString(config.FrontendURL),
+		pat.Id,
+	)
+
+	return &mailer.Message{
+		To:      []string{user.Email},
+		Subject: "Your personal access token expires soon",
+		Body:    body,
+	}
+}
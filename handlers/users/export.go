@@ -0,0 +1,567 @@
+package users
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/alexferl/echo-boilerplate/config"
+	"github.com/alexferl/echo-boilerplate/data"
+	"github.com/alexferl/echo-boilerplate/util"
+)
+
+const ExportsCollection = "exports"
+
+const (
+	ExportPending   = "pending"
+	ExportRunning   = "running"
+	ExportCompleted = "completed"
+	ExportFailed    = "failed"
+	ExportExpired   = "expired"
+)
+
+// Export is an archive of everything a user owns. Exports are built in
+// the background by StartExporter and their archive is deleted once they expire.
+type Export struct {
+	Id            string     `json:"id" bson:"id"`
+	UserId        string     `json:"-" bson:"user_id"`
+	Status        string     `json:"status" bson:"status"`
+	FileId        string     `json:"-" bson:"file_id"`
+	CreatedAt     *time.Time `json:"created_at" bson:"created_at"`
+	ClaimedAt     *time.Time `json:"-" bson:"claimed_at"`
+	CompletedAt   *time.Time `json:"completed_at" bson:"completed_at"`
+	ExpiresAt     *time.Time `json:"expires_at" bson:"expires_at"`
+	DownloadURL   string     `json:"download_url,omitempty" bson:"-"`
+	DownloadToken string     `json:"download_token,omitempty" bson:"-"`
+}
+
+func NewExport(userId string) *Export {
+	t := time.Now()
+	return &Export{
+		Id:        xid.New().String(),
+		UserId:    userId,
+		Status:    ExportPending,
+		CreatedAt: &t,
+	}
+}
+
+func (e *Export) filename() string {
+	return fmt.Sprintf("export-%s.zip", e.Id)
+}
+
+// CreateExport queues an export of the authenticated user's data.
+// Only one export can be in progress at a time.
+func (h *Handler) CreateExport(c echo.Context) error {
+	token := c.Get("token").(jwt.Token)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	filter := bson.D{
+		{"user_id", token.Subject()},
+		{"status", bson.D{{"$in", bson.A{ExportPending, ExportRunning}}}},
+	}
+	count, err := h.Mapper.Collection(ExportsCollection).Count(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("failed counting exports: %v", err)
+	}
+
+	if count > 0 {
+		return h.Validate(c, http.StatusConflict, echo.Map{"message": "an export is already in progress"})
+	}
+
+	export := NewExport(token.Subject())
+	_, err = h.Mapper.Collection(ExportsCollection).Insert(ctx, export, nil)
+	if err != nil {
+		return fmt.Errorf("failed inserting export: %v", err)
+	}
+
+	c.Response().Header().Set(echo.HeaderLocation, fmt.Sprintf("/user/export/%s", export.Id))
+
+	return h.Validate(c, http.StatusAccepted, export)
+}
+
+// GetExport returns the status of an export. Completed exports get a
+// short-lived signed token to POST to their download_url.
+func (h *Handler) GetExport(c echo.Context) error {
+	token := c.Get("token").(jwt.Token)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	filter := bson.D{{"id", c.Param("id")}, {"user_id", token.Subject()}}
+	result, err := h.Mapper.Collection(ExportsCollection).FindOne(ctx, filter, &Export{})
+	if err != nil {
+		if err == ErrNoDocuments {
+			return h.Validate(c, http.StatusNotFound, echo.Map{"message": "export not found"})
+		}
+		return fmt.Errorf("failed getting export: %v", err)
+	}
+
+	export := result.(*Export)
+	if export.Status == ExportCompleted {
+		download, err := util.GenerateExportDownloadToken(export.UserId, export.Id)
+		if err != nil {
+			return fmt.Errorf("failed generating download token: %v", err)
+		}
+
+		export.DownloadURL = fmt.Sprintf("%s/user/export/%s/download", viper.GetString(config.BaseURL), export.Id)
+		export.DownloadToken = string(download)
+	}
+
+	return h.Validate(c, http.StatusOK, export)
+}
+
+type ExportDownloadRequest struct {
+	Token string `json:"token"`
+}
+
+// DownloadExport sends the archive of a completed export. It's
+// authenticated by a download token only, which can be used once.
+// The token is sent in the body so it doesn't end up in access logs.
+func (h *Handler) DownloadExport(c echo.Context) error {
+	invalid := func() error {
+		return h.Validate(c, http.StatusUnauthorized, echo.Map{"message": "invalid download token"})
+	}
+
+	body := &ExportDownloadRequest{}
+	if err := c.Bind(body); err != nil {
+		return err
+	}
+
+	token, err := util.ParseToken([]byte(body.Token))
+	if err != nil {
+		return invalid()
+	}
+
+	if typ, _ := token.Get("type"); typ != util.ExportDownloadToken.String() {
+		return invalid()
+	}
+
+	if id, _ := token.Get("export_id"); id != c.Param("id") {
+		return invalid()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	filter := bson.D{{"id", c.Param("id")}, {"user_id", token.Subject()}}
+	result, err := h.Mapper.Collection(ExportsCollection).FindOne(ctx, filter, &Export{})
+	if err != nil {
+		if err == ErrNoDocuments {
+			return h.Validate(c, http.StatusNotFound, echo.Map{"message": "export not found"})
+		}
+		return fmt.Errorf("failed getting export: %v", err)
+	}
+
+	export := result.(*Export)
+	if export.Status == ExportExpired {
+		return h.Validate(c, http.StatusGone, echo.Map{"message": "export expired"})
+	}
+
+	if export.Status != ExportCompleted {
+		return h.Validate(c, http.StatusNotFound, echo.Map{"message": "export not found"})
+	}
+
+	// the token is added to the denylist, whose ids are unique, so
+	// only one request can use it even if they're concurrent
+	_, err = h.Mapper.Collection(RevokedTokensCollection).Insert(ctx, NewRevokedToken(token), nil)
+	if err != nil {
+		if err == ErrDuplicateKey {
+			return invalid()
+		}
+		return fmt.Errorf("failed revoking download token: %v", err)
+	}
+
+	file, err := h.Exports.Open(ctx, export.FileId)
+	if err != nil {
+		if err == data.ErrFileNotFound {
+			return h.Validate(c, http.StatusNotFound, echo.Map{"message": "export not found"})
+		}
+		return fmt.Errorf("failed opening export: %v", err)
+	}
+	defer file.Close()
+
+	c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", export.filename()))
+
+	return c.Stream(http.StatusOK, "application/zip", file)
+}
+
+// exportProfile is the profile of a user without secrets.
+type exportProfile struct {
+	Id            string     `json:"id"`
+	Username      string     `json:"username"`
+	Email         string     `json:"email"`
+	EmailVerified bool       `json:"email_verified"`
+	Name          string     `json:"name"`
+	Bio           string     `json:"bio"`
+	Roles         []string   `json:"roles"`
+	MFAEnabled    bool       `json:"mfa_enabled"`
+	CreatedAt     *time.Time `json:"created_at"`
+	UpdatedAt     *time.Time `json:"updated_at"`
+	LastLoginAt   *time.Time `json:"last_login_at"`
+}
+
+type exportTask struct {
+	Id          string     `json:"id" bson:"id"`
+	Title       string     `json:"title" bson:"title"`
+	Completed   bool       `json:"completed" bson:"completed"`
+	CreatedAt   *time.Time `json:"created_at" bson:"created_at"`
+	CreatedBy   string     `json:"created_by" bson:"created_by"`
+	CompletedAt *time.Time `json:"completed_at" bson:"completed_at"`
+	CompletedBy string     `json:"completed_by" bson:"completed_by"`
+	UpdatedAt   *time.Time `json:"updated_at" bson:"updated_at"`
+	DeletedAt   *time.Time `json:"deleted_at" bson:"deleted_at"`
+}
+
+type exportSession struct {
+	Id            string     `json:"id" bson:"id"`
+	UserAgent     string     `json:"user_agent" bson:"user_agent"`
+	IP            string     `json:"ip" bson:"ip"`
+	CreatedAt     *time.Time `json:"created_at" bson:"created_at"`
+	LastRefreshAt *time.Time `json:"last_refresh_at" bson:"last_refresh_at"`
+	ExpiresAt     *time.Time `json:"expires_at" bson:"expires_at"`
+	RevokedAt     *time.Time `json:"revoked_at" bson:"revoked_at"`
+}
+
+// exportFile is a file of the archive, written both as JSON and CSV.
+type exportFile struct {
+	name   string
+	data   any
+	header []string
+	rows   [][]string
+}
+
+// buildExport returns the archive of the data of userId.
+func buildExport(ctx context.Context, mapper data.Mapper, userId string) ([]byte, error) {
+	result, err := mapper.Collection(UsersCollection).FindOneById(ctx, userId, &User{})
+	if err != nil {
+		return nil, fmt.Errorf("failed getting user: %v", err)
+	}
+
+	user := result.(*User)
+	profile := &exportProfile{
+		Id:            user.Id,
+		Username:      user.Username,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		Name:          user.Name,
+		Bio:           user.Bio,
+		Roles:         user.Roles,
+		MFAEnabled:    user.MFAEnabled,
+		CreatedAt:     user.CreatedAt,
+		UpdatedAt:     user.UpdatedAt,
+		LastLoginAt:   user.LastLoginAt,
+	}
+
+	filter := bson.D{{"$or", bson.A{
+		bson.D{{"created_by", userId}},
+		bson.D{{"completed_by", userId}},
+	}}}
+	result, err = mapper.Collection("tasks").Find(ctx, filter, []*exportTask{})
+	if err != nil {
+		return nil, fmt.Errorf("failed getting tasks: %v", err)
+	}
+	tasks := result.([]*exportTask)
+
+	filter = bson.D{{"user_id", userId}}
+	result, err = mapper.Collection(PATCollection).Find(ctx, filter, []*PATWithoutToken{})
+	if err != nil {
+		return nil, fmt.Errorf("failed getting personal access tokens: %v", err)
+	}
+	pats := result.([]*PATWithoutToken)
+	for _, pat := range pats {
+		pat.setStatus()
+	}
+
+	result, err = mapper.Collection(SessionsCollection).Find(ctx, filter, []*exportSession{})
+	if err != nil {
+		return nil, fmt.Errorf("failed getting sessions: %v", err)
+	}
+	sessions := result.([]*exportSession)
+
+	result, err = mapper.Collection(AuditEventsCollection).Find(ctx, filter, []*AuditEvent{})
+	if err != nil {
+		return nil, fmt.Errorf("failed getting audit events: %v", err)
+	}
+	events := result.([]*AuditEvent)
+
+	files := []*exportFile{
+		{
+			name:   "profile",
+			data:   profile,
+			header: []string{"id", "username", "email", "email_verified", "name", "bio", "roles", "mfa_enabled", "created_at", "updated_at", "last_login_at"},
+			rows: [][]string{{
+				profile.Id, profile.Username, profile.Email, strconv.FormatBool(profile.EmailVerified), profile.Name,
+				profile.Bio, strings.Join(profile.Roles, " "), strconv.FormatBool(profile.MFAEnabled),
+				formatTime(profile.CreatedAt), formatTime(profile.UpdatedAt), formatTime(profile.LastLoginAt),
+			}},
+		},
+		{
+			name:   "tasks",
+			data:   tasks,
+			header: []string{"id", "title", "completed", "created_at", "created_by", "completed_at", "completed_by", "updated_at", "deleted_at"},
+		},
+		{
+			name:   "personal_access_tokens",
+			data:   pats,
+			header: []string{"id", "name", "status", "scopes", "allowed_ips", "created_at", "expires_at", "last_used_at", "last_used_ip", "request_count"},
+		},
+		{
+			name:   "sessions",
+			data:   sessions,
+			header: []string{"id", "user_agent", "ip", "created_at", "last_refresh_at", "expires_at", "revoked_at"},
+		},
+		{
+			name:   "audit_events",
+			data:   events,
+			header: []string{"id", "type", "ip", "user_agent", "data", "created_at"},
+		},
+	}
+
+	for _, t := range tasks {
+		files[1].rows = append(files[1].rows, []string{
+			t.Id, t.Title, strconv.FormatBool(t.Completed), formatTime(t.CreatedAt), t.CreatedBy,
+			formatTime(t.CompletedAt), t.CompletedBy, formatTime(t.UpdatedAt), formatTime(t.DeletedAt),
+		})
+	}
+
+	for _, p := range pats {
+		files[2].rows = append(files[2].rows, []string{
+			p.Id, p.Name, p.Status, strings.Join(p.Scopes, " "), strings.Join(p.AllowedIPs, " "),
+			formatTime(p.CreatedAt), formatTime(p.ExpiresAt), formatTime(p.LastUsedAt), p.LastUsedIP,
+			strconv.FormatInt(p.RequestCount, 10),
+		})
+	}
+
+	for _, s := range sessions {
+		files[3].rows = append(files[3].rows, []string{
+			s.Id, s.UserAgent, s.IP, formatTime(s.CreatedAt), formatTime(s.LastRefreshAt),
+			formatTime(s.ExpiresAt), formatTime(s.RevokedAt),
+		})
+	}
+
+	for _, e := range events {
+		var b []byte
+		if len(e.Data) > 0 {
+			if b, err = json.Marshal(e.Data); err != nil {
+				return nil, fmt.Errorf("failed encoding audit event data: %v", err)
+			}
+		}
+		files[4].rows = append(files[4].rows, []string{
+			e.Id, e.Type, e.IP, e.UserAgent, string(b), formatTime(e.CreatedAt),
+		})
+	}
+
+	return writeExport(files)
+}
+
+func writeExport(files []*exportFile) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for _, f := range files {
+		w, err := zw.Create(fmt.Sprintf("%s.json", f.name))
+		if err != nil {
+			return nil, err
+		}
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err = enc.Encode(f.data); err != nil {
+			return nil, err
+		}
+
+		w, err = zw.Create(fmt.Sprintf("%s.csv", f.name))
+		if err != nil {
+			return nil, err
+		}
+
+		cw := csv.NewWriter(w)
+		if err = cw.Write(f.header); err != nil {
+			return nil, err
+		}
+		if err = cw.WriteAll(f.rows); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// ProcessExports builds the pending exports one at a time and deletes
+// the expired ones. Exports left running for longer than the claim timeout,
+// by an instance that stopped, are built again. It returns how many exports were built.
+func ProcessExports(ctx context.Context, mapper data.Mapper, bucket data.Bucket) (int, error) {
+	if err := expireExports(ctx, mapper, bucket); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for {
+		// claiming the export makes sure only one instance builds it
+		now := time.Now()
+		filter := bson.D{{"$or", bson.A{
+			bson.D{{"status", ExportPending}},
+			bson.D{
+				{"status", ExportRunning},
+				{"claimed_at", bson.D{{"$lte", now.Add(-viper.GetDuration(config.ExportClaimTimeout))}}},
+			},
+		}}}
+		update := bson.D{{"status", ExportRunning}, {"claimed_at", now}}
+		opts := options.FindOneAndUpdate().SetSort(bson.D{{"created_at", 1}})
+		result, err := mapper.Collection(ExportsCollection).Upsert(ctx, filter, update, &Export{}, opts)
+		if err != nil {
+			if err == ErrNoDocuments {
+				return n, nil
+			}
+			return n, fmt.Errorf("failed claiming export: %v", err)
+		}
+
+		export := result.(*Export)
+		fileId, err := runExport(ctx, mapper, bucket, export)
+		if err != nil {
+			log.Error().Err(err).Str("export_id", export.Id).Msg("failed building export")
+			export.Status = ExportFailed
+		} else {
+			t := time.Now()
+			expiresAt := t.Add(viper.GetDuration(config.ExportExpiry))
+			export.Status = ExportCompleted
+			export.FileId = fileId
+			export.CompletedAt = &t
+			export.ExpiresAt = &expiresAt
+		}
+
+		// the export is only updated if it wasn't claimed again in the meantime
+		filter = bson.D{{"id", export.Id}, {"claimed_at", export.ClaimedAt}}
+		update = bson.D{{"$set", bson.D{
+			{"status", export.Status},
+			{"file_id", export.FileId},
+			{"completed_at", export.CompletedAt},
+			{"expires_at", export.ExpiresAt},
+		}}}
+		res, err := mapper.Collection(ExportsCollection).Update(ctx, filter, update, nil)
+		if err != nil {
+			return n, fmt.Errorf("failed updating export: %v", err)
+		}
+
+		if res.(*mongo.UpdateResult).MatchedCount == 0 {
+			log.Warn().Str("export_id", export.Id).Msg("export was claimed again while building it")
+			if fileId != "" {
+				if err = deleteExportFile(ctx, bucket, fileId); err != nil {
+					return n, err
+				}
+			}
+			continue
+		}
+
+		if export.Status == ExportCompleted {
+			n++
+		}
+	}
+}
+
+// runExport builds export and returns the id of its archive in bucket.
+func runExport(ctx context.Context, mapper data.Mapper, bucket data.Bucket, export *Export) (string, error) {
+	b, err := buildExport(ctx, mapper, export.UserId)
+	if err != nil {
+		return "", err
+	}
+
+	fileId := xid.New().String()
+	if err = bucket.Upload(ctx, fileId, export.filename(), bytes.NewReader(b)); err != nil {
+		return "", fmt.Errorf("failed uploading export: %v", err)
+	}
+
+	return fileId, nil
+}
+
+func deleteExportFile(ctx context.Context, bucket data.Bucket, fileId string) error {
+	if err := bucket.Delete(ctx, fileId); err != nil && err != data.ErrFileNotFound {
+		return fmt.Errorf("failed removing export: %v", err)
+	}
+
+	return nil
+}
+
+func expireExports(ctx context.Context, mapper data.Mapper, bucket data.Bucket) error {
+	filter := bson.D{{"status", ExportCompleted}, {"expires_at", bson.D{{"$lte", time.Now()}}}}
+	return removeExports(ctx, mapper, bucket, filter, bson.D{{"$set", bson.D{{"status", ExportExpired}}}})
+}
+
+// removeExports deletes the archives of the exports matching filter and
+// applies update to them, or deletes them if update is nil.
+func removeExports(ctx context.Context, mapper data.Mapper, bucket data.Bucket, filter any, update any) error {
+	result, err := mapper.Collection(ExportsCollection).Find(ctx, filter, []*Export{})
+	if err != nil {
+		return fmt.Errorf("failed getting exports: %v", err)
+	}
+
+	exports := result.([]*Export)
+	if len(exports) == 0 {
+		return nil
+	}
+
+	ids := bson.A{}
+	for _, export := range exports {
+		if export.FileId != "" {
+			if err = deleteExportFile(ctx, bucket, export.FileId); err != nil {
+				return err
+			}
+		}
+		ids = append(ids, export.Id)
+	}
+
+	filter = bson.D{{"id", bson.D{{"$in", ids}}}}
+	if update == nil {
+		_, err = mapper.Collection(ExportsCollection).Delete(ctx, filter)
+	} else {
+		_, err = mapper.Collection(ExportsCollection).UpdateMany(ctx, filter, update)
+	}
+	if err != nil {
+		return fmt.Errorf("failed updating exports: %v", err)
+	}
+
+	return nil
+}
+
+// StartExporter processes exports in the background every interval.
+func StartExporter(mapper data.Mapper, bucket data.Bucket, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+			n, err := ProcessExports(ctx, mapper, bucket)
+			cancel()
+			if err != nil {
+				log.Error().Err(err).Msg("failed processing exports")
+			} else if n > 0 {
+				log.Info().Msgf("Built %d exports", n)
+			}
+		}
+	}()
+}
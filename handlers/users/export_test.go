@@ -0,0 +1,636 @@
+package users_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexferl/echo-openapi"
+	"github.com/alexferl/golib/http/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	app "github.com/alexferl/echo-boilerplate"
+	"github.com/alexferl/echo-boilerplate/config"
+	"github.com/alexferl/echo-boilerplate/data"
+	"github.com/alexferl/echo-boilerplate/handlers/users"
+	"github.com/alexferl/echo-boilerplate/mocks"
+	"github.com/alexferl/echo-boilerplate/util"
+)
+
+// testBucket keeps files in memory.
+type testBucket struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func newTestBucket() *testBucket {
+	return &testBucket{files: map[string][]byte{}}
+}
+
+func (b *testBucket) Upload(ctx context.Context, id string, name string, r io.Reader) error {
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.files[id] = buf
+	return nil
+}
+
+func (b *testBucket) Open(ctx context.Context, id string) (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	buf, ok := b.files[id]
+	if !ok {
+		return nil, data.ErrFileNotFound
+	}
+	return io.NopCloser(bytes.NewReader(buf)), nil
+}
+
+func (b *testBucket) Delete(ctx context.Context, id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.files[id]; !ok {
+		return data.ErrFileNotFound
+	}
+	delete(b.files, id)
+	return nil
+}
+
+func getMapperBucketAndServer(t *testing.T) (*mocks.Mapper, *testBucket, *server.Server) {
+	mapper := mocks.NewMapper(t)
+	h := users.NewHandler(&mongo.Client{}, openapi.NewHandler(), mapper)
+	b := newTestBucket()
+	h.(*users.Handler).Exports = b
+	s := app.NewTestServer(h)
+	return mapper, b, s
+}
+
+func downloadRequest(t *testing.T, id string, token string) *http.Request {
+	b, err := json.Marshal(&users.ExportDownloadRequest{Token: token})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/user/export/%s/download", id), bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+func TestHandler_CreateExport_202(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/user/export", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.ExportsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Count",
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			int64(0),
+			nil,
+		).
+		On(
+			"Insert",
+			mock.Anything,
+			mock.MatchedBy(func(e *users.Export) bool {
+				return e.UserId == user.Id && e.Status == users.ExportPending
+			}),
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	var result users.Export
+	err = json.Unmarshal(resp.Body.Bytes(), &result)
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusAccepted, resp.Code)
+	assert.Equal(t, users.ExportPending, result.Status)
+	assert.Equal(t, fmt.Sprintf("/user/export/%s", result.Id), resp.Header().Get("Location"))
+}
+
+func TestHandler_CreateExport_409(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/user/export", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.ExportsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Count",
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			int64(1),
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Contains(t, resp.Body.String(), "an export is already in progress")
+}
+
+func TestHandler_GetExport(t *testing.T) {
+	testCases := []struct {
+		name     string
+		status   string
+		download bool
+	}{
+		{"pending", users.ExportPending, false},
+		{"completed", users.ExportCompleted, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mapper, s := getMapperAndServer(t)
+
+			user := users.NewUser("test@example.com", "test")
+			access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+			assert.NoError(t, err)
+
+			export := users.NewExport(user.Id)
+			export.Status = tc.status
+
+			req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/user/export/%s", export.Id), nil)
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+			resp := httptest.NewRecorder()
+
+			mapper.Mock.
+				On(
+					"Collection",
+					users.ExportsCollection,
+				).
+				Return(
+					mapper,
+				).
+				On(
+					"FindOne",
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					export,
+					nil,
+				)
+
+			s.ServeHTTP(resp, req)
+
+			var result users.Export
+			err = json.Unmarshal(resp.Body.Bytes(), &result)
+			assert.NoError(t, err)
+
+			assert.Equal(t, http.StatusOK, resp.Code)
+			assert.Equal(t, tc.status, result.Status)
+			if !tc.download {
+				assert.Empty(t, result.DownloadURL)
+				assert.Empty(t, result.DownloadToken)
+				return
+			}
+
+			u, err := url.Parse(result.DownloadURL)
+			assert.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("/user/export/%s/download", export.Id), u.Path)
+			assert.Empty(t, u.RawQuery)
+			token, err := util.ParseToken([]byte(result.DownloadToken))
+			assert.NoError(t, err)
+			assert.Equal(t, user.Id, token.Subject())
+			id, _ := token.Get("export_id")
+			assert.Equal(t, export.Id, id)
+		})
+	}
+}
+
+func TestHandler_GetExport_404(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/user/export/id", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.ExportsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			users.ErrNoDocuments,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
+
+func TestHandler_DownloadExport_200(t *testing.T) {
+	mapper, bucket, s := getMapperBucketAndServer(t)
+
+	export := users.NewExport("user")
+	export.Status = users.ExportCompleted
+	export.FileId = "file"
+	err := bucket.Upload(context.Background(), export.FileId, "", bytes.NewBufferString("zip"))
+	assert.NoError(t, err)
+
+	token, err := util.GenerateExportDownloadToken("user", export.Id)
+	assert.NoError(t, err)
+	parsed, err := util.ParseToken(token)
+	assert.NoError(t, err)
+
+	req := downloadRequest(t, export.Id, string(token))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			mock.Anything,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			export,
+			nil,
+		).
+		On(
+			"Insert",
+			mock.Anything,
+			mock.MatchedBy(func(r *users.RevokedToken) bool {
+				return r.Id == parsed.JwtID()
+			}),
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Header().Get("Content-Disposition"), fmt.Sprintf("export-%s.zip", export.Id))
+	assert.Equal(t, "zip", resp.Body.String())
+}
+
+func TestHandler_DownloadExport_401_Used(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	export := users.NewExport("user")
+	export.Status = users.ExportCompleted
+	export.FileId = "file"
+
+	token, err := util.GenerateExportDownloadToken("user", export.Id)
+	assert.NoError(t, err)
+
+	req := downloadRequest(t, export.Id, string(token))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			mock.Anything,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			export,
+			nil,
+		).
+		On(
+			"Insert",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			users.ErrDuplicateKey,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+	assert.Contains(t, resp.Body.String(), "invalid download token")
+}
+
+func TestHandler_DownloadExport_401(t *testing.T) {
+	other, err := util.GenerateExportDownloadToken("user", "other")
+	assert.NoError(t, err)
+	mfa, err := util.GenerateMFAToken("user")
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name  string
+		token string
+	}{
+		{"invalid token", "invalid"},
+		{"wrong token type", string(mfa)},
+		{"other export", string(other)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, s := getMapperAndServer(t)
+
+			req := downloadRequest(t, "id", tc.token)
+			resp := httptest.NewRecorder()
+
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, http.StatusUnauthorized, resp.Code)
+			assert.Contains(t, resp.Body.String(), "invalid download token")
+		})
+	}
+}
+
+func TestHandler_DownloadExport_410(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	export := users.NewExport("user")
+	export.Status = users.ExportExpired
+
+	token, err := util.GenerateExportDownloadToken("user", export.Id)
+	assert.NoError(t, err)
+
+	req := downloadRequest(t, export.Id, string(token))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.ExportsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			export,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusGone, resp.Code)
+}
+
+// claimsStale reports whether the claim filter of ProcessExports
+// also matches the exports left running past the claim timeout.
+func claimsStale(filter bson.D) bool {
+	for _, e := range filter {
+		if e.Key != "$or" {
+			continue
+		}
+		for _, f := range e.Value.(bson.A) {
+			for _, c := range f.(bson.D) {
+				if c.Key == "claimed_at" {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func exportsMapper(t *testing.T, user *users.User, export *users.Export, matched int64) *mocks.Mapper {
+	mapper := mocks.NewMapper(t)
+	now := time.Now()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			mock.Anything,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.AnythingOfType("[]*users.Export"),
+		).
+		Return(
+			[]*users.Export{},
+			nil,
+		).
+		On(
+			"Upsert",
+			mock.Anything,
+			mock.MatchedBy(claimsStale),
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			export,
+			nil,
+		).
+		Once().
+		On(
+			"Upsert",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			users.ErrNoDocuments,
+		).
+		On(
+			"FindOneById",
+			mock.Anything,
+			user.Id,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			func(ctx context.Context, filter any, result any, opts ...*options.FindOptions) any {
+				switch result.(type) {
+				case []*users.PATWithoutToken:
+					return []*users.PATWithoutToken{{Id: "pat", Name: "ci", UserId: user.Id, CreatedAt: &now}}
+				case []*users.AuditEvent:
+					return []*users.AuditEvent{{Id: "event", Type: users.AuditPasswordChanged, UserId: user.Id, CreatedAt: &now}}
+				}
+				return result
+			},
+			nil,
+		).
+		On(
+			"Update",
+			mock.Anything,
+			bson.D{{"id", export.Id}, {"claimed_at", export.ClaimedAt}},
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			&mongo.UpdateResult{MatchedCount: matched},
+			nil,
+		)
+
+	return mapper
+}
+
+func TestProcessExports(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	user := users.NewUser("test@example.com", "test")
+	user.Name = "Test User"
+	err := user.SetPassword("abcdefghijkl")
+	assert.NoError(t, err)
+	export := users.NewExport(user.Id)
+	export.Status = users.ExportRunning
+	claimedAt := time.Now()
+	export.ClaimedAt = &claimedAt
+
+	mapper := exportsMapper(t, user, export, 1)
+	bucket := newTestBucket()
+
+	n, err := users.ProcessExports(context.Background(), mapper, bucket)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, users.ExportCompleted, export.Status)
+	assert.NotNil(t, export.ExpiresAt)
+
+	f, err := bucket.Open(context.Background(), export.FileId)
+	assert.NoError(t, err)
+	b, err := io.ReadAll(f)
+	assert.NoError(t, err)
+	r, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	assert.NoError(t, err)
+
+	files := map[string][]byte{}
+	for _, f := range r.File {
+		rc, err := f.Open()
+		assert.NoError(t, err)
+		b, err := io.ReadAll(rc)
+		assert.NoError(t, err)
+		rc.Close()
+		files[f.Name] = b
+	}
+
+	for _, name := range []string{"profile", "tasks", "personal_access_tokens", "sessions", "audit_events"} {
+		assert.Contains(t, files, name+".json")
+		assert.Contains(t, files, name+".csv")
+	}
+
+	assert.Contains(t, string(files["profile.json"]), "test@example.com")
+	assert.NotContains(t, string(files["profile.json"]), user.Password)
+
+	records, err := csv.NewReader(bytes.NewReader(files["personal_access_tokens.csv"])).ReadAll()
+	assert.NoError(t, err)
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, "id", records[0][0])
+		assert.Equal(t, "ci", records[1][1])
+	}
+}
+
+func TestProcessExports_ClaimedAgain(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	user := users.NewUser("test@example.com", "test")
+	export := users.NewExport(user.Id)
+	export.Status = users.ExportRunning
+	claimedAt := time.Now()
+	export.ClaimedAt = &claimedAt
+
+	mapper := exportsMapper(t, user, export, 0)
+	bucket := newTestBucket()
+
+	n, err := users.ProcessExports(context.Background(), mapper, bucket)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Empty(t, bucket.files, "the archive of the stale build is removed")
+}
@@ -16,16 +16,21 @@ import (
 
 	"github.com/alexferl/echo-boilerplate/config"
 	"github.com/alexferl/echo-boilerplate/data"
+	"github.com/alexferl/echo-boilerplate/mailer"
 )
 
+const UsersCollection = "users"
+
 type Handler struct {
 	*openapi.Handler
-	Mapper data.Mapper
+	Mapper  data.Mapper
+	Mailer  mailer.Mailer
+	Exports data.Bucket
 }
 
 func NewHandler(db *mongo.Client, openapi *openapi.Handler, mapper data.Mapper) handler.Handler {
 	if mapper == nil {
-		mapper = NewMapper(db, "users")
+		mapper = NewMapper(db, UsersCollection)
 	}
 
 	if viper.GetBool(config.AdminCreate) {
@@ -38,6 +43,15 @@ func NewHandler(db *mongo.Client, openapi *openapi.Handler, mapper data.Mapper)
 				log.Info().Msg("Creating admin user")
 
 				user := NewAdminUser(viper.GetString(config.AdminEmail), viper.GetString(config.AdminUsername))
+				user.EmailVerified = true
+				errs, err := CheckPassword(config.AdminPassword, viper.GetString(config.AdminPassword), user.Username, user.Email)
+				if err != nil {
+					panic(fmt.Sprintf("failed checking admin password: %v", err))
+				}
+				if len(errs) > 0 {
+					panic(fmt.Sprintf("admin password rejected by the password policy: %v", errs[0]))
+				}
+
 				err = user.SetPassword(viper.GetString(config.AdminPassword))
 				user.Create(user.Id)
 				if err != nil {
@@ -56,9 +70,16 @@ func NewHandler(db *mongo.Client, openapi *openapi.Handler, mapper data.Mapper)
 		}
 	}
 
+	m, err := mailer.New()
+	if err != nil {
+		panic(fmt.Sprintf("failed creating mailer: %v", err))
+	}
+
 	return &Handler{
 		Handler: openapi,
 		Mapper:  mapper,
+		Mailer:  m,
+		Exports: data.NewBucket(db, ExportsCollection),
 	}
 }
 
@@ -66,17 +87,65 @@ func (h *Handler) GetRoutes() []*router.Route {
 	return []*router.Route{
 		{Name: "AuthSignUp", Method: http.MethodPost, Pattern: "/auth/signup", HandlerFunc: h.AuthSignUp},
 		{Name: "AuthLogIn", Method: http.MethodPost, Pattern: "/auth/login", HandlerFunc: h.AuthLogIn},
+		{Name: "AuthLogInMFA", Method: http.MethodPost, Pattern: "/auth/login/mfa", HandlerFunc: h.AuthLogInMFA},
 		{Name: "AuthRefresh", Method: http.MethodPost, Pattern: "/auth/refresh", HandlerFunc: h.AuthRefresh},
 		{Name: "AuthLogOut", Method: http.MethodPost, Pattern: "/auth/logout", HandlerFunc: h.AuthLogOut},
-		{Name: "OAuth2LogIn", Method: http.MethodGet, Pattern: "/oauth2/login", HandlerFunc: h.OAuth2LogIn},
-		{Name: "OAuth2Callback", Method: http.MethodGet, Pattern: "/oauth2/callback", HandlerFunc: h.OAuth2Callback},
+		{Name: "AuthVerifyEmailLink", Method: http.MethodGet, Pattern: "/auth/verify-email", HandlerFunc: h.AuthVerifyEmail},
+		{Name: "AuthVerifyEmail", Method: http.MethodPost, Pattern: "/auth/verify-email", HandlerFunc: h.AuthVerifyEmail},
+		{Name: "AuthResendVerifyEmail", Method: http.MethodPost, Pattern: "/auth/verify-email/resend", HandlerFunc: h.AuthResendVerifyEmail},
+		{Name: "AuthForgotPassword", Method: http.MethodPost, Pattern: "/auth/password/forgot", HandlerFunc: h.AuthForgotPassword},
+		{Name: "AuthCheckPasswordReset", Method: http.MethodGet, Pattern: "/auth/password/reset", HandlerFunc: h.AuthCheckPasswordReset},
+		{Name: "AuthResetPassword", Method: http.MethodPost, Pattern: "/auth/password/reset", HandlerFunc: h.AuthResetPassword},
+		{Name: "AuthCheckEmailChange", Method: http.MethodGet, Pattern: "/auth/email-change/confirm", HandlerFunc: h.AuthCheckEmailChange},
+		{Name: "AuthConfirmEmailChange", Method: http.MethodPost, Pattern: "/auth/email-change/confirm", HandlerFunc: h.AuthConfirmEmailChange},
+		{Name: "AuthCheckEmailChangeCancel", Method: http.MethodGet, Pattern: "/auth/email-change/cancel", HandlerFunc: h.AuthCheckEmailChangeCancel},
+		{Name: "AuthCancelEmailChange", Method: http.MethodPost, Pattern: "/auth/email-change/cancel", HandlerFunc: h.AuthCancelEmailChange},
+		{Name: "AuthCheckAccountRestore", Method: http.MethodGet, Pattern: "/auth/account/restore", HandlerFunc: h.AuthCheckAccountRestore},
+		{Name: "AuthRestoreAccount", Method: http.MethodPost, Pattern: "/auth/account/restore", HandlerFunc: h.AuthRestoreAccount},
+		{Name: "OAuth2LogIn", Method: http.MethodGet, Pattern: "/oauth2/:provider/login", HandlerFunc: h.OAuth2LogIn},
+		{Name: "OAuth2Callback", Method: http.MethodGet, Pattern: "/oauth2/:provider/callback", HandlerFunc: h.OAuth2Callback},
+		{Name: "OAuth2Onboarding", Method: http.MethodPost, Pattern: "/oauth2/onboarding", HandlerFunc: h.OAuth2Onboarding},
 		{Name: "GetUser", Method: http.MethodGet, Pattern: "/user", HandlerFunc: h.GetUser},
 		{Name: "UpdateUser", Method: http.MethodPatch, Pattern: "/user", HandlerFunc: h.UpdateUser},
+		{Name: "DeleteUser", Method: http.MethodDelete, Pattern: "/user", HandlerFunc: h.DeleteUser},
+		{Name: "UpdatePassword", Method: http.MethodPut, Pattern: "/user/password", HandlerFunc: h.UpdatePassword},
+		{Name: "CreateExport", Method: http.MethodPost, Pattern: "/user/export", HandlerFunc: h.CreateExport},
+		{Name: "GetExport", Method: http.MethodGet, Pattern: "/user/export/:id", HandlerFunc: h.GetExport},
+		{Name: "DownloadExport", Method: http.MethodPost, Pattern: "/user/export/:id/download", HandlerFunc: h.DownloadExport},
+		{Name: "EnrollTOTP", Method: http.MethodPost, Pattern: "/user/mfa/totp", HandlerFunc: h.EnrollTOTP},
+		{Name: "ConfirmTOTP", Method: http.MethodPost, Pattern: "/user/mfa/totp/confirm", HandlerFunc: h.ConfirmTOTP},
+		{Name: "DisableTOTP", Method: http.MethodDelete, Pattern: "/user/mfa/totp", HandlerFunc: h.DisableTOTP},
+		{Name: "ListSessions", Method: http.MethodGet, Pattern: "/user/sessions", HandlerFunc: h.ListSessions},
+		{Name: "RevokeOtherSessions", Method: http.MethodDelete, Pattern: "/user/sessions", HandlerFunc: h.RevokeOtherSessions},
+		{Name: "RevokeSession", Method: http.MethodDelete, Pattern: "/user/sessions/:id", HandlerFunc: h.RevokeSession},
+		{Name: "ListIdentities", Method: http.MethodGet, Pattern: "/user/identities", HandlerFunc: h.ListIdentities},
+		{Name: "LinkIdentity", Method: http.MethodGet, Pattern: "/user/identities/:provider/link", HandlerFunc: h.LinkIdentity},
+		{Name: "DeleteIdentity", Method: http.MethodDelete, Pattern: "/user/identities/:id", HandlerFunc: h.DeleteIdentity},
 		{Name: "CreatePersonalAccessToken", Method: http.MethodPost, Pattern: "/user/personal_access_tokens", HandlerFunc: h.CreatePersonalAccessToken},
 		{Name: "ListPersonalAccessTokens", Method: http.MethodGet, Pattern: "/user/personal_access_tokens", HandlerFunc: h.ListPersonalAccessTokens},
 		{Name: "GetPersonalAccessToken", Method: http.MethodGet, Pattern: "/user/personal_access_tokens/:id", HandlerFunc: h.GetPersonalAccessToken},
 		{Name: "RevokePersonalAccessToken", Method: http.MethodDelete, Pattern: "/user/personal_access_tokens/:id", HandlerFunc: h.RevokePersonalAccessToken},
+		{Name: "RotatePersonalAccessToken", Method: http.MethodPost, Pattern: "/user/personal_access_tokens/:id/rotate", HandlerFunc: h.RotatePersonalAccessToken},
 		{Name: "GetUsername", Method: http.MethodGet, Pattern: "/users/:username", HandlerFunc: h.GetUsername},
+		{Name: "AdminUpdateUser", Method: http.MethodPatch, Pattern: "/users/:id", HandlerFunc: h.AdminUpdateUser},
+		{Name: "AdminDeleteUser", Method: http.MethodDelete, Pattern: "/users/:id", HandlerFunc: h.AdminDeleteUser},
 		{Name: "ListUsers", Method: http.MethodGet, Pattern: "/users", HandlerFunc: h.ListUsers},
+		{Name: "ListLockouts", Method: http.MethodGet, Pattern: "/lockouts", HandlerFunc: h.ListLockouts},
+		{Name: "ClearLockout", Method: http.MethodDelete, Pattern: "/lockouts/:id", HandlerFunc: h.ClearLockout},
+		{Name: "RevokeUserSessions", Method: http.MethodDelete, Pattern: "/users/:id/sessions", HandlerFunc: h.RevokeUserSessions},
+		{Name: "ImpersonateUser", Method: http.MethodPost, Pattern: "/users/:id/impersonate", HandlerFunc: h.ImpersonateUser},
+		{Name: "ResetUserMFA", Method: http.MethodDelete, Pattern: "/users/:id/mfa", HandlerFunc: h.ResetUserMFA},
 	}
 }
+
+// sendMail sends msg in the background so that slow mail servers don't
+// hold up requests and response times don't leak whether an email was sent.
+func (h *Handler) sendMail(msg *mailer.Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := h.Mailer.Send(ctx, msg); err != nil {
+			log.Error().Err(err).Msgf("failed sending email '%s'", msg.Subject)
+		}
+	}()
+}
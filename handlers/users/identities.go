@@ -0,0 +1,148 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/rs/xid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const IdentitiesCollection = "identities"
+
+// Identity links a user to their account at an OAuth2 provider.
+// It is unique by provider and subject.
+type Identity struct {
+	Id          string     `json:"id" bson:"id"`
+	UserId      string     `json:"-" bson:"user_id"`
+	Provider    string     `json:"provider" bson:"provider"`
+	Subject     string     `json:"subject" bson:"subject"`
+	Email       string     `json:"email" bson:"email"`
+	CreatedAt   *time.Time `json:"created_at" bson:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at" bson:"last_login_at"`
+}
+
+func NewIdentity(userId string, provider string, info *OAuth2UserInfo) *Identity {
+	t := time.Now()
+	return &Identity{
+		Id:        xid.New().String(),
+		UserId:    userId,
+		Provider:  provider,
+		Subject:   info.Subject,
+		Email:     info.Email,
+		CreatedAt: &t,
+	}
+}
+
+// getIdentity returns the identity of info at provider, nil if it isn't linked to a user.
+func (h *Handler) getIdentity(ctx context.Context, provider string, info *OAuth2UserInfo) (*Identity, error) {
+	filter := bson.D{{"provider", provider}, {"subject", info.Subject}}
+	result, err := h.Mapper.Collection(IdentitiesCollection).FindOne(ctx, filter, &Identity{})
+	if err != nil {
+		if err == ErrNoDocuments {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed getting identity: %v", err)
+	}
+
+	return result.(*Identity), nil
+}
+
+// linkIdentity links info at provider to the user the state was issued for.
+func (h *Handler) linkIdentity(ctx context.Context, c echo.Context, state *oauth2State, provider string, info *OAuth2UserInfo) error {
+	identity, err := h.getIdentity(ctx, provider, info)
+	if err != nil {
+		return err
+	}
+
+	if identity != nil {
+		return oauth2Error(c, state, http.StatusConflict, "provider account already linked")
+	}
+
+	identity = NewIdentity(state.LinkUserId, provider, info)
+	_, err = h.Mapper.Collection(IdentitiesCollection).Insert(ctx, identity, nil)
+	if err != nil {
+		return fmt.Errorf("failed inserting identity: %v", err)
+	}
+
+	return oauth2Respond(c, state, http.StatusOK, identity, nil)
+}
+
+type ListIdentitiesResponse struct {
+	Identities []*Identity `json:"identities"`
+}
+
+func (h *Handler) ListIdentities(c echo.Context) error {
+	token := c.Get("token").(jwt.Token)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	filter := bson.D{{"user_id", token.Subject()}}
+	opts := options.Find().SetSort(bson.D{{"created_at", 1}})
+	result, err := h.Mapper.Collection(IdentitiesCollection).Find(ctx, filter, []*Identity{}, opts)
+	if err != nil {
+		return fmt.Errorf("failed getting identities: %v", err)
+	}
+
+	return h.Validate(c, http.StatusOK, ListIdentitiesResponse{Identities: result.([]*Identity)})
+}
+
+// LinkIdentity starts an OAuth2 log in that links the provider
+// account to the authenticated user instead of logging in.
+func (h *Handler) LinkIdentity(c echo.Context) error {
+	token := c.Get("token").(jwt.Token)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	provider, errResp := getOAuth2ProviderOrError(ctx, c)
+	if errResp != nil {
+		return errResp()
+	}
+
+	return oauth2Redirect(c, provider, token.Subject())
+}
+
+// DeleteIdentity unlinks a provider account. Users without a password
+// can't unlink their last one since they couldn't log in anymore.
+func (h *Handler) DeleteIdentity(c echo.Context) error {
+	token := c.Get("token").(jwt.Token)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	filter := bson.D{{"id", c.Param("id")}, {"user_id", token.Subject()}}
+	_, err := h.Mapper.Collection(IdentitiesCollection).FindOne(ctx, filter, &Identity{})
+	if err != nil {
+		if err == ErrNoDocuments {
+			return h.Validate(c, http.StatusNotFound, echo.Map{"message": "identity not found"})
+		}
+		return fmt.Errorf("failed getting identity: %v", err)
+	}
+
+	result, err := h.Mapper.FindOneById(ctx, token.Subject(), &User{})
+	if err != nil {
+		return fmt.Errorf("failed getting user: %v", err)
+	}
+
+	if result.(*User).Password == "" {
+		count, err := h.Mapper.Collection(IdentitiesCollection).Count(ctx, bson.D{{"user_id", token.Subject()}})
+		if err != nil {
+			return fmt.Errorf("failed counting identities: %v", err)
+		}
+
+		if count < 2 {
+			return h.Validate(c, http.StatusConflict, echo.Map{"message": "can't unlink the only way to log in"})
+		}
+	}
+
+	_, err = h.Mapper.Collection(IdentitiesCollection).Delete(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("failed deleting identity: %v", err)
+	}
+
+	return h.Validate(c, http.StatusNoContent, nil)
+}
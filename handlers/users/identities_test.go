@@ -0,0 +1,462 @@
+package users_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/alexferl/echo-boilerplate/handlers/users"
+	"github.com/alexferl/echo-boilerplate/util"
+)
+
+func TestHandler_ListIdentities_200(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	identity := users.NewIdentity(user.Id, "google", &users.OAuth2UserInfo{Subject: "1234", Email: user.Email})
+
+	req := httptest.NewRequest(http.MethodGet, "/user/identities", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.IdentitiesCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			[]*users.Identity{identity},
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	var result users.ListIdentitiesResponse
+	err = json.Unmarshal(resp.Body.Bytes(), &result)
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	if assert.Len(t, result.Identities, 1) {
+		assert.Equal(t, identity.Id, result.Identities[0].Id)
+		assert.Equal(t, "google", result.Identities[0].Provider)
+	}
+}
+
+func TestHandler_DeleteIdentity_204(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	err := user.SetPassword("abcdefghijkl")
+	assert.NoError(t, err)
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	identity := users.NewIdentity(user.Id, "google", &users.OAuth2UserInfo{Subject: "1234", Email: user.Email})
+
+	req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/user/identities/%s", identity.Id), nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.IdentitiesCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			identity,
+			nil,
+		).
+		On(
+			"FindOneById",
+			mock.Anything,
+			user.Id,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"Delete",
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			int64(1),
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+}
+
+func TestHandler_DeleteIdentity_404(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodDelete, "/user/identities/id", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.IdentitiesCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			users.ErrNoDocuments,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
+
+func TestHandler_DeleteIdentity_409(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	identity := users.NewIdentity(user.Id, "google", &users.OAuth2UserInfo{Subject: "1234", Email: user.Email})
+
+	req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/user/identities/%s", identity.Id), nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.IdentitiesCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			identity,
+			nil,
+		).
+		On(
+			"FindOneById",
+			mock.Anything,
+			user.Id,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"Count",
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			int64(1),
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Contains(t, resp.Body.String(), "can't unlink the only way to log in")
+}
+
+func TestHandler_LinkIdentity(t *testing.T) {
+	testCases := []struct {
+		name     string
+		existing bool
+		code     int
+	}{
+		{"linked", false, http.StatusOK},
+		{"already linked", true, http.StatusConflict},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mapper, s := getMapperAndServer(t)
+
+			p := newFakeProvider(t)
+			setOAuth2Providers(t, map[string]any{"name": "fake", "issuer": p.URL, "client-id": "client"})
+
+			user := users.NewUser("test@example.com", "test")
+			access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+			assert.NoError(t, err)
+
+			link := httptest.NewRequest(http.MethodGet, "/user/identities/fake/link", nil)
+			link.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+			req := oauth2Follow(t, s, link, "fake", p)
+			resp := httptest.NewRecorder()
+
+			mapper.Mock.
+				On(
+					"Collection",
+					users.IdentitiesCollection,
+				).
+				Return(
+					mapper,
+				)
+
+			if tc.existing {
+				mapper.Mock.
+					On(
+						"FindOne",
+						mock.Anything,
+						mock.Anything,
+						mock.Anything,
+					).
+					Return(
+						users.NewIdentity("other", "fake", &users.OAuth2UserInfo{Subject: "1234"}),
+						nil,
+					)
+			} else {
+				mapper.Mock.
+					On(
+						"FindOne",
+						mock.Anything,
+						mock.Anything,
+						mock.Anything,
+					).
+					Return(
+						nil,
+						users.ErrNoDocuments,
+					).
+					On(
+						"Insert",
+						mock.Anything,
+						mock.MatchedBy(func(i *users.Identity) bool {
+							return i.UserId == user.Id && i.Provider == "fake" && i.Subject == "1234"
+						}),
+						mock.Anything,
+					).
+					Return(
+						nil,
+						nil,
+					)
+			}
+
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, tc.code, resp.Code)
+		})
+	}
+}
+
+func TestHandler_OAuth2Onboarding_200(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	claims := map[string]any{"provider": "fake", "email": "test@example.com", "email_verified": true, "name": "Test User"}
+	token, err := util.GenerateOAuth2OnboardingToken("1234", claims)
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(&users.OAuth2OnboardingRequest{OnboardingToken: string(token), Username: "test"})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/oauth2/onboarding", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.IdentitiesCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			users.ErrNoDocuments,
+		).
+		On(
+			"Insert",
+			mock.Anything,
+			mock.MatchedBy(func(u *users.User) bool {
+				return u.Email == "test@example.com" && u.Username == "test" && u.Name == "Test User" && u.EmailVerified
+			}),
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		).
+		On(
+			"Insert",
+			mock.Anything,
+			mock.MatchedBy(func(i *users.Identity) bool {
+				return i.Provider == "fake" && i.Subject == "1234"
+			}),
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		).
+		On(
+			"Collection",
+			users.SessionsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Insert",
+			mock.Anything,
+			mock.AnythingOfType("*users.Session"),
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		).
+		On(
+			"Update",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), "access_token")
+}
+
+func TestHandler_OAuth2Onboarding_401(t *testing.T) {
+	state, err := util.GenerateOAuth2StateToken("fake", map[string]any{})
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name  string
+		token string
+	}{
+		{"invalid token", "invalid"},
+		{"wrong token type", string(state)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, s := getMapperAndServer(t)
+
+			b, err := json.Marshal(&users.OAuth2OnboardingRequest{OnboardingToken: tc.token, Username: "test"})
+			assert.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/oauth2/onboarding", bytes.NewBuffer(b))
+			req.Header.Set("Content-Type", "application/json")
+			resp := httptest.NewRecorder()
+
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, http.StatusUnauthorized, resp.Code)
+			assert.Contains(t, resp.Body.String(), "invalid onboarding token")
+		})
+	}
+}
+
+func TestHandler_OAuth2Onboarding_409(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	token, err := util.GenerateOAuth2OnboardingToken("1234", map[string]any{"provider": "fake", "email": "test@example.com"})
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(&users.OAuth2OnboardingRequest{OnboardingToken: string(token), Username: "taken"})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/oauth2/onboarding", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.IdentitiesCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.AnythingOfType("*users.Identity"),
+		).
+		Return(
+			nil,
+			users.ErrNoDocuments,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.AnythingOfType("*users.User"),
+		).
+		Return(
+			users.NewUser("other@example.com", "taken"),
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Contains(t, resp.Body.String(), "email or username already in-use")
+}
@@ -0,0 +1,58 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/spf13/viper"
+
+	"github.com/alexferl/echo-boilerplate/config"
+)
+
+type ImpersonateUserResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+	TokenType   string `json:"token_type"`
+}
+
+// ImpersonateUser gives an admin an access token to act as a user. The token
+// names the admin in its act claim, it can't be refreshed and is denied the
+// routes that could outlive it or take over the account.
+func (h *Handler) ImpersonateUser(c echo.Context) error {
+	token := c.Get("token").(jwt.Token)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	user, errResp, err := h.getManagedUser(ctx, c, token.Subject())
+	if err != nil {
+		return err
+	} else if errResp != nil {
+		return errResp()
+	}
+
+	if user.Suspended {
+		return h.Validate(c, http.StatusForbidden, echo.Map{"message": "user suspended"})
+	}
+
+	access, err := user.Impersonate(token.Subject())
+	if err != nil {
+		return fmt.Errorf("failed generating impersonation token: %v", err)
+	}
+
+	event := NewAuditEvent(c, AuditImpersonationStarted, user.Id, map[string]any{"admin_id": token.Subject()})
+	if err = h.recordEvent(ctx, event); err != nil {
+		return err
+	}
+
+	resp := &ImpersonateUserResponse{
+		AccessToken: string(access),
+		ExpiresIn:   int64(viper.GetDuration(config.ImpersonationTokenExpiry).Seconds()),
+		TokenType:   "Bearer",
+	}
+
+	return h.Validate(c, http.StatusOK, resp)
+}
@@ -0,0 +1,135 @@
+package users_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/alexferl/echo-boilerplate/handlers/users"
+	"github.com/alexferl/echo-boilerplate/util"
+)
+
+func TestHandler_ImpersonateUser_200(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	admin := users.NewAdminUser("admin@example.com", "admin")
+	access, _, err := admin.Login(users.NewSession(admin.Id, "", ""))
+	assert.NoError(t, err)
+
+	user := users.NewUser("test@example.com", "test")
+
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/users/%s/impersonate", user.Id), nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			user.Id,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"Collection",
+			users.AuditEventsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Insert",
+			mock.Anything,
+			mock.MatchedBy(func(e *users.AuditEvent) bool {
+				return e.Type == users.AuditImpersonationStarted && e.UserId == user.Id && e.Data["admin_id"] == admin.Id
+			}),
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	var result users.ImpersonateUserResponse
+	err = json.Unmarshal(resp.Body.Bytes(), &result)
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	token, err := util.ParseToken([]byte(result.AccessToken))
+	assert.NoError(t, err)
+	assert.Equal(t, user.Id, token.Subject())
+	assert.Equal(t, admin.Id, util.GetActor(token))
+	assert.False(t, util.HasRole(token, users.AdminRole.String()))
+}
+
+func TestHandler_ImpersonateUser_403(t *testing.T) {
+	_, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/users/id/impersonate", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+}
+
+func TestHandler_Impersonation_Denied(t *testing.T) {
+	admin := users.NewAdminUser("admin@example.com", "admin")
+	// impersonating an admin mustn't allow impersonating further either
+	target := users.NewAdminUser("other@example.com", "other")
+	access, err := target.Impersonate(admin.Id)
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name   string
+		method string
+		target string
+		body   string
+	}{
+		{"create personal access token", http.MethodPost, "/user/personal_access_tokens", `{"name":"ci","expires_at":"2100-01-01T00:00:00Z"}`},
+		{"change password", http.MethodPut, "/user/password", `{"current_password":"abcdefghijkl","new_password":"abcdefghijklm"}`},
+		{"impersonate", http.MethodPost, "/users/id/impersonate", ""},
+		{"change email", http.MethodPatch, "/user", `{"email":"attacker@example.com"}`},
+		{"delete account", http.MethodDelete, "/user", `{"password":"abcdefghijkl"}`},
+		{"enroll totp", http.MethodPost, "/user/mfa/totp", ""},
+		{"confirm totp", http.MethodPost, "/user/mfa/totp/confirm", `{"code":"123456"}`},
+		{"disable totp", http.MethodDelete, "/user/mfa/totp", `{"code":"123456"}`},
+		{"revoke other sessions", http.MethodDelete, "/user/sessions", ""},
+		{"revoke session", http.MethodDelete, "/user/sessions/id", ""},
+		{"link identity", http.MethodGet, "/user/identities/google/link", ""},
+		{"unlink identity", http.MethodDelete, "/user/identities/id", ""},
+		{"rotate personal access token", http.MethodPost, "/user/personal_access_tokens/id/rotate", "{}"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, s := getMapperAndServer(t)
+
+			req := httptest.NewRequest(tc.method, tc.target, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+			resp := httptest.NewRecorder()
+
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, http.StatusForbidden, resp.Code)
+			assert.Contains(t, resp.Body.String(), "Not allowed while impersonating")
+		})
+	}
+}
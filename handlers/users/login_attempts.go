@@ -0,0 +1,268 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/alexferl/echo-boilerplate/config"
+)
+
+const LoginAttemptsCollection = "login_attempts"
+
+const (
+	LoginAttemptAccount = "account"
+	LoginAttemptIP      = "ip"
+)
+
+// LoginAttempt counts the failed logins of an account or a client IP.
+// It expires once FailureWindow passes without a new failure.
+type LoginAttempt struct {
+	Id            string     `json:"id" bson:"id"`
+	Type          string     `json:"type" bson:"type"`
+	Key           string     `json:"key" bson:"key"`
+	Failures      int        `json:"failures" bson:"failures"`
+	LastFailureAt *time.Time `json:"last_failure_at" bson:"last_failure_at"`
+	RetryAt       *time.Time `json:"retry_at" bson:"retry_at"`
+	LockedUntil   *time.Time `json:"locked_until" bson:"locked_until"`
+	ExpiresAt     *time.Time `json:"-" bson:"expires_at"`
+}
+
+func NewLoginAttempt(typ string, key string) *LoginAttempt {
+	return &LoginAttempt{
+		Id:   xid.New().String(),
+		Type: typ,
+		Key:  key,
+	}
+}
+
+// RetryAfter returns how long to wait before trying again, zero if a login can be attempted now.
+func (a *LoginAttempt) RetryAfter(now time.Time) time.Duration {
+	var d time.Duration
+	for _, t := range []*time.Time{a.RetryAt, a.LockedUntil} {
+		if t != nil && t.Sub(now) > d {
+			d = t.Sub(now)
+		}
+	}
+
+	return d
+}
+
+// Fail counts a failed login.
+func (a *LoginAttempt) Fail() {
+	now := time.Now()
+	a.Failures++
+	a.LastFailureAt = &now
+
+	expiresAt := now.Add(viper.GetDuration(config.LoginFailureWindow))
+	a.ExpiresAt = &expiresAt
+
+	a.penalize(now)
+}
+
+// penalize sets when a login can be attempted again after Failures. Accounts
+// wait longer after each failure, the delay doubling each time, so that
+// guessing one password gets slow. Client IPs don't, to not slow down every
+// user behind the same proxy, and only get locked out when they reach their
+// maximum number of failures, like accounts do.
+func (a *LoginAttempt) penalize(now time.Time) {
+	var retryAt time.Time
+	if a.Failures >= a.maxFailures() {
+		lockedUntil := now.Add(viper.GetDuration(config.LoginLockoutDuration))
+		a.LockedUntil = &lockedUntil
+		retryAt = lockedUntil
+	} else if a.Type == LoginAttemptAccount {
+		retryAt = now.Add(loginBackoff(a.Failures))
+	} else {
+		return
+	}
+	a.RetryAt = &retryAt
+
+	if a.ExpiresAt == nil || retryAt.After(*a.ExpiresAt) {
+		a.ExpiresAt = &retryAt
+	}
+}
+
+func (a *LoginAttempt) maxFailures() int {
+	if a.Type == LoginAttemptIP {
+		return viper.GetInt(config.LoginIPMaxFailures)
+	}
+	return viper.GetInt(config.LoginMaxFailures)
+}
+
+func (a *LoginAttempt) Reset() {
+	a.Failures = 0
+	a.RetryAt = nil
+	a.LockedUntil = nil
+}
+
+func loginBackoff(failures int) time.Duration {
+	base := viper.GetDuration(config.LoginBackoffBase)
+	max := viper.GetDuration(config.LoginBackoffMax)
+
+	d := base
+	for i := 1; i < failures && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+
+	return d
+}
+
+// getLoginAttempts returns the counters for the account email and the client IP.
+// If either has to wait, a 429 with a Retry-After header is returned instead.
+func (h *Handler) getLoginAttempts(ctx context.Context, c echo.Context, email string) ([]*LoginAttempt, func() error) {
+	attempts := []*LoginAttempt{
+		NewLoginAttempt(LoginAttemptAccount, strings.ToLower(email)),
+		NewLoginAttempt(LoginAttemptIP, c.RealIP()),
+	}
+
+	filter := bson.D{{"$or", bson.A{
+		bson.D{{"type", attempts[0].Type}, {"key", attempts[0].Key}},
+		bson.D{{"type", attempts[1].Type}, {"key", attempts[1].Key}},
+	}}}
+	result, err := h.Mapper.Collection(LoginAttemptsCollection).Find(ctx, filter, []*LoginAttempt{})
+	if err != nil {
+		return nil, wrap(fmt.Errorf("failed getting login attempts: %v", err))
+	}
+
+	now := time.Now()
+	var retryAfter time.Duration
+	for _, found := range result.([]*LoginAttempt) {
+		for i, a := range attempts {
+			if a.Type == found.Type && a.Key == found.Key {
+				attempts[i] = found
+			}
+		}
+		if d := found.RetryAfter(now); d > retryAfter {
+			retryAfter = d
+		}
+	}
+
+	if retryAfter > 0 {
+		c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		return nil, wrap(h.Validate(c, http.StatusTooManyRequests, echo.Map{"message": "too many failed login attempts"}))
+	}
+
+	return attempts, nil
+}
+
+// loginFailed counts a failed login against every attempt. The counters are
+// incremented in the database, so that concurrent logins can't overwrite
+// each other's failures.
+func (h *Handler) loginFailed(ctx context.Context, attempts []*LoginAttempt) error {
+	for _, a := range attempts {
+		now := time.Now()
+		filter := bson.D{{"type", a.Type}, {"key", a.Key}}
+		update := bson.D{
+			{"$inc", bson.D{{"failures", 1}}},
+			{"$set", bson.D{{"last_failure_at", now}}},
+			{"$max", bson.D{{"expires_at", now.Add(viper.GetDuration(config.LoginFailureWindow))}}},
+			{"$setOnInsert", bson.D{{"id", a.Id}, {"type", a.Type}, {"key", a.Key}}},
+		}
+		opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+		result, err := h.Mapper.Collection(LoginAttemptsCollection).FindOneAndUpdate(ctx, filter, update, &LoginAttempt{}, opts)
+		if err != nil {
+			return fmt.Errorf("failed updating login attempt: %v", err)
+		}
+
+		attempt, ok := result.(*LoginAttempt)
+		if !ok || attempt.Failures < 1 {
+			return fmt.Errorf("failed updating login attempt: unexpected result %v", result)
+		}
+
+		attempt.penalize(now)
+		if attempt.RetryAt == nil {
+			continue
+		}
+
+		if attempt.Failures == attempt.maxFailures() {
+			log.Warn().Str("type", attempt.Type).Str("key", attempt.Key).Msg("login locked out")
+		}
+
+		// $max keeps the longest delay when concurrent failures race
+		penalty := bson.D{{"retry_at", attempt.RetryAt}, {"expires_at", attempt.ExpiresAt}}
+		if attempt.LockedUntil != nil {
+			penalty = append(penalty, bson.E{Key: "locked_until", Value: attempt.LockedUntil})
+		}
+		_, err = h.Mapper.Collection(LoginAttemptsCollection).Update(ctx, filter, bson.D{{"$max", penalty}}, nil)
+		if err != nil {
+			return fmt.Errorf("failed updating login attempt: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// loginSucceeded clears the account counter, the IP counter is kept so
+// a valid account can't be used to keep guessing others.
+func (h *Handler) loginSucceeded(ctx context.Context, attempts []*LoginAttempt) error {
+	for _, a := range attempts {
+		if a.Type == LoginAttemptAccount && a.Failures > 0 {
+			filter := bson.D{{"type", a.Type}, {"key", a.Key}}
+			update := bson.D{{"$set", bson.D{{"failures", 0}, {"retry_at", nil}, {"locked_until", nil}}}}
+			_, err := h.Mapper.Collection(LoginAttemptsCollection).Update(ctx, filter, update, nil)
+			if err != nil {
+				return fmt.Errorf("failed resetting login attempt: %v", err)
+			}
+			a.Reset()
+		}
+	}
+
+	return nil
+}
+
+type ListLockoutsResponse struct {
+	Lockouts []*LoginAttempt `json:"lockouts"`
+}
+
+// ListLockouts returns the accounts and client IPs currently locked out.
+func (h *Handler) ListLockouts(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	filter := bson.D{{"locked_until", bson.D{{"$gt", time.Now()}}}}
+	opts := options.Find().SetSort(bson.D{{"locked_until", -1}})
+	result, err := h.Mapper.Collection(LoginAttemptsCollection).Find(ctx, filter, []*LoginAttempt{}, opts)
+	if err != nil {
+		return fmt.Errorf("failed getting lockouts: %v", err)
+	}
+
+	return h.Validate(c, http.StatusOK, ListLockoutsResponse{Lockouts: result.([]*LoginAttempt)})
+}
+
+// ClearLockout lets an account or client IP log in again right away.
+func (h *Handler) ClearLockout(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	filter := bson.D{{"id", c.Param("id")}}
+	result, err := h.Mapper.Collection(LoginAttemptsCollection).FindOne(ctx, filter, &LoginAttempt{})
+	if err != nil {
+		if err == ErrNoDocuments {
+			return h.Validate(c, http.StatusNotFound, echo.Map{"message": "lockout not found"})
+		}
+		return fmt.Errorf("failed getting lockout: %v", err)
+	}
+
+	attempt := result.(*LoginAttempt)
+	attempt.Reset()
+
+	_, err = h.Mapper.Collection(LoginAttemptsCollection).UpdateById(ctx, attempt.Id, attempt, nil)
+	if err != nil {
+		return fmt.Errorf("failed updating lockout: %v", err)
+	}
+
+	return h.Validate(c, http.StatusNoContent, nil)
+}
@@ -0,0 +1,480 @@
+package users_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/alexferl/echo-boilerplate/config"
+	"github.com/alexferl/echo-boilerplate/handlers/users"
+)
+
+func TestHandler_AuthLogin_429(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	attempt := users.NewLoginAttempt(users.LoginAttemptAccount, "test@example.com")
+	for i := 0; i < viper.GetInt(config.LoginMaxFailures); i++ {
+		attempt.Fail()
+	}
+
+	b, err := json.Marshal(&users.AuthLogInRequest{Email: "Test@example.com", Password: "abcdefghijkl"})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/login", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.LoginAttemptsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			[]*users.LoginAttempt{attempt},
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.Contains(t, resp.Body.String(), "too many failed login attempts")
+	retryAfter, err := strconv.Atoi(resp.Header().Get("Retry-After"))
+	assert.NoError(t, err)
+	assert.InDelta(t, viper.GetDuration(config.LoginLockoutDuration).Seconds(), retryAfter, 1)
+}
+
+func TestHandler_AuthLogin_200_Resets_Account(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	pwd := "abcdefghijkl"
+	user := users.NewUser("test@example.com", "test")
+	err := user.SetPassword(pwd)
+	assert.NoError(t, err)
+
+	attempt := users.NewLoginAttempt(users.LoginAttemptAccount, user.Email)
+	attempt.Fail()
+	attempt.RetryAt = nil
+
+	b, err := json.Marshal(&users.AuthLogInRequest{Email: user.Email, Password: pwd})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/login", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.LoginAttemptsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			[]*users.LoginAttempt{attempt},
+			nil,
+		).
+		On(
+			"Update",
+			mock.Anything,
+			bson.D{{"type", users.LoginAttemptAccount}, {"key", user.Email}},
+			bson.D{{"$set", bson.D{{"failures", 0}, {"retry_at", nil}, {"locked_until", nil}}}},
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"Collection",
+			users.SessionsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Insert",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		).
+		On(
+			"Update",
+			mock.Anything,
+			bson.D{{"id", user.Id}},
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, 0, attempt.Failures)
+}
+
+func TestHandler_AuthLogin_401_CountsFailures(t *testing.T) {
+	testCases := []struct {
+		name       string
+		ipFailures int
+		ipLocked   bool
+	}{
+		{"ip below max", 1, false},
+		{"ip at max", 0, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mapper, s := getMapperAndServer(t)
+
+			ipFailures := tc.ipFailures
+			if tc.ipLocked {
+				ipFailures = viper.GetInt(config.LoginIPMaxFailures)
+			}
+
+			b, err := json.Marshal(&users.AuthLogInRequest{Email: "test@example.com", Password: "abcdefghijkl"})
+			assert.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/auth/login", bytes.NewBuffer(b))
+			req.Header.Set("Content-Type", "application/json")
+			req.RemoteAddr = "192.0.2.1:1234"
+			resp := httptest.NewRecorder()
+
+			accountFilter := bson.D{{"type", users.LoginAttemptAccount}, {"key", "test@example.com"}}
+			ipFilter := bson.D{{"type", users.LoginAttemptIP}, {"key", "192.0.2.1"}}
+			inc := mock.MatchedBy(func(update bson.D) bool {
+				return len(update) > 0 && update[0].Key == "$inc"
+			})
+			penalty := func(locked bool) any {
+				return mock.MatchedBy(func(update bson.D) bool {
+					if len(update) != 1 || update[0].Key != "$max" {
+						return false
+					}
+					fields := map[string]bool{}
+					for _, e := range update[0].Value.(bson.D) {
+						fields[e.Key] = true
+					}
+					return fields["retry_at"] && fields["locked_until"] == locked
+				})
+			}
+
+			mapper.Mock.
+				On(
+					"Collection",
+					users.LoginAttemptsCollection,
+				).
+				Return(
+					mapper,
+				).
+				On(
+					"Find",
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					[]*users.LoginAttempt{},
+					nil,
+				).
+				On(
+					"FindOneAndUpdate",
+					mock.Anything,
+					accountFilter,
+					inc,
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					&users.LoginAttempt{Type: users.LoginAttemptAccount, Key: "test@example.com", Failures: 2},
+					nil,
+				).
+				On(
+					"FindOneAndUpdate",
+					mock.Anything,
+					ipFilter,
+					inc,
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					&users.LoginAttempt{Type: users.LoginAttemptIP, Key: "192.0.2.1", Failures: ipFailures},
+					nil,
+				).
+				On(
+					"Update",
+					mock.Anything,
+					accountFilter,
+					penalty(false),
+					mock.Anything,
+				).
+				Return(
+					nil,
+					nil,
+				).
+				On(
+					"FindOne",
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					nil,
+					users.ErrNoDocuments,
+				)
+
+			// the IP has no backoff, it's only updated again to be locked out
+			if tc.ipLocked {
+				mapper.Mock.
+					On(
+						"Update",
+						mock.Anything,
+						ipFilter,
+						penalty(true),
+						mock.Anything,
+					).
+					Return(
+						nil,
+						nil,
+					)
+			}
+
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, http.StatusUnauthorized, resp.Code)
+			mapper.AssertNumberOfCalls(t, "FindOneAndUpdate", 2)
+		})
+	}
+}
+
+func TestHandler_ListLockouts_200(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	admin := users.NewAdminUser("admin@example.com", "admin")
+	access, _, err := admin.Login(users.NewSession(admin.Id, "", ""))
+	assert.NoError(t, err)
+
+	attempt := users.NewLoginAttempt(users.LoginAttemptIP, "192.0.2.1")
+	attempt.Fail()
+
+	req := httptest.NewRequest(http.MethodGet, "/lockouts", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.LoginAttemptsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			[]*users.LoginAttempt{attempt},
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	var result users.ListLockoutsResponse
+	err = json.Unmarshal(resp.Body.Bytes(), &result)
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	if assert.Len(t, result.Lockouts, 1) {
+		assert.Equal(t, attempt.Id, result.Lockouts[0].Id)
+		assert.Equal(t, "192.0.2.1", result.Lockouts[0].Key)
+	}
+}
+
+func TestHandler_ListLockouts_403(t *testing.T) {
+	_, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/lockouts", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+}
+
+func TestHandler_ClearLockout_204(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	admin := users.NewAdminUser("admin@example.com", "admin")
+	access, _, err := admin.Login(users.NewSession(admin.Id, "", ""))
+	assert.NoError(t, err)
+
+	attempt := users.NewLoginAttempt(users.LoginAttemptAccount, "test@example.com")
+	attempt.Fail()
+
+	req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/lockouts/%s", attempt.Id), nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.LoginAttemptsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			attempt,
+			nil,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			attempt.Id,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Nil(t, attempt.LockedUntil)
+	assert.Equal(t, time.Duration(0), attempt.RetryAfter(time.Now()))
+}
+
+func TestHandler_ClearLockout_404(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	admin := users.NewAdminUser("admin@example.com", "admin")
+	access, _, err := admin.Login(users.NewSession(admin.Id, "", ""))
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodDelete, "/lockouts/id", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.LoginAttemptsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			users.ErrNoDocuments,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
+
+func TestLoginAttempt_Fail(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	base := viper.GetDuration(config.LoginBackoffBase)
+	max := viper.GetDuration(config.LoginBackoffMax)
+	maxFailures := viper.GetInt(config.LoginMaxFailures)
+
+	attempt := users.NewLoginAttempt(users.LoginAttemptAccount, "test@example.com")
+	assert.Equal(t, time.Duration(0), attempt.RetryAfter(time.Now()))
+
+	attempt.Fail()
+	assert.InDelta(t, base.Seconds(), attempt.RetryAfter(time.Now()).Seconds(), 0.1)
+
+	attempt.Fail()
+	assert.InDelta(t, (2 * base).Seconds(), attempt.RetryAfter(time.Now()).Seconds(), 0.1)
+
+	for attempt.Failures < maxFailures-1 {
+		attempt.Fail()
+	}
+	assert.Nil(t, attempt.LockedUntil)
+	assert.LessOrEqual(t, attempt.RetryAfter(time.Now()), max)
+
+	attempt.Fail()
+	assert.NotNil(t, attempt.LockedUntil)
+	assert.InDelta(t, viper.GetDuration(config.LoginLockoutDuration).Seconds(), attempt.RetryAfter(time.Now()).Seconds(), 0.1)
+
+	attempt.Reset()
+	assert.Equal(t, 0, attempt.Failures)
+	assert.Equal(t, time.Duration(0), attempt.RetryAfter(time.Now()))
+
+	ip := users.NewLoginAttempt(users.LoginAttemptIP, "192.0.2.1")
+	for ip.Failures < viper.GetInt(config.LoginIPMaxFailures)-1 {
+		ip.Fail()
+	}
+	assert.Equal(t, time.Duration(0), ip.RetryAfter(time.Now()))
+
+	ip.Fail()
+	assert.NotNil(t, ip.LockedUntil)
+	assert.InDelta(t, viper.GetDuration(config.LoginLockoutDuration).Seconds(), ip.RetryAfter(time.Now()).Seconds(), 0.1)
+}
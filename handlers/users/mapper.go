@@ -13,7 +13,10 @@ import (
 	"github.com/alexferl/echo-boilerplate/data"
 )
 
-var ErrNoDocuments = errors.New("no documents in result")
+var (
+	ErrNoDocuments  = errors.New("no documents in result")
+	ErrDuplicateKey = errors.New("duplicate key")
+)
 
 type Mapper struct {
 	db         *mongo.Client
@@ -34,6 +37,10 @@ func (m *Mapper) Collection(name string) data.Mapper {
 
 func (m *Mapper) Insert(ctx context.Context, document any, result any, opts ...*options.InsertOneOptions) (any, error) {
 	_, err := m.collection.InsertOne(ctx, document, opts...)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, ErrDuplicateKey
+	}
+
 	return nil, err
 }
 
@@ -112,7 +119,9 @@ func (m *Mapper) Count(ctx context.Context, filter any, opts ...*options.CountOp
 
 func (m *Mapper) Update(ctx context.Context, filter any, update any, result any, opts ...*options.UpdateOptions) (any, error) {
 	res, err := m.collection.UpdateOne(ctx, filter, update, opts...)
-	if err != nil {
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, ErrDuplicateKey
+	} else if err != nil {
 		return nil, err
 	}
 
@@ -126,10 +135,36 @@ func (m *Mapper) UpdateById(ctx context.Context, id string, document any, result
 	return m.Update(ctx, filter, update, result, opts...)
 }
 
+func (m *Mapper) UpdateMany(ctx context.Context, filter any, update any, opts ...*options.UpdateOptions) (int64, error) {
+	res, err := m.collection.UpdateMany(ctx, filter, update, opts...)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.ModifiedCount, nil
+}
+
+func (m *Mapper) Delete(ctx context.Context, filter any, opts ...*options.DeleteOptions) (int64, error) {
+	res, err := m.collection.DeleteMany(ctx, filter, opts...)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.DeletedCount, nil
+}
+
 func (m *Mapper) Upsert(ctx context.Context, filter any, update any, result any, opts ...*options.FindOneAndUpdateOptions) (any, error) {
 	opts = append(opts, options.FindOneAndUpdate().SetReturnDocument(options.After))
-	res := m.collection.FindOneAndUpdate(ctx, filter, bson.D{{"$set", update}}, opts...)
-	if res.Err() != nil {
+	return m.FindOneAndUpdate(ctx, filter, bson.D{{"$set", update}}, result, opts...)
+}
+
+func (m *Mapper) FindOneAndUpdate(ctx context.Context, filter any, update any, result any, opts ...*options.FindOneAndUpdateOptions) (any, error) {
+	res := m.collection.FindOneAndUpdate(ctx, filter, update, opts...)
+	if mongo.IsDuplicateKeyError(res.Err()) {
+		return nil, ErrDuplicateKey
+	} else if res.Err() == mongo.ErrNoDocuments {
+		return nil, ErrNoDocuments
+	} else if res.Err() != nil {
 		return nil, res.Err()
 	}
 
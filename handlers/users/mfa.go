@@ -0,0 +1,318 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/spf13/viper"
+
+	"github.com/alexferl/echo-boilerplate/config"
+	"github.com/alexferl/echo-boilerplate/util"
+)
+
+const recoveryCodesCount = 10
+
+var (
+	ErrMFAAlreadyEnabled = errors.New("mfa already enabled")
+	ErrMFANotEnrolled    = errors.New("mfa enrollment not started")
+	ErrMFANotEnabled     = errors.New("mfa not enabled")
+	ErrMFAInvalidCode    = errors.New("invalid code")
+)
+
+// EnrollTOTP generates a new TOTP secret and returns it along with its
+// provisioning URI. MFA is only enabled once ConfirmTOTP succeeds.
+func (u *User) EnrollTOTP() (string, string, error) {
+	if u.MFAEnabled {
+		return "", "", ErrMFAAlreadyEnabled
+	}
+
+	secret, err := util.GenerateTOTPSecret()
+	if err != nil {
+		return "", "", err
+	}
+
+	u.TOTPSecret = secret
+	u.TOTPLastCounter = 0
+
+	return secret, util.TOTPURI(viper.GetString(config.MFAIssuer), u.Email, secret), nil
+}
+
+// ConfirmTOTP enables MFA if code is valid for the enrolled secret and
+// returns the recovery codes. Only their hashes are stored, so they can't
+// be shown again.
+func (u *User) ConfirmTOTP(code string) ([]string, error) {
+	if u.MFAEnabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	if u.TOTPSecret == "" {
+		return nil, ErrMFANotEnrolled
+	}
+
+	if !u.validateTOTP(code) {
+		return nil, ErrMFAInvalidCode
+	}
+
+	codes, err := u.newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	t := time.Now()
+	u.MFAEnabled = true
+	u.MFAEnabledAt = &t
+
+	return codes, nil
+}
+
+// ValidateMFACode accepts a TOTP code or an unused recovery code.
+// Recovery codes are removed once used.
+func (u *User) ValidateMFACode(code string) error {
+	if !u.MFAEnabled {
+		return ErrMFANotEnabled
+	}
+
+	if u.validateTOTP(code) {
+		return nil
+	}
+
+	normalized := []byte(normalizeRecoveryCode(code))
+	for i, h := range u.RecoveryCodes {
+		if util.ValidToken(normalized, h) {
+			u.RecoveryCodes = append(u.RecoveryCodes[:i], u.RecoveryCodes[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrMFAInvalidCode
+}
+
+// ResetMFA disables MFA and removes the secret and recovery codes.
+func (u *User) ResetMFA() {
+	u.MFAEnabled = false
+	u.MFAEnabledAt = nil
+	u.TOTPSecret = ""
+	u.TOTPLastCounter = 0
+	u.RecoveryCodes = nil
+}
+
+// validateTOTP refuses codes from a time step that was already used so
+// that a code can't be replayed.
+func (u *User) validateTOTP(code string) bool {
+	counter, ok := util.ValidateTOTP(u.TOTPSecret, strings.TrimSpace(code), time.Now())
+	if !ok || counter <= u.TOTPLastCounter {
+		return false
+	}
+
+	u.TOTPLastCounter = counter
+
+	return true
+}
+
+func (u *User) newRecoveryCodes() ([]string, error) {
+	var codes []string
+	var hashes []string
+	for i := 0; i < recoveryCodesCount; i++ {
+		s, err := util.GenerateTOTPSecret()
+		if err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(fmt.Sprintf("%s-%s", s[:5], s[5:10]))
+		codes = append(codes, code)
+		hashes = append(hashes, util.HashToken([]byte(normalizeRecoveryCode(code))))
+	}
+
+	u.RecoveryCodes = hashes
+
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	return strings.ReplaceAll(code, "-", "")
+}
+
+type TOTPEnrollmentResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+func (h *Handler) EnrollTOTP(c echo.Context) error {
+	token := c.Get("token").(jwt.Token)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := h.Mapper.FindOneById(ctx, token.Subject(), &User{})
+	if err != nil {
+		return fmt.Errorf("failed getting user: %v", err)
+	}
+
+	user := result.(*User)
+	secret, uri, err := user.EnrollTOTP()
+	if err != nil {
+		if err == ErrMFAAlreadyEnabled {
+			return h.Validate(c, http.StatusConflict, echo.Map{"message": err.Error()})
+		}
+		return fmt.Errorf("failed generating totp secret: %v", err)
+	}
+
+	_, err = h.Mapper.UpdateById(ctx, user.Id, user, nil)
+	if err != nil {
+		return fmt.Errorf("failed updating user: %v", err)
+	}
+
+	return h.Validate(c, http.StatusOK, &TOTPEnrollmentResponse{Secret: secret, URI: uri})
+}
+
+type MFACodeRequest struct {
+	Code string `json:"code"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+func (h *Handler) ConfirmTOTP(c echo.Context) error {
+	body := &MFACodeRequest{}
+	if err := c.Bind(body); err != nil {
+		return err
+	}
+
+	token := c.Get("token").(jwt.Token)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := h.Mapper.FindOneById(ctx, token.Subject(), &User{})
+	if err != nil {
+		return fmt.Errorf("failed getting user: %v", err)
+	}
+
+	user := result.(*User)
+	attempts, errResp := h.getLoginAttempts(ctx, c, user.Email)
+	if errResp != nil {
+		return errResp()
+	}
+
+	codes, err := user.ConfirmTOTP(body.Code)
+	if err != nil {
+		switch err {
+		case ErrMFAAlreadyEnabled, ErrMFANotEnrolled:
+			return h.Validate(c, http.StatusConflict, echo.Map{"message": err.Error()})
+		case ErrMFAInvalidCode:
+			if err = h.loginFailed(ctx, attempts); err != nil {
+				return err
+			}
+			m := echo.Map{
+				"message": "Validation error",
+				"errors":  []string{ErrMFAInvalidCode.Error()},
+			}
+			return h.Validate(c, http.StatusUnprocessableEntity, m)
+		}
+		return fmt.Errorf("failed confirming totp: %v", err)
+	}
+
+	if err = h.loginSucceeded(ctx, attempts); err != nil {
+		return err
+	}
+
+	_, err = h.Mapper.UpdateById(ctx, user.Id, user, nil)
+	if err != nil {
+		return fmt.Errorf("failed updating user: %v", err)
+	}
+
+	return h.Validate(c, http.StatusOK, &RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+func (h *Handler) DisableTOTP(c echo.Context) error {
+	body := &MFACodeRequest{}
+	if err := c.Bind(body); err != nil {
+		return err
+	}
+
+	token := c.Get("token").(jwt.Token)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := h.Mapper.FindOneById(ctx, token.Subject(), &User{})
+	if err != nil {
+		return fmt.Errorf("failed getting user: %v", err)
+	}
+
+	user := result.(*User)
+	attempts, errResp := h.getLoginAttempts(ctx, c, user.Email)
+	if errResp != nil {
+		return errResp()
+	}
+
+	if err = user.ValidateMFACode(body.Code); err != nil {
+		if err == ErrMFANotEnabled {
+			return h.Validate(c, http.StatusConflict, echo.Map{"message": err.Error()})
+		}
+		if err = h.loginFailed(ctx, attempts); err != nil {
+			return err
+		}
+		m := echo.Map{
+			"message": "Validation error",
+			"errors":  []string{ErrMFAInvalidCode.Error()},
+		}
+		return h.Validate(c, http.StatusUnprocessableEntity, m)
+	}
+
+	if err = h.loginSucceeded(ctx, attempts); err != nil {
+		return err
+	}
+
+	user.ResetMFA()
+	user.Update(user.Id)
+
+	_, err = h.Mapper.UpdateById(ctx, user.Id, user, nil)
+	if err != nil {
+		return fmt.Errorf("failed updating user: %v", err)
+	}
+
+	return h.Validate(c, http.StatusNoContent, nil)
+}
+
+// ResetUserMFA lets admins disable MFA for users who lost both their
+// authenticator and their recovery codes. The sessions of the user are
+// revoked since whoever holds them may not be the user.
+func (h *Handler) ResetUserMFA(c echo.Context) error {
+	token := c.Get("token").(jwt.Token)
+	adminId := token.Subject()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	user, errResp, err := h.getManagedUser(ctx, c, adminId)
+	if err != nil {
+		return err
+	} else if errResp != nil {
+		return errResp()
+	}
+
+	user.ResetMFA()
+	user.RevokeTokens()
+	user.Update(adminId)
+
+	_, err = h.Mapper.UpdateById(ctx, user.Id, user, nil)
+	if err != nil {
+		return fmt.Errorf("failed updating user: %v", err)
+	}
+
+	if err = h.revokeSessions(ctx, user.Id, ""); err != nil {
+		return err
+	}
+
+	event := NewAuditEvent(c, AuditMFAReset, user.Id, map[string]any{"admin_id": adminId})
+	if err = h.recordEvent(ctx, event); err != nil {
+		return err
+	}
+
+	return h.Validate(c, http.StatusNoContent, nil)
+}
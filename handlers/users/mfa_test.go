@@ -0,0 +1,669 @@
+package users_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/alexferl/echo-boilerplate/config"
+	"github.com/alexferl/echo-boilerplate/handlers/users"
+	"github.com/alexferl/echo-boilerplate/util"
+)
+
+// newMFAUser returns a user with MFA enabled and its recovery codes.
+func newMFAUser(t *testing.T) (*users.User, []string) {
+	c := config.New()
+	c.BindFlags()
+
+	user := users.NewUser("test@example.com", "test")
+	secret, _, err := user.EnrollTOTP()
+	assert.NoError(t, err)
+
+	codes, err := user.ConfirmTOTP(totpCode(t, secret, 0))
+	assert.NoError(t, err)
+
+	return user, codes
+}
+
+// totpCode returns the code of secret offset time steps from now.
+func totpCode(t *testing.T, secret string, offset int64) string {
+	code, err := util.TOTPCode(secret, util.TOTPCounter(time.Now())+offset)
+	assert.NoError(t, err)
+	return code
+}
+
+func TestHandler_EnrollTOTP_200(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/user/mfa/totp", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	var result users.TOTPEnrollmentResponse
+	err = json.Unmarshal(resp.Body.Bytes(), &result)
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, user.TOTPSecret, result.Secret)
+	assert.Contains(t, result.URI, "otpauth://totp/")
+	assert.False(t, user.MFAEnabled)
+}
+
+func TestHandler_EnrollTOTP_409(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user, _ := newMFAUser(t)
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/user/mfa/totp", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusConflict, resp.Code)
+}
+
+func TestHandler_ConfirmTOTP_200(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	secret, _, err := user.EnrollTOTP()
+	assert.NoError(t, err)
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(&users.MFACodeRequest{Code: totpCode(t, secret, 0)})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/user/mfa/totp/confirm", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"Collection",
+			users.LoginAttemptsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			[]*users.LoginAttempt{},
+			nil,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	var result users.RecoveryCodesResponse
+	err = json.Unmarshal(resp.Body.Bytes(), &result)
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.True(t, user.MFAEnabled)
+	assert.Len(t, result.RecoveryCodes, len(user.RecoveryCodes))
+	assert.NotContains(t, user.RecoveryCodes, result.RecoveryCodes[0])
+}
+
+func TestHandler_ConfirmTOTP_409_Not_Enrolled(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(&users.MFACodeRequest{Code: "123456"})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/user/mfa/totp/confirm", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"Collection",
+			users.LoginAttemptsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			[]*users.LoginAttempt{},
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusConflict, resp.Code)
+}
+
+func TestHandler_ConfirmTOTP_422(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	secret, _, err := user.EnrollTOTP()
+	assert.NoError(t, err)
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(&users.MFACodeRequest{Code: totpCode(t, secret, 5)})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/user/mfa/totp/confirm", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"Collection",
+			users.LoginAttemptsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			[]*users.LoginAttempt{},
+			nil,
+		).
+		On(
+			"FindOneAndUpdate",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			&users.LoginAttempt{Type: users.LoginAttemptAccount, Failures: 1},
+			nil,
+		).
+		On(
+			"Update",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+	assert.False(t, user.MFAEnabled)
+}
+
+func TestHandler_ConfirmTOTP_429(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	secret, _, err := user.EnrollTOTP()
+	assert.NoError(t, err)
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	attempt := users.NewLoginAttempt(users.LoginAttemptAccount, user.Email)
+	attempt.Fail()
+
+	b, err := json.Marshal(&users.MFACodeRequest{Code: totpCode(t, secret, 0)})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/user/mfa/totp/confirm", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"Collection",
+			users.LoginAttemptsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			[]*users.LoginAttempt{attempt},
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusTooManyRequests, resp.Code)
+	assert.NotEmpty(t, resp.Header().Get("Retry-After"))
+	assert.False(t, user.MFAEnabled)
+}
+
+func TestHandler_DisableTOTP_204(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user, codes := newMFAUser(t)
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(&users.MFACodeRequest{Code: codes[0]})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodDelete, "/user/mfa/totp", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"Collection",
+			users.LoginAttemptsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			[]*users.LoginAttempt{},
+			nil,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.False(t, user.MFAEnabled)
+	assert.Equal(t, "", user.TOTPSecret)
+	assert.Empty(t, user.RecoveryCodes)
+}
+
+func TestHandler_DisableTOTP_422(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user, _ := newMFAUser(t)
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(&users.MFACodeRequest{Code: "000000"})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodDelete, "/user/mfa/totp", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"Collection",
+			users.LoginAttemptsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			[]*users.LoginAttempt{},
+			nil,
+		).
+		On(
+			"FindOneAndUpdate",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			&users.LoginAttempt{Type: users.LoginAttemptAccount, Failures: 1},
+			nil,
+		).
+		On(
+			"Update",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+	assert.True(t, user.MFAEnabled)
+}
+
+func TestHandler_ResetUserMFA_204(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	admin := users.NewAdminUser("admin@example.com", "admin")
+	access, _, err := admin.Login(users.NewSession(admin.Id, "", ""))
+	assert.NoError(t, err)
+
+	user, _ := newMFAUser(t)
+
+	req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/users/%s/mfa", user.Id), nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			user.Id,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		).
+		On(
+			"Collection",
+			users.SessionsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"UpdateMany",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			int64(1),
+			nil,
+		).
+		On(
+			"Collection",
+			users.AuditEventsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Insert",
+			mock.Anything,
+			mock.MatchedBy(func(e *users.AuditEvent) bool {
+				return e.Type == users.AuditMFAReset && e.UserId == user.Id && e.Data["admin_id"] == admin.Id
+			}),
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.False(t, user.MFAEnabled)
+	assert.Equal(t, admin.Id, user.UpdatedBy)
+	assert.Equal(t, int64(1), user.TokenVersion)
+}
+
+func TestHandler_ResetUserMFA_403(t *testing.T) {
+	_, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodDelete, "/users/id/mfa", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+}
+
+func TestHandler_ResetUserMFA_404(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	admin := users.NewAdminUser("admin@example.com", "admin")
+	access, _, err := admin.Login(users.NewSession(admin.Id, "", ""))
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodDelete, "/users/id/mfa", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			users.ErrNoDocuments,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
+
+func TestUser_ValidateMFACode(t *testing.T) {
+	user, codes := newMFAUser(t)
+
+	assert.ErrorIs(t, user.ValidateMFACode(totpCode(t, user.TOTPSecret, 0)), users.ErrMFAInvalidCode,
+		"code used to confirm can't be replayed")
+	assert.NoError(t, user.ValidateMFACode(totpCode(t, user.TOTPSecret, 1)))
+	assert.ErrorIs(t, user.ValidateMFACode(totpCode(t, user.TOTPSecret, 1)), users.ErrMFAInvalidCode)
+
+	assert.NoError(t, user.ValidateMFACode(codes[0]))
+	assert.ErrorIs(t, user.ValidateMFACode(codes[0]), users.ErrMFAInvalidCode, "recovery codes are single use")
+	assert.NoError(t, user.ValidateMFACode(" "+codes[1][:5]+codes[1][6:]+" "))
+	assert.Len(t, user.RecoveryCodes, len(codes)-2)
+
+	user.ResetMFA()
+	assert.ErrorIs(t, user.ValidateMFACode(codes[2]), users.ErrMFANotEnabled)
+}
+
+func TestHandler_ResetUserMFA_403_Self(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	admin := users.NewAdminUser("admin@example.com", "admin")
+	access, _, err := admin.Login(users.NewSession(admin.Id, "", ""))
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/users/%s/mfa", admin.Id), nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			admin.Id,
+			mock.Anything,
+		).
+		Return(
+			admin,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Contains(t, resp.Body.String(), "cannot manage your own account")
+}
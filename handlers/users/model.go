@@ -1,11 +1,15 @@
 package users
 
 import (
+	"errors"
+	"fmt"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
+	"github.com/rs/xid"
+	"github.com/spf13/viper"
 	"golang.org/x/exp/slices"
 
+	"github.com/alexferl/echo-boilerplate/config"
 	"github.com/alexferl/echo-boilerplate/data"
 	"github.com/alexferl/echo-boilerplate/util"
 )
@@ -29,10 +33,37 @@ type User struct {
 	Name          string     `json:"name" bson:"name"`
 	Bio           string     `json:"bio" bson:"bio"`
 	Roles         []string   `json:"-" bson:"roles"`
-	RefreshToken  string     `json:"-" bson:"refresh_token"`
 	LastLoginAt   *time.Time `json:"-" bson:"last_login_at"`
 	LastLogoutAt  *time.Time `json:"-" bson:"last_logout_at"`
 	LastRefreshAt *time.Time `json:"-" bson:"last_refresh_at"`
+	TokenVersion  int64      `json:"-" bson:"token_version"`
+
+	EmailVerified          bool       `json:"email_verified" bson:"email_verified"`
+	EmailVerifiedAt        *time.Time `json:"-" bson:"email_verified_at"`
+	EmailVerificationToken string     `json:"-" bson:"email_verification_token"`
+
+	PasswordResetToken     string     `json:"-" bson:"password_reset_token"`
+	PasswordResetExpiresAt *time.Time `json:"-" bson:"password_reset_expires_at"`
+
+	PendingEmail           string     `json:"-" bson:"pending_email"`
+	PreviousEmail          string     `json:"-" bson:"previous_email"`
+	EmailChangeToken       string     `json:"-" bson:"email_change_token"`
+	EmailChangeCancelToken string     `json:"-" bson:"email_change_cancel_token"`
+	EmailChangeExpiresAt   *time.Time `json:"-" bson:"email_change_expires_at"`
+
+	PurgeAt      *time.Time `json:"-" bson:"purge_at"`
+	RestoreToken string     `json:"-" bson:"restore_token"`
+
+	Suspended             bool       `json:"-" bson:"suspended"`
+	SuspendedAt           *time.Time `json:"-" bson:"suspended_at"`
+	SuspendedBy           string     `json:"-" bson:"suspended_by"`
+	PasswordResetRequired bool       `json:"-" bson:"password_reset_required"`
+
+	MFAEnabled      bool       `json:"mfa_enabled" bson:"mfa_enabled"`
+	MFAEnabledAt    *time.Time `json:"-" bson:"mfa_enabled_at"`
+	TOTPSecret      string     `json:"-" bson:"totp_secret"`
+	TOTPLastCounter int64      `json:"-" bson:"totp_last_counter"`
+	RecoveryCodes   []string   `json:"-" bson:"recovery_codes"`
 }
 
 type PublicUser struct {
@@ -41,6 +72,13 @@ type PublicUser struct {
 	Name     string `json:"name" bson:"name"`
 }
 
+// DeletedUsername and DeletedName are shown in place of
+// the username and name of users who deleted their account.
+const (
+	DeletedUsername = "deleted"
+	DeletedName     = "Deleted user"
+)
+
 func NewUser(email string, username string) *User {
 	return &User{
 		Model:    data.NewModel(),
@@ -57,18 +95,213 @@ func NewAdminUser(email string, username string) *User {
 	return user
 }
 
+var (
+	ErrTokenMismatch = errors.New("token mismatch")
+	ErrTokenExpired  = errors.New("token expired")
+)
+
+// NewEmailVerificationToken returns a signed token to verify the user's
+// current email. Only the hash of the last token generated is kept, which
+// makes it single-use.
+func (u *User) NewEmailVerificationToken() ([]byte, error) {
+	token, err := util.GenerateVerifyEmailToken(u.Id, map[string]any{"email": u.Email})
+	if err != nil {
+		return nil, err
+	}
+
+	u.EmailVerificationToken = util.HashToken(token)
+
+	return token, nil
+}
+
+func (u *User) VerifyEmail(token string) error {
+	if u.EmailVerificationToken == "" || !util.ValidToken([]byte(token), u.EmailVerificationToken) {
+		return ErrTokenMismatch
+	}
+
+	t := time.Now()
+	u.EmailVerified = true
+	u.EmailVerifiedAt = &t
+	u.EmailVerificationToken = ""
+
+	return nil
+}
+
+// NewPasswordResetToken returns a random token to reset the user's password.
+// Only its hash is stored so the token can be looked up with HashToken.
+func (u *User) NewPasswordResetToken() (string, error) {
+	token, err := util.GenerateRandomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	t := time.Now().Add(viper.GetDuration(config.PasswordResetTokenExpiry))
+	u.PasswordResetToken = util.HashToken([]byte(token))
+	u.PasswordResetExpiresAt = &t
+
+	return token, nil
+}
+
+// ValidatePasswordResetToken returns an error unless token is the password
+// reset token of the user and it hasn't expired.
+func (u *User) ValidatePasswordResetToken(token string) error {
+	if u.PasswordResetToken == "" || !util.ValidToken([]byte(token), u.PasswordResetToken) {
+		return ErrTokenMismatch
+	}
+
+	if u.PasswordResetExpiresAt == nil || time.Now().After(*u.PasswordResetExpiresAt) {
+		return ErrTokenExpired
+	}
+
+	return nil
+}
+
+// ResetPassword sets a new password if token is valid. The token can only be
+// used once. Callers should revoke the user's sessions.
+func (u *User) ResetPassword(token string, password string) error {
+	if err := u.ValidatePasswordResetToken(token); err != nil {
+		return err
+	}
+
+	if err := u.SetPassword(password); err != nil {
+		return err
+	}
+
+	u.PasswordResetToken = ""
+	u.PasswordResetExpiresAt = nil
+	u.RevokeTokens()
+
+	return nil
+}
+
+// NewEmailChange makes email pending until it's confirmed with the returned
+// confirm token. The cancel token undoes the change, even once confirmed,
+// until the tokens expire. Only their hashes are stored.
+func (u *User) NewEmailChange(email string) (string, string, error) {
+	confirm, err := util.GenerateRandomString(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	cancel, err := util.GenerateRandomString(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	t := time.Now().Add(viper.GetDuration(config.EmailChangeTokenExpiry))
+	u.PendingEmail = email
+	u.PreviousEmail = ""
+	u.EmailChangeToken = util.HashToken([]byte(confirm))
+	u.EmailChangeCancelToken = util.HashToken([]byte(cancel))
+	u.EmailChangeExpiresAt = &t
+
+	return confirm, cancel, nil
+}
+
+// ValidateEmailChangeToken returns an error unless token can confirm the
+// pending email change.
+func (u *User) ValidateEmailChangeToken(token string) error {
+	if u.PendingEmail == "" || u.EmailChangeToken == "" || !util.ValidToken([]byte(token), u.EmailChangeToken) {
+		return ErrTokenMismatch
+	}
+
+	if u.EmailChangeExpiresAt == nil || time.Now().After(*u.EmailChangeExpiresAt) {
+		return ErrTokenExpired
+	}
+
+	return nil
+}
+
+// ConfirmEmailChange replaces the email with the pending one if token is valid.
+// The new email is verified since the token was sent to it.
+func (u *User) ConfirmEmailChange(token string) error {
+	if err := u.ValidateEmailChangeToken(token); err != nil {
+		return err
+	}
+
+	t := time.Now()
+	u.PreviousEmail = u.Email
+	u.Email = u.PendingEmail
+	u.EmailVerified = true
+	u.EmailVerifiedAt = &t
+	u.PendingEmail = ""
+	u.EmailChangeToken = ""
+
+	return nil
+}
+
+// ValidateEmailChangeCancelToken returns an error unless token can cancel
+// the email change.
+func (u *User) ValidateEmailChangeCancelToken(token string) error {
+	if u.EmailChangeCancelToken == "" || !util.ValidToken([]byte(token), u.EmailChangeCancelToken) {
+		return ErrTokenMismatch
+	}
+
+	if u.EmailChangeExpiresAt == nil || time.Now().After(*u.EmailChangeExpiresAt) {
+		return ErrTokenExpired
+	}
+
+	return nil
+}
+
+// CancelEmailChange drops the pending email if token is valid. If the change
+// was already confirmed the previous email is restored and true is returned,
+// callers should then revoke the user's sessions.
+func (u *User) CancelEmailChange(token string) (bool, error) {
+	if err := u.ValidateEmailChangeCancelToken(token); err != nil {
+		return false, err
+	}
+
+	reverted := u.PreviousEmail != ""
+	if reverted {
+		t := time.Now()
+		u.Email = u.PreviousEmail
+		u.EmailVerified = true
+		u.EmailVerifiedAt = &t
+		u.RevokeTokens()
+	}
+
+	u.PendingEmail = ""
+	u.PreviousEmail = ""
+	u.EmailChangeToken = ""
+	u.EmailChangeCancelToken = ""
+	u.EmailChangeExpiresAt = nil
+
+	return reverted, nil
+}
+
 func (u *User) SetPassword(s string) error {
-	b, err := bcrypt.GenerateFromPassword([]byte(s), bcrypt.DefaultCost)
+	hash, err := util.HashPassword(s)
 	if err != nil {
 		return err
 	}
-	u.Password = string(b)
+	u.Password = hash
+	u.PasswordResetRequired = false
 
 	return nil
 }
 
+// ValidatePassword checks s against the password hash of the user, which
+// can be an argon2id or a bcrypt one.
 func (u *User) ValidatePassword(s string) error {
-	return bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(s))
+	return util.VerifyPassword(u.Password, s)
+}
+
+// RehashPassword hashes s, the validated password of the user, again when
+// the stored hash doesn't use the configured algorithm and parameters.
+// It reports whether the hash changed.
+func (u *User) RehashPassword(s string) (bool, error) {
+	if !util.PasswordNeedsRehash(u.Password) {
+		return false, nil
+	}
+
+	hash, err := util.HashPassword(s)
+	if err != nil {
+		return false, err
+	}
+	u.Password = hash
+
+	return true, nil
 }
 
 func (u *User) AddRole(role Role) {
@@ -77,8 +310,31 @@ func (u *User) AddRole(role Role) {
 	}
 }
 
-func (u *User) Login() ([]byte, []byte, error) {
-	access, refresh, err := util.GenerateTokens(u.Id, map[string]any{"roles": u.Roles})
+func (u *User) RemoveRole(role Role) {
+	if i := slices.Index(u.Roles, role.String()); i >= 0 {
+		u.Roles = slices.Delete(u.Roles, i, i+1)
+	}
+}
+
+// Suspend cuts the user off until they're unsuspended, their tokens
+// are refused as long as they're suspended.
+func (u *User) Suspend(by string) {
+	t := time.Now()
+	u.Suspended = true
+	u.SuspendedAt = &t
+	u.SuspendedBy = by
+}
+
+func (u *User) Unsuspend() {
+	u.Suspended = false
+	u.SuspendedAt = nil
+	u.SuspendedBy = ""
+}
+
+// Login issues tokens for a new session.
+func (u *User) Login(session *Session) ([]byte, []byte, error) {
+	jti := xid.New().String()
+	access, refresh, err := util.GenerateTokens(u.Id, session.Id, jti, u.claims())
 	if err != nil {
 		return nil, nil, err
 	}
@@ -86,7 +342,7 @@ func (u *User) Login() ([]byte, []byte, error) {
 	t := time.Now()
 	u.LastLoginAt = &t
 
-	err = u.encryptRefreshToken(refresh)
+	err = session.setRefreshToken(jti, refresh)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -94,23 +350,26 @@ func (u *User) Login() ([]byte, []byte, error) {
 	return access, refresh, nil
 }
 
-func (u *User) Logout() {
+func (u *User) Logout(session *Session) {
 	t := time.Now()
 	u.LastLogoutAt = &t
 
-	u.RefreshToken = ""
+	session.Revoke()
 }
 
-func (u *User) Refresh() ([]byte, []byte, error) {
-	access, refresh, err := util.GenerateTokens(u.Id, map[string]any{"roles": u.Roles})
+// Refresh issues new tokens for an existing session.
+func (u *User) Refresh(session *Session) ([]byte, []byte, error) {
+	jti := xid.New().String()
+	access, refresh, err := util.GenerateTokens(u.Id, session.Id, jti, u.claims())
 	if err != nil {
 		return nil, nil, err
 	}
 
 	t := time.Now()
 	u.LastRefreshAt = &t
+	session.LastRefreshAt = &t
 
-	err = u.encryptRefreshToken(refresh)
+	err = session.setRefreshToken(jti, refresh)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -118,11 +377,106 @@ func (u *User) Refresh() ([]byte, []byte, error) {
 	return access, refresh, nil
 }
 
-func (u *User) ValidateRefreshToken(s string) error {
-	return bcrypt.CompareHashAndPassword([]byte(u.RefreshToken), []byte(s))
+// Impersonate issues a short-lived access token for the user on behalf of
+// the admin actor, it's revoked along with the user's other access tokens.
+func (u *User) Impersonate(actor string) ([]byte, error) {
+	return util.GenerateImpersonationToken(u.Id, actor, u.claims())
+}
+
+// NewDeletion soft-deletes the user and returns a random token to restore
+// the account until it's purged. Only its hash is stored. Callers should
+// revoke the user's sessions and personal access tokens.
+func (u *User) NewDeletion() (string, error) {
+	token, err := util.GenerateRandomString(32)
+	if err != nil {
+		return "", err
+	}
+
+	t := time.Now().Add(viper.GetDuration(config.AccountDeletionGracePeriod))
+	u.Delete(u.Id)
+	u.PurgeAt = &t
+	u.RestoreToken = util.HashToken([]byte(token))
+	u.PendingEmail = ""
+	u.PreviousEmail = ""
+	u.EmailChangeToken = ""
+	u.EmailChangeCancelToken = ""
+	u.EmailChangeExpiresAt = nil
+	u.RevokeTokens()
+
+	return token, nil
+}
+
+// ValidateRestoreToken returns an error unless token can restore the
+// account, which it can until the account is purged.
+func (u *User) ValidateRestoreToken(token string) error {
+	if u.DeletedAt == nil || u.RestoreToken == "" || !util.ValidToken([]byte(token), u.RestoreToken) {
+		return ErrTokenMismatch
+	}
+
+	if u.PurgeAt == nil || time.Now().After(*u.PurgeAt) {
+		return ErrTokenExpired
+	}
+
+	return nil
+}
+
+// Restore undoes a deletion if token is valid and the account wasn't purged yet.
+func (u *User) Restore(token string) error {
+	if err := u.ValidateRestoreToken(token); err != nil {
+		return err
+	}
+
+	u.DeletedAt = nil
+	u.DeletedBy = ""
+	u.PurgeAt = nil
+	u.RestoreToken = ""
+
+	return nil
+}
+
+// Pseudonymize scrubs the personal information of a deleted user for good.
+// The document is kept with placeholders so that what the user created
+// still refers to it.
+func (u *User) Pseudonymize() {
+	u.Email = fmt.Sprintf("%s@deleted.invalid", u.Id)
+	u.Username = fmt.Sprintf("deleted-%s", u.Id)
+	u.Password = ""
+	u.Name = ""
+	u.Bio = ""
+	u.EmailVerified = false
+	u.EmailVerifiedAt = nil
+	u.EmailVerificationToken = ""
+	u.PasswordResetToken = ""
+	u.PasswordResetExpiresAt = nil
+	u.PendingEmail = ""
+	u.PreviousEmail = ""
+	u.EmailChangeToken = ""
+	u.EmailChangeCancelToken = ""
+	u.EmailChangeExpiresAt = nil
+	u.MFAEnabled = false
+	u.MFAEnabledAt = nil
+	u.TOTPSecret = ""
+	u.TOTPLastCounter = 0
+	u.RecoveryCodes = nil
+	u.PurgeAt = nil
+	u.RestoreToken = ""
+}
+
+// RevokeTokens bumps the token version which invalidates
+// every access token issued to the user so far.
+func (u *User) RevokeTokens() {
+	u.TokenVersion++
 }
 
 func (u *User) Public() *PublicUser {
+	if u.DeletedAt != nil {
+		return &PublicUser{
+			Id:       u.Id,
+			Username: DeletedUsername,
+			Name:     DeletedName,
+		}
+	}
+
 	return &PublicUser{
 		Id:       u.Id,
 		Username: u.Username,
@@ -130,13 +484,10 @@ func (u *User) Public() *PublicUser {
 	}
 }
 
-func (u *User) encryptRefreshToken(token []byte) error {
-	b, err := bcrypt.GenerateFromPassword(token, bcrypt.DefaultCost)
-	if err != nil {
-		return err
+func (u *User) claims() map[string]any {
+	return map[string]any{
+		"roles":          u.Roles,
+		"email_verified": u.EmailVerified,
+		"token_version":  u.TokenVersion,
 	}
-
-	u.RefreshToken = string(b)
-
-	return nil
 }
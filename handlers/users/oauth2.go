@@ -2,132 +2,658 @@ package users
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	libHttp "github.com/alexferl/golib/http/handler"
 	"github.com/labstack/echo/v4"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jws"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 	"go.mongodb.org/mongo-driver/bson"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 
 	"github.com/alexferl/echo-boilerplate/config"
 	"github.com/alexferl/echo-boilerplate/util"
 )
 
-type GoogleUser struct {
-	Id            string `json:"id"`
-	Email         string `json:"email"`
-	VerifiedEmail bool   `json:"verified_email"`
-	Picture       string `json:"picture"`
+var (
+	ErrOAuth2ProviderNotFound = errors.New("oauth2 provider not found")
+	ErrOAuth2StateMismatch    = errors.New("oauth2 state mismatch")
+	ErrOAuth2NonceMismatch    = errors.New("oauth2 nonce mismatch")
+	ErrOAuth2MissingIdToken   = errors.New("oauth2 id token missing")
+	ErrOAuth2MissingClaims    = errors.New("oauth2 subject or email missing")
+)
+
+// oidcDiscovery is the part of an OpenID Connect discovery document we use.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserInfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
 }
 
-func getOAuth2Config() *oauth2.Config {
-	return &oauth2.Config{
-		RedirectURL:  fmt.Sprintf("%s/oauth2/callback", viper.GetString(config.BaseURL)),
-		ClientID:     viper.GetString(config.OAuth2ClientId),
-		ClientSecret: viper.GetString(config.OAuth2ClientSecret),
-		Scopes:       []string{"https://www.googleapis.com/auth/userinfo.email"},
-		Endpoint:     google.Endpoint,
-	}
+// discoveries caches discovery documents by issuer.
+var discoveries sync.Map
+
+// keySets caches the key sets of providers by URL, they're refreshed in the
+// background.
+var keySets = jwk.NewCache(context.Background())
+
+// OAuth2UserInfo is what we know about a user once a provider logged them in.
+type OAuth2UserInfo struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Username      string
 }
 
-func (h *Handler) OAuth2LogIn(c echo.Context) error {
-	state, err := util.GenerateRandomString(80)
+type oauth2Provider struct {
+	config.OAuth2Provider
+	discovery *oidcDiscovery
+}
+
+// getOAuth2Provider returns the configured provider name, with its discovery
+// document if it's an OpenID Connect provider.
+func getOAuth2Provider(ctx context.Context, name string) (*oauth2Provider, error) {
+	providers, err := config.GetOAuth2Providers()
 	if err != nil {
-		return fmt.Errorf("oauth2: failed to generate state: %v", err)
+		return nil, err
 	}
 
-	url := getOAuth2Config().AuthCodeURL(state)
-	opts := &util.CookieOptions{
-		Name:     "state",
-		Value:    state,
-		Path:     "/oauth2/callback",
-		SameSite: http.SameSiteLaxMode, // needs to be Lax since it's across domains
-		HttpOnly: true,
-		MaxAge:   600,
+	for _, p := range providers {
+		if p.Name != name {
+			continue
+		}
+
+		provider := &oauth2Provider{OAuth2Provider: p}
+		if p.Issuer != "" {
+			d, err := discover(ctx, p.Issuer)
+			if err != nil {
+				return nil, err
+			}
+			provider.discovery = d
+		}
+
+		return provider, nil
 	}
-	c.SetCookie(util.NewCookie(opts))
 
-	return c.Redirect(http.StatusTemporaryRedirect, url)
+	return nil, ErrOAuth2ProviderNotFound
 }
 
-func (h *Handler) OAuth2Callback(c echo.Context) error {
-	response, err := callback(c)
+func discover(ctx context.Context, issuer string) (*oidcDiscovery, error) {
+	if d, ok := discoveries.Load(issuer); ok {
+		return d.(*oidcDiscovery), nil
+	}
+
+	d := &oidcDiscovery{}
+	if err := getJSON(ctx, http.DefaultClient, issuer+"/.well-known/openid-configuration", d); err != nil {
+		return nil, fmt.Errorf("failed discovery: %v", err)
+	}
+
+	if d.Issuer != issuer {
+		return nil, fmt.Errorf("discovery issuer '%s' doesn't match '%s'", d.Issuer, issuer)
+	}
+
+	discoveries.Store(issuer, d)
+
+	return d, nil
+}
+
+func (p *oauth2Provider) isOIDC() bool {
+	return p.discovery != nil
+}
+
+func (p *oauth2Provider) callbackPath() string {
+	return fmt.Sprintf("/oauth2/%s/callback", p.Name)
+}
+
+func (p *oauth2Provider) config() *oauth2.Config {
+	c := &oauth2.Config{
+		RedirectURL:  viper.GetString(config.BaseURL) + p.callbackPath(),
+		ClientID:     p.ClientId,
+		ClientSecret: p.ClientSecret,
+		Scopes:       p.Scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  p.AuthURL,
+			TokenURL: p.TokenURL,
+		},
+	}
+
+	if p.isOIDC() {
+		c.Endpoint.AuthURL = p.discovery.AuthorizationEndpoint
+		c.Endpoint.TokenURL = p.discovery.TokenEndpoint
+		if len(c.Scopes) == 0 {
+			c.Scopes = []string{"openid", "email", "profile"}
+		}
+	}
+
+	return c
+}
+
+func (p *oauth2Provider) userInfoURL() string {
+	if p.UserInfoURL != "" {
+		return p.UserInfoURL
+	}
+
+	if p.isOIDC() {
+		return p.discovery.UserInfoEndpoint
+	}
+
+	return ""
+}
+
+// userInfo returns the user logged in by token. The claims of the ID token
+// are verified first, then completed with the userinfo response.
+func (p *oauth2Provider) userInfo(ctx context.Context, token *oauth2.Token, nonce string) (*OAuth2UserInfo, error) {
+	claims := map[string]any{}
+
+	if p.isOIDC() {
+		idToken, err := p.verifyIdToken(ctx, token, nonce)
+		if err != nil {
+			return nil, err
+		}
+
+		claims, err = idToken.AsMap(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if url := p.userInfoURL(); url != "" {
+		userInfo := map[string]any{}
+		if err := getJSON(ctx, p.config().Client(ctx, token), url, &userInfo); err != nil {
+			return nil, fmt.Errorf("failed getting userinfo: %v", err)
+		}
+
+		// the userinfo response must be about the user of the ID token
+		if sub, ok := claims["sub"]; ok && userInfo["sub"] != sub {
+			return nil, fmt.Errorf("userinfo subject doesn't match the id token")
+		}
+
+		for k, v := range userInfo {
+			claims[k] = v
+		}
+	}
+
+	info := p.mapClaims(claims)
+	if info.Subject == "" || info.Email == "" {
+		return nil, ErrOAuth2MissingClaims
+	}
+
+	return info, nil
+}
+
+func (p *oauth2Provider) verifyIdToken(ctx context.Context, token *oauth2.Token, nonce string) (jwt.Token, error) {
+	raw, ok := token.Extra("id_token").(string)
+	if !ok || raw == "" {
+		return nil, ErrOAuth2MissingIdToken
+	}
+
+	set, err := p.keySet(ctx, raw)
 	if err != nil {
-		return fmt.Errorf("oauth2: failed callback: %v", err)
+		return nil, fmt.Errorf("failed fetching jwks: %v", err)
 	}
 
-	defer response.Body.Close()
-	b, err := io.ReadAll(response.Body)
+	idToken, err := jwt.Parse(
+		[]byte(raw),
+		jwt.WithKeySet(set, jws.WithInferAlgorithmFromKey(true)),
+		jwt.WithValidate(true),
+		jwt.WithIssuer(p.discovery.Issuer),
+		jwt.WithAudience(p.ClientId),
+	)
 	if err != nil {
-		return fmt.Errorf("oauth2: failed to read body: %v", err)
+		return nil, fmt.Errorf("failed verifying id token: %v", err)
+	}
+
+	if val, _ := idToken.Get("nonce"); nonce == "" || val != nonce {
+		return nil, ErrOAuth2NonceMismatch
 	}
 
-	if response.StatusCode != http.StatusOK {
-		c.Logger().Errorf("oauth2: response code was: %d body: %s", response.StatusCode, b)
-		return libHttp.JSONError(c, http.StatusUnauthorized, "failed to log in")
+	return idToken, nil
+}
+
+// keySet returns the cached key set of the provider. It's fetched again if
+// the key the token raw was signed with isn't in it, in case the provider
+// rotated its keys since.
+func (p *oauth2Provider) keySet(ctx context.Context, raw string) (jwk.Set, error) {
+	u := p.discovery.JWKSURI
+	if !keySets.IsRegistered(u) {
+		if err := keySets.Register(u); err != nil {
+			return nil, err
+		}
 	}
 
-	googleUser := &GoogleUser{}
-	err = json.Unmarshal(b, googleUser)
+	set, err := keySets.Get(ctx, u)
 	if err != nil {
-		return fmt.Errorf("oauth2: failed unmarshalling body: %v", err)
+		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	msg, err := jws.Parse([]byte(raw))
+	if err != nil || len(msg.Signatures()) == 0 {
+		return set, nil
+	}
+
+	kid := msg.Signatures()[0].ProtectedHeaders().KeyID()
+	if _, ok := set.LookupKeyID(kid); kid != "" && !ok {
+		return keySets.Refresh(ctx, u)
+	}
+
+	return set, nil
+}
 
-	filter := bson.D{{"email", googleUser.Email}}
-	result, err := h.Mapper.FindOne(ctx, filter, &User{})
+func (p *oauth2Provider) mapClaims(claims map[string]any) *OAuth2UserInfo {
+	get := func(name string, def string) string {
+		if name == "" {
+			name = def
+		}
+
+		switch v := claims[name].(type) {
+		case nil:
+			return ""
+		case string:
+			return v
+		case json.Number:
+			return v.String()
+		default:
+			return fmt.Sprint(v)
+		}
+	}
+
+	verified := get(p.Claims.EmailVerified, "email_verified")
+
+	return &OAuth2UserInfo{
+		Subject:       get(p.Claims.Subject, "sub"),
+		Email:         get(p.Claims.Email, "email"),
+		EmailVerified: verified == "true",
+		Name:          get(p.Claims.Name, "name"),
+		Username:      get(p.Claims.Username, "preferred_username"),
+	}
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
 	if err != nil {
-		if err != ErrNoDocuments {
-			return fmt.Errorf("oauth2: failed to get user: %v", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("response code was: %d", resp.StatusCode)
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+
+	return dec.Decode(v)
+}
+
+func oauth2Cookie(p *oauth2Provider, name string, value string, maxAge int) *http.Cookie {
+	opts := &util.CookieOptions{
+		Name:     name,
+		Value:    value,
+		Path:     p.callbackPath(),
+		SameSite: http.SameSiteLaxMode, // needs to be Lax since it's across domains
+		HttpOnly: true,
+		MaxAge:   maxAge,
+	}
+
+	return util.NewCookie(opts)
+}
+
+// getOAuth2ProviderOrError returns the provider of the request.
+func getOAuth2ProviderOrError(ctx context.Context, c echo.Context) (*oauth2Provider, func() error) {
+	provider, err := getOAuth2Provider(ctx, c.Param("provider"))
+	if err != nil {
+		if err == ErrOAuth2ProviderNotFound {
+			return nil, wrap(libHttp.JSONError(c, http.StatusNotFound, "provider not found"))
 		}
+		return nil, wrap(fmt.Errorf("oauth2: failed getting provider: %v", err))
 	}
-	var access, refresh []byte
 
-	if result == nil {
-		// TODO: username?
-		newUser := NewUser(googleUser.Email, googleUser.Email)
-		access, refresh, err = newUser.Login()
+	return provider, nil
+}
+
+// oauth2State is what a log in at a provider is bound to. It's kept in a
+// signed, short-lived cookie until the provider redirects to the callback.
+type oauth2State struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+	RedirectTo   string
+	LinkUserId   string
+}
+
+// oauth2Redirect sends the user to log in at provider. The state is bound to
+// a PKCE code verifier, a nonce for OpenID Connect providers, and redirect_to.
+// A non-empty linkUserId links the provider account to that user instead.
+func oauth2Redirect(c echo.Context, provider *oauth2Provider, linkUserId string) error {
+	redirectTo := c.QueryParam("redirect_to")
+	if redirectTo != "" && !validRedirect(redirectTo) {
+		return libHttp.JSONError(c, http.StatusBadRequest, "invalid redirect_to")
+	}
+
+	state, err := util.GenerateRandomString(80)
+	if err != nil {
+		return fmt.Errorf("oauth2: failed to generate state: %v", err)
+	}
+
+	verifier, err := util.GenerateCodeVerifier()
+	if err != nil {
+		return fmt.Errorf("oauth2: failed to generate code verifier: %v", err)
+	}
+
+	opts := []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_challenge", util.CodeChallengeS256(verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	}
+
+	var nonce string
+	if provider.isOIDC() {
+		nonce, err = util.GenerateRandomString(32)
 		if err != nil {
-			return fmt.Errorf("oauth2: failed to generate tokens: %v", err)
+			return fmt.Errorf("oauth2: failed to generate nonce: %v", err)
 		}
+		opts = append(opts, oauth2.SetAuthURLParam("nonce", nonce))
+	}
+
+	claims := map[string]any{
+		"state":         state,
+		"nonce":         nonce,
+		"code_verifier": verifier,
+		"redirect_to":   redirectTo,
+	}
+	if linkUserId != "" {
+		claims["link_user_id"] = linkUserId
+	}
+	token, err := util.GenerateOAuth2StateToken(provider.Name, claims)
+	if err != nil {
+		return fmt.Errorf("oauth2: failed generating state token: %v", err)
+	}
+	maxAge := int(viper.GetDuration(config.OAuth2StateExpiry).Seconds())
+	c.SetCookie(oauth2Cookie(provider, "state", string(token), maxAge))
+
+	url := provider.config().AuthCodeURL(state, opts...)
+
+	return c.Redirect(http.StatusTemporaryRedirect, url)
+}
 
-		newUser.Create(newUser.Id)
+// validRedirect returns whether the users can be sent back to u,
+// it must match the scheme, host and path of an allowlisted URL.
+func validRedirect(u string) bool {
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.User != nil {
+		return false
+	}
 
-		_, err = h.Mapper.Insert(ctx, newUser, nil)
+	for _, allowed := range viper.GetStringSlice(config.OAuth2RedirectAllowlist) {
+		a, err := url.Parse(allowed)
 		if err != nil {
-			return fmt.Errorf("oauth2: failed to insert user: %v", err)
+			continue
 		}
-	} else {
-		user := result.(*User)
-		access, refresh, err = user.Login()
-		if err != nil {
-			return fmt.Errorf("oauth2: failed to generate tokens: %v", err)
+
+		if parsed.Scheme != a.Scheme || parsed.Host != a.Host {
+			continue
 		}
 
-		_, err = h.Mapper.UpdateById(ctx, user.Id, user, nil)
-		if err != nil {
-			return fmt.Errorf("oauth2: failed to update user: %v", err)
+		prefix := strings.TrimSuffix(a.Path, "/")
+		if parsed.Path == prefix || strings.HasPrefix(parsed.Path, prefix+"/") {
+			return true
 		}
 	}
 
-	stateOpts := &util.CookieOptions{
-		Name:     "state",
-		Value:    "",
-		Path:     "/oauth2/callback",
-		SameSite: http.SameSiteLaxMode, // needs to be Lax since it's across domains
-		HttpOnly: true,
-		MaxAge:   -1,
+	return false
+}
+
+// oauth2Respond returns body, or when the log in started with a redirect_to,
+// sends the users back to it with params in the fragment.
+func oauth2Respond(c echo.Context, state *oauth2State, code int, body any, params url.Values) error {
+	if state == nil || state.RedirectTo == "" {
+		return c.JSON(code, body)
+	}
+
+	u := state.RedirectTo
+	if len(params) > 0 {
+		u += "#" + params.Encode()
+	}
+
+	return c.Redirect(http.StatusFound, u)
+}
+
+func oauth2Error(c echo.Context, state *oauth2State, code int, message string) error {
+	if state == nil || state.RedirectTo == "" {
+		return libHttp.JSONError(c, code, message)
+	}
+
+	return oauth2Respond(c, state, code, nil, url.Values{"error": {message}})
+}
+
+func (h *Handler) OAuth2LogIn(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	provider, errResp := getOAuth2ProviderOrError(ctx, c)
+	if errResp != nil {
+		return errResp()
+	}
+
+	return oauth2Redirect(c, provider, "")
+}
+
+// OAuth2OnboardingResponse is returned to users logging in with a provider
+// for the first time. They pick a username and send it with the
+// onboarding_token to /oauth2/onboarding to finish signing up.
+type OAuth2OnboardingResponse struct {
+	OnboardingToken string `json:"onboarding_token"`
+	ExpiresIn       int64  `json:"expires_in"`
+	Email           string `json:"email"`
+	Name            string `json:"name"`
+	Username        string `json:"username"`
+}
+
+func (h *Handler) OAuth2Callback(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	provider, errResp := getOAuth2ProviderOrError(ctx, c)
+	if errResp != nil {
+		return errResp()
+	}
+
+	c.SetCookie(oauth2Cookie(provider, "state", "", -1))
+
+	info, state, err := callback(ctx, c, provider)
+	if err != nil {
+		log.Error().Err(err).Str("provider", provider.Name).Msg("oauth2: failed callback")
+		return oauth2Error(c, state, http.StatusUnauthorized, "failed to log in")
+	}
+
+	if state.LinkUserId != "" {
+		return h.linkIdentity(ctx, c, state, provider.Name, info)
+	}
+
+	identity, err := h.getIdentity(ctx, provider.Name, info)
+	if err != nil {
+		return fmt.Errorf("oauth2: %v", err)
+	}
+
+	if identity == nil {
+		return h.oauth2Onboarding(ctx, c, state, provider.Name, info)
+	}
+
+	result, err := h.Mapper.FindOneById(ctx, identity.UserId, &User{})
+	if err != nil {
+		return fmt.Errorf("oauth2: failed to get user: %v", err)
+	}
+
+	user := result.(*User)
+	if user.DeletedAt != nil {
+		return oauth2Error(c, state, http.StatusUnauthorized, "failed to log in")
+	}
+
+	// the provider only replaces the password, the rest of the log in is the same
+	status, resp, err := h.logInUser(ctx, c, user)
+	if err != nil {
+		return fmt.Errorf("oauth2: %v", err)
+	}
+
+	switch r := resp.(type) {
+	case *MFARequiredResponse:
+		params := url.Values{
+			"mfa_token":  {r.MFAToken},
+			"expires_in": {strconv.FormatInt(r.ExpiresIn, 10)},
+		}
+		return oauth2Respond(c, state, status, r, params)
+	case echo.Map:
+		msg, _ := r["message"].(string)
+		return oauth2Error(c, state, status, msg)
+	}
+
+	t := time.Now()
+	identity.LastLoginAt = &t
+	_, err = h.Mapper.Collection(IdentitiesCollection).UpdateById(ctx, identity.Id, identity, nil)
+	if err != nil {
+		return fmt.Errorf("oauth2: failed updating identity: %v", err)
+	}
+
+	tokens := resp.(*TokenResponse)
+	if viper.GetBool(config.CookiesEnabled) {
+		util.SetTokenCookies(c, []byte(tokens.AccessToken), []byte(tokens.RefreshToken))
+	}
+
+	return oauth2Respond(c, state, status, tokens, nil)
+}
+
+// oauth2Onboarding starts signing up a user new to provider. Accounts are
+// never matched by email, the owner of an existing account has to log in
+// and link the provider.
+func (h *Handler) oauth2Onboarding(ctx context.Context, c echo.Context, state *oauth2State, provider string, info *OAuth2UserInfo) error {
+	_, err := h.Mapper.FindOne(ctx, bson.D{{"email", info.Email}}, &User{})
+	if err == nil {
+		return oauth2Error(c, state, http.StatusConflict, "email already in-use, log in to link this provider")
+	} else if err != ErrNoDocuments {
+		return fmt.Errorf("oauth2: failed to get user: %v", err)
+	}
+
+	claims := map[string]any{
+		"provider":       provider,
+		"email":          info.Email,
+		"email_verified": info.EmailVerified,
+		"name":           info.Name,
+	}
+	token, err := util.GenerateOAuth2OnboardingToken(info.Subject, claims)
+	if err != nil {
+		return fmt.Errorf("oauth2: failed generating onboarding token: %v", err)
+	}
+
+	resp := &OAuth2OnboardingResponse{
+		OnboardingToken: string(token),
+		ExpiresIn:       int64(viper.GetDuration(config.OAuth2TokenExpiry).Seconds()),
+		Email:           info.Email,
+		Name:            info.Name,
+		Username:        info.Username,
+	}
+
+	params := url.Values{
+		"onboarding_token": {resp.OnboardingToken},
+		"expires_in":       {strconv.FormatInt(resp.ExpiresIn, 10)},
+		"email":            {resp.Email},
+		"name":             {resp.Name},
+		"username":         {resp.Username},
+	}
+
+	return oauth2Respond(c, state, http.StatusAccepted, resp, params)
+}
+
+type OAuth2OnboardingRequest struct {
+	OnboardingToken string `json:"onboarding_token"`
+	Username        string `json:"username"`
+}
+
+// OAuth2Onboarding creates the user of an onboarding token with the username they picked.
+func (h *Handler) OAuth2Onboarding(c echo.Context) error {
+	body := &OAuth2OnboardingRequest{}
+	if err := c.Bind(body); err != nil {
+		return err
+	}
+
+	token, err := util.ParseToken([]byte(body.OnboardingToken))
+	if err != nil {
+		return h.Validate(c, http.StatusUnauthorized, echo.Map{"message": "invalid onboarding token"})
+	}
+
+	if typ, _ := token.Get("type"); typ != util.OAuth2OnboardingToken.String() {
+		return h.Validate(c, http.StatusUnauthorized, echo.Map{"message": "invalid onboarding token"})
+	}
+
+	claims := token.PrivateClaims()
+	provider, _ := claims["provider"].(string)
+	info := &OAuth2UserInfo{Subject: token.Subject()}
+	info.Email, _ = claims["email"].(string)
+	info.EmailVerified, _ = claims["email_verified"].(bool)
+	info.Name, _ = claims["name"].(string)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	identity, err := h.getIdentity(ctx, provider, info)
+	if err != nil {
+		return err
+	}
+
+	if identity != nil {
+		return h.Validate(c, http.StatusConflict, echo.Map{"message": "provider account already linked"})
+	}
+
+	filter := bson.D{{"$or", bson.A{
+		bson.D{{"username", body.Username}},
+		bson.D{{"email", info.Email}},
+	}}}
+	_, err = h.Mapper.FindOne(ctx, filter, &User{})
+	if err == nil {
+		return h.Validate(c, http.StatusConflict, echo.Map{"message": "email or username already in-use"})
+	} else if err != ErrNoDocuments {
+		return fmt.Errorf("failed getting user: %v", err)
+	}
+
+	user := NewUser(info.Email, body.Username)
+	user.Name = info.Name
+	user.EmailVerified = info.EmailVerified
+	user.Create(user.Id)
+
+	_, err = h.Mapper.Insert(ctx, user, nil)
+	if err != nil {
+		return fmt.Errorf("failed inserting user: %v", err)
+	}
+
+	_, err = h.Mapper.Collection(IdentitiesCollection).Insert(ctx, NewIdentity(user.Id, provider, info), nil)
+	if err != nil {
+		return fmt.Errorf("failed inserting identity: %v", err)
+	}
+
+	access, refresh, err := h.login(ctx, c, user)
+	if err != nil {
+		return err
+	}
+
+	if viper.GetBool(config.CookiesEnabled) {
+		util.SetTokenCookies(c, access, refresh)
 	}
-	c.SetCookie(util.NewCookie(stateOpts))
-	util.SetTokenCookies(c, access, refresh)
 
 	resp := &TokenResponse{
 		AccessToken:  string(access),
@@ -136,33 +662,68 @@ func (h *Handler) OAuth2Callback(c echo.Context) error {
 		TokenType:    "Bearer",
 	}
 
-	return c.JSON(http.StatusOK, resp)
+	return h.Validate(c, http.StatusOK, resp)
 }
 
-func callback(c echo.Context) (*http.Response, error) {
-	state := c.FormValue("state")
-	code := c.FormValue("code")
-
-	stateCooke, err := c.Cookie("state")
+// callback verifies the state of the request against the state cookie, and
+// exchanges the code with its PKCE verifier. The state is returned as soon
+// as it's verified so errors can be sent back to redirect_to.
+func callback(ctx context.Context, c echo.Context, provider *oauth2Provider) (*OAuth2UserInfo, *oauth2State, error) {
+	state, err := getOAuth2State(c, provider)
 	if err != nil {
-		return nil, fmt.Errorf("oauth2: cookie was empty")
+		return nil, nil, err
 	}
 
-	if state != stateCooke.Value {
-		return nil, fmt.Errorf("oauth2: state mismatch")
+	if e := c.FormValue("error"); e != "" {
+		return nil, state, fmt.Errorf("provider returned error: %s", e)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	token, err := getOAuth2Config().Exchange(ctx, code)
+	opt := oauth2.SetAuthURLParam("code_verifier", state.CodeVerifier)
+	token, err := provider.config().Exchange(ctx, c.FormValue("code"), opt)
 	if err != nil {
-		return nil, err
+		return nil, state, fmt.Errorf("failed exchanging code: %v", err)
 	}
 
-	resp, err := http.Get("https://www.googleapis.com/oauth2/v2/userinfo?access_token=" + token.AccessToken)
+	info, err := provider.userInfo(ctx, token, state.Nonce)
 	if err != nil {
-		return nil, fmt.Errorf("oauth2: failed getting user info: %v", err)
+		return nil, state, err
+	}
+
+	return info, state, nil
+}
+
+func getOAuth2State(c echo.Context, provider *oauth2Provider) (*oauth2State, error) {
+	cookie, err := c.Cookie("state")
+	if err != nil || cookie.Value == "" {
+		return nil, ErrOAuth2StateMismatch
+	}
+
+	token, err := util.ParseToken([]byte(cookie.Value))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", ErrOAuth2StateMismatch, err)
+	}
+
+	if typ, _ := token.Get("type"); typ != util.OAuth2StateToken.String() || token.Subject() != provider.Name {
+		return nil, ErrOAuth2StateMismatch
+	}
+
+	claim := func(name string) string {
+		v, _ := token.Get(name)
+		s, _ := v.(string)
+		return s
+	}
+
+	state := &oauth2State{
+		State:        claim("state"),
+		Nonce:        claim("nonce"),
+		CodeVerifier: claim("code_verifier"),
+		RedirectTo:   claim("redirect_to"),
+		LinkUserId:   claim("link_user_id"),
+	}
+
+	if state.State == "" || subtle.ConstantTimeCompare([]byte(c.FormValue("state")), []byte(state.State)) != 1 {
+		return nil, ErrOAuth2StateMismatch
 	}
 
-	return resp, nil
+	return state, nil
 }
@@ -0,0 +1,732 @@
+package users_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/alexferl/echo-boilerplate/config"
+	"github.com/alexferl/echo-boilerplate/handlers/users"
+	"github.com/alexferl/echo-boilerplate/util"
+)
+
+// fakeProvider is an OpenID Connect provider. It signs ID tokens with
+// the nonce sent to its authorization endpoint, and only exchanges codes
+// with the verifier of the PKCE challenge it was sent.
+type fakeProvider struct {
+	*httptest.Server
+	key       jwk.Key
+	issuer    string
+	audience  string
+	nonce     string
+	challenge string
+	userInfo  map[string]any
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	raw, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	key, err := jwk.FromRaw(raw)
+	assert.NoError(t, err)
+	assert.NoError(t, key.Set(jwk.KeyIDKey, "test"))
+	assert.NoError(t, key.Set(jwk.AlgorithmKey, jwa.RS256))
+
+	p := &fakeProvider{key: key, audience: "client"}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"userinfo_endpoint":      p.URL + "/userinfo",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if util.CodeChallengeS256(r.FormValue("code_verifier")) != p.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]any{"error": "invalid_grant"})
+			return
+		}
+
+		token, err := jwt.NewBuilder().
+			Issuer(p.issuer).
+			Audience([]string{p.audience}).
+			Subject("1234").
+			IssuedAt(time.Now()).
+			Expiration(time.Now().Add(time.Minute)).
+			Claim("nonce", p.nonce).
+			Build()
+		assert.NoError(t, err)
+		signed, err := jwt.Sign(token, jwt.WithKey(jwa.RS256, p.key))
+		assert.NoError(t, err)
+
+		writeJSON(w, map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     string(signed),
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer access" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, p.userInfo)
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		pub, err := p.key.PublicKey()
+		assert.NoError(t, err)
+		set := jwk.NewSet()
+		assert.NoError(t, set.AddKey(pub))
+		writeJSON(w, set)
+	})
+
+	p.Server = httptest.NewServer(mux)
+	p.issuer = p.URL
+	p.userInfo = map[string]any{
+		"sub":                "1234",
+		"email":              "test@example.com",
+		"email_verified":     true,
+		"name":               "Test User",
+		"preferred_username": "test",
+	}
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func setOAuth2Providers(t *testing.T, providers ...map[string]any) {
+	viper.Set(config.OAuth2Providers, providers)
+	t.Cleanup(func() { viper.Set(config.OAuth2Providers, nil) })
+}
+
+func setOAuth2RedirectAllowlist(t *testing.T, urls ...string) {
+	viper.Set(config.OAuth2RedirectAllowlist, urls)
+	t.Cleanup(func() { viper.Set(config.OAuth2RedirectAllowlist, []string{}) })
+}
+
+func TestGetOAuth2Providers_ClientIdAlias(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	viper.Set(config.OAuth2ClientId, "id")
+	viper.Set(config.OAuth2ClientSecret, "secret")
+	t.Cleanup(func() {
+		viper.Set(config.OAuth2ClientId, "")
+		viper.Set(config.OAuth2ClientSecret, "")
+	})
+
+	setOAuth2Providers(t, map[string]any{"name": "fake", "issuer": "https://fake.example.com", "client-id": "client"})
+	providers, err := config.GetOAuth2Providers()
+	assert.NoError(t, err)
+	if assert.Len(t, providers, 2) {
+		assert.Equal(t, "google", providers[1].Name)
+		assert.Equal(t, config.DefaultOAuth2Provider.Issuer, providers[1].Issuer)
+		assert.Equal(t, "id", providers[1].ClientId)
+		assert.Equal(t, "secret", providers[1].ClientSecret)
+	}
+
+	// a configured google provider wins over the flags
+	setOAuth2Providers(t, map[string]any{"name": "google", "issuer": "https://accounts.google.com", "client-id": "client"})
+	providers, err = config.GetOAuth2Providers()
+	assert.NoError(t, err)
+	if assert.Len(t, providers, 1) {
+		assert.Equal(t, "client", providers[0].ClientId)
+	}
+}
+
+// oauth2LogIn starts a log in and returns the callback request the provider redirects to.
+func oauth2LogIn(t *testing.T, s http.Handler, provider string, p *fakeProvider) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/oauth2/"+provider+"/login", nil)
+	return oauth2Follow(t, s, req, provider, p)
+}
+
+// oauth2Follow sends req, which must redirect to the provider, and
+// returns the callback request the provider redirects back to.
+func oauth2Follow(t *testing.T, s http.Handler, req *http.Request, provider string, p *fakeProvider) *http.Request {
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.Code)
+
+	location, err := url.Parse(resp.Header().Get("Location"))
+	assert.NoError(t, err)
+	if p != nil {
+		if p.nonce == "" {
+			p.nonce = location.Query().Get("nonce")
+		}
+		p.challenge = location.Query().Get("code_challenge")
+	}
+
+	params := url.Values{"state": {location.Query().Get("state")}, "code": {"code"}}
+	callback := httptest.NewRequest(http.MethodGet, "/oauth2/"+provider+"/callback?"+params.Encode(), nil)
+	for _, cookie := range resp.Result().Cookies() {
+		callback.AddCookie(cookie)
+	}
+
+	return callback
+}
+
+func TestHandler_OAuth2LogIn_307(t *testing.T) {
+	_, s := getMapperAndServer(t)
+
+	p := newFakeProvider(t)
+	setOAuth2Providers(t, map[string]any{"name": "fake", "issuer": p.URL, "client-id": "client"})
+
+	req := httptest.NewRequest(http.MethodGet, "/oauth2/fake/login", nil)
+	resp := httptest.NewRecorder()
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.Code)
+	location, err := url.Parse(resp.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, p.URL+"/authorize", location.Scheme+"://"+location.Host+location.Path)
+	assert.Equal(t, "client", location.Query().Get("client_id"))
+	assert.Equal(t, "openid email profile", location.Query().Get("scope"))
+	assert.NotEmpty(t, location.Query().Get("state"))
+	assert.NotEmpty(t, location.Query().Get("nonce"))
+	assert.NotEmpty(t, location.Query().Get("code_challenge"))
+	assert.Equal(t, "S256", location.Query().Get("code_challenge_method"))
+	if assert.Len(t, resp.Result().Cookies(), 1) {
+		assert.Equal(t, "state", resp.Result().Cookies()[0].Name)
+	}
+}
+
+func TestHandler_OAuth2LogIn_400(t *testing.T) {
+	testCases := []struct {
+		name       string
+		redirectTo string
+	}{
+		{"not allowlisted", "https://evil.example.com/app"},
+		{"other path", "https://app.example.com/other"},
+		{"path prefix", "https://app.example.com/application"},
+		{"other scheme", "http://app.example.com/app"},
+		{"relative", "/app"},
+		{"userinfo", "https://evil.example.com@app.example.com/app"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, s := getMapperAndServer(t)
+
+			p := newFakeProvider(t)
+			setOAuth2Providers(t, map[string]any{"name": "fake", "issuer": p.URL, "client-id": "client"})
+			setOAuth2RedirectAllowlist(t, "https://app.example.com/app")
+
+			params := url.Values{"redirect_to": {tc.redirectTo}}
+			req := httptest.NewRequest(http.MethodGet, "/oauth2/fake/login?"+params.Encode(), nil)
+			resp := httptest.NewRecorder()
+
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, http.StatusBadRequest, resp.Code)
+			assert.Contains(t, resp.Body.String(), "invalid redirect_to")
+		})
+	}
+}
+
+func TestHandler_OAuth2LogIn_404(t *testing.T) {
+	_, s := getMapperAndServer(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/oauth2/unknown/login", nil)
+	resp := httptest.NewRecorder()
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
+
+func TestHandler_OAuth2Callback_200(t *testing.T) {
+	testCases := []struct {
+		name    string
+		cookies bool
+	}{
+		{"cookies", true},
+		{"no cookies", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mapper, s := getMapperAndServer(t)
+			viper.Set(config.CookiesEnabled, tc.cookies)
+
+			p := newFakeProvider(t)
+			setOAuth2Providers(t, map[string]any{"name": "fake", "issuer": p.URL, "client-id": "client"})
+
+			user := users.NewUser("test@example.com", "test")
+			identity := users.NewIdentity(user.Id, "fake", &users.OAuth2UserInfo{Subject: "1234", Email: user.Email})
+
+			req := oauth2LogIn(t, s, "fake", p)
+			resp := httptest.NewRecorder()
+
+			mapper.Mock.
+				On(
+					"Collection",
+					users.IdentitiesCollection,
+				).
+				Return(
+					mapper,
+				).
+				On(
+					"FindOne",
+					mock.Anything,
+					bson.D{{"provider", "fake"}, {"subject", "1234"}},
+					mock.Anything,
+				).
+				Return(
+					identity,
+					nil,
+				).
+				On(
+					"FindOneById",
+					mock.Anything,
+					user.Id,
+					mock.Anything,
+				).
+				Return(
+					user,
+					nil,
+				).
+				On(
+					"Collection",
+					users.SessionsCollection,
+				).
+				Return(
+					mapper,
+				).
+				On(
+					"Insert",
+					mock.Anything,
+					mock.AnythingOfType("*users.Session"),
+					mock.Anything,
+				).
+				Return(
+					nil,
+					nil,
+				).
+				On(
+					"UpdateById",
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					nil,
+					nil,
+				).
+				On(
+					"Update",
+					mock.Anything,
+					bson.D{{"id", user.Id}},
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					nil,
+					nil,
+				)
+
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, http.StatusOK, resp.Code)
+			assert.Contains(t, resp.Body.String(), "access_token")
+			assert.Contains(t, resp.Body.String(), "refresh_token")
+			assert.NotNil(t, identity.LastLoginAt)
+		})
+	}
+}
+
+func TestHandler_OAuth2Callback_Gate(t *testing.T) {
+	testCases := []struct {
+		name       string
+		update     func(user *users.User)
+		statusCode int
+		msg        string
+	}{
+		{"mfa enabled", func(user *users.User) { user.MFAEnabled = true }, http.StatusAccepted, "mfa_token"},
+		{"password reset required", func(user *users.User) { user.PasswordResetRequired = true }, http.StatusForbidden, "password reset required"},
+		{"suspended", func(user *users.User) { user.Suspend("admin") }, http.StatusForbidden, "account suspended"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mapper, s := getMapperAndServer(t)
+
+			p := newFakeProvider(t)
+			setOAuth2Providers(t, map[string]any{"name": "fake", "issuer": p.URL, "client-id": "client"})
+
+			user := users.NewUser("test@example.com", "test")
+			tc.update(user)
+			identity := users.NewIdentity(user.Id, "fake", &users.OAuth2UserInfo{Subject: "1234", Email: user.Email})
+
+			req := oauth2LogIn(t, s, "fake", p)
+			resp := httptest.NewRecorder()
+
+			mapper.Mock.
+				On(
+					"Collection",
+					users.IdentitiesCollection,
+				).
+				Return(
+					mapper,
+				).
+				On(
+					"FindOne",
+					mock.Anything,
+					bson.D{{"provider", "fake"}, {"subject", "1234"}},
+					mock.Anything,
+				).
+				Return(
+					identity,
+					nil,
+				).
+				On(
+					"FindOneById",
+					mock.Anything,
+					user.Id,
+					mock.Anything,
+				).
+				Return(
+					user,
+					nil,
+				)
+
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, tc.statusCode, resp.Code)
+			assert.Contains(t, resp.Body.String(), tc.msg)
+			assert.NotContains(t, resp.Body.String(), "access_token")
+		})
+	}
+}
+
+func TestHandler_OAuth2Callback_202(t *testing.T) {
+	testCases := []struct {
+		name     string
+		provider func(p *fakeProvider) map[string]any
+		subject  string
+		email    string
+		username string
+		verified bool
+	}{
+		{"OpenID Connect", func(p *fakeProvider) map[string]any {
+			return map[string]any{"name": "fake", "issuer": p.URL, "client-id": "client"}
+		}, "1234", "test@example.com", "test", true},
+		{"OAuth 2.0", func(p *fakeProvider) map[string]any {
+			p.userInfo = map[string]any{"id": 1234567, "login": "octocat", "email": "octocat@example.com"}
+			return map[string]any{
+				"name":         "fake",
+				"client-id":    "client",
+				"auth-url":     p.URL + "/authorize",
+				"token-url":    p.URL + "/token",
+				"userinfo-url": p.URL + "/userinfo",
+				"claims":       map[string]any{"subject": "id", "username": "login"},
+			}
+		}, "1234567", "octocat@example.com", "octocat", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mapper, s := getMapperAndServer(t)
+
+			p := newFakeProvider(t)
+			setOAuth2Providers(t, tc.provider(p))
+
+			req := oauth2LogIn(t, s, "fake", p)
+			resp := httptest.NewRecorder()
+
+			mapper.Mock.
+				On(
+					"Collection",
+					users.IdentitiesCollection,
+				).
+				Return(
+					mapper,
+				).
+				On(
+					"FindOne",
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					nil,
+					users.ErrNoDocuments,
+				)
+
+			s.ServeHTTP(resp, req)
+
+			var result users.OAuth2OnboardingResponse
+			err := json.Unmarshal(resp.Body.Bytes(), &result)
+			assert.NoError(t, err)
+
+			assert.Equal(t, http.StatusAccepted, resp.Code)
+			assert.Equal(t, tc.email, result.Email)
+			assert.Equal(t, tc.username, result.Username)
+
+			token, err := util.ParseToken([]byte(result.OnboardingToken))
+			assert.NoError(t, err)
+			assert.Equal(t, tc.subject, token.Subject())
+			typ, _ := token.Get("type")
+			assert.Equal(t, util.OAuth2OnboardingToken.String(), typ)
+			verified, _ := token.Get("email_verified")
+			assert.Equal(t, tc.verified, verified)
+		})
+	}
+}
+
+func TestHandler_OAuth2Callback_409(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	p := newFakeProvider(t)
+	setOAuth2Providers(t, map[string]any{"name": "fake", "issuer": p.URL, "client-id": "client"})
+
+	req := oauth2LogIn(t, s, "fake", p)
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.IdentitiesCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.AnythingOfType("*users.Identity"),
+		).
+		Return(
+			nil,
+			users.ErrNoDocuments,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			bson.D{{"email", "test@example.com"}},
+			mock.AnythingOfType("*users.User"),
+		).
+		Return(
+			users.NewUser("test@example.com", "test"),
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Contains(t, resp.Body.String(), "log in to link this provider")
+}
+
+func TestHandler_OAuth2Callback_401(t *testing.T) {
+	testCases := []struct {
+		name  string
+		setup func(p *fakeProvider, req *http.Request)
+	}{
+		{"state mismatch", func(p *fakeProvider, req *http.Request) {
+			q := req.URL.Query()
+			q.Set("state", "invalid")
+			req.URL.RawQuery = q.Encode()
+		}},
+		{"state cookie missing", func(p *fakeProvider, req *http.Request) { req.Header.Del("Cookie") }},
+		{"state cookie not signed", func(p *fakeProvider, req *http.Request) {
+			req.Header.Del("Cookie")
+			req.AddCookie(&http.Cookie{Name: "state", Value: req.URL.Query().Get("state")})
+		}},
+		{"code verifier mismatch", func(p *fakeProvider, req *http.Request) { p.challenge = "invalid" }},
+		{"nonce mismatch", func(p *fakeProvider, req *http.Request) { p.nonce = "invalid" }},
+		{"wrong issuer", func(p *fakeProvider, req *http.Request) { p.issuer = "https://invalid.example.com" }},
+		{"wrong audience", func(p *fakeProvider, req *http.Request) { p.audience = "invalid" }},
+		{"userinfo subject mismatch", func(p *fakeProvider, req *http.Request) { p.userInfo["sub"] = "invalid" }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, s := getMapperAndServer(t)
+
+			p := newFakeProvider(t)
+			setOAuth2Providers(t, map[string]any{"name": "fake", "issuer": p.URL, "client-id": "client"})
+
+			req := oauth2LogIn(t, s, "fake", p)
+			tc.setup(p, req)
+			resp := httptest.NewRecorder()
+
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, http.StatusUnauthorized, resp.Code)
+			assert.Contains(t, resp.Body.String(), "failed to log in")
+		})
+	}
+}
+
+func TestHandler_OAuth2Callback_302(t *testing.T) {
+	testCases := []struct {
+		name     string
+		identity bool
+		fragment url.Values
+	}{
+		{"logged in", true, url.Values{}},
+		{"onboarding", false, url.Values{"email": {"test@example.com"}, "username": {"test"}}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mapper, s := getMapperAndServer(t)
+
+			p := newFakeProvider(t)
+			setOAuth2Providers(t, map[string]any{"name": "fake", "issuer": p.URL, "client-id": "client"})
+			setOAuth2RedirectAllowlist(t, "https://app.example.com/")
+
+			user := users.NewUser("test@example.com", "test")
+
+			params := url.Values{"redirect_to": {"https://app.example.com/settings?tab=1"}}
+			login := httptest.NewRequest(http.MethodGet, "/oauth2/fake/login?"+params.Encode(), nil)
+			req := oauth2Follow(t, s, login, "fake", p)
+			resp := httptest.NewRecorder()
+
+			mapper.Mock.
+				On(
+					"Collection",
+					users.IdentitiesCollection,
+				).
+				Return(
+					mapper,
+				)
+
+			if tc.identity {
+				mapper.Mock.
+					On(
+						"FindOne",
+						mock.Anything,
+						mock.Anything,
+						mock.Anything,
+					).
+					Return(
+						users.NewIdentity(user.Id, "fake", &users.OAuth2UserInfo{Subject: "1234"}),
+						nil,
+					).
+					On(
+						"FindOneById",
+						mock.Anything,
+						user.Id,
+						mock.Anything,
+					).
+					Return(
+						user,
+						nil,
+					).
+					On(
+						"Collection",
+						users.SessionsCollection,
+					).
+					Return(
+						mapper,
+					).
+					On(
+						"Insert",
+						mock.Anything,
+						mock.Anything,
+						mock.Anything,
+					).
+					Return(
+						nil,
+						nil,
+					).
+					On(
+						"UpdateById",
+						mock.Anything,
+						mock.Anything,
+						mock.Anything,
+						mock.Anything,
+					).
+					Return(
+						nil,
+						nil,
+					).
+					On(
+						"Update",
+						mock.Anything,
+						bson.D{{"id", user.Id}},
+						mock.Anything,
+						mock.Anything,
+					).
+					Return(
+						nil,
+						nil,
+					)
+			} else {
+				mapper.Mock.
+					On(
+						"FindOne",
+						mock.Anything,
+						mock.Anything,
+						mock.Anything,
+					).
+					Return(
+						nil,
+						users.ErrNoDocuments,
+					)
+			}
+
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, http.StatusFound, resp.Code)
+			location, err := url.Parse(resp.Header().Get("Location"))
+			assert.NoError(t, err)
+			assert.Equal(t, "https://app.example.com/settings?tab=1", location.Scheme+"://"+location.Host+location.Path+"?"+location.RawQuery)
+
+			fragment, err := url.ParseQuery(location.Fragment)
+			assert.NoError(t, err)
+			for k := range tc.fragment {
+				assert.Equal(t, tc.fragment.Get(k), fragment.Get(k))
+			}
+			if tc.identity {
+				assert.Empty(t, location.Fragment)
+			} else {
+				assert.NotEmpty(t, fragment.Get("onboarding_token"))
+			}
+		})
+	}
+}
+
+func TestHandler_OAuth2Callback_302_Error(t *testing.T) {
+	_, s := getMapperAndServer(t)
+
+	p := newFakeProvider(t)
+	setOAuth2Providers(t, map[string]any{"name": "fake", "issuer": p.URL, "client-id": "client"})
+	setOAuth2RedirectAllowlist(t, "https://app.example.com")
+
+	params := url.Values{"redirect_to": {"https://app.example.com/"}}
+	login := httptest.NewRequest(http.MethodGet, "/oauth2/fake/login?"+params.Encode(), nil)
+	req := oauth2Follow(t, s, login, "fake", p)
+	p.nonce = "invalid"
+	resp := httptest.NewRecorder()
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusFound, resp.Code)
+	assert.Equal(t, "https://app.example.com/#error=failed+to+log+in", resp.Header().Get("Location"))
+}
@@ -0,0 +1,99 @@
+package users
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+
+	"github.com/alexferl/echo-boilerplate/config"
+	"github.com/alexferl/echo-boilerplate/util"
+)
+
+// Password policy violation codes.
+const (
+	PasswordTooShort         = "password_too_short"
+	PasswordTooWeak          = "password_too_weak"
+	PasswordContainsUserInfo = "password_contains_user_info"
+	PasswordBreached         = "password_breached"
+)
+
+// PasswordError is a rule of the password policy the value of Field breaks.
+type PasswordError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *PasswordError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// CheckPassword returns the rules of the password policy that password,
+// sent as field, breaks for the user with username and email.
+func CheckPassword(field string, password string, username string, email string) ([]*PasswordError, error) {
+	var errs []*PasswordError
+	violation := func(code string, msg string) {
+		errs = append(errs, &PasswordError{Field: field, Code: code, Message: msg})
+	}
+
+	if n := viper.GetInt(config.PasswordMinLength); utf8.RuneCountInString(password) < n {
+		violation(PasswordTooShort, fmt.Sprintf("must be at least %d characters long", n))
+	}
+
+	local, _, _ := strings.Cut(email, "@")
+	userInputs := []string{username, email, local}
+
+	lower := strings.ToLower(password)
+	for _, s := range userInputs {
+		// short inputs would match too many passwords by chance
+		if len(s) >= 3 && strings.Contains(lower, strings.ToLower(s)) {
+			violation(PasswordContainsUserInfo, "must not contain the username or email")
+			break
+		}
+	}
+
+	if n := viper.GetInt(config.PasswordMinScore); util.PasswordStrength(password, userInputs...) < n {
+		violation(PasswordTooWeak, "is too easy to guess, add words or avoid common patterns")
+	}
+
+	if dir := viper.GetString(config.PasswordBreachedDir); dir != "" {
+		breached, err := util.PasswordBreached(dir, password)
+		if err != nil {
+			return nil, err
+		}
+		if breached {
+			violation(PasswordBreached, "appeared in a data breach, choose another one")
+		}
+	}
+
+	return errs, nil
+}
+
+// checkPassword returns a 422 response listing the rules password breaks,
+// or nil when it follows the password policy.
+func (h *Handler) checkPassword(c echo.Context, field string, password string, username string, email string) func() error {
+	errs, err := CheckPassword(field, password, username, email)
+	if err != nil {
+		return wrap(fmt.Errorf("failed checking password: %v", err))
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	messages := make([]string, 0, len(errs))
+	for _, e := range errs {
+		messages = append(messages, e.Error())
+	}
+
+	m := echo.Map{
+		"message": "Validation error",
+		"errors":  messages,
+		"details": errs,
+	}
+	return wrap(h.Validate(c, http.StatusUnprocessableEntity, m))
+}
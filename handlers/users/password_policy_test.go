@@ -0,0 +1,103 @@
+package users_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/alexferl/echo-boilerplate/config"
+	"github.com/alexferl/echo-boilerplate/handlers/users"
+)
+
+func TestCheckPassword(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	// SHA-1 of "violet-tractor-77-meadow" is FF9D7F2D34457E0F9AA7028BBF63019B9C681257
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "FF9D7"), []byte("F2D34457E0F9AA7028BBF63019B9C681257:12\n"), 0o600)
+	assert.NoError(t, err)
+
+	viper.Set(config.PasswordBreachedDir, dir)
+	t.Cleanup(func() { viper.Set(config.PasswordBreachedDir, "") })
+
+	testCases := []struct {
+		name     string
+		password string
+		codes    []string
+	}{
+		{"valid", "violet-tractor-88-meadow", nil},
+		{"too short", "kT9v#q", []string{users.PasswordTooShort, users.PasswordTooWeak}},
+		{"too weak", "abcdefghijkl", []string{users.PasswordTooWeak}},
+		{"username", "violet-tractor-jdoe", []string{users.PasswordContainsUserInfo}},
+		{"email", "jdoe@example.com-violet", []string{users.PasswordContainsUserInfo, users.PasswordTooWeak}},
+		{"breached", "violet-tractor-77-meadow", []string{users.PasswordBreached}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			errs, err := users.CheckPassword("password", tc.password, "jdoe", "jdoe@example.com")
+			assert.NoError(t, err)
+
+			var codes []string
+			for _, e := range errs {
+				assert.Equal(t, "password", e.Field)
+				codes = append(codes, e.Code)
+			}
+			assert.Equal(t, tc.codes, codes)
+		})
+	}
+}
+
+func TestHandler_Auth_Signup_422_PasswordPolicy(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	payload := &users.AuthSignUpRequest{
+		Email:    "test@example.com",
+		Username: "test",
+		Name:     "Test",
+		Password: "test-password-1234",
+	}
+	b, err := json.Marshal(payload)
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/auth/signup", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+
+	var result struct {
+		Errors  []string              `json:"errors"`
+		Details []users.PasswordError `json:"details"`
+	}
+	err = json.Unmarshal(resp.Body.Bytes(), &result)
+	assert.NoError(t, err)
+	assert.Contains(t, result.Errors, "password: must not contain the username or email")
+	assert.Equal(t, []users.PasswordError{
+		{Field: "password", Code: users.PasswordContainsUserInfo, Message: "must not contain the username or email"},
+		{Field: "password", Code: users.PasswordTooWeak, Message: "is too easy to guess, add words or avoid common patterns"},
+	}, result.Details)
+}
@@ -0,0 +1,92 @@
+package users
+
+import (
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/alexferl/echo-boilerplate/config"
+	"github.com/alexferl/echo-boilerplate/util"
+)
+
+type patCacheEntry struct {
+	id        string
+	userId    string
+	expiresAt time.Time
+}
+
+// patCache remembers the personal access tokens issued as JWTs that were
+// validated recently so the bcrypt compare isn't paid on every request.
+// Entries are keyed by the hash of the encoded token and removed when the
+// token is revoked. They also expire on their own, which bounds how long a
+// token revoked by another instance keeps working.
+type patCache struct {
+	mu      sync.Mutex
+	entries map[string]*patCacheEntry
+}
+
+var validatedPATs = &patCache{entries: map[string]*patCacheEntry{}}
+
+// get returns the id of encodedToken if it was validated recently.
+func (pc *patCache) get(encodedToken string) (string, bool) {
+	key := util.HashToken([]byte(encodedToken))
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	entry, ok := pc.entries[key]
+	if !ok {
+		return "", false
+	}
+
+	if time.Now().After(entry.expiresAt) {
+		delete(pc.entries, key)
+		return "", false
+	}
+
+	return entry.id, true
+}
+
+// set remembers encodedToken until the cache TTL passes or it stops being
+// valid at validUntil.
+func (pc *patCache) set(encodedToken string, pat *PersonalAccessToken, validUntil *time.Time) {
+	ttl := viper.GetDuration(config.PATCacheTTL)
+	if ttl <= 0 {
+		return
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	if validUntil != nil && validUntil.Before(expiresAt) {
+		expiresAt = *validUntil
+	}
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	pc.entries[util.HashToken([]byte(encodedToken))] = &patCacheEntry{
+		id:        pat.Id,
+		userId:    pat.UserId,
+		expiresAt: expiresAt,
+	}
+}
+
+// invalidate removes the entries matching fn.
+func (pc *patCache) invalidate(fn func(*patCacheEntry) bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	for key, entry := range pc.entries {
+		if fn(entry) {
+			delete(pc.entries, key)
+		}
+	}
+}
+
+func (pc *patCache) invalidateToken(id string) {
+	pc.invalidate(func(e *patCacheEntry) bool { return e.id == id })
+}
+
+func (pc *patCache) invalidateUser(userId string) {
+	pc.invalidate(func(e *patCacheEntry) bool { return e.userId == userId })
+}
@@ -0,0 +1,88 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/alexferl/echo-boilerplate/data"
+	"github.com/alexferl/echo-boilerplate/mailer"
+)
+
+// NotifyExpiringPATs emails the owners of the personal access tokens expiring
+// within notice and returns how many were notified. Each token is claimed
+// before its email is sent so that it's only notified once per expiry date,
+// even with several instances running.
+func NotifyExpiringPATs(ctx context.Context, mapper data.Mapper, m mailer.Mailer, notice time.Duration) (int, error) {
+	now := time.Now()
+	filter := bson.D{
+		{"revoked", false},
+		{"expiry_notified_at", nil},
+		{"expires_at", bson.D{{"$gt", now}, {"$lte", now.Add(notice)}}},
+	}
+	claim := bson.D{{"$set", bson.D{{"expiry_notified_at", now}}}}
+
+	n := 0
+	for {
+		result, err := mapper.Collection(PATCollection).FindOneAndUpdate(ctx, filter, claim, &PersonalAccessToken{})
+		if err != nil {
+			if err == ErrNoDocuments {
+				return n, nil
+			}
+			return n, fmt.Errorf("failed claiming expiring personal access token: %v", err)
+		}
+
+		pat := result.(*PersonalAccessToken)
+		result, err = mapper.Collection(UsersCollection).FindOneById(ctx, pat.UserId, &User{})
+		if err != nil {
+			if err == ErrNoDocuments {
+				continue
+			}
+			releasePATExpiryClaim(ctx, mapper, pat.Id)
+			return n, fmt.Errorf("failed getting user: %v", err)
+		}
+
+		user := result.(*User)
+		if user.DeletedAt != nil {
+			continue
+		}
+
+		if err = m.Send(ctx, newPATExpiringMessage(user, pat)); err != nil {
+			releasePATExpiryClaim(ctx, mapper, pat.Id)
+			return n, fmt.Errorf("failed sending email: %v", err)
+		}
+		n++
+	}
+}
+
+// releasePATExpiryClaim undoes the claim on the token id so that it's
+// notified on the next run.
+func releasePATExpiryClaim(ctx context.Context, mapper data.Mapper, id string) {
+	filter := bson.D{{"id", id}}
+	update := bson.D{{"$set", bson.D{{"expiry_notified_at", nil}}}}
+	if _, err := mapper.Collection(PATCollection).Update(ctx, filter, update, nil); err != nil {
+		log.Error().Err(err).Msgf("failed releasing personal access token %s", id)
+	}
+}
+
+// StartPATExpiryNotifier notifies the owners of expiring personal access
+// tokens in the background every interval.
+func StartPATExpiryNotifier(mapper data.Mapper, m mailer.Mailer, notice time.Duration, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			n, err := NotifyExpiringPATs(ctx, mapper, m, notice)
+			cancel()
+			if err != nil {
+				log.Error().Err(err).Msg("failed notifying expiring personal access tokens")
+			} else if n > 0 {
+				log.Info().Msgf("Notified %d expiring personal access tokens", n)
+			}
+		}
+	}()
+}
@@ -0,0 +1,105 @@
+package users_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/alexferl/echo-boilerplate/config"
+	"github.com/alexferl/echo-boilerplate/handlers/users"
+	"github.com/alexferl/echo-boilerplate/mailer"
+	"github.com/alexferl/echo-boilerplate/mocks"
+)
+
+func TestNotifyExpiringPATs(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	mapper := mocks.NewMapper(t)
+	m := &testMailer{messages: make(chan *mailer.Message, 10)}
+
+	user := users.NewUser("test@example.com", "test")
+	pat, _ := newEncryptedPAT(t, user)
+	orphan, _ := newEncryptedPAT(t, users.NewUser("deleted@example.com", "deleted"))
+
+	mapper.Mock.
+		On(
+			"Collection",
+			mock.Anything,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOneAndUpdate",
+			mock.Anything,
+			mock.Anything,
+			mock.MatchedBy(func(update bson.D) bool {
+				return update[0].Value.(bson.D)[0].Key == "expiry_notified_at"
+			}),
+			mock.Anything,
+		).
+		Return(
+			pat,
+			nil,
+		).
+		Once().
+		On(
+			"FindOneAndUpdate",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			orphan,
+			nil,
+		).
+		Once().
+		On(
+			"FindOneAndUpdate",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			users.ErrNoDocuments,
+		).
+		Once().
+		On(
+			"FindOneById",
+			mock.Anything,
+			user.Id,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"FindOneById",
+			mock.Anything,
+			orphan.UserId,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			users.ErrNoDocuments,
+		)
+
+	n, err := users.NotifyExpiringPATs(context.Background(), mapper, m, 7*24*time.Hour)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	msg := m.wait(t)
+	assert.Equal(t, []string{"test@example.com"}, msg.To)
+	assert.Contains(t, msg.Body, pat.Name)
+	assert.Contains(t, msg.Body, viper.GetString(config.FrontendURL)+"/settings/personal-access-tokens/"+pat.Id)
+}
@@ -0,0 +1,109 @@
+package users
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/spf13/viper"
+
+	"github.com/alexferl/echo-boilerplate/config"
+)
+
+// patPolicy limits the personal access tokens of a user, zero means no limit.
+type patPolicy struct {
+	maxLifetime time.Duration
+	maxTokens   int
+}
+
+// newPATPolicy returns the policy of a user with roles. Each limit is the
+// most permissive override of the roles, or the global one when none of the
+// roles overrides it.
+func newPATPolicy(roles []string) *patPolicy {
+	policy := &patPolicy{
+		maxLifetime: viper.GetDuration(config.PATMaxLifetime),
+		maxTokens:   viper.GetInt(config.PATMaxTokens),
+	}
+
+	lifetimes := viper.GetStringMapString(config.PATRoleMaxLifetime)
+	tokens := viper.GetStringMapString(config.PATRoleMaxTokens)
+
+	var lifetime *time.Duration
+	var count *int
+	for _, role := range roles {
+		// the values were validated when the config was loaded
+		if s, ok := lifetimes[role]; ok {
+			d, _ := time.ParseDuration(s)
+			if lifetime == nil || morePermissive(int64(d), int64(*lifetime)) {
+				lifetime = &d
+			}
+		}
+
+		if s, ok := tokens[role]; ok {
+			n, _ := strconv.Atoi(s)
+			if count == nil || morePermissive(int64(n), int64(*count)) {
+				count = &n
+			}
+		}
+	}
+
+	if lifetime != nil {
+		policy.maxLifetime = *lifetime
+	}
+
+	if count != nil {
+		policy.maxTokens = *count
+	}
+
+	return policy
+}
+
+// morePermissive reports whether limit a is more permissive than b.
+func morePermissive(a int64, b int64) bool {
+	return b != 0 && (a == 0 || a > b)
+}
+
+// lifetimeAllowed reports whether a token can expire at expiresAt.
+func (p *patPolicy) lifetimeAllowed(expiresAt time.Time) bool {
+	return p.maxLifetime == 0 || !expiresAt.After(time.Now().Add(p.maxLifetime))
+}
+
+// validAllowedIPs reports whether every entry of ips is a CIDR range.
+func validAllowedIPs(ips []string) bool {
+	for _, ip := range ips {
+		if _, _, err := net.ParseCIDR(ip); err != nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// IPAllowed reports whether a personal access token can be used from ip,
+// tokens without an allowlist can be used from anywhere.
+func IPAllowed(token jwt.Token, ip string) bool {
+	val, ok := token.Get("allowed_ips")
+	if !ok {
+		return true
+	}
+
+	ranges, _ := val.([]interface{})
+	if len(ranges) == 0 {
+		return true
+	}
+
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	for _, r := range ranges {
+		s, _ := r.(string)
+		if _, ipNet, err := net.ParseCIDR(s); err == nil && ipNet.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,152 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/alexferl/echo-boilerplate/config"
+	"github.com/alexferl/echo-boilerplate/data"
+)
+
+type patUsage struct {
+	lastUsedAt time.Time
+	lastUsedIP string
+	count      int64
+}
+
+// patUsageRecorder collects the use of personal access tokens in memory so
+// authenticating a request doesn't wait on a write. FlushPATUsage writes them
+// in batches.
+type patUsageRecorder struct {
+	mu      sync.Mutex
+	pending map[string]*patUsage
+}
+
+var patUsages = &patUsageRecorder{pending: map[string]*patUsage{}}
+
+// RecordPATUsage records a request made from ip with the personal access
+// token id. ip is the client IP found by the trusted proxy IP extractor.
+func RecordPATUsage(id string, ip string) {
+	patUsages.mu.Lock()
+	defer patUsages.mu.Unlock()
+
+	usage, ok := patUsages.pending[id]
+	if !ok {
+		usage = &patUsage{}
+		patUsages.pending[id] = usage
+	}
+
+	usage.lastUsedAt = time.Now()
+	usage.lastUsedIP = ip
+	usage.count++
+}
+
+// take returns the usage recorded so far and starts over.
+func (r *patUsageRecorder) take() map[string]*patUsage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pending := r.pending
+	r.pending = map[string]*patUsage{}
+
+	return pending
+}
+
+// restore puts back usage that couldn't be written.
+func (r *patUsageRecorder) restore(pending map[string]*patUsage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, usage := range pending {
+		current, ok := r.pending[id]
+		if !ok {
+			r.pending[id] = usage
+			continue
+		}
+
+		current.count += usage.count
+	}
+}
+
+// patUsageDay returns the key of the day t is in in request counts.
+func patUsageDay(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// windowRequestCount returns how many requests counts holds for the days
+// within the usage window before now.
+func windowRequestCount(counts map[string]int64, now time.Time) int64 {
+	cutoff := patUsageDay(now.Add(-viper.GetDuration(config.PATUsageWindow)))
+
+	var n int64
+	for day, count := range counts {
+		if day > cutoff {
+			n += count
+		}
+	}
+
+	return n
+}
+
+// FlushPATUsage writes the usage recorded since the last flush and returns
+// for how many tokens. Requests are added to the count of the day they were
+// last made, and the counts of the days out of the usage window are dropped.
+func FlushPATUsage(ctx context.Context, mapper data.Mapper) (int, error) {
+	pending := patUsages.take()
+
+	cutoff := patUsageDay(time.Now().Add(-viper.GetDuration(config.PATUsageWindow)))
+	n := 0
+	for id, usage := range pending {
+		filter := bson.D{{"id", id}}
+		day := fmt.Sprintf("request_counts.%s", patUsageDay(usage.lastUsedAt))
+		counts := bson.D{{"$objectToArray", bson.D{{"$ifNull", bson.A{"$request_counts", bson.D{}}}}}}
+		recent := bson.D{{"$filter", bson.D{
+			{"input", counts},
+			{"cond", bson.D{{"$gt", bson.A{"$$this.k", cutoff}}}},
+		}}}
+		update := mongo.Pipeline{
+			{{"$set", bson.D{
+				{"last_used_at", usage.lastUsedAt},
+				{"last_used_ip", bson.D{{"$literal", usage.lastUsedIP}}},
+				{"request_counts", bson.D{{"$arrayToObject", recent}}},
+			}}},
+			{{"$set", bson.D{
+				{day, bson.D{{"$add", bson.A{bson.D{{"$ifNull", bson.A{"$" + day, 0}}}, usage.count}}}},
+			}}},
+		}
+		_, err := mapper.Collection(PATCollection).Update(ctx, filter, update, nil)
+		if err != nil {
+			patUsages.restore(pending)
+			return n, fmt.Errorf("failed updating personal access token usage: %v", err)
+		}
+
+		delete(pending, id)
+		n++
+	}
+
+	return n, nil
+}
+
+// StartPATUsageFlusher writes the usage of personal access tokens in the
+// background every interval.
+func StartPATUsageFlusher(mapper data.Mapper, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			_, err := FlushPATUsage(ctx, mapper)
+			cancel()
+			if err != nil {
+				log.Error().Err(err).Msg("failed flushing personal access token usage")
+			}
+		}
+	}()
+}
@@ -0,0 +1,124 @@
+package users_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/alexferl/echo-boilerplate/config"
+	"github.com/alexferl/echo-boilerplate/handlers/users"
+	"github.com/alexferl/echo-boilerplate/mocks"
+)
+
+func TestFlushPATUsage(t *testing.T) {
+	mapper := mocks.NewMapper(t)
+
+	users.RecordPATUsage("pat", "127.0.0.1")
+	users.RecordPATUsage("pat", "127.0.0.2")
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.PATCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Update",
+			mock.Anything,
+			bson.D{{"id", "pat"}},
+			mock.MatchedBy(func(update mongo.Pipeline) bool {
+				set := update[0][0].Value.(bson.D)
+				ip := set[1].Value.(bson.D)[0].Value
+				count := update[1][0].Value.(bson.D)[0]
+				add := count.Value.(bson.D)[0].Value.(bson.A)
+				day := fmt.Sprintf("request_counts.%s", time.Now().UTC().Format("2006-01-02"))
+				return ip == "127.0.0.2" && count.Key == day && add[1] == int64(2)
+			}),
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		).
+		Once()
+
+	n, err := users.FlushPATUsage(context.Background(), mapper)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	n, err = users.FlushPATUsage(context.Background(), mapper)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestFlushPATUsage_Error(t *testing.T) {
+	mapper := mocks.NewMapper(t)
+
+	users.RecordPATUsage("pat", "127.0.0.1")
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.PATCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Update",
+			mock.Anything,
+			bson.D{{"id", "pat"}},
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			errors.New("error"),
+		).
+		Once().
+		On(
+			"Update",
+			mock.Anything,
+			bson.D{{"id", "pat"}},
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		).
+		Once()
+
+	_, err := users.FlushPATUsage(context.Background(), mapper)
+	assert.Error(t, err)
+
+	n, err := users.FlushPATUsage(context.Background(), mapper)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestPATRequestCount_Window(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	day := func(d time.Duration) string {
+		return time.Now().Add(-d).UTC().Format("2006-01-02")
+	}
+
+	pat := &users.PersonalAccessToken{RequestCounts: map[string]int64{
+		day(0):                   3,
+		day(24 * time.Hour):      2,
+		day(40 * 24 * time.Hour): 100,
+	}}
+
+	assert.Equal(t, int64(5), pat.MakeResponse().RequestCount, "days out of the window aren't counted")
+}
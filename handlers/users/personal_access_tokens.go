@@ -5,57 +5,161 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/lestrrat-go/jwx/v2/jwt"
 	"github.com/rs/xid"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/viper"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/exp/slices"
 
+	"github.com/alexferl/echo-boilerplate/config"
+	"github.com/alexferl/echo-boilerplate/data"
 	"github.com/alexferl/echo-boilerplate/util"
 )
 
 const PATCollection = "personal_access_tokens"
 
 type PersonalAccessToken struct {
-	Id        string     `json:"id" bson:"id"`
-	Name      string     `json:"name" bson:"name"`
-	Revoked   bool       `json:"revoked" bson:"revoked"`
-	UserId    string     `json:"user_id" bson:"user_id"`
-	CreatedAt *time.Time `json:"created_at" bson:"created_at"`
-	ExpiresAt *time.Time `json:"expires_at" bson:"expires_at"`
-	Token     string     `json:"token" bson:"token"`
+	Id         string     `json:"id" bson:"id"`
+	Name       string     `json:"name" bson:"name"`
+	Revoked    bool       `json:"revoked" bson:"revoked"`
+	UserId     string     `json:"user_id" bson:"user_id"`
+	CreatedAt  *time.Time `json:"created_at" bson:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at" bson:"expires_at"`
+	Scopes     []string   `json:"scopes" bson:"scopes"`
+	AllowedIPs []string   `json:"allowed_ips" bson:"allowed_ips"`
+	Token      string     `json:"token" bson:"token"`
+	TokenHash  string     `json:"-" bson:"token_hash"`
+	Roles      []string   `json:"-" bson:"roles"`
+	RotatedAt  *time.Time `json:"rotated_at" bson:"rotated_at"`
+
+	// PreviousTokenHash is the hash of the token replaced by the last
+	// rotation, it keeps working until PreviousTokenExpiresAt. PreviousToken
+	// is the same for tokens issued as JWTs.
+	PreviousToken          string     `json:"-" bson:"previous_token"`
+	PreviousTokenHash      string     `json:"-" bson:"previous_token_hash"`
+	PreviousTokenExpiresAt *time.Time `json:"-" bson:"previous_token_expires_at"`
+	ExpiryNotifiedAt       *time.Time `json:"-" bson:"expiry_notified_at"`
+
+	// RequestCounts are the requests made with the token by UTC day, only
+	// the days within the usage window are kept. RequestCount is their sum.
+	LastUsedAt    *time.Time       `json:"last_used_at" bson:"last_used_at"`
+	LastUsedIP    string           `json:"last_used_ip" bson:"last_used_ip"`
+	RequestCounts map[string]int64 `json:"-" bson:"request_counts"`
+	RequestCount  int64            `json:"request_count" bson:"-"`
 }
 
-func (pat *PersonalAccessToken) Encrypt() error {
-	b, err := bcrypt.GenerateFromPassword([]byte(pat.Token), bcrypt.DefaultCost)
-	if err != nil {
-		return err
+// Encrypt replaces the token by its SHA-256 hash, which is enough for random
+// tokens and lets them be looked up by hash.
+func (pat *PersonalAccessToken) Encrypt() {
+	pat.TokenHash = util.HashToken([]byte(pat.Token))
+	pat.Token = ""
+}
+
+// Validate returns an error unless s is the token issued as a JWT or the
+// previous one during its grace period. The JWTs were hashed with bcrypt.
+func (pat *PersonalAccessToken) Validate(s string) error {
+	err := compareToken(pat.Token, s)
+	if err != nil && pat.inGracePeriod() {
+		return compareToken(pat.PreviousToken, s)
 	}
 
-	pat.Token = string(b)
+	return err
+}
 
-	return nil
+// validUntil returns when the token matching s stops being valid.
+func (pat *PersonalAccessToken) validUntil(s string) *time.Time {
+	if pat.inGracePeriod() && compareToken(pat.Token, s) != nil {
+		return pat.PreviousTokenExpiresAt
+	}
+
+	return pat.ExpiresAt
 }
 
-func (pat *PersonalAccessToken) Validate(s string) error {
-	return bcrypt.CompareHashAndPassword([]byte(pat.Token), []byte(s))
+func (pat *PersonalAccessToken) inGracePeriod() bool {
+	return pat.PreviousTokenExpiresAt != nil && time.Now().Before(*pat.PreviousTokenExpiresAt)
 }
 
+func compareToken(hash string, s string) error {
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(util.HashToken([]byte(s)))); err == nil {
+		return nil
+	}
+
+	// tokens encrypted before they were hashed first
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(s))
+}
+
+const (
+	PATActive  = "active"
+	PATExpired = "expired"
+	PATRevoked = "revoked"
+)
+
 type PATWithoutToken struct {
-	Id        string     `json:"id" bson:"id"`
-	Name      string     `json:"name" bson:"name"`
-	Revoked   bool       `json:"revoked" bson:"revoked"`
-	UserId    string     `json:"user_id" bson:"user_id"`
-	CreatedAt *time.Time `json:"created_at" bson:"created_at"`
-	ExpiresAt *time.Time `json:"expires_at" bson:"expires_at"`
+	Id         string     `json:"id" bson:"id"`
+	Name       string     `json:"name" bson:"name"`
+	Revoked    bool       `json:"revoked" bson:"revoked"`
+	UserId     string     `json:"user_id" bson:"user_id"`
+	CreatedAt  *time.Time `json:"created_at" bson:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at" bson:"expires_at"`
+	Scopes     []string   `json:"scopes" bson:"scopes"`
+	AllowedIPs []string   `json:"allowed_ips" bson:"allowed_ips"`
+	RotatedAt  *time.Time `json:"rotated_at" bson:"rotated_at"`
+	Status     string     `json:"status" bson:"-"`
+
+	LastUsedAt    *time.Time       `json:"last_used_at" bson:"last_used_at"`
+	LastUsedIP    string           `json:"last_used_ip" bson:"last_used_ip"`
+	RequestCounts map[string]int64 `json:"-" bson:"request_counts"`
+	RequestCount  int64            `json:"request_count" bson:"-"`
+}
+
+// setStatus sets whether the token is active, expired or revoked, and how
+// many requests it made within the usage window.
+func (pat *PATWithoutToken) setStatus() {
+	now := time.Now()
+	switch {
+	case pat.Revoked:
+		pat.Status = PATRevoked
+	case pat.ExpiresAt != nil && now.After(*pat.ExpiresAt):
+		pat.Status = PATExpired
+	default:
+		pat.Status = PATActive
+	}
+
+	pat.RequestCount = windowRequestCount(pat.RequestCounts, now)
+}
+
+// Scopes limit what a personal access token can do on top of the roles of
+// its user, each scope is granted by a role. The routes a scope allows are
+// the p2 policies of the Casbin model.
+var Scopes = map[string]Role{
+	"user:read":   UserRole,
+	"user:write":  UserRole,
+	"tasks:read":  UserRole,
+	"tasks:write": UserRole,
+	"admin:read":  AdminRole,
+	"admin:write": AdminRole,
 }
 
-var ErrExpiresAtPast = errors.New("expires_at cannot be in the past")
+var (
+	ErrExpiresAtPast      = errors.New("expires_at cannot be in the past")
+	ErrScopeNotHeld       = errors.New("scopes must be held by the user")
+	ErrGracePeriodTooLong = errors.New("grace_period is too long")
+	ErrLifetimeTooLong    = errors.New("expires_at is beyond the maximum lifetime of personal access tokens")
+	ErrTooManyTokens      = errors.New("maximum number of personal access tokens reached")
+	ErrInvalidAllowedIPs  = errors.New("allowed_ips must be CIDR ranges")
+)
 
-func NewPersonalAccessToken(token jwt.Token, name string, expiresAt string) (*PersonalAccessToken, error) {
+// NewPersonalAccessToken returns a token for the user of token limited to
+// scopes, which token must hold itself.
+func NewPersonalAccessToken(token jwt.Token, name string, expiresAt string, scopes []string) (*PersonalAccessToken, error) {
 	t, err := time.Parse("2006-01-02", expiresAt)
 	if err != nil {
 		return nil, err
@@ -66,8 +170,15 @@ func NewPersonalAccessToken(token jwt.Token, name string, expiresAt string) (*Pe
 		return nil, ErrExpiresAtPast
 	}
 
-	roles := util.GetRoles(token)
-	pat, err := util.GeneratePersonalToken(token.Subject(), t.Sub(now), map[string]any{"roles": roles})
+	if !newPATPolicy(util.GetRoles(token)).lifetimeAllowed(t) {
+		return nil, ErrLifetimeTooLong
+	}
+
+	if err = checkScopes(token, scopes); err != nil {
+		return nil, err
+	}
+
+	encoded, err := util.GenerateOpaqueToken(viper.GetString(config.PATPrefix))
 	if err != nil {
 		return nil, err
 	}
@@ -76,26 +187,134 @@ func NewPersonalAccessToken(token jwt.Token, name string, expiresAt string) (*Pe
 		Id:        xid.New().String(),
 		Name:      name,
 		UserId:    token.Subject(),
-		Token:     string(pat),
+		Token:     encoded,
+		Roles:     util.GetRoles(token),
 		CreatedAt: &now,
 		ExpiresAt: &t,
+		Scopes:    scopes,
 	}, nil
 }
 
+// checkScopes returns ErrScopeNotHeld unless token holds every scope.
+func checkScopes(token jwt.Token, scopes []string) error {
+	held, scoped := util.GetScopes(token)
+	for _, scope := range scopes {
+		role, ok := Scopes[scope]
+		if !ok || !util.HasRole(token, role.String()) || (scoped && !slices.Contains(held, scope)) {
+			return ErrScopeNotHeld
+		}
+	}
+
+	return nil
+}
+
+// Rotate replaces the token by a new one with the same lifetime and returns
+// it. The old token keeps working for gracePeriod, a token still in the grace
+// period of an earlier rotation stops working right away.
+func (pat *PersonalAccessToken) Rotate(token jwt.Token, gracePeriod time.Duration) (string, error) {
+	if err := checkScopes(token, pat.Scopes); err != nil {
+		return "", err
+	}
+
+	encoded, err := util.GenerateOpaqueToken(viper.GetString(config.PATPrefix))
+	if err != nil {
+		return "", err
+	}
+
+	issuedAt := pat.CreatedAt
+	if pat.RotatedAt != nil {
+		issuedAt = pat.RotatedAt
+	}
+
+	// the lifetime is capped in case the policy changed since
+	now := time.Now()
+	lifetime := pat.ExpiresAt.Sub(*issuedAt)
+	if max := newPATPolicy(util.GetRoles(token)).maxLifetime; max > 0 && lifetime > max {
+		lifetime = max
+	}
+	expiresAt := now.Add(lifetime)
+
+	previous, previousHash := pat.Token, pat.TokenHash
+	pat.Token = encoded
+	pat.Encrypt()
+
+	pat.PreviousToken = ""
+	pat.PreviousTokenHash = ""
+	pat.PreviousTokenExpiresAt = nil
+	if gracePeriod > 0 {
+		graceEnd := now.Add(gracePeriod)
+		pat.PreviousToken = previous
+		pat.PreviousTokenHash = previousHash
+		pat.PreviousTokenExpiresAt = &graceEnd
+	}
+
+	pat.Roles = util.GetRoles(token)
+	pat.ExpiresAt = &expiresAt
+	pat.RotatedAt = &now
+	pat.ExpiryNotifiedAt = nil
+
+	return encoded, nil
+}
+
+// jwt returns the claims of an opaque token as a token for the middlewares
+// that run after it's parsed.
+func (pat *PersonalAccessToken) jwt() (jwt.Token, error) {
+	roles := make([]any, 0, len(pat.Roles))
+	for _, role := range pat.Roles {
+		roles = append(roles, role)
+	}
+
+	b := jwt.NewBuilder().
+		JwtID(pat.Id).
+		Subject(pat.UserId).
+		IssuedAt(*pat.CreatedAt).
+		Expiration(*pat.ExpiresAt).
+		Claim("type", util.PersonalToken.String()).
+		Claim("roles", roles)
+
+	if pat.Scopes != nil {
+		scopes := make([]any, 0, len(pat.Scopes))
+		for _, scope := range pat.Scopes {
+			scopes = append(scopes, scope)
+		}
+		b = b.Claim("scopes", scopes)
+	}
+
+	if len(pat.AllowedIPs) > 0 {
+		ips := make([]any, 0, len(pat.AllowedIPs))
+		for _, ip := range pat.AllowedIPs {
+			ips = append(ips, ip)
+		}
+		b = b.Claim("allowed_ips", ips)
+	}
+
+	return b.Build()
+}
+
 func (pat *PersonalAccessToken) MakeResponse() *PATWithoutToken {
 	return &PATWithoutToken{
-		Id:        pat.Id,
-		Name:      pat.Name,
-		Revoked:   pat.Revoked,
-		UserId:    pat.UserId,
-		CreatedAt: pat.CreatedAt,
-		ExpiresAt: pat.ExpiresAt,
+		Id:         pat.Id,
+		Name:       pat.Name,
+		Revoked:    pat.Revoked,
+		UserId:     pat.UserId,
+		CreatedAt:  pat.CreatedAt,
+		ExpiresAt:  pat.ExpiresAt,
+		Scopes:     pat.Scopes,
+		AllowedIPs: pat.AllowedIPs,
+		RotatedAt:  pat.RotatedAt,
+
+		LastUsedAt:    pat.LastUsedAt,
+		LastUsedIP:    pat.LastUsedIP,
+		RequestCounts: pat.RequestCounts,
+		RequestCount:  windowRequestCount(pat.RequestCounts, time.Now()),
 	}
 }
 
 type CreatePATRequest struct {
-	Name      string `json:"name" bson:"name"`
-	ExpiresAt string `json:"expires_at" bson:"expires_at"`
+	Name       string   `json:"name" bson:"name"`
+	ExpiresAt  string   `json:"expires_at" bson:"expires_at"`
+	Scopes     []string `json:"scopes" bson:"scopes"`
+	AllowedIPs []string `json:"allowed_ips,omitempty" bson:"allowed_ips"`
 }
 
 func (h *Handler) CreatePersonalAccessToken(c echo.Context) error {
@@ -120,26 +339,47 @@ func (h *Handler) CreatePersonalAccessToken(c echo.Context) error {
 		return h.Validate(c, http.StatusConflict, echo.Map{"message": "token name already in-use"})
 	}
 
-	newPAT, err := NewPersonalAccessToken(token, body.Name, body.ExpiresAt)
+	invalid := func(err error) error {
+		m := echo.Map{
+			"message": "Validation error",
+			"errors":  []string{err.Error()},
+		}
+		return h.Validate(c, http.StatusUnprocessableEntity, m)
+	}
+
+	if !validAllowedIPs(body.AllowedIPs) {
+		return invalid(ErrInvalidAllowedIPs)
+	}
+
+	newPAT, err := NewPersonalAccessToken(token, body.Name, body.ExpiresAt, body.Scopes)
 	if err != nil {
-		if err == ErrExpiresAtPast {
-			m := echo.Map{
-				"message": "Validation error",
-				"errors":  []string{ErrExpiresAtPast.Error()},
-			}
-			return h.Validate(c, http.StatusUnprocessableEntity, m)
+		if err == ErrExpiresAtPast || err == ErrScopeNotHeld || err == ErrLifetimeTooLong {
+			return invalid(err)
 		}
 		return fmt.Errorf("failed generating personal access token: %v", err)
 	}
 
-	decodedToken := newPAT.Token
-	if err = newPAT.Encrypt(); err != nil {
-		return fmt.Errorf("failed encrypting personal access token: %v", err)
+	newPAT.AllowedIPs = body.AllowedIPs
+
+	max := newPATPolicy(util.GetRoles(token)).maxTokens
+	reserved, err := h.reservePATSlot(ctx, newPAT, max)
+	if err != nil {
+		return err
 	}
 
+	if !reserved {
+		return invalid(ErrTooManyTokens)
+	}
+
+	decodedToken := newPAT.Token
+	newPAT.Encrypt()
+
 	opts := options.FindOneAndUpdate().SetUpsert(true)
 	upsert, err := h.Mapper.Collection(PATCollection).Upsert(ctx, filter, newPAT, &PersonalAccessToken{}, opts)
 	if err != nil {
+		if err := h.releasePATSlots(ctx, token.Subject(), newPAT.Id); err != nil {
+			log.Error().Err(err).Msg("failed releasing personal access token slot")
+		}
 		return fmt.Errorf("failed inserting personal access token: %v", err)
 	}
 
@@ -153,18 +393,32 @@ type ListPATResponse struct {
 	Tokens []*PATWithoutToken `json:"personal_access_tokens"`
 }
 
+// ListPersonalAccessTokens lists the tokens of the authenticated user,
+// unused_days only lists the ones that weren't used for that many days.
 func (h *Handler) ListPersonalAccessTokens(c echo.Context) error {
 	token := c.Get("token").(jwt.Token)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	filter := bson.D{{"user_id", token.Subject()}}
+	if days, err := strconv.Atoi(c.QueryParam("unused_days")); err == nil && days > 0 {
+		cutoff := time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+		filter = append(filter, bson.E{"$or", bson.A{
+			bson.D{{"last_used_at", bson.D{{"$lte", cutoff}}}},
+			bson.D{{"last_used_at", nil}, {"created_at", bson.D{{"$lte", cutoff}}}},
+		}})
+	}
 	result, err := h.Mapper.Collection(PATCollection).Find(ctx, filter, []*PATWithoutToken{})
 	if err != nil {
 		return fmt.Errorf("failed getting personal access token: %v", err)
 	}
 
-	return h.Validate(c, http.StatusOK, ListPATResponse{Tokens: result.([]*PATWithoutToken)})
+	tokens := result.([]*PATWithoutToken)
+	for _, pat := range tokens {
+		pat.setStatus()
+	}
+
+	return h.Validate(c, http.StatusOK, ListPATResponse{Tokens: tokens})
 }
 
 func (h *Handler) GetPersonalAccessToken(c echo.Context) error {
@@ -175,6 +429,78 @@ func (h *Handler) GetPersonalAccessToken(c echo.Context) error {
 		return errResp()
 	}
 
+	pat.setStatus()
+
+	return h.Validate(c, http.StatusOK, pat)
+}
+
+type RotatePATRequest struct {
+	GracePeriod int `json:"grace_period"`
+}
+
+// RotatePersonalAccessToken issues a new secret for a token with the same
+// name and scopes. The old secret keeps working for grace_period seconds.
+func (h *Handler) RotatePersonalAccessToken(c echo.Context) error {
+	body := &RotatePATRequest{}
+	if err := c.Bind(body); err != nil {
+		return err
+	}
+
+	gracePeriod := time.Duration(body.GracePeriod) * time.Second
+	if gracePeriod > viper.GetDuration(config.PATRotationMaxGracePeriod) {
+		m := echo.Map{
+			"message": "Validation error",
+			"errors":  []string{ErrGracePeriodTooLong.Error()},
+		}
+		return h.Validate(c, http.StatusUnprocessableEntity, m)
+	}
+
+	token := c.Get("token").(jwt.Token)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	filter := bson.D{{"id", c.Param("id")}, {"user_id", token.Subject()}}
+	result, err := h.Mapper.Collection(PATCollection).FindOne(ctx, filter, &PersonalAccessToken{})
+	if err != nil {
+		if err == ErrNoDocuments {
+			return h.Validate(c, http.StatusNotFound, echo.Map{"message": "personal access token not found"})
+		}
+		return fmt.Errorf("failed getting personal access token: %v", err)
+	}
+
+	pat := result.(*PersonalAccessToken)
+	if pat.Revoked {
+		return h.Validate(c, http.StatusConflict, echo.Map{"message": "personal access token revoked"})
+	}
+	if pat.ExpiresAt != nil && time.Now().After(*pat.ExpiresAt) {
+		return h.Validate(c, http.StatusConflict, echo.Map{"message": "personal access token expired"})
+	}
+
+	previous := bson.D{{"token", pat.Token}, {"token_hash", pat.TokenHash}}
+	decodedToken, err := pat.Rotate(token, gracePeriod)
+	if err != nil {
+		if err == ErrScopeNotHeld {
+			m := echo.Map{
+				"message": "Validation error",
+				"errors":  []string{err.Error()},
+			}
+			return h.Validate(c, http.StatusUnprocessableEntity, m)
+		}
+		return fmt.Errorf("failed rotating personal access token: %v", err)
+	}
+
+	rotated, err := h.saveRotatedPAT(ctx, pat, previous)
+	if err != nil {
+		return err
+	} else if !rotated {
+		return h.Validate(c, http.StatusConflict, echo.Map{"message": "personal access token changed"})
+	}
+
+	validatedPATs.invalidateToken(pat.Id)
+
+	pat.Token = decodedToken
+	pat.RequestCount = windowRequestCount(pat.RequestCounts, time.Now())
+
 	return h.Validate(c, http.StatusOK, pat)
 }
 
@@ -186,20 +512,214 @@ func (h *Handler) RevokePersonalAccessToken(c echo.Context) error {
 		return errResp()
 	}
 
-	pat.Revoked = true
-	_, err := h.Mapper.Collection(PATCollection).UpdateById(ctx, c.Param("id"), pat, nil)
+	// only revoked is set so that usage flushed concurrently isn't overwritten
+	filter := bson.D{{"id", pat.Id}, {"user_id", pat.UserId}}
+	update := bson.D{{"$set", bson.D{{"revoked", true}}}}
+	_, err := h.Mapper.Collection(PATCollection).Update(ctx, filter, update, nil)
 	if err != nil {
-		return fmt.Errorf("failed inserting personal access token: %v", err)
+		return fmt.Errorf("failed revoking personal access token: %v", err)
+	}
+
+	if err = h.releasePATSlots(ctx, pat.UserId, pat.Id); err != nil {
+		return err
 	}
 
+	validatedPATs.invalidateToken(pat.Id)
+
 	return h.Validate(c, http.StatusNoContent, nil)
 }
 
+// revokePersonalAccessTokens revokes all the personal access tokens of a user.
+func (h *Handler) revokePersonalAccessTokens(ctx context.Context, userId string) error {
+	filter := bson.D{{"user_id", userId}, {"revoked", false}}
+	update := bson.D{{"$set", bson.D{{"revoked", true}}}}
+	_, err := h.Mapper.Collection(PATCollection).UpdateMany(ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("failed revoking personal access tokens: %v", err)
+	}
+
+	if err = h.releasePATSlots(ctx, userId); err != nil {
+		return err
+	}
+
+	validatedPATs.invalidateUser(userId)
+
+	return nil
+}
+
+// saveRotatedPAT stores the fields Rotate changed, unless the token was
+// revoked or rotated again since it was read: previous is the token before
+// the rotation. It reports whether pat was saved. The slot of the token is
+// extended to its new expiry first, so that a failure can only keep the slot
+// longer than the token and never let the user go over the cap.
+func (h *Handler) saveRotatedPAT(ctx context.Context, pat *PersonalAccessToken, previous bson.D) (bool, error) {
+	slot := bson.D{{"id", pat.UserId}, {"pat_slots.id", pat.Id}}
+	extend := bson.D{{"$max", bson.D{{"pat_slots.$.expires_at", pat.ExpiresAt}}}}
+	_, err := h.Mapper.Collection(UsersCollection).Update(ctx, slot, extend, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed updating personal access token slot: %v", err)
+	}
+
+	filter := append(bson.D{{"id", pat.Id}, {"user_id", pat.UserId}, {"revoked", false}}, previous...)
+	update := bson.D{{"$set", bson.D{
+		{"token", pat.Token},
+		{"token_hash", pat.TokenHash},
+		{"previous_token", pat.PreviousToken},
+		{"previous_token_hash", pat.PreviousTokenHash},
+		{"previous_token_expires_at", pat.PreviousTokenExpiresAt},
+		{"roles", pat.Roles},
+		{"expires_at", pat.ExpiresAt},
+		{"rotated_at", pat.RotatedAt},
+		{"expiry_notified_at", pat.ExpiryNotifiedAt},
+	}}}
+	res, err := h.Mapper.Collection(PATCollection).Update(ctx, filter, update, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed updating personal access token: %v", err)
+	}
+
+	return res.(*mongo.UpdateResult).MatchedCount == 1, nil
+}
+
+// reservePATSlot records pat in the slots of its user, unless the user
+// already has max live tokens. The check and the write are a single update
+// so that concurrent requests can't both take the last slot. Slots of
+// expired tokens are dropped by the same update since nothing else tracks
+// when tokens expire.
+func (h *Handler) reservePATSlot(ctx context.Context, pat *PersonalAccessToken, max int) (bool, error) {
+	now := time.Now()
+	live := bson.D{{"$filter", bson.D{
+		{"input", bson.D{{"$ifNull", bson.A{"$pat_slots", bson.A{}}}}},
+		{"cond", bson.D{{"$gt", bson.A{"$$this.expires_at", now}}}},
+	}}}
+
+	filter := bson.D{{"id", pat.UserId}}
+	if max > 0 {
+		filter = append(filter, bson.E{"$expr", bson.D{{"$lt", bson.A{bson.D{{"$size", live}}, max}}}})
+	}
+
+	slot := bson.D{{"id", pat.Id}, {"expires_at", pat.ExpiresAt}}
+	update := mongo.Pipeline{
+		{{"$set", bson.D{{"pat_slots", bson.D{{"$concatArrays", bson.A{live, bson.A{slot}}}}}}}},
+	}
+	res, err := h.Mapper.Collection(UsersCollection).Update(ctx, filter, update, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed reserving personal access token slot: %v", err)
+	}
+
+	return res.(*mongo.UpdateResult).MatchedCount == 1, nil
+}
+
+// releasePATSlots frees the slots of the tokens ids of a user, or all of
+// them when ids is empty.
+func (h *Handler) releasePATSlots(ctx context.Context, userId string, ids ...string) error {
+	update := bson.D{{"$set", bson.D{{"pat_slots", bson.A{}}}}}
+	if len(ids) > 0 {
+		update = bson.D{{"$pull", bson.D{{"pat_slots", bson.D{{"id", bson.D{{"$in", ids}}}}}}}}
+	}
+
+	filter := bson.D{{"id", userId}}
+	_, err := h.Mapper.Collection(UsersCollection).Update(ctx, filter, update, nil)
+	if err != nil {
+		return fmt.Errorf("failed releasing personal access token slots: %v", err)
+	}
+
+	return nil
+}
+
+// ParsePersonalAccessToken returns the token encodedToken stands for, it's
+// looked up by its hash. It returns ErrTokenMismatch if there's no such token,
+// ErrTokenRevoked if it was revoked and ErrTokenExpired if it expired.
+func ParsePersonalAccessToken(ctx context.Context, mapper data.Mapper, encodedToken string) (jwt.Token, error) {
+	if !util.ValidOpaqueToken(viper.GetString(config.PATPrefix), encodedToken) {
+		return nil, ErrTokenMismatch
+	}
+
+	hash := util.HashToken([]byte(encodedToken))
+	filter := bson.D{{"$or", bson.A{
+		bson.D{{"token_hash", hash}},
+		bson.D{{"previous_token_hash", hash}},
+	}}}
+	result, err := mapper.Collection(PATCollection).FindOne(ctx, filter, &PersonalAccessToken{})
+	if err != nil {
+		if err == ErrNoDocuments {
+			return nil, ErrTokenMismatch
+		}
+		return nil, fmt.Errorf("failed getting personal access token: %v", err)
+	}
+
+	pat := result.(*PersonalAccessToken)
+	if pat.TokenHash != hash && !pat.inGracePeriod() {
+		return nil, ErrTokenExpired
+	}
+
+	if pat.Revoked {
+		return nil, ErrTokenRevoked
+	}
+
+	if time.Now().After(*pat.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+
+	return pat.jwt()
+}
+
+// ValidatePersonalAccessToken returns the id of encodedToken, a personal
+// access token issued as a JWT. It returns ErrTokenMismatch unless it's a
+// token of its user and ErrTokenRevoked if it was revoked.
+// Tokens are looked up by their jti, the tokens issued before it was their id
+// are compared with every token of their user.
+func ValidatePersonalAccessToken(ctx context.Context, mapper data.Mapper, token jwt.Token, encodedToken string) (string, error) {
+	if id, ok := validatedPATs.get(encodedToken); ok {
+		return id, nil
+	}
+
+	filter := bson.D{{"id", token.JwtID()}, {"user_id", token.Subject()}}
+	result, err := mapper.Collection(PATCollection).FindOne(ctx, filter, &PersonalAccessToken{})
+	if err != nil && err != ErrNoDocuments {
+		return "", fmt.Errorf("failed getting personal access token: %v", err)
+	}
+
+	var pat *PersonalAccessToken
+	if err == nil {
+		pat = result.(*PersonalAccessToken)
+		if pat.Validate(encodedToken) != nil {
+			return "", ErrTokenMismatch
+		}
+	} else {
+		filter = bson.D{{"user_id", token.Subject()}}
+		result, err = mapper.Collection(PATCollection).Find(ctx, filter, []*PersonalAccessToken{})
+		if err != nil {
+			return "", fmt.Errorf("failed getting personal access tokens: %v", err)
+		}
+
+		// the old tokens of a user can match each other's hash, any of
+		// them being revoked is enough to refuse the token
+		for _, p := range result.([]*PersonalAccessToken) {
+			if p.Validate(encodedToken) != nil {
+				continue
+			}
+			if pat == nil || p.Revoked {
+				pat = p
+			}
+		}
+
+		if pat == nil {
+			return "", ErrTokenMismatch
+		}
+	}
+
+	if pat.Revoked {
+		return "", ErrTokenRevoked
+	}
+
+	validatedPATs.set(encodedToken, pat, pat.validUntil(encodedToken))
+
+	return pat.Id, nil
+}
+
 func (h *Handler) getToken(ctx context.Context, c echo.Context) (*PATWithoutToken, func() error) {
-	taskId := c.Param("id")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	filter := bson.D{{"id", taskId}}
+	token := c.Get("token").(jwt.Token)
+	filter := bson.D{{"id", c.Param("id")}, {"user_id", token.Subject()}}
 	result, err := h.Mapper.Collection(PATCollection).FindOne(ctx, filter, &PATWithoutToken{})
 	if err != nil {
 		if err == ErrNoDocuments {
@@ -2,6 +2,7 @@ package users_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -9,12 +10,19 @@ import (
 	"testing"
 	"time"
 
+	"github.com/labstack/echo/v4"
 	"github.com/lestrrat-go/jwx/v2/jwt"
-
+	"github.com/rs/xid"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"golang.org/x/crypto/bcrypt"
 
+	"github.com/alexferl/echo-boilerplate/config"
 	"github.com/alexferl/echo-boilerplate/handlers/users"
+	"github.com/alexferl/echo-boilerplate/mocks"
 	"github.com/alexferl/echo-boilerplate/util"
 )
 
@@ -22,7 +30,7 @@ func TestHandler_CreatePersonalAccessToken_200(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	token, err := util.ParseToken(access)
@@ -31,11 +39,12 @@ func TestHandler_CreatePersonalAccessToken_200(t *testing.T) {
 	payload := &users.CreatePATRequest{
 		Name:      "My Token",
 		ExpiresAt: time.Now().Add((7 * 24) * time.Hour).Format("2006-01-02"),
+		Scopes:    []string{"tasks:read"},
 	}
 	b, err := json.Marshal(payload)
 	assert.NoError(t, err)
 
-	newPAT, err := users.NewPersonalAccessToken(token, payload.Name, payload.ExpiresAt)
+	newPAT, err := users.NewPersonalAccessToken(token, payload.Name, payload.ExpiresAt, payload.Scopes)
 	assert.NoError(t, err)
 
 	req := httptest.NewRequest(http.MethodPost, "/user/personal_access_tokens", bytes.NewBuffer(b))
@@ -61,6 +70,19 @@ func TestHandler_CreatePersonalAccessToken_200(t *testing.T) {
 			nil,
 			nil,
 		).
+		On(
+			"Update",
+			mock.Anything,
+			mock.MatchedBy(func(filter bson.D) bool {
+				return len(filter) == 2 && filter[0].Value == user.Id && filter[1].Key == "$expr"
+			}),
+			mock.AnythingOfType("mongo.Pipeline"),
+			mock.Anything,
+		).
+		Return(
+			&mongo.UpdateResult{MatchedCount: 1},
+			nil,
+		).
 		On(
 			"Collection",
 			mock.Anything,
@@ -106,7 +128,7 @@ func TestHandler_CreatePersonalAccessToken_409(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	token, err := util.ParseToken(access)
@@ -115,11 +137,12 @@ func TestHandler_CreatePersonalAccessToken_409(t *testing.T) {
 	payload := &users.CreatePATRequest{
 		Name:      "My Token",
 		ExpiresAt: time.Now().Add((7 * 24) * time.Hour).Format("2006-01-02"),
+		Scopes:    []string{"tasks:read"},
 	}
 	b, err := json.Marshal(payload)
 	assert.NoError(t, err)
 
-	newPAT, err := users.NewPersonalAccessToken(token, payload.Name, payload.ExpiresAt)
+	newPAT, err := users.NewPersonalAccessToken(token, payload.Name, payload.ExpiresAt, payload.Scopes)
 	assert.NoError(t, err)
 
 	req := httptest.NewRequest(http.MethodPost, "/user/personal_access_tokens", bytes.NewBuffer(b))
@@ -155,7 +178,7 @@ func TestHandler_CreatePersonalAccessToken_422(t *testing.T) {
 	_, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	payload := &users.CreatePATRequest{
@@ -183,6 +206,7 @@ func createTokens(t *testing.T, token jwt.Token, num int) []*users.PATWithoutTok
 			token,
 			fmt.Sprintf("my_token%d", i),
 			time.Now().Add((7*24)*time.Hour).Format("2006-01-02"),
+			[]string{"tasks:read"},
 		)
 		assert.NoError(t, err)
 		resp := pat.MakeResponse()
@@ -196,7 +220,7 @@ func TestHandler_ListPersonalAccessTokens_200(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	token, err := util.ParseToken(access)
@@ -238,6 +262,54 @@ func TestHandler_ListPersonalAccessTokens_200(t *testing.T) {
 	assert.Equal(t, 10, len(result.Tokens))
 }
 
+func TestHandler_ListPersonalAccessTokens_200_UnusedDays(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	token, err := util.ParseToken(access)
+	assert.NoError(t, err)
+
+	tokens := createTokens(t, token, 2)
+
+	req := httptest.NewRequest(http.MethodGet, "/user/personal_access_tokens?unused_days=30", nil)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			mock.Anything,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.MatchedBy(func(filter bson.D) bool {
+				return len(filter) == 2 && filter[1].Key == "$or"
+			}),
+			mock.Anything,
+		).
+		Return(
+			tokens,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	var result users.ListPATResponse
+	err = json.Unmarshal(resp.Body.Bytes(), &result)
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, 2, len(result.Tokens))
+}
+
 func TestHandler_ListPersonalAccessTokens_401(t *testing.T) {
 	_, s := getMapperAndServer(t)
 
@@ -254,7 +326,7 @@ func TestHandler_GetPersonalAccessToken_200(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	token, err := util.ParseToken(access)
@@ -264,6 +336,7 @@ func TestHandler_GetPersonalAccessToken_200(t *testing.T) {
 		token,
 		fmt.Sprintf("my_token"),
 		time.Now().Add((7*24)*time.Hour).Format("2006-01-02"),
+		[]string{"tasks:read"},
 	)
 	assert.NoError(t, err)
 	pat := newPAT.MakeResponse()
@@ -305,7 +378,7 @@ func TestHandler_GetPersonalAccessToken_404(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	req := httptest.NewRequest(http.MethodGet, "/user/personal_access_tokens/id", nil)
@@ -341,7 +414,7 @@ func TestHandler_RevokePersonalAccessToken_204(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	token, err := util.ParseToken(access)
@@ -351,6 +424,7 @@ func TestHandler_RevokePersonalAccessToken_204(t *testing.T) {
 		token,
 		fmt.Sprintf("my_token"),
 		time.Now().Add((7*24)*time.Hour).Format("2006-01-02"),
+		[]string{"tasks:read"},
 	)
 	assert.NoError(t, err)
 	pat := newPAT.MakeResponse()
@@ -379,14 +453,25 @@ func TestHandler_RevokePersonalAccessToken_204(t *testing.T) {
 			nil,
 		).
 		On(
-			"UpdateById",
+			"Update",
 			mock.Anything,
+			bson.D{{"id", pat.Id}, {"user_id", pat.UserId}},
+			bson.D{{"$set", bson.D{{"revoked", true}}}},
 			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		).
+		On(
+			"Update",
 			mock.Anything,
+			bson.D{{"id", pat.UserId}},
+			bson.D{{"$pull", bson.D{{"pat_slots", bson.D{{"id", bson.D{{"$in", []string{pat.Id}}}}}}}}},
 			mock.Anything,
 		).
 		Return(
-			nil,
+			&mongo.UpdateResult{MatchedCount: 1},
 			nil,
 		)
 
@@ -399,7 +484,7 @@ func TestHandler_RevokePersonalAccessToken_404(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	req := httptest.NewRequest(http.MethodDelete, "/user/personal_access_tokens/id", nil)
@@ -430,3 +515,1002 @@ func TestHandler_RevokePersonalAccessToken_404(t *testing.T) {
 
 	assert.Equal(t, http.StatusNotFound, resp.Code)
 }
+
+func TestHandler_CreatePersonalAccessToken_422_Scopes(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	payload := &users.CreatePATRequest{
+		Name:      "My Token",
+		ExpiresAt: time.Now().Add((7 * 24) * time.Hour).Format("2006-01-02"),
+		Scopes:    []string{"tasks:read", "admin:read"},
+	}
+	b, err := json.Marshal(payload)
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/user/personal_access_tokens", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			mock.Anything,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			users.ErrNoDocuments,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+	assert.Contains(t, resp.Body.String(), users.ErrScopeNotHeld.Error())
+}
+
+func TestNewPersonalAccessToken_Scopes(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+	token, err := util.ParseToken(access)
+	assert.NoError(t, err)
+
+	expiresAt := time.Now().Add((7 * 24) * time.Hour).Format("2006-01-02")
+	scoped, err := users.NewPersonalAccessToken(token, "scoped", expiresAt, []string{"user:write", "tasks:read"})
+	assert.NoError(t, err)
+	assert.True(t, util.ValidOpaqueToken(viper.GetString(config.PATPrefix), scoped.Token))
+	assert.Equal(t, []string{"user:write", "tasks:read"}, scoped.Scopes)
+
+	claims := map[string]any{"roles": user.Roles, "scopes": scoped.Scopes}
+	encoded, err := util.GeneratePersonalToken(user.Id, time.Hour, claims)
+	assert.NoError(t, err)
+	scopedToken, err := util.ParseToken(encoded)
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name   string
+		token  jwt.Token
+		scopes []string
+		err    error
+	}{
+		{"held", token, []string{"tasks:write"}, nil},
+		{"unknown scope", token, []string{"invalid"}, users.ErrScopeNotHeld},
+		{"role not held", token, []string{"admin:read"}, users.ErrScopeNotHeld},
+		{"subset of token scopes", scopedToken, []string{"tasks:read"}, nil},
+		{"scope not held by token", scopedToken, []string{"tasks:write"}, users.ErrScopeNotHeld},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := users.NewPersonalAccessToken(tc.token, "my_token", expiresAt, tc.scopes)
+			assert.Equal(t, tc.err, err)
+		})
+	}
+}
+
+func TestHandler_PersonalAccessToken_403_Scopes(t *testing.T) {
+	_, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	_, encoded, _ := newLegacyPAT(t, user)
+
+	req := httptest.NewRequest(http.MethodGet, "/user", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", encoded))
+	resp := httptest.NewRecorder()
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Contains(t, resp.Body.String(), "Token scopes don't allow this request")
+}
+
+func TestHandler_PersonalAccessToken_403_Impersonate(t *testing.T) {
+	_, s := getMapperAndServer(t)
+
+	admin := users.NewAdminUser("admin@example.com", "admin")
+	claims := map[string]any{"jti": xid.New().String(), "roles": admin.Roles, "scopes": []string{"admin:write"}}
+	encoded, err := util.GeneratePersonalToken(admin.Id, 7*24*time.Hour, claims)
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/users/1/impersonate", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", encoded))
+	resp := httptest.NewRecorder()
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Contains(t, resp.Body.String(), "Token scopes don't allow this request")
+}
+
+// newLegacyPAT returns a personal access token issued as a JWT as it's stored
+// along with its encoded and parsed token.
+func newLegacyPAT(t *testing.T, user *users.User) (*users.PersonalAccessToken, string, jwt.Token) {
+	id := xid.New().String()
+	claims := map[string]any{"jti": id, "roles": user.Roles, "scopes": []string{"tasks:read"}}
+	encoded, err := util.GeneratePersonalToken(user.Id, 7*24*time.Hour, claims)
+	assert.NoError(t, err)
+	parsed, err := util.ParseToken(encoded)
+	assert.NoError(t, err)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(util.HashToken(encoded)), bcrypt.MinCost)
+	assert.NoError(t, err)
+
+	now := time.Now()
+	expiresAt := now.Add(7 * 24 * time.Hour)
+	pat := &users.PersonalAccessToken{
+		Id:        id,
+		Name:      "my_token",
+		UserId:    user.Id,
+		Token:     string(hash),
+		CreatedAt: &now,
+		ExpiresAt: &expiresAt,
+		Scopes:    []string{"tasks:read"},
+	}
+
+	return pat, string(encoded), parsed
+}
+
+// newEncryptedPAT returns a personal access token as it's stored along with
+// the token.
+func newEncryptedPAT(t *testing.T, user *users.User) (*users.PersonalAccessToken, string) {
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+	token, err := util.ParseToken(access)
+	assert.NoError(t, err)
+
+	pat, err := users.NewPersonalAccessToken(
+		token,
+		"my_token",
+		time.Now().Add((7*24)*time.Hour).Format("2006-01-02"),
+		[]string{"tasks:read"},
+	)
+	assert.NoError(t, err)
+
+	encoded := pat.Token
+	pat.Encrypt()
+
+	return pat, encoded
+}
+
+func TestValidatePersonalAccessToken(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	user := users.NewUser("test@example.com", "test")
+
+	testCases := []struct {
+		name    string
+		revoked bool
+		other   bool
+		legacy  bool
+		err     error
+	}{
+		{"valid", false, false, false, nil},
+		{"revoked", true, false, false, users.ErrTokenRevoked},
+		{"other token", false, true, false, users.ErrTokenMismatch},
+		{"legacy token", false, false, true, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pat, encoded, token := newLegacyPAT(t, user)
+			pat.Revoked = tc.revoked
+			assert.Equal(t, pat.Id, token.JwtID())
+			if tc.other {
+				pat, _, _ = newLegacyPAT(t, user)
+			}
+
+			mapper := mocks.NewMapper(t)
+			mapper.Mock.
+				On(
+					"Collection",
+					users.PATCollection,
+				).
+				Return(
+					mapper,
+				)
+
+			if tc.legacy {
+				other, _, _ := newLegacyPAT(t, user)
+				mapper.Mock.
+					On(
+						"FindOne",
+						mock.Anything,
+						mock.Anything,
+						mock.Anything,
+					).
+					Return(
+						nil,
+						users.ErrNoDocuments,
+					).
+					On(
+						"Find",
+						mock.Anything,
+						mock.Anything,
+						mock.Anything,
+					).
+					Return(
+						[]*users.PersonalAccessToken{other, pat},
+						nil,
+					)
+			} else {
+				mapper.Mock.
+					On(
+						"FindOne",
+						mock.Anything,
+						mock.Anything,
+						mock.Anything,
+					).
+					Return(
+						pat,
+						nil,
+					)
+			}
+
+			_, err := users.ValidatePersonalAccessToken(context.Background(), mapper, token, encoded)
+			assert.Equal(t, tc.err, err)
+		})
+	}
+}
+
+func TestValidatePersonalAccessToken_Cache(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	pat, encoded, token := newLegacyPAT(t, user)
+
+	db := mocks.NewMapper(t)
+	db.Mock.
+		On(
+			"Collection",
+			users.PATCollection,
+		).
+		Return(
+			db,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			pat,
+			nil,
+		).
+		Once()
+
+	// the second validation is served by the cache
+	for i := 0; i < 2; i++ {
+		_, err = users.ValidatePersonalAccessToken(context.Background(), db, token, encoded)
+		assert.NoError(t, err)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/user/personal_access_tokens/%s", pat.Id), nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			mock.Anything,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			pat.MakeResponse(),
+			nil,
+		).
+		On(
+			"Update",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+
+	// revoking the token removed it from the cache
+	pat.Revoked = true
+	db.Mock.
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			pat,
+			nil,
+		)
+
+	_, err = users.ValidatePersonalAccessToken(context.Background(), db, token, encoded)
+	assert.Equal(t, users.ErrTokenRevoked, err)
+}
+
+func TestHandler_ListPersonalAccessTokens_200_Status(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	token, err := util.ParseToken(access)
+	assert.NoError(t, err)
+
+	tokens := createTokens(t, token, 3)
+	expired := time.Now().Add(-time.Hour)
+	tokens[1].ExpiresAt = &expired
+	tokens[2].Revoked = true
+
+	req := httptest.NewRequest(http.MethodGet, "/user/personal_access_tokens", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			mock.Anything,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			tokens,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	var result users.ListPATResponse
+	err = json.Unmarshal(resp.Body.Bytes(), &result)
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	if assert.Len(t, result.Tokens, 3) {
+		assert.Equal(t, users.PATActive, result.Tokens[0].Status)
+		assert.Equal(t, users.PATExpired, result.Tokens[1].Status)
+		assert.Equal(t, users.PATRevoked, result.Tokens[2].Status)
+	}
+}
+
+func TestHandler_RotatePersonalAccessToken_200(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	pat, encoded, _ := newLegacyPAT(t, user)
+	expiresAt := *pat.ExpiresAt
+
+	b, err := json.Marshal(&users.RotatePATRequest{GracePeriod: 3600})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/user/personal_access_tokens/%s/rotate", pat.Id), bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.PATCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			pat,
+			nil,
+		).
+		On(
+			"Collection",
+			users.UsersCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Update",
+			mock.Anything,
+			bson.D{{"id", user.Id}, {"pat_slots.id", pat.Id}},
+			mock.MatchedBy(func(update bson.D) bool {
+				return update[0].Key == "$max" && update[0].Value.(bson.D)[0].Key == "pat_slots.$.expires_at"
+			}),
+			mock.Anything,
+		).
+		Return(
+			&mongo.UpdateResult{MatchedCount: 1},
+			nil,
+		).
+		On(
+			"Update",
+			mock.Anything,
+			bson.D{
+				{"id", pat.Id},
+				{"user_id", user.Id},
+				{"revoked", false},
+				{"token", pat.Token},
+				{"token_hash", pat.TokenHash},
+			},
+			mock.MatchedBy(func(update bson.D) bool {
+				// usage is left to the usage tracking
+				set := update[0].Value.(bson.D)
+				for _, e := range set {
+					if e.Key == "request_counts" || e.Key == "last_used_at" {
+						return false
+					}
+				}
+				return len(update) == 1 && update[0].Key == "$set"
+			}),
+			mock.Anything,
+		).
+		Return(
+			&mongo.UpdateResult{MatchedCount: 1},
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	var result users.PersonalAccessToken
+	err = json.Unmarshal(resp.Body.Bytes(), &result)
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, pat.Id, result.Id)
+	assert.Equal(t, "my_token", result.Name)
+	assert.Equal(t, []string{"tasks:read"}, result.Scopes)
+	assert.NotEqual(t, encoded, result.Token)
+	assert.NotNil(t, result.RotatedAt)
+	assert.True(t, result.ExpiresAt.After(expiresAt))
+
+	assert.True(t, util.ValidOpaqueToken(viper.GetString(config.PATPrefix), result.Token))
+}
+
+func TestHandler_RotatePersonalAccessToken_404(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/user/personal_access_tokens/id/rotate", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.PATCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			users.ErrNoDocuments,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
+
+func TestHandler_RotatePersonalAccessToken_409(t *testing.T) {
+	testCases := []struct {
+		name    string
+		revoked bool
+		expired bool
+		msg     string
+	}{
+		{"revoked", true, false, "personal access token revoked"},
+		{"expired", false, true, "personal access token expired"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mapper, s := getMapperAndServer(t)
+
+			user := users.NewUser("test@example.com", "test")
+			access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+			assert.NoError(t, err)
+
+			pat, _, _ := newLegacyPAT(t, user)
+			pat.Revoked = tc.revoked
+			if tc.expired {
+				expiresAt := time.Now().Add(-time.Hour)
+				pat.ExpiresAt = &expiresAt
+			}
+
+			req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/user/personal_access_tokens/%s/rotate", pat.Id), nil)
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+			resp := httptest.NewRecorder()
+
+			mapper.Mock.
+				On(
+					"Collection",
+					users.PATCollection,
+				).
+				Return(
+					mapper,
+				).
+				On(
+					"FindOne",
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					pat,
+					nil,
+				)
+
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, http.StatusConflict, resp.Code)
+			assert.Contains(t, resp.Body.String(), tc.msg)
+		})
+	}
+}
+
+func TestHandler_RotatePersonalAccessToken_409_Rotated(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	pat, _, _ := newLegacyPAT(t, user)
+
+	req := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/user/personal_access_tokens/%s/rotate", pat.Id), nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	// another request rotated or revoked the token after it was read
+	mapper.Mock.
+		On(
+			"Collection",
+			users.PATCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			pat,
+			nil,
+		).
+		On(
+			"Collection",
+			users.UsersCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Update",
+			mock.Anything,
+			bson.D{{"id", user.Id}, {"pat_slots.id", pat.Id}},
+			mock.MatchedBy(func(update bson.D) bool {
+				return update[0].Key == "$max" && update[0].Value.(bson.D)[0].Key == "pat_slots.$.expires_at"
+			}),
+			mock.Anything,
+		).
+		Return(
+			&mongo.UpdateResult{MatchedCount: 1},
+			nil,
+		).
+		On(
+			"Update",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			&mongo.UpdateResult{MatchedCount: 0},
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusConflict, resp.Code)
+	assert.Contains(t, resp.Body.String(), "personal access token changed")
+}
+
+func TestHandler_RotatePersonalAccessToken_422(t *testing.T) {
+	_, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(&users.RotatePATRequest{GracePeriod: 30 * 24 * 3600})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/user/personal_access_tokens/id/rotate", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+	assert.Contains(t, resp.Body.String(), users.ErrGracePeriodTooLong.Error())
+}
+
+func TestPersonalAccessToken_Rotate(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	user := users.NewUser("test@example.com", "test")
+
+	testCases := []struct {
+		name        string
+		gracePeriod time.Duration
+		oldValid    bool
+	}{
+		{"no grace period", 0, false},
+		{"grace period", time.Hour, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pat, encoded, token := newLegacyPAT(t, user)
+
+			rotated, err := pat.Rotate(token, tc.gracePeriod)
+			assert.NoError(t, err)
+
+			assert.Equal(t, util.HashToken([]byte(rotated)), pat.TokenHash)
+			assert.Equal(t, tc.oldValid, pat.Validate(encoded) == nil)
+
+			// rotating again ends the grace period of the first token
+			_, err = pat.Rotate(token, tc.gracePeriod)
+			assert.NoError(t, err)
+			assert.Error(t, pat.Validate(encoded))
+		})
+	}
+}
+
+func TestParsePersonalAccessToken(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	user := users.NewUser("test@example.com", "test")
+
+	testCases := []struct {
+		name     string
+		revoked  bool
+		expired  bool
+		rotated  bool
+		graceEnd time.Duration
+		notFound bool
+		err      error
+	}{
+		{"valid", false, false, false, 0, false, nil},
+		{"revoked", true, false, false, 0, false, users.ErrTokenRevoked},
+		{"expired", false, true, false, 0, false, users.ErrTokenExpired},
+		{"not found", false, false, false, 0, true, users.ErrTokenMismatch},
+		{"rotated in grace period", false, false, true, time.Hour, false, nil},
+		{"rotated after grace period", false, false, true, -time.Hour, false, users.ErrTokenExpired},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pat, encoded := newEncryptedPAT(t, user)
+			pat.Roles = user.Roles
+			pat.Revoked = tc.revoked
+			if tc.expired {
+				expiresAt := time.Now().Add(-time.Hour)
+				pat.ExpiresAt = &expiresAt
+			}
+			if tc.rotated {
+				graceEnd := time.Now().Add(tc.graceEnd)
+				pat.PreviousTokenHash = pat.TokenHash
+				pat.PreviousTokenExpiresAt = &graceEnd
+				pat.TokenHash = util.HashToken([]byte("new"))
+			}
+
+			mapper := mocks.NewMapper(t)
+			mapper.Mock.
+				On(
+					"Collection",
+					users.PATCollection,
+				).
+				Return(
+					mapper,
+				)
+
+			if tc.notFound {
+				mapper.Mock.
+					On(
+						"FindOne",
+						mock.Anything,
+						mock.Anything,
+						mock.Anything,
+					).
+					Return(
+						nil,
+						users.ErrNoDocuments,
+					)
+			} else {
+				mapper.Mock.
+					On(
+						"FindOne",
+						mock.Anything,
+						mock.Anything,
+						mock.Anything,
+					).
+					Return(
+						pat,
+						nil,
+					)
+			}
+
+			token, err := users.ParsePersonalAccessToken(context.Background(), mapper, encoded)
+			assert.Equal(t, tc.err, err)
+			if tc.err != nil {
+				return
+			}
+
+			typ, _ := token.Get("type")
+			assert.Equal(t, util.PersonalToken.String(), typ)
+			assert.Equal(t, pat.Id, token.JwtID())
+			assert.Equal(t, user.Id, token.Subject())
+			assert.True(t, util.HasRole(token, users.UserRole.String()))
+			scopes, ok := util.GetScopes(token)
+			assert.True(t, ok)
+			assert.Equal(t, []string{"tasks:read"}, scopes)
+		})
+	}
+}
+
+func TestParsePersonalAccessToken_Invalid(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	// tokens with a bad checksum are refused without a lookup
+	mapper := mocks.NewMapper(t)
+	_, err := users.ParsePersonalAccessToken(context.Background(), mapper, "ebp_invalid")
+	assert.Equal(t, users.ErrTokenMismatch, err)
+}
+
+func TestHandler_CreatePersonalAccessToken_422_Policy(t *testing.T) {
+	testCases := []struct {
+		name       string
+		expiresAt  time.Time
+		allowedIPs []string
+		matched    int64
+		err        error
+	}{
+		{"lifetime too long", time.Now().Add(2 * 365 * 24 * time.Hour), nil, -1, users.ErrLifetimeTooLong},
+		{"invalid allowed ips", time.Now().Add(24 * time.Hour), []string{"10.0.0.1"}, -1, users.ErrInvalidAllowedIPs},
+		{"too many tokens", time.Now().Add(24 * time.Hour), nil, 0, users.ErrTooManyTokens},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mapper, s := getMapperAndServer(t)
+
+			user := users.NewUser("test@example.com", "test")
+			access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+			assert.NoError(t, err)
+
+			payload := &users.CreatePATRequest{
+				Name:       "My Token",
+				ExpiresAt:  tc.expiresAt.Format("2006-01-02"),
+				Scopes:     []string{"tasks:read"},
+				AllowedIPs: tc.allowedIPs,
+			}
+			b, err := json.Marshal(payload)
+			assert.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "/user/personal_access_tokens", bytes.NewBuffer(b))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+			resp := httptest.NewRecorder()
+
+			mapper.Mock.
+				On(
+					"Collection",
+					mock.Anything,
+				).
+				Return(
+					mapper,
+				).
+				On(
+					"FindOne",
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					nil,
+					users.ErrNoDocuments,
+				)
+
+			if tc.matched >= 0 {
+				mapper.Mock.
+					On(
+						"Update",
+						mock.Anything,
+						mock.Anything,
+						mock.Anything,
+						mock.Anything,
+					).
+					Return(
+						&mongo.UpdateResult{MatchedCount: tc.matched},
+						nil,
+					)
+			}
+
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+			assert.Contains(t, resp.Body.String(), tc.err.Error())
+		})
+	}
+}
+
+func TestNewPersonalAccessToken_RoleMaxLifetime(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	viper.Set(config.PATRoleMaxLifetime, map[string]string{"admin": "0s", "user": "720h"})
+	t.Cleanup(func() { viper.Set(config.PATRoleMaxLifetime, map[string]string{}) })
+
+	expiresAt := time.Now().Add(2 * 365 * 24 * time.Hour).Format("2006-01-02")
+
+	testCases := []struct {
+		name      string
+		user      *users.User
+		expiresAt string
+		err       error
+	}{
+		{"role override", users.NewUser("test@example.com", "test"), time.Now().Add(60 * 24 * time.Hour).Format("2006-01-02"), users.ErrLifetimeTooLong},
+		{"within role override", users.NewUser("test@example.com", "test"), time.Now().Add(7 * 24 * time.Hour).Format("2006-01-02"), nil},
+		{"most permissive role", users.NewAdminUser("admin@example.com", "admin"), expiresAt, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			access, _, err := tc.user.Login(users.NewSession(tc.user.Id, "", ""))
+			assert.NoError(t, err)
+			token, err := util.ParseToken(access)
+			assert.NoError(t, err)
+
+			_, err = users.NewPersonalAccessToken(token, "my_token", tc.expiresAt, []string{"tasks:read"})
+			assert.Equal(t, tc.err, err)
+		})
+	}
+}
+
+func TestHandler_PersonalAccessToken_403_AllowedIPs(t *testing.T) {
+	_, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	claims := map[string]any{"jti": xid.New().String(), "roles": user.Roles, "allowed_ips": []string{"10.0.0.0/8"}}
+	encoded, err := util.GeneratePersonalToken(user.Id, time.Hour, claims)
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/user", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", encoded))
+	resp := httptest.NewRecorder()
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Contains(t, resp.Body.String(), "Token not allowed from this IP address")
+}
+
+func TestHandler_PersonalAccessToken_403_AllowedIPs_Spoofed(t *testing.T) {
+	_, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	claims := map[string]any{"jti": xid.New().String(), "roles": user.Roles, "allowed_ips": []string{"10.0.0.0/8"}}
+	encoded, err := util.GeneratePersonalToken(user.Id, time.Hour, claims)
+	assert.NoError(t, err)
+
+	// the peer isn't a trusted proxy so the headers must be ignored
+	req := httptest.NewRequest(http.MethodGet, "/user", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", encoded))
+	req.Header.Set(echo.HeaderXForwardedFor, "10.0.0.1")
+	req.Header.Set(echo.HeaderXRealIP, "10.0.0.1")
+	resp := httptest.NewRecorder()
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Contains(t, resp.Body.String(), "Token not allowed from this IP address")
+}
+
+func TestIPAllowed(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	user := users.NewUser("test@example.com", "test")
+
+	testCases := []struct {
+		name       string
+		allowedIPs []string
+		ip         string
+		allowed    bool
+	}{
+		{"no allowlist", nil, "192.0.2.1", true},
+		{"in range", []string{"10.0.0.0/8", "192.0.2.0/24"}, "192.0.2.1", true},
+		{"out of range", []string{"10.0.0.0/8"}, "192.0.2.1", false},
+		{"ipv6", []string{"2001:db8::/32"}, "2001:db8::1", true},
+		{"invalid ip", []string{"10.0.0.0/8"}, "invalid", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			claims := map[string]any{"roles": user.Roles}
+			if tc.allowedIPs != nil {
+				claims["allowed_ips"] = tc.allowedIPs
+			}
+			encoded, err := util.GeneratePersonalToken(user.Id, time.Hour, claims)
+			assert.NoError(t, err)
+			token, err := util.ParseToken(encoded)
+			assert.NoError(t, err)
+
+			assert.Equal(t, tc.allowed, users.IPAllowed(token, tc.ip))
+		})
+	}
+}
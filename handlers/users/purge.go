@@ -0,0 +1,84 @@
+package users
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/alexferl/echo-boilerplate/data"
+)
+
+// purgeUser permanently removes the personal information of a deleted user
+// along with their sessions, personal access tokens, identities, exports and lockouts.
+func purgeUser(ctx context.Context, mapper data.Mapper, bucket data.Bucket, user *User) error {
+	email := user.Email
+	user.Pseudonymize()
+	_, err := mapper.Collection(UsersCollection).UpdateById(ctx, user.Id, user, nil)
+	if err != nil {
+		return fmt.Errorf("failed updating user: %v", err)
+	}
+
+	filter := bson.D{{"user_id", user.Id}}
+	for _, collection := range []string{SessionsCollection, PATCollection, IdentitiesCollection} {
+		_, err = mapper.Collection(collection).Delete(ctx, filter)
+		if err != nil {
+			return fmt.Errorf("failed deleting %s: %v", collection, err)
+		}
+	}
+
+	if err = removeExports(ctx, mapper, bucket, filter, nil); err != nil {
+		return err
+	}
+
+	filter = bson.D{{"type", LoginAttemptAccount}, {"key", strings.ToLower(email)}}
+	_, err = mapper.Collection(LoginAttemptsCollection).Delete(ctx, filter)
+	if err != nil {
+		return fmt.Errorf("failed deleting login attempts: %v", err)
+	}
+
+	return nil
+}
+
+// PurgeDeletedUsers purges the deleted users whose grace period ended
+// and returns how many were purged.
+func PurgeDeletedUsers(ctx context.Context, mapper data.Mapper, bucket data.Bucket) (int, error) {
+	filter := bson.D{
+		{"deleted_at", bson.D{{"$ne", nil}}},
+		{"purge_at", bson.D{{"$lte", time.Now()}}},
+	}
+	result, err := mapper.Collection(UsersCollection).Find(ctx, filter, []*User{})
+	if err != nil {
+		return 0, fmt.Errorf("failed getting deleted users: %v", err)
+	}
+
+	users := result.([]*User)
+	for _, user := range users {
+		if err = purgeUser(ctx, mapper, bucket, user); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(users), nil
+}
+
+// StartPurger purges deleted users in the background every interval.
+func StartPurger(mapper data.Mapper, bucket data.Bucket, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			n, err := PurgeDeletedUsers(ctx, mapper, bucket)
+			cancel()
+			if err != nil {
+				log.Error().Err(err).Msg("failed purging deleted users")
+			} else if n > 0 {
+				log.Info().Msgf("Purged %d deleted users", n)
+			}
+		}
+	}()
+}
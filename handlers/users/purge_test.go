@@ -0,0 +1,84 @@
+package users_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/alexferl/echo-boilerplate/handlers/users"
+	"github.com/alexferl/echo-boilerplate/mocks"
+)
+
+func TestPurgeDeletedUsers(t *testing.T) {
+	mapper := mocks.NewMapper(t)
+
+	user := users.NewUser("test@example.com", "test")
+	user.Name = "Test User"
+	user.Bio = "Hello"
+	user.Delete(user.Id)
+
+	mapper.Mock.
+		On(
+			"Collection",
+			mock.Anything,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.AnythingOfType("[]*users.Export"),
+		).
+		Return(
+			[]*users.Export{},
+			nil,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			[]*users.User{user},
+			nil,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			user.Id,
+			user,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		).
+		On(
+			"Delete",
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			int64(1),
+			nil,
+		)
+
+	n, err := users.PurgeDeletedUsers(context.Background(), mapper, newTestBucket())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, fmt.Sprintf("%s@deleted.invalid", user.Id), user.Email)
+	assert.Equal(t, fmt.Sprintf("deleted-%s", user.Id), user.Username)
+	assert.Empty(t, user.Name)
+	assert.Empty(t, user.Bio)
+	assert.NotNil(t, user.DeletedAt)
+
+	public := user.Public()
+	assert.Equal(t, users.DeletedUsername, public.Username)
+	assert.Equal(t, users.DeletedName, public.Name)
+}
@@ -0,0 +1,97 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/alexferl/echo-boilerplate/data"
+	"github.com/alexferl/echo-boilerplate/util"
+)
+
+const RevokedTokensCollection = "revoked_tokens"
+
+var (
+	ErrTokenRevoked  = errors.New("token revoked")
+	ErrUserSuspended = errors.New("user suspended")
+)
+
+// RevokedToken is a denylist entry for a token that must stop working
+// before it expires. It is removed by a TTL index once the token expires.
+type RevokedToken struct {
+	Id        string     `json:"id" bson:"id"`
+	UserId    string     `json:"user_id" bson:"user_id"`
+	ExpiresAt *time.Time `json:"expires_at" bson:"expires_at"`
+	CreatedAt *time.Time `json:"created_at" bson:"created_at"`
+}
+
+func NewRevokedToken(token jwt.Token) *RevokedToken {
+	t := time.Now()
+	exp := token.Expiration()
+	return &RevokedToken{
+		Id:        token.JwtID(),
+		UserId:    token.Subject(),
+		ExpiresAt: &exp,
+		CreatedAt: &t,
+	}
+}
+
+func (h *Handler) revokeToken(ctx context.Context, token jwt.Token) error {
+	_, err := h.Mapper.Collection(RevokedTokensCollection).Insert(ctx, NewRevokedToken(token), nil)
+	if err != nil {
+		return fmt.Errorf("failed revoking token: %v", err)
+	}
+
+	return nil
+}
+
+// CheckTokenRevoked returns ErrTokenRevoked if token is on the denylist.
+func CheckTokenRevoked(ctx context.Context, mapper data.Mapper, token jwt.Token) error {
+	filter := bson.D{{"id", token.JwtID()}}
+	_, err := mapper.Collection(RevokedTokensCollection).FindOne(ctx, filter, &RevokedToken{})
+	if err == nil {
+		return ErrTokenRevoked
+	} else if err != ErrNoDocuments {
+		return fmt.Errorf("failed getting revoked token: %v", err)
+	}
+
+	return nil
+}
+
+// CheckTokenUser returns ErrTokenRevoked if the user token was issued to is
+// gone or deleted or, with checkVersion, if token is an access token issued before the
+// user's token version was bumped. It returns ErrUserSuspended if the user
+// is suspended, which cuts off their personal access tokens as well.
+func CheckTokenUser(ctx context.Context, mapper data.Mapper, token jwt.Token, checkVersion bool) error {
+	result, err := mapper.Collection(UsersCollection).FindOneById(ctx, token.Subject(), &User{})
+	if err != nil {
+		if err == ErrNoDocuments {
+			return ErrTokenRevoked
+		}
+		return fmt.Errorf("failed getting user: %v", err)
+	}
+
+	user := result.(*User)
+	if user.DeletedAt != nil {
+		return ErrTokenRevoked
+	}
+
+	if checkVersion {
+		// numbers are decoded as float64, tokens without the claim are version 0
+		val, _ := token.Get("token_version")
+		version, _ := val.(float64)
+		if typ, _ := token.Get("type"); typ == util.AccessToken.String() && int64(version) != user.TokenVersion {
+			return ErrTokenRevoked
+		}
+	}
+
+	if user.Suspended {
+		return ErrUserSuspended
+	}
+
+	return nil
+}
@@ -0,0 +1,215 @@
+package users_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/alexferl/echo-boilerplate/config"
+	"github.com/alexferl/echo-boilerplate/handlers/users"
+	"github.com/alexferl/echo-boilerplate/mocks"
+	"github.com/alexferl/echo-boilerplate/util"
+)
+
+func TestCheckTokenRevoked(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+	token, err := util.ParseToken(access)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, token.JwtID())
+
+	testCases := []struct {
+		name     string
+		denylist error
+		err      error
+	}{
+		{"valid", users.ErrNoDocuments, nil},
+		{"denylisted", nil, users.ErrTokenRevoked},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mapper := mocks.NewMapper(t)
+			mapper.Mock.
+				On(
+					"Collection",
+					users.RevokedTokensCollection,
+				).
+				Return(
+					mapper,
+				).
+				On(
+					"FindOne",
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					nil,
+					tc.denylist,
+				)
+
+			err := users.CheckTokenRevoked(context.Background(), mapper, token)
+			assert.Equal(t, tc.err, err)
+		})
+	}
+}
+
+func TestCheckTokenUser(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+	accessToken, err := util.ParseToken(access)
+	assert.NoError(t, err)
+
+	pat, err := util.GeneratePersonalToken(user.Id, time.Hour, map[string]any{"roles": user.Roles})
+	assert.NoError(t, err)
+	patToken, err := util.ParseToken(pat)
+	assert.NoError(t, err)
+
+	suspended := users.NewUser("test@example.com", "test")
+	suspended.Id = user.Id
+	suspended.Suspend("admin")
+
+	bumped := users.NewUser("test@example.com", "test")
+	bumped.Id = user.Id
+	bumped.RevokeTokens()
+
+	deleted := users.NewUser("test@example.com", "test")
+	deleted.Id = user.Id
+	deleted.Delete(user.Id)
+
+	testCases := []struct {
+		name         string
+		token        jwt.Token
+		checkVersion bool
+		user         *users.User
+		result       error
+		err          error
+	}{
+		{"active", accessToken, true, user, nil, nil},
+		{"suspended", accessToken, true, suspended, nil, users.ErrUserSuspended},
+		{"suspended personal token", patToken, false, suspended, nil, users.ErrUserSuspended},
+		{"not found", patToken, false, nil, users.ErrNoDocuments, users.ErrTokenRevoked},
+		{"deleted", patToken, false, deleted, nil, users.ErrTokenRevoked},
+		{"version bumped", accessToken, true, bumped, nil, users.ErrTokenRevoked},
+		{"version bumped unchecked", accessToken, false, bumped, nil, nil},
+		{"version bumped personal token", patToken, true, bumped, nil, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mapper := mocks.NewMapper(t)
+			mapper.Mock.
+				On(
+					"Collection",
+					users.UsersCollection,
+				).
+				Return(
+					mapper,
+				).
+				On(
+					"FindOneById",
+					mock.Anything,
+					user.Id,
+					mock.Anything,
+				).
+				Return(
+					tc.user,
+					tc.result,
+				).
+				Once()
+
+			err := users.CheckTokenUser(context.Background(), mapper, tc.token, tc.checkVersion)
+			assert.Equal(t, tc.err, err)
+		})
+	}
+}
+
+func TestServer_Token_Checks(t *testing.T) {
+	testCases := []struct {
+		name     string
+		denylist error
+		user     func(*users.User)
+		code     int
+		msg      string
+	}{
+		{"revoked token", nil, func(*users.User) {}, http.StatusUnauthorized, "Token is revoked"},
+		{"revoked version", users.ErrNoDocuments, func(u *users.User) { u.RevokeTokens() }, http.StatusUnauthorized, "Token is revoked"},
+		{"suspended user", users.ErrNoDocuments, func(u *users.User) { u.Suspended = true }, http.StatusForbidden, "Account suspended"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mapper, s := getMapperAndCheckedServer(t)
+
+			user := users.NewUser("test@example.com", "test")
+			access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+			assert.NoError(t, err)
+			tc.user(user)
+
+			req := httptest.NewRequest(http.MethodGet, "/user", nil)
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+			resp := httptest.NewRecorder()
+
+			mapper.Mock.
+				On(
+					"Collection",
+					users.RevokedTokensCollection,
+				).
+				Return(
+					mapper,
+				).
+				On(
+					"FindOne",
+					mock.Anything,
+					mock.Anything,
+					mock.Anything,
+				).
+				Return(
+					&users.RevokedToken{},
+					tc.denylist,
+				)
+
+			if tc.denylist != nil {
+				mapper.Mock.
+					On(
+						"Collection",
+						users.UsersCollection,
+					).
+					Return(
+						mapper,
+					).
+					On(
+						"FindOneById",
+						mock.Anything,
+						user.Id,
+						mock.Anything,
+					).
+					Return(
+						user,
+						nil,
+					)
+			}
+
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, tc.code, resp.Code)
+			assert.Contains(t, resp.Body.String(), tc.msg)
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/rs/xid"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/alexferl/echo-boilerplate/config"
+	"github.com/alexferl/echo-boilerplate/util"
+)
+
+const SessionsCollection = "sessions"
+
+var (
+	ErrSessionRevoked     = errors.New("session revoked")
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// Session is a device the user logged in from. Each session has its own
+// refresh token so devices don't log each other out. A session is also the
+// refresh token family: refresh tokens are rotated on every use and only
+// the latest one, identified by RefreshTokenId, is accepted.
+type Session struct {
+	Id             string     `json:"id" bson:"id"`
+	UserId         string     `json:"user_id" bson:"user_id"`
+	UserAgent      string     `json:"user_agent" bson:"user_agent"`
+	IP             string     `json:"ip" bson:"ip"`
+	RefreshToken   string     `json:"-" bson:"refresh_token"`
+	RefreshTokenId string     `json:"-" bson:"refresh_token_id"`
+	CreatedAt      *time.Time `json:"created_at" bson:"created_at"`
+	LastRefreshAt  *time.Time `json:"last_refresh_at" bson:"last_refresh_at"`
+	ExpiresAt      *time.Time `json:"expires_at" bson:"expires_at"`
+	RevokedAt      *time.Time `json:"-" bson:"revoked_at"`
+}
+
+func NewSession(userId string, userAgent string, ip string) *Session {
+	t := time.Now()
+	return &Session{
+		Id:        xid.New().String(),
+		UserId:    userId,
+		UserAgent: userAgent,
+		IP:        ip,
+		CreatedAt: &t,
+	}
+}
+
+// ValidateRefreshToken returns ErrRefreshTokenReused if token was already
+// rotated, which means it was copied and the session must be revoked.
+// Sessions whose refresh token was hashed with bcrypt, before keyed hashes
+// were used, are still accepted until the token is rotated.
+func (s *Session) ValidateRefreshToken(token jwt.Token, encodedToken string) error {
+	if s.RevokedAt != nil {
+		return ErrSessionRevoked
+	}
+
+	if token.JwtID() != s.RefreshTokenId {
+		return ErrRefreshTokenReused
+	}
+
+	if strings.HasPrefix(s.RefreshToken, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(s.RefreshToken), []byte(encodedToken))
+	}
+
+	valid, err := util.ValidRefreshToken([]byte(encodedToken), s.RefreshToken)
+	if err != nil {
+		return err
+	}
+
+	if !valid {
+		return ErrTokenMismatch
+	}
+
+	return nil
+}
+
+func (s *Session) Revoke() {
+	t := time.Now()
+	s.RevokedAt = &t
+	s.RefreshToken = ""
+	s.RefreshTokenId = ""
+}
+
+// setRefreshToken stores the id and hash of token and extends
+// the session until the new refresh token expires.
+func (s *Session) setRefreshToken(jti string, token []byte) error {
+	hash, err := util.HashRefreshToken(token)
+	if err != nil {
+		return err
+	}
+
+	t := time.Now().Add(viper.GetDuration(config.JWTRefreshTokenExpiry))
+	s.RefreshToken = hash
+	s.RefreshTokenId = jti
+	s.ExpiresAt = &t
+
+	return nil
+}
+
+// login creates a session for the device making the request and returns its tokens.
+func (h *Handler) login(ctx context.Context, c echo.Context, user *User) ([]byte, []byte, error) {
+	session := NewSession(user.Id, c.Request().UserAgent(), c.RealIP())
+	access, refresh, err := user.Login(session)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed generating tokens: %v", err)
+	}
+
+	_, err = h.Mapper.Collection(SessionsCollection).Insert(ctx, session, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed inserting session: %v", err)
+	}
+
+	update := bson.D{{"$set", bson.D{{"last_login_at", user.LastLoginAt}}}}
+	_, err = h.Mapper.Update(ctx, bson.D{{"id", user.Id}}, update, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed updating user: %v", err)
+	}
+
+	return access, refresh, nil
+}
+
+// getRefreshSession returns the session of the refresh token on the request
+// once the token is validated. If the token was already rotated, the whole
+// session is revoked and a security event is recorded.
+func (h *Handler) getRefreshSession(ctx context.Context, c echo.Context) (*Session, func() error) {
+	token := c.Get("refresh_token").(jwt.Token)
+	encodedToken := c.Get("refresh_token_encoded").(string)
+	sid, _ := token.Get("sid")
+
+	mismatch := func() error {
+		return h.Validate(c, http.StatusUnauthorized, echo.Map{"message": "Token mismatch"})
+	}
+
+	filter := bson.D{{"id", sid}, {"user_id", token.Subject()}}
+	result, err := h.Mapper.Collection(SessionsCollection).FindOne(ctx, filter, &Session{})
+	if err != nil {
+		if err == ErrNoDocuments {
+			return nil, mismatch
+		}
+		return nil, wrap(fmt.Errorf("failed getting session: %v", err))
+	}
+
+	session := result.(*Session)
+	err = session.ValidateRefreshToken(token, encodedToken)
+	if err == ErrRefreshTokenReused {
+		if err = h.refreshTokenReused(ctx, c, session, token.JwtID()); err != nil {
+			return nil, wrap(err)
+		}
+		return nil, mismatch
+	} else if err != nil {
+		return nil, mismatch
+	}
+
+	return session, nil
+}
+
+// rotateRefreshToken saves the refresh token session was just given, as long
+// as the token it replaces, jti, is still the current one. Otherwise another
+// request used the same token first, which is handled as a reuse.
+func (h *Handler) rotateRefreshToken(ctx context.Context, c echo.Context, session *Session, jti string) (bool, error) {
+	filter := bson.D{{"id", session.Id}, {"refresh_token_id", jti}, {"revoked_at", nil}}
+	update := bson.D{{"$set", bson.D{
+		{"refresh_token", session.RefreshToken},
+		{"refresh_token_id", session.RefreshTokenId},
+		{"last_refresh_at", session.LastRefreshAt},
+		{"expires_at", session.ExpiresAt},
+	}}}
+
+	result, err := h.Mapper.Collection(SessionsCollection).Update(ctx, filter, update, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed updating session: %v", err)
+	}
+
+	if res, ok := result.(*mongo.UpdateResult); ok && res.MatchedCount == 1 {
+		return true, nil
+	}
+
+	return false, h.refreshTokenReused(ctx, c, session, jti)
+}
+
+// refreshTokenReused revokes session, the refresh token family jti belongs
+// to, and records a security event.
+func (h *Handler) refreshTokenReused(ctx context.Context, c echo.Context, session *Session, jti string) error {
+	session.Revoke()
+	_, err := h.Mapper.Collection(SessionsCollection).UpdateById(ctx, session.Id, session, nil)
+	if err != nil {
+		return fmt.Errorf("failed revoking session: %v", err)
+	}
+
+	data := map[string]any{"session_id": session.Id, "refresh_token_id": jti}
+	event := NewAuditEvent(c, AuditRefreshTokenReuse, session.UserId, data)
+	return h.recordEvent(ctx, event)
+}
+
+// revokeSessions revokes all the active sessions of a user except the session except.
+func (h *Handler) revokeSessions(ctx context.Context, userId string, except string) error {
+	filter := bson.D{
+		{"user_id", userId},
+		{"revoked_at", nil},
+		{"id", bson.D{{"$ne", except}}},
+	}
+	update := bson.D{{"$set", bson.D{
+		{"revoked_at", time.Now()},
+		{"refresh_token", ""},
+		{"refresh_token_id", ""},
+	}}}
+
+	_, err := h.Mapper.Collection(SessionsCollection).UpdateMany(ctx, filter, update)
+	if err != nil {
+		return fmt.Errorf("failed revoking sessions: %v", err)
+	}
+
+	return nil
+}
+
+type SessionResponse struct {
+	Id            string     `json:"id" bson:"id"`
+	UserAgent     string     `json:"user_agent" bson:"user_agent"`
+	IP            string     `json:"ip" bson:"ip"`
+	CreatedAt     *time.Time `json:"created_at" bson:"created_at"`
+	LastRefreshAt *time.Time `json:"last_refresh_at" bson:"last_refresh_at"`
+	ExpiresAt     *time.Time `json:"expires_at" bson:"expires_at"`
+	Current       bool       `json:"current" bson:"-"`
+}
+
+type ListSessionsResponse struct {
+	Sessions []*SessionResponse `json:"sessions"`
+}
+
+func (h *Handler) ListSessions(c echo.Context) error {
+	token := c.Get("token").(jwt.Token)
+	sid, _ := token.Get("sid")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	filter := bson.D{
+		{"user_id", token.Subject()},
+		{"revoked_at", nil},
+		{"expires_at", bson.D{{"$gt", time.Now()}}},
+	}
+	opts := options.Find().SetSort(bson.D{{"created_at", -1}})
+	result, err := h.Mapper.Collection(SessionsCollection).Find(ctx, filter, []*SessionResponse{}, opts)
+	if err != nil {
+		return fmt.Errorf("failed getting sessions: %v", err)
+	}
+
+	sessions := result.([]*SessionResponse)
+	for _, s := range sessions {
+		s.Current = s.Id == sid
+	}
+
+	return h.Validate(c, http.StatusOK, ListSessionsResponse{Sessions: sessions})
+}
+
+func (h *Handler) RevokeSession(c echo.Context) error {
+	token := c.Get("token").(jwt.Token)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	filter := bson.D{{"id", c.Param("id")}, {"user_id", token.Subject()}, {"revoked_at", nil}}
+	result, err := h.Mapper.Collection(SessionsCollection).FindOne(ctx, filter, &Session{})
+	if err != nil {
+		if err == ErrNoDocuments {
+			return h.Validate(c, http.StatusNotFound, echo.Map{"message": "session not found"})
+		}
+		return fmt.Errorf("failed getting session: %v", err)
+	}
+
+	session := result.(*Session)
+	session.Revoke()
+
+	_, err = h.Mapper.Collection(SessionsCollection).UpdateById(ctx, session.Id, session, nil)
+	if err != nil {
+		return fmt.Errorf("failed updating session: %v", err)
+	}
+
+	return h.Validate(c, http.StatusNoContent, nil)
+}
+
+// RevokeOtherSessions logs out every device except the one making the request.
+func (h *Handler) RevokeOtherSessions(c echo.Context) error {
+	token := c.Get("token").(jwt.Token)
+	sid, _ := token.Get("sid")
+	current, _ := sid.(string)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := h.revokeSessions(ctx, token.Subject(), current); err != nil {
+		return err
+	}
+
+	return h.Validate(c, http.StatusNoContent, nil)
+}
+
+// RevokeUserSessions logs a user out of every device and invalidates
+// their outstanding access tokens.
+func (h *Handler) RevokeUserSessions(c echo.Context) error {
+	token := c.Get("token").(jwt.Token)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := h.Mapper.FindOneById(ctx, c.Param("id"), &User{})
+	if err != nil {
+		if err == ErrNoDocuments {
+			return h.Validate(c, http.StatusNotFound, echo.Map{"message": "user not found"})
+		}
+		return fmt.Errorf("failed getting user: %v", err)
+	}
+
+	user := result.(*User)
+	if err = h.revokeSessions(ctx, user.Id, ""); err != nil {
+		return err
+	}
+
+	user.Update(token.Subject())
+
+	update := bson.D{
+		{"$inc", bson.D{{"token_version", 1}}},
+		{"$set", bson.D{{"updated_at", user.UpdatedAt}, {"updated_by", user.UpdatedBy}}},
+	}
+	_, err = h.Mapper.Update(ctx, bson.D{{"id", user.Id}}, update, nil)
+	if err != nil {
+		return fmt.Errorf("failed updating user: %v", err)
+	}
+
+	return h.Validate(c, http.StatusNoContent, nil)
+}
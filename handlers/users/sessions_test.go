@@ -0,0 +1,378 @@
+package users_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/alexferl/echo-boilerplate/config"
+	"github.com/alexferl/echo-boilerplate/handlers/users"
+	"github.com/alexferl/echo-boilerplate/util"
+)
+
+func TestHandler_ListSessions_200(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	current := users.NewSession(user.Id, "laptop", "192.0.2.1")
+	access, _, err := user.Login(current)
+	assert.NoError(t, err)
+
+	other := users.NewSession(user.Id, "phone", "192.0.2.2")
+	_, _, err = user.Login(other)
+	assert.NoError(t, err)
+
+	sessions := []*users.SessionResponse{
+		{Id: current.Id, UserAgent: current.UserAgent, IP: current.IP, CreatedAt: current.CreatedAt, ExpiresAt: current.ExpiresAt},
+		{Id: other.Id, UserAgent: other.UserAgent, IP: other.IP, CreatedAt: other.CreatedAt, ExpiresAt: other.ExpiresAt},
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/user/sessions", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.SessionsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			sessions,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	var result users.ListSessionsResponse
+	err = json.Unmarshal(resp.Body.Bytes(), &result)
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	if assert.Equal(t, 2, len(result.Sessions)) {
+		assert.True(t, result.Sessions[0].Current)
+		assert.False(t, result.Sessions[1].Current)
+		assert.Equal(t, "phone", result.Sessions[1].UserAgent)
+	}
+}
+
+func TestHandler_RevokeSession_204(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	other := users.NewSession(user.Id, "", "")
+	_, _, err = user.Login(other)
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/user/sessions/%s", other.Id), nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.SessionsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			other,
+			nil,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			other.Id,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.NotNil(t, other.RevokedAt)
+	assert.Equal(t, "", other.RefreshToken)
+}
+
+func TestHandler_RevokeSession_404(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodDelete, "/user/sessions/id", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.SessionsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			users.ErrNoDocuments,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
+
+func TestHandler_RevokeOtherSessions_204(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	current := users.NewSession(user.Id, "", "")
+	access, _, err := user.Login(current)
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodDelete, "/user/sessions", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	filter := bson.D{
+		{"user_id", user.Id},
+		{"revoked_at", nil},
+		{"id", bson.D{{"$ne", current.Id}}},
+	}
+
+	mapper.Mock.
+		On(
+			"Collection",
+			users.SessionsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"UpdateMany",
+			mock.Anything,
+			filter,
+			mock.Anything,
+		).
+		Return(
+			int64(2),
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+}
+
+func TestHandler_RevokeUserSessions_204(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	admin := users.NewAdminUser("admin@example.com", "admin")
+	access, _, err := admin.Login(users.NewSession(admin.Id, "", ""))
+	assert.NoError(t, err)
+
+	user := users.NewUser("test@example.com", "test")
+
+	req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/users/%s/sessions", user.Id), nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			user.Id,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"Collection",
+			users.SessionsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"UpdateMany",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			int64(2),
+			nil,
+		).
+		On(
+			"Update",
+			mock.Anything,
+			bson.D{{"id", user.Id}},
+			mock.MatchedBy(func(update bson.D) bool {
+				return update[0].Key == "$inc" && update[0].Value.(bson.D)[0].Key == "token_version"
+			}),
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Equal(t, admin.Id, user.UpdatedBy)
+}
+
+func TestHandler_RevokeUserSessions_403(t *testing.T) {
+	_, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodDelete, "/users/id/sessions", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+}
+
+func TestHandler_RevokeUserSessions_404(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	admin := users.NewAdminUser("admin@example.com", "admin")
+	access, _, err := admin.Login(users.NewSession(admin.Id, "", ""))
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodDelete, "/users/id/sessions", nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			"id",
+			mock.Anything,
+		).
+		Return(
+			nil,
+			users.ErrNoDocuments,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+}
+
+func TestUser_Sessions(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	validate := func(session *users.Session, encodedToken []byte) error {
+		token, err := util.ParseToken(encodedToken)
+		assert.NoError(t, err)
+		return session.ValidateRefreshToken(token, string(encodedToken))
+	}
+
+	user := users.NewUser("test@example.com", "test")
+	laptop := users.NewSession(user.Id, "", "")
+	phone := users.NewSession(user.Id, "", "")
+
+	_, laptopRefresh, err := user.Login(laptop)
+	assert.NoError(t, err)
+	_, phoneRefresh, err := user.Login(phone)
+	assert.NoError(t, err)
+
+	assert.NoError(t, validate(laptop, laptopRefresh), "logging in on a new device keeps other sessions")
+	assert.NoError(t, validate(phone, phoneRefresh))
+
+	_, newRefresh, err := user.Refresh(laptop)
+	assert.NoError(t, err)
+	assert.NotNil(t, laptop.LastRefreshAt)
+	assert.NoError(t, validate(laptop, newRefresh))
+	assert.ErrorIs(t, validate(laptop, laptopRefresh), users.ErrRefreshTokenReused, "rotated token is rejected")
+
+	user.Logout(laptop)
+	assert.ErrorIs(t, validate(laptop, newRefresh), users.ErrSessionRevoked)
+	assert.NoError(t, validate(phone, phoneRefresh))
+}
+
+func TestSession_ValidateRefreshToken_Legacy(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	user := users.NewUser("test@example.com", "test")
+	session := users.NewSession(user.Id, "", "")
+	_, refresh, err := user.Login(session)
+	assert.NoError(t, err)
+	token, err := util.ParseToken(refresh)
+	assert.NoError(t, err)
+
+	hash, err := util.HashRefreshToken(refresh)
+	assert.NoError(t, err)
+	assert.Equal(t, hash, session.RefreshToken)
+	assert.NoError(t, session.ValidateRefreshToken(token, string(refresh)))
+
+	other, err := util.HashRefreshToken([]byte("other"))
+	assert.NoError(t, err)
+	session.RefreshToken = other
+	assert.ErrorIs(t, session.ValidateRefreshToken(token, string(refresh)), users.ErrTokenMismatch)
+
+	legacy, err := bcrypt.GenerateFromPassword(refresh, bcrypt.MinCost)
+	assert.NoError(t, err)
+	session.RefreshToken = string(legacy)
+	assert.NoError(t, session.ValidateRefreshToken(token, string(refresh)), "bcrypt hashes are accepted until rotated")
+	assert.Error(t, session.ValidateRefreshToken(token, "wrong"))
+
+	_, newRefresh, err := user.Refresh(session)
+	assert.NoError(t, err)
+	newToken, err := util.ParseToken(newRefresh)
+	assert.NoError(t, err)
+
+	hash, err = util.HashRefreshToken(newRefresh)
+	assert.NoError(t, err)
+	assert.Equal(t, hash, session.RefreshToken, "rotated tokens are stored as keyed hashes")
+	assert.NoError(t, session.ValidateRefreshToken(newToken, string(newRefresh)))
+}
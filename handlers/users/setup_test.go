@@ -1,21 +1,85 @@
 package users_test
 
 import (
+	"context"
+	"net/url"
+	"regexp"
 	"testing"
+	"time"
 
 	"github.com/alexferl/echo-openapi"
 	"github.com/alexferl/golib/http/server"
+	"github.com/spf13/viper"
 	"go.mongodb.org/mongo-driver/mongo"
 
 	app "github.com/alexferl/echo-boilerplate"
+	"github.com/alexferl/echo-boilerplate/config"
 	"github.com/alexferl/echo-boilerplate/handlers/users"
+	"github.com/alexferl/echo-boilerplate/mailer"
 	"github.com/alexferl/echo-boilerplate/mocks"
 	_ "github.com/alexferl/echo-boilerplate/testing"
 )
 
-func getMapperAndServer(t *testing.T) (*mocks.Mapper, *server.Server) {
+func getMapperAndServer(t testing.TB) (*mocks.Mapper, *server.Server) {
 	mapper := mocks.NewMapper(t)
 	h := users.NewHandler(&mongo.Client{}, openapi.NewHandler(), mapper)
 	s := app.NewTestServer(h)
 	return mapper, s
 }
+
+// getMapperAndCheckedServer is getMapperAndServer with the checks of the
+// tokens and their users enabled, they're made with the same mapper.
+func getMapperAndCheckedServer(t testing.TB) (*mocks.Mapper, *server.Server) {
+	mapper := mocks.NewMapper(t)
+	h := users.NewHandler(&mongo.Client{}, openapi.NewHandler(), mapper)
+	s := app.NewCheckedTestServer(mapper, h)
+	return mapper, s
+}
+
+type testMailer struct {
+	messages chan *mailer.Message
+}
+
+func (m *testMailer) Send(ctx context.Context, msg *mailer.Message) error {
+	m.messages <- msg
+	return nil
+}
+
+func (m *testMailer) wait(t *testing.T) *mailer.Message {
+	select {
+	case msg := <-m.messages:
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for email")
+		return nil
+	}
+}
+
+func getMapperMailerAndServer(t *testing.T) (*mocks.Mapper, *testMailer, *server.Server) {
+	mapper := mocks.NewMapper(t)
+	h := users.NewHandler(&mongo.Client{}, openapi.NewHandler(), mapper)
+	m := &testMailer{messages: make(chan *mailer.Message, 10)}
+	h.(*users.Handler).Mailer = m
+	s := app.NewTestServer(h)
+	return mapper, m, s
+}
+
+// link returns the first link to the app in the body of msg,
+// exactly as the user would follow it.
+func link(t *testing.T, msg *mailer.Message) string {
+	re := regexp.MustCompile(regexp.QuoteMeta(viper.GetString(config.BaseURL)) + `/\S+`)
+	l := re.FindString(msg.Body)
+	if l == "" {
+		t.Fatalf("no link in email '%s'", msg.Subject)
+	}
+	return l
+}
+
+// linkToken returns the token of the link in msg.
+func linkToken(t *testing.T, msg *mailer.Message) string {
+	u, err := url.Parse(link(t, msg))
+	if err != nil {
+		t.Fatalf("invalid link in email '%s': %v", msg.Subject, err)
+	}
+	return u.Query().Get("token")
+}
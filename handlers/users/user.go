@@ -4,20 +4,29 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/alexferl/echo-boilerplate/config"
+	"github.com/alexferl/echo-boilerplate/util"
 )
 
 type UserResponse struct {
-	Id        string     `json:"id" bson:"id"`
-	Username  string     `json:"username" bson:"username"`
-	Email     string     `json:"email" bson:"email"`
-	Name      string     `json:"name" bson:"name"`
-	Bio       string     `json:"bio" bson:"bio"`
-	CreatedAt *time.Time `json:"created_at" bson:"created_at"`
-	UpdatedAt *time.Time `json:"updated_at" bson:"updated_at"`
+	Id            string     `json:"id" bson:"id"`
+	Username      string     `json:"username" bson:"username"`
+	Email         string     `json:"email" bson:"email"`
+	EmailVerified bool       `json:"email_verified" bson:"email_verified"`
+	PendingEmail  string     `json:"pending_email,omitempty" bson:"pending_email"`
+	MFAEnabled    bool       `json:"mfa_enabled" bson:"mfa_enabled"`
+	Name          string     `json:"name" bson:"name"`
+	Bio           string     `json:"bio" bson:"bio"`
+	CreatedAt     *time.Time `json:"created_at" bson:"created_at"`
+	UpdatedAt     *time.Time `json:"updated_at" bson:"updated_at"`
 }
 
 func (h *Handler) GetUser(c echo.Context) error {
@@ -46,6 +55,11 @@ func (h *Handler) UpdateUser(c echo.Context) error {
 
 	token := c.Get("token").(jwt.Token)
 
+	// the new address could be used to reset the password and take the account
+	if body.Email != "" && util.GetActor(token) != "" {
+		return h.Validate(c, http.StatusForbidden, echo.Map{"message": "Not allowed while impersonating"})
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	result, err := h.Mapper.FindOneById(ctx, token.Subject(), &User{})
@@ -54,8 +68,22 @@ func (h *Handler) UpdateUser(c echo.Context) error {
 	}
 
 	user := result.(*User)
-	if body.Email != "" {
-		user.Email = body.Email
+
+	// changing the email needs a confirmation from the new address,
+	// until then it's only pending
+	var confirm, cancelToken string
+	if body.Email != "" && !strings.EqualFold(body.Email, user.Email) {
+		_, err = h.Mapper.FindOne(ctx, bson.D{{"email", body.Email}}, &User{})
+		if err == nil {
+			return h.Validate(c, http.StatusConflict, echo.Map{"message": "email already in-use"})
+		} else if err != ErrNoDocuments {
+			return fmt.Errorf("failed getting user: %v", err)
+		}
+
+		confirm, cancelToken, err = user.NewEmailChange(body.Email)
+		if err != nil {
+			return fmt.Errorf("failed generating email change tokens: %v", err)
+		}
 	}
 
 	if body.Name != "" {
@@ -70,8 +98,228 @@ func (h *Handler) UpdateUser(c echo.Context) error {
 
 	update, err := h.Mapper.UpdateById(ctx, user.Id, user, &UserResponse{})
 	if err != nil {
+		if err == ErrDuplicateKey {
+			return h.Validate(c, http.StatusConflict, echo.Map{"message": "email already in-use"})
+		}
 		return fmt.Errorf("failed updating user: %v", err)
 	}
 
+	if confirm != "" {
+		h.sendMail(newConfirmEmailChangeMessage(user, confirm))
+		h.sendMail(newEmailChangeNotificationMessage(user, cancelToken))
+	}
+
 	return h.Validate(c, http.StatusOK, update)
 }
+
+type UpdatePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// UpdatePassword changes the password of the authenticated user once the
+// current one is confirmed. Every other session and all the access tokens
+// issued so far are revoked, the current session gets new tokens.
+func (h *Handler) UpdatePassword(c echo.Context) error {
+	body := &UpdatePasswordRequest{}
+	if err := c.Bind(body); err != nil {
+		return err
+	}
+
+	token := c.Get("token").(jwt.Token)
+	sid, _ := token.Get("sid")
+	current, _ := sid.(string)
+	if current == "" {
+		return h.Validate(c, http.StatusForbidden, echo.Map{"message": "password can only be changed from a session"})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := h.Mapper.FindOneById(ctx, token.Subject(), &User{})
+	if err != nil {
+		return fmt.Errorf("failed getting user: %v", err)
+	}
+
+	user := result.(*User)
+	attempts, errResp := h.getLoginAttempts(ctx, c, user.Email)
+	if errResp != nil {
+		return errResp()
+	}
+
+	if err = user.ValidatePassword(body.CurrentPassword); err != nil {
+		if err = h.loginFailed(ctx, attempts); err != nil {
+			return err
+		}
+		return h.Validate(c, http.StatusForbidden, echo.Map{"message": "invalid current password"})
+	}
+
+	if err = h.loginSucceeded(ctx, attempts); err != nil {
+		return err
+	}
+
+	if errResp := h.checkPassword(c, "new_password", body.NewPassword, user.Username, user.Email); errResp != nil {
+		return errResp()
+	}
+
+	filter := bson.D{{"id", current}, {"user_id", user.Id}, {"revoked_at", nil}}
+	res, err := h.Mapper.Collection(SessionsCollection).FindOne(ctx, filter, &Session{})
+	if err != nil {
+		if err == ErrNoDocuments {
+			return h.Validate(c, http.StatusUnauthorized, echo.Map{"message": "session revoked"})
+		}
+		return fmt.Errorf("failed getting session: %v", err)
+	}
+
+	session := res.(*Session)
+	if err = user.SetPassword(body.NewPassword); err != nil {
+		return fmt.Errorf("failed setting password: %v", err)
+	}
+
+	user.RevokeTokens()
+	access, refresh, err := user.Refresh(session)
+	if err != nil {
+		return fmt.Errorf("failed generating tokens: %v", err)
+	}
+
+	user.Update(user.Id)
+
+	update := bson.D{
+		{"$inc", bson.D{{"token_version", 1}}},
+		{"$set", bson.D{
+			{"password", user.Password},
+			{"password_reset_required", user.PasswordResetRequired},
+			{"last_refresh_at", user.LastRefreshAt},
+			{"updated_at", user.UpdatedAt},
+			{"updated_by", user.UpdatedBy},
+		}},
+	}
+	_, err = h.Mapper.Update(ctx, bson.D{{"id", user.Id}}, update, nil)
+	if err != nil {
+		return fmt.Errorf("failed updating user: %v", err)
+	}
+
+	_, err = h.Mapper.Collection(SessionsCollection).UpdateById(ctx, session.Id, session, nil)
+	if err != nil {
+		return fmt.Errorf("failed updating session: %v", err)
+	}
+
+	if err = h.revokeSessions(ctx, user.Id, session.Id); err != nil {
+		return err
+	}
+
+	if err = h.recordEvent(ctx, NewAuditEvent(c, AuditPasswordChanged, user.Id, nil)); err != nil {
+		return err
+	}
+
+	if viper.GetBool(config.CookiesEnabled) {
+		util.SetTokenCookies(c, access, refresh)
+	}
+
+	resp := &TokenResponse{
+		AccessToken:  string(access),
+		ExpiresIn:    int64(viper.GetDuration(config.JWTAccessTokenExpiry).Seconds()),
+		RefreshToken: string(refresh),
+		TokenType:    "Bearer",
+	}
+
+	return h.Validate(c, http.StatusOK, resp)
+}
+
+type DeleteUserRequest struct {
+	Password string `json:"password"`
+}
+
+// DeleteUser deletes the account of the authenticated user once their
+// password is confirmed. Their sessions and personal access tokens are
+// revoked right away and the account can be restored with the link emailed
+// to them until the grace period ends, it's then purged of personal information.
+func (h *Handler) DeleteUser(c echo.Context) error {
+	body := &DeleteUserRequest{}
+	if err := c.Bind(body); err != nil {
+		return err
+	}
+
+	token := c.Get("token").(jwt.Token)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	result, err := h.Mapper.FindOneById(ctx, token.Subject(), &User{})
+	if err != nil {
+		return fmt.Errorf("failed getting user: %v", err)
+	}
+
+	user := result.(*User)
+	attempts, errResp := h.getLoginAttempts(ctx, c, user.Email)
+	if errResp != nil {
+		return errResp()
+	}
+
+	if err = user.ValidatePassword(body.Password); err != nil {
+		if err = h.loginFailed(ctx, attempts); err != nil {
+			return err
+		}
+		return h.Validate(c, http.StatusForbidden, echo.Map{"message": "invalid password"})
+	}
+
+	if err = h.loginSucceeded(ctx, attempts); err != nil {
+		return err
+	}
+
+	restore, err := h.deleteUser(ctx, c, user, user.Id)
+	if err != nil {
+		return err
+	}
+
+	if restore != "" {
+		h.sendMail(newAccountDeletedMessage(user, restore))
+	}
+
+	util.SetExpiredTokenCookies(c)
+
+	return h.Validate(c, http.StatusNoContent, nil)
+}
+
+// deleteUser soft-deletes user on behalf of by and revokes their sessions and
+// personal access tokens. The returned token restores the account during the
+// grace period, it's only given to users deleting their own account. Without a
+// grace period the account is purged right away.
+func (h *Handler) deleteUser(ctx context.Context, c echo.Context, user *User, by string) (string, error) {
+	restore, err := user.NewDeletion()
+	if err != nil {
+		return "", fmt.Errorf("failed generating restore token: %v", err)
+	}
+
+	var data map[string]any
+	if by != user.Id {
+		user.DeletedBy = by
+		user.RestoreToken = ""
+		restore = ""
+		data = map[string]any{"admin_id": by}
+	}
+
+	_, err = h.Mapper.UpdateById(ctx, user.Id, user, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed updating user: %v", err)
+	}
+
+	if err = h.revokeSessions(ctx, user.Id, ""); err != nil {
+		return "", err
+	}
+
+	if err = h.revokePersonalAccessTokens(ctx, user.Id); err != nil {
+		return "", err
+	}
+
+	if err = h.recordEvent(ctx, NewAuditEvent(c, AuditAccountDeleted, user.Id, data)); err != nil {
+		return "", err
+	}
+
+	if viper.GetDuration(config.AccountDeletionGracePeriod) <= 0 {
+		if err = purgeUser(ctx, h.Mapper, h.Exports, user); err != nil {
+			return "", err
+		}
+		return "", nil
+	}
+
+	return restore, nil
+}
@@ -7,18 +7,24 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 
+	"github.com/alexferl/echo-boilerplate/config"
 	"github.com/alexferl/echo-boilerplate/handlers/users"
+	"github.com/alexferl/echo-boilerplate/util"
 )
 
 func TestHandler_GetUser_200(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	respUser := &users.UserResponse{
@@ -68,7 +74,7 @@ func TestHandler_UpdateUser_200(t *testing.T) {
 	user := users.NewUser("test@example.com", "test")
 	user.Name = "test name"
 	user.Bio = "test bio"
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	updatedUser := user
@@ -142,7 +148,7 @@ func TestHandler_UpdateUser_422(t *testing.T) {
 	user := users.NewUser("test@example.com", "test")
 	user.Name = "test name"
 	user.Bio = "test bio"
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	req := httptest.NewRequest(http.MethodPatch, "/user", bytes.NewBuffer([]byte(`{"invalid": "key"}`)))
@@ -154,3 +160,644 @@ func TestHandler_UpdateUser_422(t *testing.T) {
 
 	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
 }
+
+func TestHandler_UpdatePassword_200(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	err := user.SetPassword("abcdefghijkl")
+	assert.NoError(t, err)
+	session := users.NewSession(user.Id, "", "")
+	access, _, err := user.Login(session)
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(&users.UpdatePasswordRequest{CurrentPassword: "abcdefghijkl", NewPassword: "amber-falcon-93-ridge"})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPut, "/user/password", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			user.Id,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"Collection",
+			users.LoginAttemptsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			[]*users.LoginAttempt{},
+			nil,
+		).
+		On(
+			"Collection",
+			users.SessionsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			session,
+			nil,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		).
+		On(
+			"Update",
+			mock.Anything,
+			bson.D{{"id", user.Id}},
+			mock.MatchedBy(func(update bson.D) bool {
+				return update[0].Key == "$inc" && update[0].Value.(bson.D)[0].Key == "token_version"
+			}),
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		).
+		On(
+			"UpdateMany",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			int64(1),
+			nil,
+		).
+		On(
+			"Collection",
+			users.AuditEventsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Insert",
+			mock.Anything,
+			mock.MatchedBy(func(e *users.AuditEvent) bool { return e.Type == users.AuditPasswordChanged }),
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	var result users.TokenResponse
+	err = json.Unmarshal(resp.Body.Bytes(), &result)
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.NoError(t, user.ValidatePassword("amber-falcon-93-ridge"))
+	assert.Equal(t, int64(1), user.TokenVersion)
+
+	token, err := util.ParseToken([]byte(result.AccessToken))
+	assert.NoError(t, err)
+	sid, _ := token.Get("sid")
+	assert.Equal(t, session.Id, sid)
+	version, _ := token.Get("token_version")
+	assert.Equal(t, float64(1), version)
+
+	refresh, err := util.ParseToken([]byte(result.RefreshToken))
+	assert.NoError(t, err)
+	assert.NoError(t, session.ValidateRefreshToken(refresh, result.RefreshToken))
+}
+
+func TestHandler_UpdatePassword_403(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	err := user.SetPassword("abcdefghijkl")
+	assert.NoError(t, err)
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(&users.UpdatePasswordRequest{CurrentPassword: "wrong", NewPassword: "lkjihgfedcba"})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPut, "/user/password", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			user.Id,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"Collection",
+			users.LoginAttemptsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			[]*users.LoginAttempt{},
+			nil,
+		).
+		On(
+			"FindOneAndUpdate",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			&users.LoginAttempt{Type: users.LoginAttemptAccount, Failures: 1},
+			nil,
+		).
+		On(
+			"Update",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Contains(t, resp.Body.String(), "invalid current password")
+	assert.NoError(t, user.ValidatePassword("abcdefghijkl"))
+}
+
+func TestHandler_UpdatePassword_422(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	err := user.SetPassword("abcdefghijkl")
+	assert.NoError(t, err)
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(&users.UpdatePasswordRequest{CurrentPassword: "abcdefghijkl", NewPassword: "short"})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPut, "/user/password", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			user.Id,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"Collection",
+			users.LoginAttemptsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			[]*users.LoginAttempt{},
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.Code)
+	assert.Contains(t, resp.Body.String(), users.PasswordTooShort)
+}
+
+func TestHandler_DeleteUser_204(t *testing.T) {
+	mapper, m, s := getMapperMailerAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	err := user.SetPassword("abcdefghijkl")
+	assert.NoError(t, err)
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(&users.DeleteUserRequest{Password: "abcdefghijkl"})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodDelete, "/user", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			user.Id,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"Collection",
+			users.LoginAttemptsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			[]*users.LoginAttempt{},
+			nil,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			user.Id,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		).
+		On(
+			"Collection",
+			users.SessionsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Collection",
+			users.PATCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"UpdateMany",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			int64(1),
+			nil,
+		).
+		On(
+			"Collection",
+			users.UsersCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Update",
+			mock.Anything,
+			bson.D{{"id", user.Id}},
+			bson.D{{"$set", bson.D{{"pat_slots", bson.A{}}}}},
+			mock.Anything,
+		).
+		Return(
+			&mongo.UpdateResult{MatchedCount: 1},
+			nil,
+		).
+		On(
+			"Collection",
+			users.AuditEventsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Insert",
+			mock.Anything,
+			mock.MatchedBy(func(e *users.AuditEvent) bool { return e.Type == users.AuditAccountDeleted }),
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.NotNil(t, user.DeletedAt)
+	assert.NotNil(t, user.PurgeAt)
+	assert.Equal(t, "test@example.com", user.Email)
+	assert.Equal(t, int64(1), user.TokenVersion)
+	mapper.AssertNumberOfCalls(t, "UpdateMany", 2)
+
+	msg := m.wait(t)
+	assert.Equal(t, []string{"test@example.com"}, msg.To)
+	assert.Contains(t, msg.Body, "/auth/account/restore?token=")
+
+	mapper.Mock.
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"Insert",
+			mock.Anything,
+			mock.MatchedBy(func(e *users.AuditEvent) bool { return e.Type == users.AuditAccountRestored }),
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	// fetching the link only checks the token
+	req = httptest.NewRequest(http.MethodGet, link(t, msg), nil)
+	resp = httptest.NewRecorder()
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.NotNil(t, user.DeletedAt)
+	mapper.AssertNotCalled(t, "Insert", mock.Anything, mock.MatchedBy(func(e *users.AuditEvent) bool {
+		return e.Type == users.AuditAccountRestored
+	}), mock.Anything)
+
+	b, err = json.Marshal(&users.AuthRestoreAccountRequest{Token: linkToken(t, msg)})
+	assert.NoError(t, err)
+
+	req = httptest.NewRequest(http.MethodPost, "/auth/account/restore", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	resp = httptest.NewRecorder()
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.Nil(t, user.DeletedAt)
+}
+
+func TestHandler_DeleteUser_204_Purge(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	viper.Set(config.AccountDeletionGracePeriod, 0)
+	t.Cleanup(func() { viper.Set(config.AccountDeletionGracePeriod, 30*24*time.Hour) })
+
+	user := users.NewUser("test@example.com", "test")
+	user.Name = "Test User"
+	user.Bio = "Hello"
+	err := user.SetPassword("abcdefghijkl")
+	assert.NoError(t, err)
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(&users.DeleteUserRequest{Password: "abcdefghijkl"})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodDelete, "/user", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			user.Id,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"Collection",
+			mock.Anything,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.AnythingOfType("[]*users.Export"),
+		).
+		Return(
+			[]*users.Export{},
+			nil,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			[]*users.LoginAttempt{},
+			nil,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			user.Id,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		).
+		On(
+			"UpdateMany",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			int64(1),
+			nil,
+		).
+		On(
+			"Update",
+			mock.Anything,
+			bson.D{{"id", user.Id}},
+			bson.D{{"$set", bson.D{{"pat_slots", bson.A{}}}}},
+			mock.Anything,
+		).
+		Return(
+			&mongo.UpdateResult{MatchedCount: 1},
+			nil,
+		).
+		On(
+			"Insert",
+			mock.Anything,
+			mock.AnythingOfType("*users.AuditEvent"),
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		).
+		On(
+			"Delete",
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			int64(1),
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.NotNil(t, user.DeletedAt)
+	assert.Equal(t, fmt.Sprintf("%s@deleted.invalid", user.Id), user.Email)
+	assert.Equal(t, fmt.Sprintf("deleted-%s", user.Id), user.Username)
+	assert.Empty(t, user.Name)
+	assert.Empty(t, user.Bio)
+	assert.Empty(t, user.Password)
+	mapper.AssertNumberOfCalls(t, "Delete", 4)
+}
+
+func TestHandler_DeleteUser_403(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	err := user.SetPassword("abcdefghijkl")
+	assert.NoError(t, err)
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	b, err := json.Marshal(&users.DeleteUserRequest{Password: "wrong"})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodDelete, "/user", bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			user.Id,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"Collection",
+			users.LoginAttemptsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Find",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			[]*users.LoginAttempt{},
+			nil,
+		).
+		On(
+			"FindOneAndUpdate",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			&users.LoginAttempt{Type: users.LoginAttemptAccount, Failures: 1},
+			nil,
+		).
+		On(
+			"Update",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Contains(t, resp.Body.String(), "invalid password")
+	assert.Nil(t, user.DeletedAt)
+}
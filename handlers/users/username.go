@@ -7,7 +7,10 @@ import (
 	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/lestrrat-go/jwx/v2/jwt"
 	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/alexferl/echo-boilerplate/util"
 )
 
 type GetUsernameResponse struct {
@@ -18,6 +21,8 @@ type GetUsernameResponse struct {
 	UpdatedAt *time.Time `json:"updated_at" bson:"updated_at"`
 }
 
+// GetUsername returns a user by id or username. Admins get the full
+// account, deleted users included.
 func (h *Handler) GetUsername(c echo.Context) error {
 	username := c.Param("username")
 
@@ -27,6 +32,18 @@ func (h *Handler) GetUsername(c echo.Context) error {
 		bson.D{{"id", username}},
 		bson.D{{"username", username}},
 	}}}
+
+	if token, ok := c.Get("token").(jwt.Token); ok && util.HasRole(token, AdminRole.String()) {
+		result, err := h.Mapper.FindOne(ctx, filter, &AdminUserResponse{})
+		if err == ErrNoDocuments {
+			return h.Validate(c, http.StatusNotFound, echo.Map{"message": "user not found"})
+		} else if err != nil {
+			return fmt.Errorf("failed getting username: %v", err)
+		}
+
+		return h.Validate(c, http.StatusOK, result)
+	}
+
 	result, err := h.Mapper.FindOne(ctx, filter, &GetUsernameResponse{})
 	if err == ErrNoDocuments {
 		return h.Validate(c, http.StatusNotFound, echo.Map{"message": "user not found"})
@@ -1,6 +1,7 @@
 package users_test
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -14,7 +15,7 @@ import (
 
 func TestHandler_GetUsername_200(t *testing.T) {
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	result := &users.GetUsernameResponse{
@@ -105,7 +106,7 @@ func TestHandler_GetUsername_404(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	req := httptest.NewRequest(http.MethodGet, "/users/notfound", nil)
@@ -135,7 +136,7 @@ func TestHandler_GetUsername_410(t *testing.T) {
 
 	user := users.NewUser("test@example.com", "test")
 	user.Delete(user.Id)
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	result := &users.GetUsernameResponse{
@@ -166,3 +167,50 @@ func TestHandler_GetUsername_410(t *testing.T) {
 
 	assert.Equal(t, http.StatusGone, resp.Code)
 }
+
+func TestHandler_GetUsername_200_Admin(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	admin := users.NewAdminUser("admin@example.com", "admin")
+	access, _, err := admin.Login(users.NewSession(admin.Id, "", ""))
+	assert.NoError(t, err)
+
+	user := users.NewUser("test@example.com", "test")
+	user.Suspend(admin.Id)
+	result := &users.AdminUserResponse{
+		Id:          user.Id,
+		Username:    user.Username,
+		Email:       user.Email,
+		Roles:       user.Roles,
+		Suspended:   true,
+		SuspendedAt: user.SuspendedAt,
+		SuspendedBy: admin.Id,
+		CreatedAt:   user.CreatedAt,
+	}
+
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/users/%s", user.Id), nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOne",
+			mock.Anything,
+			mock.Anything,
+			mock.AnythingOfType("*users.AdminUserResponse"),
+		).
+		Return(
+			result,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	var body users.AdminUserResponse
+	err = json.Unmarshal(resp.Body.Bytes(), &body)
+	assert.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, user.Email, body.Email)
+	assert.True(t, body.Suspended)
+}
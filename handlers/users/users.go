@@ -7,7 +7,9 @@ import (
 	"time"
 
 	"github.com/labstack/echo/v4"
+	"github.com/lestrrat-go/jwx/v2/jwt"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/exp/slices"
 
 	"github.com/alexferl/echo-boilerplate/util"
 )
@@ -39,3 +41,189 @@ func (h *Handler) ListUsers(c echo.Context) error {
 
 	return h.Validate(c, http.StatusOK, resp)
 }
+
+// AdminUserResponse is what admins see of a user, it includes the
+// account state that's hidden from everyone else.
+type AdminUserResponse struct {
+	Id                    string     `json:"id" bson:"id"`
+	Username              string     `json:"username" bson:"username"`
+	Email                 string     `json:"email" bson:"email"`
+	EmailVerified         bool       `json:"email_verified" bson:"email_verified"`
+	PendingEmail          string     `json:"pending_email,omitempty" bson:"pending_email"`
+	MFAEnabled            bool       `json:"mfa_enabled" bson:"mfa_enabled"`
+	Name                  string     `json:"name" bson:"name"`
+	Bio                   string     `json:"bio" bson:"bio"`
+	Roles                 []string   `json:"roles" bson:"roles"`
+	Suspended             bool       `json:"suspended" bson:"suspended"`
+	SuspendedAt           *time.Time `json:"suspended_at" bson:"suspended_at"`
+	SuspendedBy           string     `json:"suspended_by,omitempty" bson:"suspended_by"`
+	PasswordResetRequired bool       `json:"password_reset_required" bson:"password_reset_required"`
+	LastLoginAt           *time.Time `json:"last_login_at" bson:"last_login_at"`
+	CreatedAt             *time.Time `json:"created_at" bson:"created_at"`
+	UpdatedAt             *time.Time `json:"updated_at" bson:"updated_at"`
+	DeletedAt             *time.Time `json:"deleted_at" bson:"deleted_at"`
+}
+
+type AdminUpdateUserRequest struct {
+	Roles              *[]string `json:"roles"`
+	Suspended          *bool     `json:"suspended"`
+	ForcePasswordReset bool      `json:"force_password_reset"`
+	RevokeTokens       bool      `json:"revoke_tokens"`
+}
+
+// getManagedUser returns the user an admin is acting on, errResp is set
+// when the user doesn't exist, is deleted or is the admin themselves.
+func (h *Handler) getManagedUser(ctx context.Context, c echo.Context, adminId string) (*User, func() error, error) {
+	result, err := h.Mapper.FindOneById(ctx, c.Param("id"), &User{})
+	if err != nil {
+		if err == ErrNoDocuments {
+			return nil, func() error {
+				return h.Validate(c, http.StatusNotFound, echo.Map{"message": "user not found"})
+			}, nil
+		}
+		return nil, nil, fmt.Errorf("failed getting user: %v", err)
+	}
+
+	user := result.(*User)
+	if user.DeletedAt != nil {
+		return nil, func() error {
+			return h.Validate(c, http.StatusGone, echo.Map{"message": "user deleted"})
+		}, nil
+	}
+
+	if user.Id == adminId {
+		return nil, func() error {
+			return h.Validate(c, http.StatusForbidden, echo.Map{"message": "cannot manage your own account"})
+		}, nil
+	}
+
+	return user, nil, nil
+}
+
+// AdminUpdateUser lets an admin assign roles, suspend a user, force them to
+// reset their password or revoke all their sessions and tokens.
+func (h *Handler) AdminUpdateUser(c echo.Context) error {
+	body := &AdminUpdateUserRequest{}
+	if err := c.Bind(body); err != nil {
+		return err
+	}
+
+	token := c.Get("token").(jwt.Token)
+	adminId := token.Subject()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	user, errResp, err := h.getManagedUser(ctx, c, adminId)
+	if err != nil {
+		return err
+	} else if errResp != nil {
+		return errResp()
+	}
+
+	var events []*AuditEvent
+	data := map[string]any{"admin_id": adminId}
+	revokeSessions, revokePATs := body.RevokeTokens, body.RevokeTokens
+
+	if body.Roles != nil {
+		hadAdmin := slices.Contains(user.Roles, AdminRole.String())
+		// every account keeps the user role
+		user.AddRole(UserRole)
+		if slices.Contains(*body.Roles, AdminRole.String()) {
+			user.AddRole(AdminRole)
+		} else {
+			user.RemoveRole(AdminRole)
+		}
+
+		// roles are claims of the tokens, the old ones have to go
+		if hadAdmin != slices.Contains(user.Roles, AdminRole.String()) {
+			user.RevokeTokens()
+			revokePATs = revokePATs || hadAdmin
+			events = append(events, NewAuditEvent(c, AuditRolesChanged, user.Id, map[string]any{
+				"admin_id": adminId,
+				"roles":    user.Roles,
+			}))
+		}
+	}
+
+	if body.Suspended != nil && *body.Suspended != user.Suspended {
+		if *body.Suspended {
+			user.Suspend(adminId)
+			revokeSessions = true
+			events = append(events, NewAuditEvent(c, AuditAccountSuspended, user.Id, data))
+		} else {
+			user.Unsuspend()
+			events = append(events, NewAuditEvent(c, AuditAccountUnsuspended, user.Id, data))
+		}
+	}
+
+	var reset string
+	if body.ForcePasswordReset {
+		reset, err = user.NewPasswordResetToken()
+		if err != nil {
+			return fmt.Errorf("failed generating password reset token: %v", err)
+		}
+		user.PasswordResetRequired = true
+		revokeSessions = true
+		events = append(events, NewAuditEvent(c, AuditPasswordResetForced, user.Id, data))
+	}
+
+	if revokeSessions {
+		user.RevokeTokens()
+	}
+
+	if body.RevokeTokens {
+		events = append(events, NewAuditEvent(c, AuditTokensRevoked, user.Id, data))
+	}
+
+	user.Update(adminId)
+
+	update, err := h.Mapper.UpdateById(ctx, user.Id, user, &AdminUserResponse{})
+	if err != nil {
+		return fmt.Errorf("failed updating user: %v", err)
+	}
+
+	if revokeSessions {
+		if err = h.revokeSessions(ctx, user.Id, ""); err != nil {
+			return err
+		}
+	}
+
+	if revokePATs {
+		if err = h.revokePersonalAccessTokens(ctx, user.Id); err != nil {
+			return err
+		}
+	}
+
+	for _, event := range events {
+		if err = h.recordEvent(ctx, event); err != nil {
+			return err
+		}
+	}
+
+	if reset != "" {
+		h.sendMail(newForcedPasswordResetMessage(user, reset))
+	}
+
+	return h.Validate(c, http.StatusOK, update)
+}
+
+// AdminDeleteUser deletes the account of a user on behalf of an admin.
+// Unlike users deleting their own account, it can't be restored.
+func (h *Handler) AdminDeleteUser(c echo.Context) error {
+	token := c.Get("token").(jwt.Token)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	user, errResp, err := h.getManagedUser(ctx, c, token.Subject())
+	if err != nil {
+		return err
+	} else if errResp != nil {
+		return errResp()
+	}
+
+	if _, err = h.deleteUser(ctx, c, user, token.Subject()); err != nil {
+		return err
+	}
+
+	return h.Validate(c, http.StatusNoContent, nil)
+}
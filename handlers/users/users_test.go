@@ -1,14 +1,18 @@
 package users_test
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
+	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 
 	"github.com/alexferl/echo-boilerplate/handlers/users"
 )
@@ -33,7 +37,7 @@ func TestHandler_ListUsers_200(t *testing.T) {
 	mapper, s := getMapperAndServer(t)
 
 	user := users.NewAdminUser("admin@example.com", "admin")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	req := httptest.NewRequest(http.MethodGet, "/users?per_page=1&page=2", nil)
@@ -101,7 +105,7 @@ func TestHandler_ListUsers_403(t *testing.T) {
 	_, s := getMapperAndServer(t)
 
 	user := users.NewUser("test@example.com", "test")
-	access, _, err := user.Login()
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
 	assert.NoError(t, err)
 
 	req := httptest.NewRequest(http.MethodGet, "/users", nil)
@@ -112,3 +116,347 @@ func TestHandler_ListUsers_403(t *testing.T) {
 	s.ServeHTTP(resp, req)
 	assert.Equal(t, http.StatusForbidden, resp.Code)
 }
+
+func TestHandler_AdminUpdateUser_200(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	admin := users.NewAdminUser("admin@example.com", "admin")
+	access, _, err := admin.Login(users.NewSession(admin.Id, "", ""))
+	assert.NoError(t, err)
+
+	user := users.NewUser("test@example.com", "test")
+
+	b, err := json.Marshal(echo.Map{"roles": []string{"admin"}, "suspended": true})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/users/%s", user.Id), bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			user.Id,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			user.Id,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			&users.AdminUserResponse{
+				Id:        user.Id,
+				Username:  user.Username,
+				Email:     user.Email,
+				Roles:     user.Roles,
+				Suspended: true,
+			},
+			nil,
+		).
+		On(
+			"Collection",
+			users.SessionsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"UpdateMany",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			int64(1),
+			nil,
+		).
+		On(
+			"Collection",
+			users.AuditEventsCollection,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"Insert",
+			mock.Anything,
+			mock.MatchedBy(func(e *users.AuditEvent) bool {
+				return e.Type == users.AuditRolesChanged && e.Data["admin_id"] == admin.Id
+			}),
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		).
+		On(
+			"Insert",
+			mock.Anything,
+			mock.MatchedBy(func(e *users.AuditEvent) bool {
+				return e.Type == users.AuditAccountSuspended
+			}),
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, []string{"user", "admin"}, user.Roles)
+	assert.True(t, user.Suspended)
+	assert.Equal(t, admin.Id, user.SuspendedBy)
+	assert.Equal(t, admin.Id, user.UpdatedBy)
+	assert.Greater(t, user.TokenVersion, int64(0))
+}
+
+func TestHandler_AdminUpdateUser_200_ForcePasswordReset(t *testing.T) {
+	mapper, m, s := getMapperMailerAndServer(t)
+
+	admin := users.NewAdminUser("admin@example.com", "admin")
+	access, _, err := admin.Login(users.NewSession(admin.Id, "", ""))
+	assert.NoError(t, err)
+
+	user := users.NewUser("test@example.com", "test")
+
+	b, err := json.Marshal(echo.Map{"force_password_reset": true})
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/users/%s", user.Id), bytes.NewBuffer(b))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			user.Id,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			user.Id,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			&users.AdminUserResponse{
+				Id:                    user.Id,
+				Username:              user.Username,
+				Email:                 user.Email,
+				Roles:                 user.Roles,
+				PasswordResetRequired: true,
+			},
+			nil,
+		).
+		On(
+			"Collection",
+			mock.Anything,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"UpdateMany",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			int64(1),
+			nil,
+		).
+		On(
+			"Insert",
+			mock.Anything,
+			mock.MatchedBy(func(e *users.AuditEvent) bool {
+				return e.Type == users.AuditPasswordResetForced
+			}),
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.True(t, user.PasswordResetRequired)
+	assert.NotEmpty(t, user.PasswordResetToken)
+
+	msg := m.wait(t)
+	assert.Equal(t, []string{user.Email}, msg.To)
+	assert.Contains(t, msg.Body, "/auth/password/reset?token=")
+
+	err = user.SetPassword("abcdefghijkl")
+	assert.NoError(t, err)
+	assert.False(t, user.PasswordResetRequired)
+}
+
+func TestHandler_AdminUpdateUser_Errors(t *testing.T) {
+	admin := users.NewAdminUser("admin@example.com", "admin")
+	deleted := users.NewUser("deleted@example.com", "deleted")
+	_, err := deleted.NewDeletion()
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name       string
+		id         string
+		user       *users.User
+		err        error
+		statusCode int
+	}{
+		{"self", admin.Id, admin, nil, http.StatusForbidden},
+		{"not found", "id", nil, users.ErrNoDocuments, http.StatusNotFound},
+		{"deleted", deleted.Id, deleted, nil, http.StatusGone},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mapper, s := getMapperAndServer(t)
+
+			access, _, err := admin.Login(users.NewSession(admin.Id, "", ""))
+			assert.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/users/%s", tc.id), bytes.NewBufferString(`{"suspended":true}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+			resp := httptest.NewRecorder()
+
+			mapper.Mock.
+				On(
+					"FindOneById",
+					mock.Anything,
+					tc.id,
+					mock.Anything,
+				).
+				Return(
+					tc.user,
+					tc.err,
+				)
+
+			s.ServeHTTP(resp, req)
+
+			assert.Equal(t, tc.statusCode, resp.Code)
+		})
+	}
+}
+
+func TestHandler_AdminUpdateUser_403(t *testing.T) {
+	_, s := getMapperAndServer(t)
+
+	user := users.NewUser("test@example.com", "test")
+	access, _, err := user.Login(users.NewSession(user.Id, "", ""))
+	assert.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPatch, "/users/id", bytes.NewBufferString(`{"roles":["admin"]}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+}
+
+func TestHandler_AdminDeleteUser_204(t *testing.T) {
+	mapper, s := getMapperAndServer(t)
+
+	admin := users.NewAdminUser("admin@example.com", "admin")
+	access, _, err := admin.Login(users.NewSession(admin.Id, "", ""))
+	assert.NoError(t, err)
+
+	user := users.NewUser("test@example.com", "test")
+
+	req := httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/users/%s", user.Id), nil)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", access))
+	resp := httptest.NewRecorder()
+
+	mapper.Mock.
+		On(
+			"FindOneById",
+			mock.Anything,
+			user.Id,
+			mock.Anything,
+		).
+		Return(
+			user,
+			nil,
+		).
+		On(
+			"UpdateById",
+			mock.Anything,
+			user.Id,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		).
+		On(
+			"Collection",
+			mock.Anything,
+		).
+		Return(
+			mapper,
+		).
+		On(
+			"UpdateMany",
+			mock.Anything,
+			mock.Anything,
+			mock.Anything,
+		).
+		Return(
+			int64(1),
+			nil,
+		).
+		On(
+			"Update",
+			mock.Anything,
+			bson.D{{"id", user.Id}},
+			bson.D{{"$set", bson.D{{"pat_slots", bson.A{}}}}},
+			mock.Anything,
+		).
+		Return(
+			&mongo.UpdateResult{MatchedCount: 1},
+			nil,
+		).
+		On(
+			"Insert",
+			mock.Anything,
+			mock.MatchedBy(func(e *users.AuditEvent) bool {
+				return e.Type == users.AuditAccountDeleted && e.Data["admin_id"] == admin.Id
+			}),
+			mock.Anything,
+		).
+		Return(
+			nil,
+			nil,
+		)
+
+	s.ServeHTTP(resp, req)
+
+	assert.Equal(t, http.StatusNoContent, resp.Code)
+	assert.NotNil(t, user.DeletedAt)
+	assert.Equal(t, admin.Id, user.DeletedBy)
+	assert.Empty(t, user.RestoreToken)
+}
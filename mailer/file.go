@@ -0,0 +1,44 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/xid"
+)
+
+// FileMailer writes emails as .eml files in a directory instead of sending them.
+// Useful for local development and testing.
+type FileMailer struct {
+	dir  string
+	from string
+}
+
+func NewFileMailer(dir string, from string) *FileMailer {
+	return &FileMailer{
+		dir:  dir,
+		from: from,
+	}
+}
+
+func (m *FileMailer) Send(ctx context.Context, msg *Message) error {
+	if msg.From == "" {
+		msg.From = m.from
+	}
+
+	err := os.MkdirAll(m.dir, 0o755)
+	if err != nil {
+		return fmt.Errorf("failed creating mail directory: %v", err)
+	}
+
+	name := fmt.Sprintf("%d_%s.eml", time.Now().UnixNano(), xid.New().String())
+	err = os.WriteFile(filepath.Join(m.dir, name), msg.Bytes(), 0o644)
+	if err != nil {
+		return fmt.Errorf("failed writing email: %v", err)
+	}
+
+	return nil
+}
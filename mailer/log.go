@@ -0,0 +1,31 @@
+package mailer
+
+import (
+	"context"
+
+	"github.com/rs/zerolog/log"
+)
+
+// LogMailer writes emails to the logger instead of sending them.
+// Useful for local development.
+type LogMailer struct {
+	from string
+}
+
+func NewLogMailer(from string) *LogMailer {
+	return &LogMailer{from: from}
+}
+
+func (m *LogMailer) Send(ctx context.Context, msg *Message) error {
+	if msg.From == "" {
+		msg.From = m.from
+	}
+
+	log.Info().
+		Str("from", msg.From).
+		Strs("to", msg.To).
+		Str("subject", msg.Subject).
+		Msg(msg.Body)
+
+	return nil
+}
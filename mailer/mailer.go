@@ -0,0 +1,59 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+
+	"github.com/alexferl/echo-boilerplate/config"
+)
+
+// Message is a plain text email.
+type Message struct {
+	From    string
+	To      []string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails using a transport.
+type Mailer interface {
+	Send(ctx context.Context, msg *Message) error
+}
+
+// New creates a Mailer for the configured transport.
+func New() (Mailer, error) {
+	from := viper.GetString(config.MailerFrom)
+
+	transport := viper.GetString(config.MailerTransport)
+	if transport == "" {
+		transport = config.MailerTransportLog
+	}
+
+	switch transport {
+	case config.MailerTransportSMTP:
+		return NewSMTPMailer(
+			viper.GetString(config.MailerSMTPHost),
+			viper.GetInt(config.MailerSMTPPort),
+			viper.GetString(config.MailerSMTPUsername),
+			viper.GetString(config.MailerSMTPPassword),
+			from,
+		), nil
+	case config.MailerTransportFile:
+		return NewFileMailer(viper.GetString(config.MailerFileDir), from), nil
+	case config.MailerTransportLog:
+		return NewLogMailer(from), nil
+	default:
+		return nil, fmt.Errorf("unknown mailer transport: %s", transport)
+	}
+}
+
+// Bytes returns the message formatted as an RFC 5322 email.
+func (m *Message) Bytes() []byte {
+	return []byte(fmt.Sprintf(
+		"From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=\"utf-8\"\r\n\r\n%s\r\n",
+		m.From, strings.Join(m.To, ", "), m.Subject, m.Body,
+	))
+}
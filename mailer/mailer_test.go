@@ -0,0 +1,81 @@
+package mailer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alexferl/echo-boilerplate/config"
+	_ "github.com/alexferl/echo-boilerplate/testing"
+)
+
+func TestNew(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	testCases := []struct {
+		transport string
+		expected  any
+		err       bool
+	}{
+		{config.MailerTransportLog, &LogMailer{}, false},
+		{config.MailerTransportFile, &FileMailer{}, false},
+		{config.MailerTransportSMTP, &SMTPMailer{}, false},
+		{"invalid", nil, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.transport, func(t *testing.T) {
+			viper.Set(config.MailerTransport, tc.transport)
+			defer viper.Set(config.MailerTransport, config.MailerTransportLog)
+
+			m, err := New()
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.IsType(t, tc.expected, m)
+		})
+	}
+}
+
+func TestFileMailer_Send(t *testing.T) {
+	dir := t.TempDir()
+	m := NewFileMailer(dir, "from@example.com")
+
+	err := m.Send(context.Background(), &Message{
+		To:      []string{"test@example.com"},
+		Subject: "Subject",
+		Body:    "Body",
+	})
+	assert.NoError(t, err)
+
+	files, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(files)) {
+		b, err := os.ReadFile(filepath.Join(dir, files[0].Name()))
+		assert.NoError(t, err)
+		assert.Contains(t, string(b), "From: from@example.com")
+		assert.Contains(t, string(b), "To: test@example.com")
+		assert.Contains(t, string(b), "Subject: Subject")
+		assert.Contains(t, string(b), "Body")
+	}
+}
+
+func TestLogMailer_Send(t *testing.T) {
+	m := NewLogMailer("from@example.com")
+
+	msg := &Message{
+		To:      []string{"test@example.com"},
+		Subject: "Subject",
+		Body:    "Body",
+	}
+	err := m.Send(context.Background(), msg)
+	assert.NoError(t, err)
+	assert.Equal(t, "from@example.com", msg.From)
+}
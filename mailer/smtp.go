@@ -0,0 +1,48 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"net/smtp"
+)
+
+// SMTPMailer sends emails through an SMTP server.
+type SMTPMailer struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+func NewSMTPMailer(host string, port int, username string, password string, from string) *SMTPMailer {
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	return &SMTPMailer{
+		addr: fmt.Sprintf("%s:%d", host, port),
+		auth: auth,
+		from: from,
+	}
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg *Message) error {
+	if msg.From == "" {
+		msg.From = m.from
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- smtp.SendMail(m.addr, m.auth, msg.From, msg.To, msg.Bytes())
+	}()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			return fmt.Errorf("failed sending email: %v", err)
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -90,6 +90,34 @@ func (_m *Mapper) Count(ctx context.Context, filter interface{}, opts ...*option
 	return r0, r1
 }
 
+// Delete provides a mock function with given fields: ctx, filter, opts
+func (_m *Mapper) Delete(ctx context.Context, filter interface{}, opts ...*options.DeleteOptions) (int64, error) {
+	_va := make([]interface{}, len(opts))
+	for _i := range opts {
+		_va[_i] = opts[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, ctx, filter)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, interface{}, ...*options.DeleteOptions) int64); ok {
+		r0 = rf(ctx, filter, opts...)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, interface{}, ...*options.DeleteOptions) error); ok {
+		r1 = rf(ctx, filter, opts...)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // Find provides a mock function with given fields: ctx, filter, result, opts
 func (_m *Mapper) Find(ctx context.Context, filter interface{}, result interface{}, opts ...*options.FindOptions) (interface{}, error) {
 	_va := make([]interface{}, len(opts))
@@ -180,6 +208,36 @@ func (_m *Mapper) FindOneById(ctx context.Context, id string, result interface{}
 	return r0, r1
 }
 
+// FindOneAndUpdate provides a mock function with given fields: ctx, filter, update, result, opts
+func (_m *Mapper) FindOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, result interface{}, opts ...*options.FindOneAndUpdateOptions) (interface{}, error) {
+	_va := make([]interface{}, len(opts))
+	for _i := range opts {
+		_va[_i] = opts[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, ctx, filter, update, result)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
+
+	var r0 interface{}
+	if rf, ok := ret.Get(0).(func(context.Context, interface{}, interface{}, interface{}, ...*options.FindOneAndUpdateOptions) interface{}); ok {
+		r0 = rf(ctx, filter, update, result, opts...)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(interface{})
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, interface{}, interface{}, interface{}, ...*options.FindOneAndUpdateOptions) error); ok {
+		r1 = rf(ctx, filter, update, result, opts...)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // Insert provides a mock function with given fields: ctx, document, result, opts
 func (_m *Mapper) Insert(ctx context.Context, document interface{}, result interface{}, opts ...*options.InsertOneOptions) (interface{}, error) {
 	_va := make([]interface{}, len(opts))
@@ -270,6 +328,34 @@ func (_m *Mapper) UpdateById(ctx context.Context, id string, document interface{
 	return r0, r1
 }
 
+// UpdateMany provides a mock function with given fields: ctx, filter, update, opts
+func (_m *Mapper) UpdateMany(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (int64, error) {
+	_va := make([]interface{}, len(opts))
+	for _i := range opts {
+		_va[_i] = opts[_i]
+	}
+	var _ca []interface{}
+	_ca = append(_ca, ctx, filter, update)
+	_ca = append(_ca, _va...)
+	ret := _m.Called(_ca...)
+
+	var r0 int64
+	if rf, ok := ret.Get(0).(func(context.Context, interface{}, interface{}, ...*options.UpdateOptions) int64); ok {
+		r0 = rf(ctx, filter, update, opts...)
+	} else {
+		r0 = ret.Get(0).(int64)
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func(context.Context, interface{}, interface{}, ...*options.UpdateOptions) error); ok {
+		r1 = rf(ctx, filter, update, opts...)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // Upsert provides a mock function with given fields: ctx, filter, update, result, opts
 func (_m *Mapper) Upsert(ctx context.Context, filter interface{}, update interface{}, result interface{}, opts ...*options.FindOneAndUpdateOptions) (interface{}, error) {
 	_va := make([]interface{}, len(opts))
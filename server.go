@@ -14,17 +14,53 @@ import (
 	"github.com/casbin/casbin/v2"
 	"github.com/labstack/echo/v4"
 	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
-	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/exp/slices"
 
 	"github.com/alexferl/echo-boilerplate/config"
 	"github.com/alexferl/echo-boilerplate/data"
 	"github.com/alexferl/echo-boilerplate/handlers"
 	"github.com/alexferl/echo-boilerplate/handlers/tasks"
 	"github.com/alexferl/echo-boilerplate/handlers/users"
+	"github.com/alexferl/echo-boilerplate/mailer"
 	"github.com/alexferl/echo-boilerplate/util"
 )
 
+// impersonationDeniedRoutes can't be reached with a token impersonating a
+// user, they could take over the account or outlive the token. Changing the
+// email is denied by UpdateUser since PATCH /user also edits the profile.
+var impersonationDeniedRoutes = map[string][]string{
+	"/user":                                   {http.MethodDelete},
+	"/user/password":                          {http.MethodPut},
+	"/user/mfa/totp":                          {http.MethodPost, http.MethodDelete},
+	"/user/mfa/totp/confirm":                  {http.MethodPost},
+	"/user/sessions":                          {http.MethodDelete},
+	"/user/sessions/:id":                      {http.MethodDelete},
+	"/user/identities/:provider/link":         {http.MethodGet},
+	"/user/identities/:id":                    {http.MethodDelete},
+	"/user/personal_access_tokens":            {http.MethodPost},
+	"/user/personal_access_tokens/:id/rotate": {http.MethodPost},
+	"/users/:id/impersonate":                  {http.MethodPost},
+}
+
+// scopesAllowed returns whether any of scopes allows act on obj
+// according to the p2 policies of the casbin model.
+func scopesAllowed(enforcer *casbin.Enforcer, scopes []string, obj string, act string) (bool, error) {
+	ctx := casbin.NewEnforceContext("2")
+	for _, scope := range scopes {
+		ok, err := enforcer.Enforce(ctx, scope, obj, act)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
 func DefaultHandlers() []handler.Handler {
 	client, err := data.NewClient()
 	if err != nil {
@@ -32,6 +68,29 @@ func DefaultHandlers() []handler.Handler {
 	}
 	data.CreateIndexes(client)
 
+	m, err := mailer.New()
+	if err != nil {
+		panic(err)
+	}
+
+	users.StartPurger(
+		users.NewMapper(client, users.UsersCollection),
+		data.NewBucket(client, users.ExportsCollection),
+		viper.GetDuration(config.AccountDeletionPurgeInterval),
+	)
+	users.StartPATUsageFlusher(users.NewMapper(client, users.PATCollection), viper.GetDuration(config.PATUsageFlushInterval))
+	users.StartPATExpiryNotifier(
+		users.NewMapper(client, users.PATCollection),
+		m,
+		viper.GetDuration(config.PATExpiryNotice),
+		viper.GetDuration(config.PATExpiryNotifyInterval),
+	)
+	users.StartExporter(
+		users.NewMapper(client, users.ExportsCollection),
+		data.NewBucket(client, users.ExportsCollection),
+		viper.GetDuration(config.ExportInterval),
+	)
+
 	openapi := openapiMw.NewHandler()
 
 	return []handler.Handler{
@@ -42,7 +101,12 @@ func DefaultHandlers() []handler.Handler {
 }
 
 func NewServer() *server.Server {
-	return newServer(DefaultHandlers()...)
+	client, err := data.NewClient()
+	if err != nil {
+		panic(err)
+	}
+
+	return newServer(users.NewMapper(client, users.PATCollection), true, DefaultHandlers()...)
 }
 
 func NewTestServer(handler ...handler.Handler) *server.Server {
@@ -52,11 +116,35 @@ func NewTestServer(handler ...handler.Handler) *server.Server {
 	viper.Set(config.CookiesEnabled, true)
 	// TODO: add tests with CSRF enabled
 	viper.Set(config.CSRFEnabled, false)
+	viper.Set(config.JWTRevocationEnabled, false)
+
+	client, err := data.NewClient()
+	if err != nil {
+		panic(err)
+	}
+
+	// handlers are tested with mocked mappers, the server's own mapper
+	// isn't connected to look up the users of tokens
+	return newServer(users.NewMapper(client, users.PATCollection), false, handler...)
+}
+
+// NewCheckedTestServer is NewTestServer with the checks of the tokens and
+// their users enabled, they're made with mapper.
+func NewCheckedTestServer(mapper data.Mapper, handler ...handler.Handler) *server.Server {
+	c := config.New()
+	c.BindFlags()
+
+	viper.Set(config.CookiesEnabled, true)
+	viper.Set(config.CSRFEnabled, false)
+	viper.Set(config.JWTRevocationEnabled, true)
 
-	return newServer(handler...)
+	return newServer(mapper, true, handler...)
 }
 
-func newServer(handler ...handler.Handler) *server.Server {
+// newServer returns a server for handler. Personal access tokens and revoked
+// tokens are looked up with mapper and, unless checkUsers is false, so is the
+// user of each token to cut off suspended and deleted users.
+func newServer(mapper data.Mapper, checkUsers bool, handler ...handler.Handler) *server.Server {
 	var routes []*router.Route
 	for _, h := range handler {
 		routes = append(routes, h.GetRoutes()...)
@@ -69,34 +157,91 @@ func newServer(handler ...handler.Handler) *server.Server {
 		panic(err)
 	}
 
-	client, err := data.NewClient()
+	enforcer, err := casbin.NewEnforcer(viper.GetString(config.CasbinModel), viper.GetString(config.CasbinPolicy))
 	if err != nil {
 		panic(err)
 	}
-	mapper := users.NewMapper(client, users.PATCollection)
 
 	jwtConfig := jwtMw.Config{
 		Key:             key,
 		UseRefreshToken: true,
 		ExemptRoutes: map[string][]string{
-			"/":                {http.MethodGet},
-			"/healthz":         {http.MethodGet},
-			"/favicon.ico":     {http.MethodGet},
-			"/docs":            {http.MethodGet},
-			"/openapi/*":       {http.MethodGet},
-			"/auth/signup":     {http.MethodPost},
-			"/auth/login":      {http.MethodPost},
-			"/oauth2/login":    {http.MethodGet},
-			"/oauth2/callback": {http.MethodGet},
+			"/":                          {http.MethodGet},
+			"/healthz":                   {http.MethodGet},
+			"/favicon.ico":               {http.MethodGet},
+			"/docs":                      {http.MethodGet},
+			"/openapi/*":                 {http.MethodGet},
+			"/auth/signup":               {http.MethodPost},
+			"/auth/login":                {http.MethodPost},
+			"/auth/login/mfa":            {http.MethodPost},
+			"/oauth2/:provider/login":    {http.MethodGet},
+			"/oauth2/:provider/callback": {http.MethodGet},
+			"/oauth2/onboarding":         {http.MethodPost},
+			"/auth/verify-email":         {http.MethodGet, http.MethodPost},
+			"/auth/verify-email/resend":  {http.MethodPost},
+			"/auth/password/forgot":      {http.MethodPost},
+			"/auth/password/reset":       {http.MethodGet, http.MethodPost},
+			"/auth/email-change/confirm": {http.MethodGet, http.MethodPost},
+			"/auth/email-change/cancel":  {http.MethodGet, http.MethodPost},
+			"/auth/account/restore":      {http.MethodGet, http.MethodPost},
+			"/user/export/:id/download":  {http.MethodPost},
 		},
 		OptionalRoutes: map[string][]string{
 			"/users/:username": {http.MethodGet},
 		},
+		ParseTokenFunc: func(encodedToken string, options []jwt.ParseOption) (jwt.Token, error) {
+			if !util.ValidOpaqueToken(viper.GetString(config.PATPrefix), encodedToken) {
+				return jwtMw.DefaultConfig.ParseTokenFunc(encodedToken, options)
+			}
+
+			// Opaque personal access tokens only exist in the database
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			t, err := users.ParsePersonalAccessToken(ctx, mapper, encodedToken)
+			if err != nil {
+				switch err {
+				case users.ErrTokenMismatch:
+					return nil, echo.NewHTTPError(http.StatusUnauthorized, "Token invalid")
+				case users.ErrTokenRevoked:
+					return nil, echo.NewHTTPError(http.StatusUnauthorized, "Token is revoked")
+				case users.ErrTokenExpired:
+					return nil, echo.NewHTTPError(http.StatusUnauthorized, "Token is expired")
+				}
+				return nil, echo.NewHTTPError(http.StatusInternalServerError, "Internal Server Error")
+			}
+
+			return t, nil
+		},
 		AfterParseFunc: func(c echo.Context, t jwt.Token, encodedToken string, src jwtMw.TokenSource) *echo.HTTPError {
 			// set roles for casbin
 			claims := t.PrivateClaims()
 			c.Set("roles", claims["roles"])
 
+			// Only session tokens can authenticate requests, single purpose
+			// tokens like the MFA token are checked by their handlers
+			typ := claims["type"]
+			if c.Get("refresh_token") != nil {
+				if typ != util.RefreshToken.String() {
+					return echo.NewHTTPError(http.StatusUnauthorized, "Token invalid")
+				}
+			} else if typ != util.AccessToken.String() && typ != util.PersonalToken.String() {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Token invalid")
+			}
+
+			// Impersonation tokens act as the user on behalf of an admin
+			if actor := util.GetActor(t); actor != "" {
+				if slices.Contains(impersonationDeniedRoutes[c.Path()], c.Request().Method) {
+					return echo.NewHTTPError(http.StatusForbidden, "Not allowed while impersonating")
+				}
+
+				log.Info().
+					Str("user_id", t.Subject()).
+					Str("actor_id", actor).
+					Str("method", c.Request().Method).
+					Str("path", c.Request().URL.Path).
+					Msg("impersonated request")
+			}
+
 			// CSRF
 			if viper.GetBool(config.CookiesEnabled) && viper.GetBool(config.CSRFEnabled) {
 				if src == jwtMw.Cookie {
@@ -120,49 +265,102 @@ func newServer(handler ...handler.Handler) *server.Server {
 				}
 			}
 
-			// Personal Access Tokens
-			typ := claims["type"]
-			if typ == util.PersonalToken.String() {
+			// Unverified users can only reach /user in restricted mode
+			if viper.GetString(config.EmailVerificationMode) == config.EmailVerificationRestricted {
+				if verified, ok := claims["email_verified"]; ok && verified == false && c.Path() != "/user" {
+					return echo.NewHTTPError(http.StatusForbidden, "Email not verified")
+				}
+			}
+
+			// Revoked tokens
+			revocation := viper.GetBool(config.JWTRevocationEnabled)
+			if c.Get("refresh_token") == nil && revocation {
 				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 				defer cancel()
-				filter := bson.D{{"user_id", t.Subject()}}
-				result, err := mapper.Collection(users.PATCollection).FindOne(ctx, filter, &users.PersonalAccessToken{})
-				if err != nil {
-					if err == users.ErrNoDocuments {
-						return echo.NewHTTPError(http.StatusUnauthorized, "Token invalid")
+				if err := users.CheckTokenRevoked(ctx, mapper, t); err != nil {
+					if err == users.ErrTokenRevoked {
+						return echo.NewHTTPError(http.StatusUnauthorized, "Token is revoked")
 					}
 					return echo.NewHTTPError(http.StatusInternalServerError, "Internal Server Error")
 				}
+			}
 
-				pat := result.(*users.PersonalAccessToken)
-				if err = pat.Validate(encodedToken); err != nil {
-					return echo.NewHTTPError(http.StatusUnauthorized, "Token mismatch")
+			// Suspended users are cut off right away, whatever the token and
+			// whether revocation is enabled. Refresh tokens are checked by
+			// the refresh handler.
+			if c.Get("refresh_token") == nil && checkUsers {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+				if err := users.CheckTokenUser(ctx, mapper, t, revocation); err != nil {
+					switch err {
+					case users.ErrTokenRevoked:
+						return echo.NewHTTPError(http.StatusUnauthorized, "Token is revoked")
+					case users.ErrUserSuspended:
+						return echo.NewHTTPError(http.StatusForbidden, "Account suspended")
+					}
+					return echo.NewHTTPError(http.StatusInternalServerError, "Internal Server Error")
 				}
+			}
 
-				if pat.Revoked {
-					return echo.NewHTTPError(http.StatusUnauthorized, "Token is revoked")
+			// Personal Access Tokens
+			if typ == util.PersonalToken.String() {
+				// Opaque tokens were looked up when they were parsed, the ones
+				// issued as JWTs are only accepted during the migration
+				opaque := util.ValidOpaqueToken(viper.GetString(config.PATPrefix), encodedToken)
+				if !opaque && !viper.GetBool(config.PATLegacyJWTEnabled) {
+					return echo.NewHTTPError(http.StatusUnauthorized, "Token invalid")
+				}
+
+				if !users.IPAllowed(t, c.RealIP()) {
+					return echo.NewHTTPError(http.StatusForbidden, "Token not allowed from this IP address")
+				}
+
+				// Scopes are checked on top of the roles checked by casbin
+				if scopes, ok := util.GetScopes(t); ok {
+					allowed, err := scopesAllowed(enforcer, scopes, c.Path(), c.Request().Method)
+					if err != nil {
+						return echo.NewHTTPError(http.StatusInternalServerError, "Internal Server Error")
+					}
+					if !allowed {
+						return echo.NewHTTPError(http.StatusForbidden, "Token scopes don't allow this request")
+					}
 				}
+
+				id := t.JwtID()
+				if !opaque {
+					ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+					defer cancel()
+					var err error
+					id, err = users.ValidatePersonalAccessToken(ctx, mapper, t, encodedToken)
+					if err != nil {
+						switch err {
+						case users.ErrTokenMismatch:
+							return echo.NewHTTPError(http.StatusUnauthorized, "Token mismatch")
+						case users.ErrTokenRevoked:
+							return echo.NewHTTPError(http.StatusUnauthorized, "Token is revoked")
+						}
+						return echo.NewHTTPError(http.StatusInternalServerError, "Internal Server Error")
+					}
+				}
+
+				users.RecordPATUsage(id, c.RealIP())
 			}
 
 			return nil
 		},
 	}
 
-	enforcer, err := casbin.NewEnforcer(viper.GetString(config.CasbinModel), viper.GetString(config.CasbinPolicy))
-	if err != nil {
-		panic(err)
-	}
-
 	openAPIConfig := openapiMw.Config{
 		Schema: viper.GetString(config.OpenAPISchema),
 		ExemptRoutes: map[string][]string{
-			"/":                {http.MethodGet},
-			"/healthz":         {http.MethodGet},
-			"/favicon.ico":     {http.MethodGet},
-			"/docs":            {http.MethodGet},
-			"/openapi/*":       {http.MethodGet},
-			"/oauth2/login":    {http.MethodGet},
-			"/oauth2/callback": {http.MethodGet},
+			"/":                               {http.MethodGet},
+			"/healthz":                        {http.MethodGet},
+			"/favicon.ico":                    {http.MethodGet},
+			"/docs":                           {http.MethodGet},
+			"/openapi/*":                      {http.MethodGet},
+			"/oauth2/:provider/login":         {http.MethodGet},
+			"/oauth2/:provider/callback":      {http.MethodGet},
+			"/user/identities/:provider/link": {http.MethodGet},
 		},
 	}
 
@@ -177,6 +375,10 @@ func newServer(handler ...handler.Handler) *server.Server {
 	s.File("/docs", "./assets/index.html")
 	s.Static("/openapi/", "./openapi")
 
+	// RealIP() must not trust headers any client can set, the IP
+	// allowlists of tokens and the login throttle rely on it
+	s.IPExtractor = util.NewIPExtractor()
+
 	s.HideBanner = true
 	s.HidePort = true
 
@@ -61,7 +61,7 @@ func TestSetTokenCookies(t *testing.T) {
 	resp := httptest.NewRecorder()
 	ctx := echo.New().NewContext(req, resp)
 
-	access, refresh, err := GenerateTokens("123", nil)
+	access, refresh, err := GenerateTokens("123", "456", "789", nil)
 	assert.NoError(t, err)
 
 	SetTokenCookies(ctx, access, refresh)
@@ -3,7 +3,13 @@ package util
 import (
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/hex"
+	"sync"
+
+	"github.com/spf13/viper"
+
+	"github.com/alexferl/echo-boilerplate/config"
 )
 
 func NewHMAC(message []byte, key []byte) string {
@@ -17,3 +23,74 @@ func ValidMAC(message []byte, messageMAC []byte, key []byte) bool {
 	expectedMAC := NewHMAC(message, key)
 	return hmac.Equal(messageMAC, []byte(expectedMAC))
 }
+
+// HashToken returns the SHA-256 hex digest of a high entropy token.
+// It's meant for storing single-use tokens, not passwords.
+func HashToken(token []byte) string {
+	sum := sha256.Sum256(token)
+	return hex.EncodeToString(sum[:])
+}
+
+// ValidToken reports whether token matches the hash returned by HashToken.
+func ValidToken(token []byte, hash string) bool {
+	return hmac.Equal([]byte(HashToken(token)), []byte(hash))
+}
+
+// HashRefreshToken returns the HMAC-SHA256 hex digest of a refresh token
+// keyed with RefreshTokenKey. Refresh tokens are random enough that a keyed
+// hash is as safe as a slow password hash to store them, and much cheaper.
+func HashRefreshToken(token []byte) (string, error) {
+	key, err := RefreshTokenKey()
+	if err != nil {
+		return "", err
+	}
+
+	return NewHMAC(token, key), nil
+}
+
+// ValidRefreshToken reports whether token matches the hash returned by
+// HashRefreshToken. Hashes are compared in constant time.
+func ValidRefreshToken(token []byte, hash string) (bool, error) {
+	key, err := RefreshTokenKey()
+	if err != nil {
+		return false, err
+	}
+
+	return ValidMAC(token, []byte(hash), key), nil
+}
+
+// derivedKey caches the refresh token key derived from the private key at
+// path so the key file isn't read and parsed on every refresh.
+var derivedKey struct {
+	sync.Mutex
+	path string
+	key  []byte
+}
+
+// RefreshTokenKey returns the secret refresh tokens are hashed with. When
+// it's unset, it's derived once from the private key signing the tokens.
+func RefreshTokenKey() ([]byte, error) {
+	if secret := viper.GetString(config.JWTRefreshTokenSecret); secret != "" {
+		return []byte(secret), nil
+	}
+
+	path := viper.GetString(config.JWTPrivateKey)
+
+	derivedKey.Lock()
+	defer derivedKey.Unlock()
+	if derivedKey.key != nil && derivedKey.path == path {
+		return derivedKey.key, nil
+	}
+
+	key, err := LoadPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, x509.MarshalPKCS1PrivateKey(key))
+	mac.Write([]byte("refresh token"))
+	derivedKey.path = path
+	derivedKey.key = mac.Sum(nil)
+
+	return derivedKey.key, nil
+}
@@ -0,0 +1,105 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/alexferl/echo-boilerplate/config"
+)
+
+func TestValidMAC(t *testing.T) {
+	key := []byte("secret")
+	msg := []byte("message")
+	mac := NewHMAC(msg, key)
+
+	assert.True(t, ValidMAC(msg, []byte(mac), key))
+	assert.False(t, ValidMAC(msg, []byte(mac), []byte("wrong")))
+}
+
+func TestValidToken(t *testing.T) {
+	token := []byte("token")
+	hash := HashToken(token)
+
+	assert.Equal(t, 64, len(hash))
+	assert.True(t, ValidToken(token, hash))
+	assert.False(t, ValidToken([]byte("wrong"), hash))
+	assert.False(t, ValidToken(token, ""))
+}
+
+func TestValidRefreshToken(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	token := []byte("token")
+	hash, err := HashRefreshToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, 64, len(hash))
+
+	valid, err := ValidRefreshToken(token, hash)
+	assert.NoError(t, err)
+	assert.True(t, valid)
+
+	valid, err = ValidRefreshToken([]byte("wrong"), hash)
+	assert.NoError(t, err)
+	assert.False(t, valid)
+
+	viper.Set(config.JWTRefreshTokenSecret, "secret")
+	t.Cleanup(func() { viper.Set(config.JWTRefreshTokenSecret, "") })
+
+	valid, err = ValidRefreshToken(token, hash)
+	assert.NoError(t, err)
+	assert.False(t, valid, "hashes depend on the secret")
+
+	secretHash, err := HashRefreshToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, NewHMAC(token, []byte("secret")), secretHash)
+}
+
+func TestRefreshTokenKey(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	key, err := RefreshTokenKey()
+	assert.NoError(t, err)
+	assert.Equal(t, 32, len(key))
+
+	again, err := RefreshTokenKey()
+	assert.NoError(t, err)
+	assert.Equal(t, key, again)
+
+	path := viper.GetString(config.JWTPrivateKey)
+	viper.Set(config.JWTPrivateKey, "missing.pem")
+	t.Cleanup(func() { viper.Set(config.JWTPrivateKey, path) })
+
+	_, err = RefreshTokenKey()
+	assert.Error(t, err, "the key is derived again when the private key changes")
+}
+
+// BenchmarkHashRefreshToken compares hashing a refresh token with a keyed
+// hash and with bcrypt, without signing the token.
+func BenchmarkHashRefreshToken(b *testing.B) {
+	c := config.New()
+	c.BindFlags()
+
+	token, err := GenerateRandomString(64)
+	assert.NoError(b, err)
+
+	b.Run("hmac-sha256", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := HashRefreshToken([]byte(token)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("bcrypt", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := bcrypt.GenerateFromPassword([]byte(token), bcrypt.DefaultCost); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
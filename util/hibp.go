@@ -0,0 +1,54 @@
+package util
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// PasswordBreached reports whether password is in the Have I Been Pwned
+// range files of dir. Like the responses of the range API, each file is
+// named after the first 5 characters of the uppercase SHA-1 hashes, with an
+// optional .txt extension, and has a SUFFIX:COUNT line for each hash.
+// Lines with a count of 0 are padding. A missing file means that no
+// breached password starts with the prefix.
+func PasswordBreached(dir string, password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := os.Open(filepath.Join(dir, prefix))
+	if errors.Is(err, fs.ErrNotExist) {
+		f, err = os.Open(filepath.Join(dir, prefix+".txt"))
+	}
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		s, count, found := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !found || !strings.EqualFold(s, suffix) {
+			continue
+		}
+
+		n, err := strconv.Atoi(count)
+		if err != nil {
+			return false, err
+		}
+
+		return n > 0, nil
+	}
+
+	return false, scanner.Err()
+}
@@ -0,0 +1,38 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordBreached(t *testing.T) {
+	dir := t.TempDir()
+
+	// SHA-1 of "password" is 5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8
+	// and SHA-1 of "padding" is DD4355D9D6A2995312181255C8360ADB304D044D
+	err := os.WriteFile(filepath.Join(dir, "5BAA6"), []byte("003D68EB55068C33ACE09247EE4C639306B:3\r\n1E4C9B93F3F0682250B6CF8331B7EE68FD8:9545824\r\n"), 0o600)
+	assert.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dir, "DD435.txt"), []byte("5D9D6A2995312181255C8360ADB304D044D:0\n"), 0o600)
+	assert.NoError(t, err)
+
+	testCases := []struct {
+		name     string
+		password string
+		breached bool
+	}{
+		{"breached", "password", true},
+		{"padding", "padding", false},
+		{"missing range file", "violet-tractor-88-meadow", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			breached, err := PasswordBreached(dir, tc.password)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.breached, breached)
+		})
+	}
+}
@@ -3,13 +3,41 @@ package util
 import (
 	"fmt"
 	"math"
+	"net"
 	"net/http"
 	"strconv"
 
 	"github.com/alexferl/httplink"
 	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+
+	"github.com/alexferl/echo-boilerplate/config"
 )
 
+// NewIPExtractor returns how echo finds the IP address of clients. It's the
+// address of the peer unless the request comes through one of the trusted
+// proxies, only those can set X-Forwarded-For.
+func NewIPExtractor() echo.IPExtractor {
+	proxies := viper.GetStringSlice(config.HTTPTrustedProxies)
+	if len(proxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+
+	opts := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, proxy := range proxies {
+		// the ranges were validated when the config was loaded
+		if _, ipRange, err := net.ParseCIDR(proxy); err == nil {
+			opts = append(opts, echo.TrustIPRange(ipRange))
+		}
+	}
+
+	return echo.ExtractIPFromXFFHeader(opts...)
+}
+
 func ParsePaginationParams(c echo.Context) (int, int, int, int) {
 	var page int
 	pageQuery := c.QueryParam("page")
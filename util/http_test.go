@@ -2,11 +2,16 @@ package util
 
 import (
 	"fmt"
+	"net/http"
 	"net/http/httptest"
 	"strconv"
 	"testing"
 
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+
+	"github.com/alexferl/echo-boilerplate/config"
 )
 
 func TestPaginate(t *testing.T) {
@@ -92,3 +97,33 @@ func TestPaginate(t *testing.T) {
 		})
 	}
 }
+
+func TestNewIPExtractor(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	testCases := []struct {
+		name       string
+		proxies    []string
+		remoteAddr string
+		ip         string
+	}{
+		{"no trusted proxies", nil, "192.0.2.1:1234", "192.0.2.1"},
+		{"untrusted peer", []string{"10.0.0.0/8"}, "192.0.2.1:1234", "192.0.2.1"},
+		{"trusted proxy", []string{"10.0.0.0/8"}, "10.0.0.1:1234", "203.0.113.1"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			viper.Set(config.HTTPTrustedProxies, tc.proxies)
+			t.Cleanup(func() { viper.Set(config.HTTPTrustedProxies, []string{}) })
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tc.remoteAddr
+			req.Header.Set(echo.HeaderXForwardedFor, "203.0.113.1")
+			req.Header.Set(echo.HeaderXRealIP, "203.0.113.1")
+
+			assert.Equal(t, tc.ip, NewIPExtractor()(req))
+		})
+	}
+}
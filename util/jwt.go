@@ -11,6 +11,7 @@ import (
 
 	"github.com/lestrrat-go/jwx/v2/jwa"
 	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/rs/xid"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 
@@ -23,19 +24,32 @@ const (
 	AccessToken TokenType = iota + 1
 	RefreshToken
 	PersonalToken
+	VerifyEmailToken
+	MFAToken
+	OAuth2OnboardingToken
+	OAuth2StateToken
+	ExportDownloadToken
 )
 
 func (t TokenType) String() string {
-	return [...]string{"access", "refresh", "personal"}[t-1]
+	return [...]string{"access", "refresh", "personal", "verify_email", "mfa", "oauth2_onboarding", "oauth2_state", "export_download"}[t-1]
 }
 
-func GenerateTokens(sub string, claims map[string]any) ([]byte, []byte, error) {
-	access, err := GenerateAccessToken(sub, claims)
+// GenerateTokens returns an access token and a refresh token with the id jti
+// for the session sid. The session is the refresh token family: every refresh
+// token issued for it shares the same sid.
+func GenerateTokens(sub string, sid string, jti string, claims map[string]any) ([]byte, []byte, error) {
+	accessClaims := map[string]any{"sid": sid}
+	for k, v := range claims {
+		accessClaims[k] = v
+	}
+
+	access, err := GenerateAccessToken(sub, accessClaims)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	refresh, err := GenerateRefreshToken(sub)
+	refresh, err := GenerateRefreshToken(sub, map[string]any{"sid": sid, "jti": jti})
 	if err != nil {
 		return nil, nil, err
 	}
@@ -48,15 +62,76 @@ func GenerateAccessToken(sub string, claims map[string]any) ([]byte, error) {
 	return generateToken(AccessToken, expiry, sub, claims)
 }
 
-func GenerateRefreshToken(sub string) ([]byte, error) {
+func GenerateRefreshToken(sub string, claims map[string]any) ([]byte, error) {
 	expiry := viper.GetDuration(config.JWTRefreshTokenExpiry)
-	return generateToken(RefreshToken, expiry, sub, map[string]any{})
+	return generateToken(RefreshToken, expiry, sub, claims)
 }
 
 func GeneratePersonalToken(sub string, expiry time.Duration, claims map[string]any) ([]byte, error) {
 	return generateToken(PersonalToken, expiry, sub, claims)
 }
 
+func GenerateVerifyEmailToken(sub string, claims map[string]any) ([]byte, error) {
+	expiry := viper.GetDuration(config.EmailVerificationTokenExpiry)
+	return generateToken(VerifyEmailToken, expiry, sub, claims)
+}
+
+// GenerateMFAToken returns a token proving the first factor was validated.
+// It can only be exchanged at /auth/login/mfa.
+func GenerateMFAToken(sub string) ([]byte, error) {
+	expiry := viper.GetDuration(config.MFATokenExpiry)
+	return generateToken(MFAToken, expiry, sub, map[string]any{})
+}
+
+// GenerateOAuth2OnboardingToken returns a token holding the identity of a new
+// user at a provider. It can only be exchanged at /oauth2/onboarding.
+func GenerateOAuth2OnboardingToken(sub string, claims map[string]any) ([]byte, error) {
+	expiry := viper.GetDuration(config.OAuth2TokenExpiry)
+	return generateToken(OAuth2OnboardingToken, expiry, sub, claims)
+}
+
+// GenerateOAuth2StateToken returns a token binding the state, nonce and PKCE
+// verifier of a log in at provider. It's only ever stored in a cookie.
+func GenerateOAuth2StateToken(provider string, claims map[string]any) ([]byte, error) {
+	expiry := viper.GetDuration(config.OAuth2StateExpiry)
+	return generateToken(OAuth2StateToken, expiry, provider, claims)
+}
+
+// GenerateImpersonationToken returns an access token for the user sub acting
+// on behalf of actor, who is named by an RFC 8693 act claim. It has no session
+// so it can't be refreshed.
+func GenerateImpersonationToken(sub string, actor string, claims map[string]any) ([]byte, error) {
+	expiry := viper.GetDuration(config.ImpersonationTokenExpiry)
+	actClaims := map[string]any{"act": map[string]any{"sub": actor}}
+	for k, v := range claims {
+		actClaims[k] = v
+	}
+	return generateToken(AccessToken, expiry, sub, actClaims)
+}
+
+// GetActor returns the subject of the act claim of token, it's empty unless
+// token was issued to impersonate a user.
+func GetActor(token jwt.Token) string {
+	val, ok := token.Get("act")
+	if !ok {
+		return ""
+	}
+
+	act, _ := val.(map[string]any)
+	sub, _ := act["sub"].(string)
+
+	return sub
+}
+
+// GenerateExportDownloadToken returns a token to download the data export
+// exportId of the user sub. It's meant to be used in a link.
+func GenerateExportDownloadToken(sub string, exportId string) ([]byte, error) {
+	expiry := viper.GetDuration(config.ExportDownloadExpiry)
+	return generateToken(ExportDownloadToken, expiry, sub, map[string]any{"export_id": exportId})
+}
+
+// generateToken gives every token a unique jti so it can be revoked on its
+// own, claims can override it.
 func generateToken(typ TokenType, expiry time.Duration, sub string, claims map[string]any) ([]byte, error) {
 	key, err := LoadPrivateKey()
 	if err != nil {
@@ -64,6 +139,7 @@ func generateToken(typ TokenType, expiry time.Duration, sub string, claims map[s
 	}
 
 	builder := jwt.NewBuilder().
+		JwtID(xid.New().String()).
 		Subject(sub).
 		Issuer(viper.GetString(config.JWTIssuer)).
 		IssuedAt(time.Now()).
@@ -114,6 +190,25 @@ func GetRoles(token jwt.Token) []string {
 	return res
 }
 
+// GetScopes returns the scopes of a personal access token, ok is false
+// for tokens that aren't limited to scopes.
+func GetScopes(token jwt.Token) ([]string, bool) {
+	val, ok := token.Get("scopes")
+	if !ok {
+		return nil, false
+	}
+
+	var res []string
+	scopes, _ := val.([]interface{})
+	for _, scope := range scopes {
+		if s, ok := scope.(string); ok {
+			res = append(res, s)
+		}
+	}
+
+	return res, true
+}
+
 func HasRole(token jwt.Token, role string) bool {
 	if val, ok := token.Get("roles"); !ok {
 		log.Error().Msgf("failed getting roles for token: %s", token.Subject())
@@ -13,7 +13,7 @@ func TestGenerateTokens(t *testing.T) {
 	c := config.New()
 	c.BindFlags()
 
-	_, _, err := GenerateTokens("123", nil)
+	_, _, err := GenerateTokens("123", "456", "789", nil)
 	assert.NoError(t, err)
 }
 
@@ -24,7 +24,9 @@ func TestParseToken(t *testing.T) {
 	sub := "123"
 	claim := "mine"
 
-	access, refresh, err := GenerateTokens(sub, map[string]any{"claim": claim})
+	sid := "456"
+	jti := "789"
+	access, refresh, err := GenerateTokens(sub, sid, jti, map[string]any{"claim": claim})
 	assert.NoError(t, err)
 
 	accessToken, err := ParseToken(access)
@@ -33,12 +35,19 @@ func TestParseToken(t *testing.T) {
 	accessClaim, ok := accessToken.Get("claim")
 	assert.True(t, ok)
 	assert.Equal(t, claim, accessClaim)
+	accessSid, _ := accessToken.Get("sid")
+	assert.Equal(t, sid, accessSid)
+	assert.NotEmpty(t, accessToken.JwtID())
+	assert.NotEqual(t, jti, accessToken.JwtID())
 
 	refreshToken, err := ParseToken(refresh)
 	assert.NoError(t, err)
 	assert.Equal(t, sub, refreshToken.Subject())
 	_, ok = refreshToken.Get("claim")
 	assert.False(t, ok)
+	refreshSid, _ := refreshToken.Get("sid")
+	assert.Equal(t, sid, refreshSid)
+	assert.Equal(t, jti, refreshToken.JwtID())
 }
 
 func TestHasRole(t *testing.T) {
@@ -59,7 +68,7 @@ func TestHasRole(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			access, _, err := GenerateTokens("123", tc.claims)
+			access, _, err := GenerateTokens("123", "456", "789", tc.claims)
 			assert.NoError(t, err)
 
 			token, err := ParseToken(access)
@@ -69,3 +78,26 @@ func TestHasRole(t *testing.T) {
 		})
 	}
 }
+
+func TestGenerateImpersonationToken(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	encoded, err := GenerateImpersonationToken("123", "admin", map[string]any{"roles": []string{"user"}})
+	assert.NoError(t, err)
+
+	token, err := ParseToken(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, "123", token.Subject())
+	assert.Equal(t, "admin", GetActor(token))
+	typ, _ := token.Get("type")
+	assert.Equal(t, AccessToken.String(), typ)
+	_, ok := token.Get("sid")
+	assert.False(t, ok)
+
+	access, _, err := GenerateTokens("123", "456", "789", nil)
+	assert.NoError(t, err)
+	token, err = ParseToken(access)
+	assert.NoError(t, err)
+	assert.Empty(t, GetActor(token))
+}
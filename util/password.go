@@ -0,0 +1,210 @@
+package util
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// commonPasswords are ranked from most to least common.
+var commonPasswords = []string{
+	"password", "123456", "qwerty", "letmein", "welcome", "admin", "iloveyou", "monkey", "dragon",
+	"football", "baseball", "master", "login", "princess", "sunshine", "shadow", "superman", "trustno",
+	"passw", "secret", "hello", "freedom", "whatever", "starwars", "computer", "michael", "jordan",
+	"summer", "winter", "spring", "autumn", "flower", "hunter", "ranger", "killer", "soccer", "hockey",
+	"batman", "charlie", "thomas", "access", "mustang", "cheese", "pepper", "ginger", "cookie", "banana",
+	"orange", "purple", "silver", "golden", "family", "change", "default", "guest", "root", "user",
+	"test", "love", "god", "money", "pass", "abc", "qwe", "asd", "zxc",
+}
+
+var leetSubstitutions = map[rune]rune{
+	'0': 'o', '1': 'i', '3': 'e', '4': 'a', '@': 'a', '5': 's', '$': 's', '7': 't', '!': 'i', '+': 't',
+}
+
+var keyboardRows = []string{"qwertyuiop", "asdfghjkl", "zxcvbnm", "1234567890"}
+
+// bruteforceGuesses is what each character that isn't part of a pattern
+// adds, in log10 guesses.
+const bruteforceGuesses = 1
+
+type passwordMatch struct {
+	start   int
+	guesses float64
+}
+
+// PasswordStrength estimates how hard password is to guess the way zxcvbn
+// does. The password is split into the cheapest run of patterns, like common
+// passwords, userInputs, repeats, sequences and keyboard walks, and the
+// number of guesses they need is turned into a score from 0 (too guessable)
+// to 4 (very unguessable).
+func PasswordStrength(password string, userInputs ...string) int {
+	guesses := passwordGuesses(password, userInputs)
+	switch {
+	case guesses < 3:
+		return 0
+	case guesses < 6:
+		return 1
+	case guesses < 8:
+		return 2
+	case guesses < 10:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// passwordGuesses returns the log10 of the guesses needed for password.
+func passwordGuesses(password string, userInputs []string) float64 {
+	runes := []rune(password)
+	lower := []rune(strings.ToLower(password))
+
+	ranks := map[string]int{}
+	for i, p := range commonPasswords {
+		ranks[p] = i + 1
+	}
+	for _, s := range userInputs {
+		if s = strings.ToLower(s); len(s) >= 3 {
+			ranks[s] = 1
+		}
+	}
+
+	// matches[j] are the patterns ending at j
+	matches := make([][]passwordMatch, len(runes))
+	add := func(i, j int, guesses float64) {
+		matches[j] = append(matches[j], passwordMatch{start: i, guesses: math.Log10(guesses)})
+	}
+
+	for i := range lower {
+		for j := i + 2; j < len(lower); j++ {
+			s := string(lower[i : j+1])
+			caps := capitalizationGuesses(runes[i : j+1])
+
+			if rank, ok := ranks[s]; ok {
+				add(i, j, float64(rank)*caps)
+			}
+			if rank, ok := ranks[reverse(s)]; ok {
+				add(i, j, float64(rank)*caps*2)
+			}
+			if u := unleet(s); u != s {
+				if rank, ok := ranks[u]; ok {
+					add(i, j, float64(rank)*caps*2)
+				}
+			}
+
+			if isRepeat(lower[i : j+1]) {
+				add(i, j, 10*float64(j-i+1))
+			}
+			if delta, ok := sequenceDelta(lower[i : j+1]); ok {
+				add(i, j, sequenceGuesses(lower[i], delta)*float64(j-i+1))
+			}
+			if isKeyboardWalk(s) {
+				add(i, j, 20*float64(j-i+1)*caps)
+			}
+		}
+	}
+
+	// best[k] is the fewest guesses for the first k characters
+	best := make([]float64, len(runes)+1)
+	for k := 1; k <= len(runes); k++ {
+		best[k] = best[k-1] + bruteforceGuesses
+		for _, m := range matches[k-1] {
+			if g := best[m.start] + m.guesses; g < best[k] {
+				best[k] = g
+			}
+		}
+	}
+
+	return best[len(runes)]
+}
+
+// capitalizationGuesses is how many ways s could have been capitalized.
+func capitalizationGuesses(s []rune) float64 {
+	upper := 0
+	for _, r := range s {
+		if unicode.IsUpper(r) {
+			upper++
+		}
+	}
+
+	switch {
+	case upper == 0:
+		return 1
+	case upper == len(s), upper == 1 && unicode.IsUpper(s[0]):
+		return 2
+	default:
+		return float64(len(s))
+	}
+}
+
+func isRepeat(s []rune) bool {
+	for _, r := range s[1:] {
+		if r != s[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// sequenceDelta reports whether s is a sequence like abc, 321 or acegi and
+// returns the step between its characters.
+func sequenceDelta(s []rune) (int, bool) {
+	delta := int(s[1]) - int(s[0])
+	if delta == 0 || delta < -5 || delta > 5 {
+		return 0, false
+	}
+
+	for i := 2; i < len(s); i++ {
+		if int(s[i])-int(s[i-1]) != delta {
+			return 0, false
+		}
+	}
+
+	return delta, true
+}
+
+func sequenceGuesses(start rune, delta int) float64 {
+	var guesses float64
+	switch {
+	case strings.ContainsRune("az019", start):
+		guesses = 4
+	case unicode.IsDigit(start):
+		guesses = 10
+	default:
+		guesses = 26
+	}
+
+	if delta < 0 {
+		guesses *= 2
+	}
+	if delta != 1 && delta != -1 {
+		guesses *= 5
+	}
+
+	return guesses
+}
+
+func isKeyboardWalk(s string) bool {
+	for _, row := range keyboardRows {
+		if strings.Contains(row, s) || strings.Contains(row, reverse(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+func unleet(s string) string {
+	return strings.Map(func(r rune) rune {
+		if sub, ok := leetSubstitutions[r]; ok {
+			return sub
+		}
+		return r
+	}, s)
+}
+
+func reverse(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
@@ -0,0 +1,190 @@
+package util
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/alexferl/echo-boilerplate/config"
+)
+
+var (
+	ErrPasswordMismatch    = errors.New("password mismatch")
+	ErrUnknownPasswordHash = errors.New("unknown password hash")
+)
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// argon2Slots limits how many argon2id hashes run at once since each one
+// holds its memory parameter for as long as it runs. A burst of logins
+// would otherwise use memory * requests.
+var argon2Slots struct {
+	sync.Mutex
+	size  int
+	slots chan struct{}
+}
+
+// acquireArgon2Slot waits until fewer than the configured number of
+// argon2id hashes are running and returns the func releasing the slot.
+func acquireArgon2Slot() func() {
+	n := viper.GetInt(config.PasswordHashArgon2Concurrency)
+	if n < 1 {
+		return func() {}
+	}
+
+	argon2Slots.Lock()
+	if argon2Slots.size != n {
+		argon2Slots.size = n
+		argon2Slots.slots = make(chan struct{}, n)
+	}
+	slots := argon2Slots.slots
+	argon2Slots.Unlock()
+
+	slots <- struct{}{}
+	return func() { <-slots }
+}
+
+type argon2Hash struct {
+	version     int
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+// HashPassword hashes password with the configured algorithm and parameters.
+// Hashes say how they were made: argon2id ones use the PHC string format,
+// like $argon2id$v=19$m=65536,t=3,p=2$salt$key, and bcrypt ones the modular
+// crypt format, like $2a$10$saltkey.
+func HashPassword(password string) (string, error) {
+	if viper.GetString(config.PasswordHashAlgorithm) == config.PasswordHashBcrypt {
+		b, err := bcrypt.GenerateFromPassword([]byte(password), viper.GetInt(config.PasswordHashBcryptCost))
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	h := &argon2Hash{
+		version:     argon2.Version,
+		memory:      viper.GetUint32(config.PasswordHashArgon2Memory),
+		iterations:  viper.GetUint32(config.PasswordHashArgon2Iterations),
+		parallelism: uint8(viper.GetUint(config.PasswordHashArgon2Parallelism)),
+		salt:        salt,
+	}
+	release := acquireArgon2Slot()
+	h.key = argon2.IDKey([]byte(password), h.salt, h.iterations, h.memory, h.parallelism, argon2KeyLength)
+	release()
+
+	return h.String(), nil
+}
+
+// VerifyPassword returns ErrPasswordMismatch unless password matches hash,
+// whatever the algorithm and parameters it was made with.
+func VerifyPassword(hash string, password string) error {
+	if isBcryptHash(hash) {
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return ErrPasswordMismatch
+		}
+		return err
+	}
+
+	h, err := parseArgon2Hash(hash)
+	if err != nil {
+		return err
+	}
+
+	release := acquireArgon2Slot()
+	key := argon2.IDKey([]byte(password), h.salt, h.iterations, h.memory, h.parallelism, uint32(len(h.key)))
+	release()
+	if subtle.ConstantTimeCompare(key, h.key) != 1 {
+		return ErrPasswordMismatch
+	}
+
+	return nil
+}
+
+// PasswordNeedsRehash reports whether hash wasn't made with the configured
+// algorithm and parameters, so that the password should be hashed again
+// the next time it's known.
+func PasswordNeedsRehash(hash string) bool {
+	if isBcryptHash(hash) {
+		if viper.GetString(config.PasswordHashAlgorithm) != config.PasswordHashBcrypt {
+			return true
+		}
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != viper.GetInt(config.PasswordHashBcryptCost)
+	}
+
+	if viper.GetString(config.PasswordHashAlgorithm) != config.PasswordHashArgon2id {
+		return true
+	}
+
+	h, err := parseArgon2Hash(hash)
+	if err != nil {
+		return true
+	}
+
+	return h.version != argon2.Version ||
+		h.memory != viper.GetUint32(config.PasswordHashArgon2Memory) ||
+		h.iterations != viper.GetUint32(config.PasswordHashArgon2Iterations) ||
+		h.parallelism != uint8(viper.GetUint(config.PasswordHashArgon2Parallelism)) ||
+		len(h.key) != argon2KeyLength
+}
+
+func (h *argon2Hash) String() string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		h.version, h.memory, h.iterations, h.parallelism,
+		base64.RawStdEncoding.EncodeToString(h.salt),
+		base64.RawStdEncoding.EncodeToString(h.key),
+	)
+}
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func parseArgon2Hash(hash string) (*argon2Hash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+		return nil, ErrUnknownPasswordHash
+	}
+
+	h := &argon2Hash{}
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &h.version); err != nil {
+		return nil, ErrUnknownPasswordHash
+	}
+
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.iterations, &h.parallelism)
+	if err != nil || h.iterations < 1 || h.parallelism < 1 {
+		return nil, ErrUnknownPasswordHash
+	}
+
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, ErrUnknownPasswordHash
+	}
+
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, ErrUnknownPasswordHash
+	}
+
+	return h, nil
+}
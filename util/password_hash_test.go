@@ -0,0 +1,121 @@
+package util
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alexferl/echo-boilerplate/config"
+)
+
+func TestHashPassword(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	hash, err := HashPassword("password")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=65536,t=3,p=2$"))
+	assert.NoError(t, VerifyPassword(hash, "password"))
+	assert.ErrorIs(t, VerifyPassword(hash, "wrong"), ErrPasswordMismatch)
+	assert.False(t, PasswordNeedsRehash(hash))
+
+	other, err := HashPassword("password")
+	assert.NoError(t, err)
+	assert.NotEqual(t, hash, other)
+
+	viper.Set(config.PasswordHashAlgorithm, config.PasswordHashBcrypt)
+	t.Cleanup(func() { viper.Set(config.PasswordHashAlgorithm, config.PasswordHashArgon2id) })
+
+	hash, err = HashPassword("password")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(hash, "$2a$10$"))
+	assert.NoError(t, VerifyPassword(hash, "password"))
+	assert.ErrorIs(t, VerifyPassword(hash, "wrong"), ErrPasswordMismatch)
+	assert.False(t, PasswordNeedsRehash(hash))
+}
+
+func TestPasswordNeedsRehash(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	argon2id, err := HashPassword("password")
+	assert.NoError(t, err)
+
+	viper.Set(config.PasswordHashAlgorithm, config.PasswordHashBcrypt)
+	bcrypt, err := HashPassword("password")
+	assert.NoError(t, err)
+	viper.Set(config.PasswordHashAlgorithm, config.PasswordHashArgon2id)
+
+	testCases := []struct {
+		name     string
+		settings map[string]any
+		hash     string
+		rehash   bool
+	}{
+		{"argon2id unchanged", nil, argon2id, false},
+		{"argon2id memory raised", map[string]any{config.PasswordHashArgon2Memory: 128 * 1024}, argon2id, true},
+		{"argon2id iterations raised", map[string]any{config.PasswordHashArgon2Iterations: 4}, argon2id, true},
+		{"argon2id parallelism raised", map[string]any{config.PasswordHashArgon2Parallelism: 4}, argon2id, true},
+		{"bcrypt to argon2id", nil, bcrypt, true},
+		{"argon2id to bcrypt", map[string]any{config.PasswordHashAlgorithm: config.PasswordHashBcrypt}, argon2id, true},
+		{"bcrypt unchanged", map[string]any{config.PasswordHashAlgorithm: config.PasswordHashBcrypt}, bcrypt, false},
+		{
+			"bcrypt cost raised",
+			map[string]any{config.PasswordHashAlgorithm: config.PasswordHashBcrypt, config.PasswordHashBcryptCost: 12},
+			bcrypt,
+			true,
+		},
+		{"malformed", nil, "$argon2id$v=19$m=65536", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for k, v := range tc.settings {
+				k, old := k, viper.Get(k)
+				viper.Set(k, v)
+				t.Cleanup(func() { viper.Set(k, old) })
+			}
+
+			assert.Equal(t, tc.rehash, PasswordNeedsRehash(tc.hash))
+		})
+	}
+}
+
+func TestVerifyPassword_Unknown(t *testing.T) {
+	for _, hash := range []string{"", "password", "$argon2id$v=19$m=65536,t=3,p=2$salt", "$argon2id$v=19$m=a,t=3,p=2$c2FsdA$a2V5"} {
+		assert.ErrorIs(t, VerifyPassword(hash, "password"), ErrUnknownPasswordHash)
+	}
+}
+
+func TestAcquireArgon2Slot(t *testing.T) {
+	c := config.New()
+	c.BindFlags()
+
+	viper.Set(config.PasswordHashArgon2Concurrency, 1)
+	t.Cleanup(func() { viper.Set(config.PasswordHashArgon2Concurrency, 4) })
+
+	release := acquireArgon2Slot()
+
+	acquired := make(chan struct{})
+	go func() {
+		acquireArgon2Slot()()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("slot acquired while the only one was held")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("slot not acquired after it was released")
+	}
+}
@@ -0,0 +1,34 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPasswordStrength(t *testing.T) {
+	testCases := []struct {
+		name       string
+		password   string
+		userInputs []string
+		score      int
+	}{
+		{"common password", "password", nil, 0},
+		{"leet common password", "P@ssw0rd", nil, 0},
+		{"sequence", "abcdefghijkl", nil, 0},
+		{"reversed sequence", "987654321", nil, 0},
+		{"repeat", "aaaaaaaaaaaa", nil, 0},
+		{"keyboard walk", "qwertyuiop", nil, 0},
+		{"user input", "johndoe123", []string{"johndoe"}, 0},
+		{"short random", "kT9v", nil, 1},
+		{"patterns and random", "summer2024!x", nil, 2},
+		{"random", "Xk9#mQ2$vL7!pR", nil, 4},
+		{"passphrase", "violet-tractor-88-meadow", nil, 4},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.score, PasswordStrength(tc.password, tc.userInputs...))
+		})
+	}
+}
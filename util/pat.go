@@ -0,0 +1,67 @@
+package util
+
+import (
+	"crypto/rand"
+	"hash/crc32"
+	"math/big"
+	"strings"
+)
+
+const (
+	base62             = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	opaqueTokenLength  = 30
+	opaqueChecksumSize = 6
+)
+
+// GenerateOpaqueToken returns a random token like <prefix>_<body><checksum>.
+// The checksum is the CRC32 of the body, which lets secret scanners tell a
+// leaked token from a random string without asking the server.
+func GenerateOpaqueToken(prefix string) (string, error) {
+	b := make([]byte, opaqueTokenLength)
+	max := big.NewInt(int64(len(base62)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = base62[n.Int64()]
+	}
+
+	body := string(b)
+
+	return prefix + "_" + body + opaqueChecksum(body), nil
+}
+
+// ValidOpaqueToken reports whether token was generated by
+// GenerateOpaqueToken with prefix. It doesn't tell if the token exists.
+func ValidOpaqueToken(prefix string, token string) bool {
+	if !strings.HasPrefix(token, prefix+"_") {
+		return false
+	}
+
+	s := strings.TrimPrefix(token, prefix+"_")
+	if len(s) != opaqueTokenLength+opaqueChecksumSize {
+		return false
+	}
+
+	body, checksum := s[:opaqueTokenLength], s[opaqueTokenLength:]
+	for _, c := range body {
+		if !strings.ContainsRune(base62, c) {
+			return false
+		}
+	}
+
+	return checksum == opaqueChecksum(body)
+}
+
+func opaqueChecksum(body string) string {
+	n := crc32.ChecksumIEEE([]byte(body))
+
+	b := make([]byte, opaqueChecksumSize)
+	for i := opaqueChecksumSize - 1; i >= 0; i-- {
+		b[i] = base62[n%62]
+		n /= 62
+	}
+
+	return string(b)
+}
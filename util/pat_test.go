@@ -0,0 +1,49 @@
+package util
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateOpaqueToken(t *testing.T) {
+	token, err := GenerateOpaqueToken("app")
+	assert.NoError(t, err)
+
+	assert.True(t, strings.HasPrefix(token, "app_"))
+	assert.Equal(t, len("app_")+36, len(token))
+	assert.True(t, ValidOpaqueToken("app", token))
+
+	other, err := GenerateOpaqueToken("app")
+	assert.NoError(t, err)
+	assert.NotEqual(t, token, other)
+}
+
+func TestValidOpaqueToken(t *testing.T) {
+	token, err := GenerateOpaqueToken("app")
+	assert.NoError(t, err)
+
+	last := token[len(token)-1:]
+	typo := "0"
+	if last == "0" {
+		typo = "1"
+	}
+
+	testCases := []struct {
+		name  string
+		token string
+	}{
+		{"other prefix", "other" + strings.TrimPrefix(token, "app")},
+		{"bad checksum", token[:len(token)-1] + typo},
+		{"too short", token[:len(token)-1]},
+		{"not base62", "app_" + strings.Repeat("-", 36)},
+		{"jwt", "eyJhbGciOiJSUzI1NiIsInR5cCI6IkpXVCJ9.e30.sig"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.False(t, ValidOpaqueToken("app", tc.token))
+		})
+	}
+}
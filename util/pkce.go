@@ -0,0 +1,18 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// GenerateCodeVerifier returns a PKCE code verifier (RFC 7636).
+func GenerateCodeVerifier() (string, error) {
+	b, err := GenerateRandomBytes(32)
+	return base64.RawURLEncoding.EncodeToString(b), err
+}
+
+// CodeChallengeS256 returns the S256 code challenge of verifier.
+func CodeChallengeS256(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
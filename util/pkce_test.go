@@ -0,0 +1,21 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateCodeVerifier(t *testing.T) {
+	v, err := GenerateCodeVerifier()
+
+	assert.NoError(t, err)
+	assert.Equal(t, 43, len(v))
+}
+
+func TestCodeChallengeS256(t *testing.T) {
+	// RFC 7636 appendix B
+	challenge := CodeChallengeS256("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+
+	assert.Equal(t, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", challenge)
+}
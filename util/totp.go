@@ -0,0 +1,93 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	TOTPPeriod = 30
+	TOTPDigits = 6
+	totpSkew   = 1
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a random base32 encoded secret as used by authenticator apps.
+func GenerateTOTPSecret() (string, error) {
+	b, err := GenerateRandomBytes(20)
+	if err != nil {
+		return "", err
+	}
+
+	return b32.EncodeToString(b), nil
+}
+
+// TOTPURI returns the provisioning URI that authenticator apps read from QR codes.
+func TOTPURI(issuer string, account string, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(TOTPDigits))
+	v.Set("period", fmt.Sprint(TOTPPeriod))
+
+	label := url.PathEscape(fmt.Sprintf("%s:%s", issuer, account))
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, v.Encode())
+}
+
+// TOTPCounter returns the RFC 6238 time step for t.
+func TOTPCounter(t time.Time) int64 {
+	return t.Unix() / TOTPPeriod
+}
+
+// TOTPCode returns the RFC 6238 code of secret for the time step counter.
+func TOTPCode(secret string, counter int64) (string, error) {
+	key, err := b32.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("failed decoding secret: %v", err)
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < TOTPDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", TOTPDigits, code%mod), nil
+}
+
+// ValidateTOTP reports whether code is valid for secret at t, allowing for one
+// time step of clock drift. It returns the matching time step so that callers
+// can refuse codes that were already used.
+func ValidateTOTP(secret string, code string, t time.Time) (int64, bool) {
+	counter := TOTPCounter(t)
+	for i := -totpSkew; i <= totpSkew; i++ {
+		expected, err := TOTPCode(secret, counter+int64(i))
+		if err != nil {
+			return 0, false
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter + int64(i), true
+		}
+	}
+
+	return 0, false
+}
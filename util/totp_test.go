@@ -0,0 +1,62 @@
+package util
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 SHA1 test vectors truncated to 6 digits
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+	testCases := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tc := range testCases {
+		code, err := TOTPCode(secret, TOTPCounter(time.Unix(tc.time, 0)))
+		assert.NoError(t, err)
+		assert.Equal(t, tc.code, code)
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	assert.NoError(t, err)
+
+	now := time.Now()
+	code, err := TOTPCode(secret, TOTPCounter(now))
+	assert.NoError(t, err)
+
+	counter, ok := ValidateTOTP(secret, code, now)
+	assert.True(t, ok)
+	assert.Equal(t, TOTPCounter(now), counter)
+
+	_, ok = ValidateTOTP(secret, code, now.Add(TOTPPeriod*time.Second))
+	assert.True(t, ok, "previous time step is accepted")
+
+	_, ok = ValidateTOTP(secret, code, now.Add(3*TOTPPeriod*time.Second))
+	assert.False(t, ok)
+
+	_, ok = ValidateTOTP("invalid secret!", code, now)
+	assert.False(t, ok)
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := TOTPURI("app", "test@example.com", "SECRET")
+
+	assert.True(t, strings.HasPrefix(uri, "otpauth://totp/app:test@example.com?"))
+	assert.Contains(t, uri, "secret=SECRET")
+	assert.Contains(t, uri, "issuer=app")
+}